@@ -0,0 +1,152 @@
+/*
+Copyright 2018 the Gimbal contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/aggregate"
+	"github.com/projectcontour/gimbal/pkg/buildinfo"
+	"github.com/projectcontour/gimbal/pkg/k8s"
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/signals"
+	"github.com/projectcontour/gimbal/pkg/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	kubeinformers "k8s.io/client-go/informers"
+)
+
+var (
+	printVersion          bool
+	gimbalKubeCfgFile     string
+	numProcessThreads     int
+	resyncInterval        time.Duration
+	debug                 bool
+	logFormat             string
+	prometheusListenPort  int
+	adminListenAddress    string
+	gimbalKubeClientQPS   float64
+	gimbalKubeClientBurst int
+	aggregateLabel        string
+	namePrefix            string
+)
+
+func init() {
+	flag.BoolVar(&printVersion, "version", false, "Show version and quit")
+	flag.IntVar(&numProcessThreads, "num-threads", 2, "Specify number of threads to use when processing queue items.")
+	flag.StringVar(&gimbalKubeCfgFile, "gimbal-kubecfg-file", "", "Location of kubecfg file for access to gimbal system kubernetes api, defaults to service account tokens")
+	flag.DurationVar(&resyncInterval, "resync-interval", time.Minute*30, "Default resync period for watcher to refresh")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging. The log level can be changed at runtime with a PUT to /debug/loglevel?level=<level> on the admin listener.")
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json.")
+	flag.IntVar(&prometheusListenPort, "prometheus-listen-address", 8080, "The address to listen on for Prometheus HTTP requests")
+	flag.StringVar(&adminListenAddress, "admin-listen-address", "127.0.0.1:8081", "The address to listen on for admin HTTP requests, which change the state of the aggregator. If empty, admin requests are not served.")
+	flag.Float64Var(&gimbalKubeClientQPS, "gimbal-client-qps", 5, "The maximum queries per second (QPS) that can be performed on the Gimbal Kubernetes API server")
+	flag.IntVar(&gimbalKubeClientBurst, "gimbal-client-burst", 10, "The maximum number of queries that can be performed on the Gimbal Kubernetes API server during a burst")
+	flag.StringVar(&aggregateLabel, "aggregate-label", "", "The label whose value selects the discovered services that are aggregated together. If empty, the services of the same namespace and upstream name are aggregated.")
+	flag.StringVar(&namePrefix, "name-prefix", "all", "The prefix of the names of the aggregate services, which are named <prefix>-<key>. It must not be the name of a backend.")
+	flag.Parse()
+}
+
+func main() {
+	var log = logrus.New()
+	formatter, err := util.NewFormatter(logFormat, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Formatter = formatter
+
+	if printVersion {
+		fmt.Println("gimbal-aggregator")
+		fmt.Printf("Version: %s\n", buildinfo.Version)
+		fmt.Printf("Git commit: %s\n", buildinfo.GitSHA)
+		fmt.Printf("Git tree state: %s\n", buildinfo.GitTreeState)
+		os.Exit(0)
+	}
+
+	log.Info("Gimbal Aggregator Starting up...")
+	log.Infof("Version: %s", buildinfo.Version)
+	log.Infof("Number of queue worker threads: %d", numProcessThreads)
+	log.Infof("Resync interval: %v", resyncInterval)
+	log.Infof("Aggregate label: %q", aggregateLabel)
+	log.Infof("Name prefix: %s", namePrefix)
+
+	if debug {
+		log.Level = logrus.DebugLevel
+	}
+
+	if util.IsInvalidBackendName(namePrefix) {
+		log.Fatalf("The name prefix passed with the `--name-prefix` flag is invalid")
+	}
+
+	// Init prometheus metrics
+	metrics := localmetrics.NewMetrics("aggregator", namePrefix)
+	metrics.RegisterPrometheus(true)
+	metrics.DiscovererInfoMetric(buildinfo.Version)
+
+	gimbalKubeClient, err := k8s.NewClientWithQPS(gimbalKubeCfgFile, log, float32(gimbalKubeClientQPS), gimbalKubeClientBurst)
+	if err != nil {
+		log.Fatal("Could not init k8sclient! ", err)
+	}
+
+	discovered := kubeinformers.NewSharedInformerFactoryWithOptions(gimbalKubeClient, resyncInterval, aggregate.WithSelector(aggregate.DiscoveredSelector))
+	aggregates := kubeinformers.NewSharedInformerFactoryWithOptions(gimbalKubeClient, resyncInterval, aggregate.WithSelector(aggregate.AggregateSelector))
+	c := aggregate.NewController(log, gimbalKubeClient, discovered, aggregates, aggregate.Key{Label: aggregateLabel}, namePrefix, numProcessThreads, metrics)
+
+	// set up signals so we handle the first shutdown signal gracefully
+	stopCh := signals.SetupSignalHandler()
+	go discovered.Start(stopCh)
+	go aggregates.Start(stopCh)
+
+	if adminListenAddress != "" {
+		go func() {
+			// The admin routes change the state of the aggregator, so they
+			// are not served with the metrics, which are scraped from outside
+			// the pod
+			mux := http.NewServeMux()
+			// Expose the log level, which a PUT changes
+			mux.Handle("/debug/loglevel", util.LogLevelHandler(log))
+			log.Info("Listening for admin requests on: ", adminListenAddress)
+			if err := http.ListenAndServe(adminListenAddress, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	go func() {
+		// Expose the registered metrics via HTTP.
+		http.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+		srv := &http.Server{Addr: fmt.Sprintf(":%d", prometheusListenPort)}
+		log.Info("Listening for Prometheus metrics on port: ", prometheusListenPort)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+		<-stopCh
+		log.Info("Shutting down Prometheus server...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// Kick it off
+	if err = c.Run(stopCh); err != nil {
+		log.Fatalf("Error running controller: %s", err.Error())
+	}
+}
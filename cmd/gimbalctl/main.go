@@ -0,0 +1,237 @@
+/*
+Copyright 2018 the Gimbal contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/projectcontour/gimbal/pkg/buildinfo"
+	"github.com/projectcontour/gimbal/pkg/gimbalctl"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const usage = `gimbalctl inspects the services and endpoints discovered into a Gimbal cluster.
+
+Usage:
+  gimbalctl [flags] <command> [command flags] [arguments]
+
+Commands:
+  list      List the discovered services, with the number of their endpoints and their readiness
+  inspect   Show a discovered service, its endpoints, its origin and when it was last synced
+  diff      Compare a discovered service with the upstream service of a Kubernetes backend
+  resolve   Map discovered service names to the upstream objects they come from, and back
+  version   Show version, build information and quit
+
+Flags:
+`
+
+var kubeCfgFile string
+
+func main() {
+	flag.StringVar(&kubeCfgFile, "kubecfg-file", "", "Location of kubecfg file for access to the Kubernetes cluster hosting Gimbal, defaults to $KUBECONFIG or ~/.kube/config")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "list":
+		err = list(args)
+	case "inspect":
+		err = inspect(args)
+	case "diff":
+		err = diff(args)
+	case "resolve":
+		err = resolve(args)
+	case "version":
+		fmt.Println("gimbalctl")
+		fmt.Printf("Version: %s\n", buildinfo.Version)
+		fmt.Printf("Git commit: %s\n", buildinfo.GitSHA)
+		fmt.Printf("Git tree state: %s\n", buildinfo.GitTreeState)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func list(args []string) error {
+	fs, output := newFlagSet("list", "")
+	namespace := fs.String("namespace", "", "The namespace of the services. If empty, services of all namespaces are listed")
+	backend := fs.String("backend", "", "Only list the services discovered from this backend")
+	parseArgs(fs, args, 0)
+	format, err := gimbalctl.ParseFormat(*output)
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(kubeCfgFile)
+	if err != nil {
+		return err
+	}
+	summaries, err := gimbalctl.List(client, *backend, *namespace)
+	if err != nil {
+		return err
+	}
+	return gimbalctl.Print(os.Stdout, format, summaries, func(w io.Writer) error {
+		return gimbalctl.PrintSummaries(w, summaries)
+	})
+}
+
+func inspect(args []string) error {
+	fs, output := newFlagSet("inspect", "NAME")
+	namespace := fs.String("namespace", "", "The namespace of the service. Required if services with the same name exist in several namespaces")
+	parseArgs(fs, args, 1)
+	format, err := gimbalctl.ParseFormat(*output)
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(kubeCfgFile)
+	if err != nil {
+		return err
+	}
+	inspection, err := gimbalctl.Inspect(client, *namespace, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return gimbalctl.Print(os.Stdout, format, inspection, func(w io.Writer) error {
+		return gimbalctl.PrintInspection(w, inspection)
+	})
+}
+
+func diff(args []string) error {
+	fs, output := newFlagSet("diff", "NAME")
+	namespace := fs.String("namespace", "", "The namespace of the service. Required if services with the same name exist in several namespaces")
+	upstreamKubeCfgFile := fs.String("upstream-kubecfg-file", "", "Location of kubecfg file for access to the backend cluster the service was discovered from (required)")
+	parseArgs(fs, args, 1)
+	format, err := gimbalctl.ParseFormat(*output)
+	if err != nil {
+		return err
+	}
+	if *upstreamKubeCfgFile == "" {
+		return fmt.Errorf("`--upstream-kubecfg-file` is required")
+	}
+
+	client, err := newClient(kubeCfgFile)
+	if err != nil {
+		return err
+	}
+	upstream, err := newClient(*upstreamKubeCfgFile)
+	if err != nil {
+		return err
+	}
+	diffs, err := gimbalctl.Diff(client, upstream, *namespace, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := gimbalctl.Print(os.Stdout, format, diffs, func(w io.Writer) error {
+		return gimbalctl.PrintDifferences(w, diffs)
+	}); err != nil {
+		return err
+	}
+	// Exit with 1 if there are differences, like diff does
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func resolve(args []string) error {
+	fs, output := newFlagSet("resolve", "NAME...")
+	namespace := fs.String("namespace", "", "The namespace of the services. If empty, services of all namespaces are resolved")
+	origin := fs.Bool("origin", false, "Find the discovered services of the given upstream names instead. OpenStack load balancers can also be given by ID or name")
+	backend := fs.String("backend", "", "With --origin, only find the services discovered from this backend")
+	parseArgs(fs, args, -1)
+	format, err := gimbalctl.ParseFormat(*output)
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(kubeCfgFile)
+	if err != nil {
+		return err
+	}
+	var resolved []gimbalctl.Resolved
+	for _, name := range fs.Args() {
+		var r []gimbalctl.Resolved
+		if *origin {
+			r, err = gimbalctl.Lookup(client, *backend, *namespace, name)
+		} else {
+			r, err = gimbalctl.Resolve(client, *namespace, name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(r) == 0 {
+			fmt.Fprintf(os.Stderr, "no discovered service found for %q\n", name)
+		}
+		resolved = append(resolved, r...)
+	}
+	if len(resolved) == 0 {
+		os.Exit(1)
+	}
+	return gimbalctl.Print(os.Stdout, format, resolved, func(w io.Writer) error {
+		return gimbalctl.PrintResolved(w, resolved)
+	})
+}
+
+// newFlagSet returns the flag set of a command, and its output flag
+func newFlagSet(cmd, arguments string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	output := fs.String("o", string(gimbalctl.FormatTable), "Output format: table, json or yaml")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s\n\nFlags:\n", strings.TrimSpace("gimbalctl "+cmd+" [flags] "+arguments))
+		fs.PrintDefaults()
+	}
+	return fs, output
+}
+
+// parseArgs parses the flags of a command, which must be followed by n
+// arguments, or by at least one if n is negative
+func parseArgs(fs *flag.FlagSet, args []string, n int) {
+	fs.Parse(args)
+	if (n < 0 && fs.NArg() == 0) || (n >= 0 && fs.NArg() != n) {
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// newClient returns a client of a cluster, using the same kubecfg file that
+// kubectl would use unless one is given
+func newClient(kubeCfgFile string) (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeCfgFile
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
@@ -19,13 +19,18 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/projectcontour/gimbal/pkg/buildinfo"
 
+	"github.com/projectcontour/gimbal/pkg/health"
 	"github.com/projectcontour/gimbal/pkg/k8s"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/probe"
+	"github.com/projectcontour/gimbal/pkg/reload"
 	"github.com/projectcontour/gimbal/pkg/signals"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -41,10 +46,34 @@ var (
 	backendName           string
 	resyncInterval        time.Duration
 	debug                 bool
+	logFormat             string
 	prometheusListenPort  int
+	adminListenAddress    string
 	discovererMetrics     localmetrics.DiscovererMetrics
 	gimbalKubeClientQPS   float64
 	gimbalKubeClientBurst int
+
+	credentialsReloadInterval time.Duration
+	cacheSyncTimeout          time.Duration
+	ipFamily                  string
+	endpointsPolicy           string
+	overlayNetwork            bool
+	topology                  bool
+	nameTemplate              string
+	driftCheckInterval        time.Duration
+	driftResync               bool
+	maxDeletions              int
+	maxDeletionPercent        int
+	deletionWindow            time.Duration
+	endpointsGracePeriod      time.Duration
+	backendDegradedAfter      time.Duration
+	backendUnreachableAfter   time.Duration
+	unreachablePolicy         string
+	probeType                 string
+	probePath                 string
+	probeInterval             time.Duration
+	probeTimeout              time.Duration
+	probeFailureThreshold     int
 )
 
 func init() {
@@ -54,16 +83,44 @@ func init() {
 	flag.StringVar(&discovererKubeCfgFile, "discover-kubecfg-file", "", "Location of kubecfg file for access to remote discover system kubernetes api")
 	flag.StringVar(&backendName, "backend-name", "", "Name of backend (must be unique)")
 	flag.DurationVar(&resyncInterval, "resync-interval", time.Minute*30, "Default resync period for watcher to refresh")
-	flag.BoolVar(&debug, "debug", false, "Enable debug logging.")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging. The log level can be changed at runtime with a PUT to /debug/loglevel?level=<level> on the admin listener.")
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json.")
 	flag.IntVar(&prometheusListenPort, "prometheus-listen-address", 8080, "The address to listen on for Prometheus HTTP requests")
+	flag.StringVar(&adminListenAddress, "admin-listen-address", "127.0.0.1:8081", "The address to listen on for admin HTTP requests, which change the state of the discoverer. If empty, admin requests are not served.")
 	flag.Float64Var(&gimbalKubeClientQPS, "gimbal-client-qps", 5, "The maximum queries per second (QPS) that can be performed on the Gimbal Kubernetes API server")
 	flag.IntVar(&gimbalKubeClientBurst, "gimbal-client-burst", 10, "The maximum number of queries that can be performed on the Gimbal Kubernetes API server during a burst")
+	flag.DurationVar(&credentialsReloadInterval, "credentials-reload-interval", 30*time.Second, "The interval of time between checks for changes to the discover kubecfg file. The backend watches are restarted when the file changes. Set to 0 to disable.")
+	flag.DurationVar(&cacheSyncTimeout, "cache-sync-timeout", 2*time.Minute, "The maximum time to wait for the backend caches to sync after the discover kubecfg file changes.")
+	flag.StringVar(&endpointsPolicy, "endpoints-policy", "", "Comma-separated list of service types and the source of their endpoints, such as LoadBalancer=ingress,NodePort=node-port. Sources are pods, ingress, node-port and skip. Services of types that are not listed use the endpoints of their pods.")
+	flag.BoolVar(&overlayNetwork, "overlay-network", false, "Discover a cluster whose pods cannot be routed to from Gimbal, such as a cluster with an overlay network. The endpoints of LoadBalancer and NodePort services are built from their ingress and node addresses, and ClusterIP services are skipped, unless --endpoints-policy says otherwise.")
+	flag.BoolVar(&topology, "topology", false, "Label and annotate the discovered endpoints with the region and zone of the nodes of their addresses, taken from the topology labels of the nodes.")
+	flag.StringVar(&nameTemplate, "name-template", translator.DefaultNameTemplate, "The template of the names of the discovered services and endpoints, using the {{.Backend}}, {{.Namespace}} and {{.Name}} fields. Names longer than 63 characters are shortened.")
+	flag.StringVar(&ipFamily, "ip-family", "", "The only IP family of the endpoint addresses to discover: IPv4 or IPv6. If empty, addresses of all families are discovered.")
+	flag.DurationVar(&driftCheckInterval, "drift-check-interval", 5*time.Minute, "The interval of time between checks that the discovered services and endpoints match the backend. Set to 0 to disable.")
+	flag.BoolVar(&driftResync, "drift-resync", false, "Sync again the discovered services and endpoints that two consecutive drift checks find out of sync with the backend.")
+	flag.IntVar(&maxDeletions, "max-deletions", 0, "The number of discovered services and endpoints that can be deleted within --deletion-window. Further deletions are paused until the objects are discovered again, or the deletions are released. Set to 0 to disable.")
+	flag.IntVar(&maxDeletionPercent, "max-deletion-percent", 0, "The percentage of the discovered services and endpoints that can be deleted within --deletion-window. Further deletions are paused until the objects are discovered again, or the deletions are released. Set to 0 to disable.")
+	flag.DurationVar(&deletionWindow, "deletion-window", time.Minute, "The period of time over which deletions are counted against --max-deletions and --max-deletion-percent.")
+	flag.DurationVar(&endpointsGracePeriod, "endpoints-grace-period", 0, "The time addresses removed from upstream endpoints are kept as not ready addresses of the discovered endpoints, unless they come back. Set to 0 to remove them right away.")
+	flag.DurationVar(&backendDegradedAfter, "backend-degraded-after", 15*time.Second, "The time the calls to the backend cluster must fail, at least partially, without a call that succeeds, before it is considered degraded.")
+	flag.DurationVar(&backendUnreachableAfter, "backend-unreachable-after", 5*time.Minute, "The time the calls to the backend cluster must fail before it is considered unreachable, and --unreachable-endpoints-policy applies. Set to 0 to never consider it unreachable.")
+	flag.StringVar(&unreachablePolicy, "unreachable-endpoints-policy", "keep", "What happens to the discovered endpoints while the backend cluster is unreachable: keep them as they are, move their addresses to not-ready, or remove their addresses.")
+	flag.StringVar(&probeType, "probe", "none", "The probe of the addresses of the discovered endpoints of services without a gimbal.projectcontour.io/probe annotation: none, tcp or http.")
+	flag.StringVar(&probePath, "probe-path", "/", "The path of the HTTP probes of services without a gimbal.projectcontour.io/probe-path annotation.")
+	flag.DurationVar(&probeInterval, "probe-interval", 0, "The interval of time between probes of the addresses of the discovered endpoints. Addresses that fail their probe are moved to the not ready addresses. Set to 0 to disable probes.")
+	flag.DurationVar(&probeTimeout, "probe-timeout", 2*time.Second, "The time after which a probe fails.")
+	flag.IntVar(&probeFailureThreshold, "probe-failure-threshold", 3, "The number of consecutive failed probes after which an address is not ready.")
 	flag.Parse()
 }
 
 func main() {
 	var log = logrus.New()
-	log.Formatter = util.GetFormatter()
+	// Every log entry carries the backend
+	formatter, err := util.NewFormatter(logFormat, logrus.Fields{util.FieldBackend: backendName, util.FieldBackendType: "kubernetes"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Formatter = formatter
 
 	if printVersion {
 		fmt.Println("kubernetes-discoverer")
@@ -103,13 +160,52 @@ func main() {
 		log.Fatalf("`discover-kubecfg-file` arg is required!")
 	}
 
+	family, err := translator.ParseIPFamily(ipFamily)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names, err := translator.ParseNameTemplate(nameTemplate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Name template: %s", names)
+
+	healthPolicy, err := health.ParsePolicy(unreachablePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defaultProbe, err := probe.ParseDefault(probeType, probePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	policy, err := k8s.ParseEndpointsPolicy(endpointsPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if overlayNetwork {
+		log.Info("Discovering a cluster with an overlay network")
+		policy, err = k8s.OverlayEndpointsPolicy(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Init
 	gimbalKubeClient, err := k8s.NewClientWithQPS(gimbalKubeCfgFile, log, float32(gimbalKubeClientQPS), gimbalKubeClientBurst)
 	if err != nil {
 		log.Fatal("Could not init k8sclient! ", err)
 	}
 
-	k8sDiscovererClient, err := k8s.NewClient(discovererKubeCfgFile, log)
+	// The calls to the backend cluster record its health
+	backendHealth := health.NewBackend(log, discovererMetrics)
+	backendHealth.DegradedAfter = backendDegradedAfter
+	backendHealth.UnreachableAfter = backendUnreachableAfter
+	backendHealth.Policy = healthPolicy
+
+	k8sDiscovererClient, err := k8s.NewClientWithTransport(discovererKubeCfgFile, log, backendHealth.WrapTransport)
 	if err != nil {
 		log.Fatal("Could not init k8s discoverer client! ", err)
 	}
@@ -118,19 +214,75 @@ func main() {
 
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(k8sDiscovererClient, resyncInterval)
 
-	c := k8s.NewController(log, gimbalKubeClient, kubeInformerFactory, backendName, numProcessThreads, discovererMetrics)
-	if err != nil {
-		log.Fatal("Could not init Controller! ", err)
-	}
+	c := k8s.NewController(log, gimbalKubeClient, kubeInformerFactory, backendName, numProcessThreads, discovererMetrics, policy, topology, backendHealth)
+	c.IPFamily = family
+	c.NameTemplate = names
+	c.DriftCheckInterval = driftCheckInterval
+	c.DriftResync = driftResync
+	c.Brake.MaxDeletions = maxDeletions
+	c.Brake.MaxDeletionPercent = maxDeletionPercent
+	c.Brake.Window = deletionWindow
+	c.Grace.Period = endpointsGracePeriod
+	c.Prober.Default = defaultProbe
+	c.Prober.Interval = probeInterval
+	c.Prober.Timeout = probeTimeout
+	c.Prober.FailureThreshold = probeFailureThreshold
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
 
-	go kubeInformerFactory.Start(stopCh)
+	// The informer factory has its own stop channel so that it can be replaced
+	// when the credentials are reloaded
+	informerStopCh, stopInformers := newInformerStopCh(stopCh)
+	go kubeInformerFactory.Start(informerStopCh)
+
+	if credentialsReloadInterval > 0 {
+		reloadCredentials := func() error {
+			k8sDiscovererClient, err := k8s.NewClientWithTransport(discovererKubeCfgFile, log, backendHealth.WrapTransport)
+			if err != nil {
+				return fmt.Errorf("could not init k8s discoverer client: %v", err)
+			}
+			newStopCh, stopNewInformers := newInformerStopCh(stopCh)
+			kubeInformerFactory := kubeinformers.NewSharedInformerFactory(k8sDiscovererClient, resyncInterval)
+			if err := c.ReplaceInformerFactory(kubeInformerFactory, newStopCh, cacheSyncTimeout); err != nil {
+				stopNewInformers()
+				return err
+			}
+			// Stop watching the backend with the previous credentials
+			stopInformers()
+			stopInformers = stopNewInformers
+			return nil
+		}
+
+		log.Infof("Watching discover kubecfg file %s for changes", discovererKubeCfgFile)
+		watcher := reload.NewWatcher([]string{discovererKubeCfgFile}, credentialsReloadInterval, reloadCredentials, log, discovererMetrics)
+		go watcher.Run(stopCh)
+	}
+
+	if adminListenAddress != "" {
+		go func() {
+			// The admin routes change the state of the discoverer, so they
+			// are not served with the metrics, which are scraped from outside
+			// the pod
+			mux := http.NewServeMux()
+			// Expose the log level, which a PUT changes
+			mux.Handle("/debug/loglevel", util.LogLevelHandler(log))
+			// Expose the held deletions, which a POST releases
+			mux.Handle("/debug/deletions", c.Brake)
+			log.Info("Listening for admin requests on: ", adminListenAddress)
+			if err := http.ListenAndServe(adminListenAddress, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	go func() {
 		// Expose the registered metrics via HTTP.
 		http.Handle("/metrics", promhttp.HandlerFor(discovererMetrics.Registry, promhttp.HandlerOpts{}))
+		// Expose the services and endpoints that could not be synced
+		http.Handle("/debug/invalid", c.Invalid)
+		// Expose the services and endpoints that differ from the backend
+		http.Handle("/debug/drift", c.Drift)
 		srv := &http.Server{Addr: fmt.Sprintf(":%d", prometheusListenPort)}
 		log.Info("Listening for Prometheus metrics on port: ", prometheusListenPort)
 		if err := srv.ListenAndServe(); err != nil {
@@ -150,3 +302,19 @@ func main() {
 		log.Fatalf("Error running controller: %s", err.Error())
 	}
 }
+
+// newInformerStopCh returns a channel that is closed either when stopCh is
+// closed or when the returned function is called
+func newInformerStopCh(stopCh <-chan struct{}) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(ch) }) }
+	go func() {
+		select {
+		case <-stopCh:
+			stop()
+		case <-ch:
+		}
+	}()
+	return ch, stop
+}
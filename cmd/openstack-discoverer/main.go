@@ -23,16 +23,20 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/projectcontour/gimbal/pkg/buildinfo"
 	"github.com/projectcontour/gimbal/pkg/openstack"
+	"github.com/projectcontour/gimbal/pkg/reload"
 
-	"github.com/gophercloud/gophercloud"
 	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	"github.com/projectcontour/gimbal/pkg/health"
 	"github.com/projectcontour/gimbal/pkg/k8s"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/probe"
 	"github.com/projectcontour/gimbal/pkg/signals"
+	"github.com/projectcontour/gimbal/pkg/translator"
 	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
@@ -44,22 +48,48 @@ var (
 	backendName                       string
 	numProcessThreads                 int
 	debug                             bool
+	logFormat                         string
 	reconciliationPeriod              time.Duration
 	httpClientTimeout                 time.Duration
 	openstackCertificateAuthorityFile string
 	prometheusListenPort              int
+	adminListenAddress                string
 	discovererMetrics                 localmetrics.DiscovererMetrics
 	log                               *logrus.Logger
 	gimbalKubeClientQPS               float64
 	gimbalKubeClientBurst             int
 	openstackProjectWatchlist         string
+	openstackStatusTree               bool
+	openstackCloudsFile               string
+	openstackCloud                    string
+	credentialsReloadInterval         time.Duration
+	openstackRegions                  string
+	openstackEndpointInterface        string
+	openstackResolveHostnames         bool
+	openstackDNSTTL                   time.Duration
+	openstackDNSMaxStale              time.Duration
+	ipFamily                          string
+	subnetZones                       string
+	nameTemplate                      string
+	driftResync                       bool
+	maxDeletions                      int
+	maxDeletionPercent                int
+	endpointsGracePeriod              time.Duration
+	backendDegradedAfter              time.Duration
+	backendUnreachableAfter           time.Duration
+	unreachablePolicy                 string
+	probeType                         string
+	probePath                         string
+	probeInterval                     time.Duration
+	probeTimeout                      time.Duration
+	probeFailureThreshold             int
 )
 
-var reconciler openstack.Reconciler
+var reconciler *openstack.Reconciler
 
 const (
-	clusterType           = "openstack"
-	defaultUserDomainName = "Default"
+	clusterType      = "openstack"
+	dnsLookupTimeout = 5 * time.Second
 )
 
 func init() {
@@ -67,14 +97,40 @@ func init() {
 	flag.StringVar(&gimbalKubeCfgFile, "gimbal-kubecfg-file", "", "Location of kubecfg file for access to gimbal system kubernetes api, defaults to service account tokens")
 	flag.StringVar(&backendName, "backend-name", "", "Name of cluster (must be unique)")
 	flag.IntVar(&numProcessThreads, "num-threads", 2, "Specify number of threads to use when processing queue items.")
-	flag.BoolVar(&debug, "debug", false, "Enable debug logging.")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging. The log level can be changed at runtime with a PUT to /debug/loglevel?level=<level> on the admin listener.")
+	flag.StringVar(&logFormat, "log-format", "text", "The format of the logs: text or json.")
 	flag.DurationVar(&reconciliationPeriod, "reconciliation-period", 30*time.Second, "The interval of time between reconciliation loop runs.")
 	flag.DurationVar(&httpClientTimeout, "http-client-timeout", 5*time.Second, "The HTTP client request timeout.")
 	flag.StringVar(&openstackCertificateAuthorityFile, "openstack-certificate-authority", "", "Path to cert file of the OpenStack API certificate authority.")
 	flag.IntVar(&prometheusListenPort, "prometheus-listen-address", 8080, "The address to listen on for Prometheus HTTP requests")
+	flag.StringVar(&adminListenAddress, "admin-listen-address", "127.0.0.1:8081", "The address to listen on for admin HTTP requests, which change the state of the discoverer. If empty, admin requests are not served.")
 	flag.Float64Var(&gimbalKubeClientQPS, "gimbal-client-qps", 5, "The maximum queries per second (QPS) that can be performed on the Gimbal Kubernetes API server")
 	flag.IntVar(&gimbalKubeClientBurst, "gimbal-client-burst", 10, "The maximum number of queries that can be performed on the Gimbal Kubernetes API server during a burst")
 	flag.StringVar(&openstackProjectWatchlist, "openstack-project-watchlist", "", "List of projects to be watched for reconciliation. If empty, load balancers across all projects will be reconciled.")
+	flag.BoolVar(&openstackStatusTree, "openstack-status-tree", false, "Use the load balancer status tree to discover pools and members, which requires one API call per load balancer instead of one per pool. Status trees do not report the weights and subnets of members, so members are discovered with a weight of 1 unless the tree has their weight, and --subnet-zones cannot be used.")
+	flag.StringVar(&openstackCloudsFile, "openstack-clouds-file", "", "Path to the clouds.yaml file that contains the OpenStack credentials. Defaults to the OS_CLIENT_CONFIG_FILE environment variable or the standard clouds.yaml locations.")
+	flag.StringVar(&openstackCloud, "openstack-cloud", "", "Name of the cloud in the clouds.yaml file to use. Defaults to the OS_CLOUD environment variable. If empty, credentials are read from the OS_* environment variables only.")
+	flag.DurationVar(&credentialsReloadInterval, "credentials-reload-interval", 30*time.Second, "The interval of time between checks for changes to the clouds.yaml, certificate authority and secret files. The OpenStack clients are rebuilt when the files change. Set to 0 to disable.")
+	flag.StringVar(&openstackRegions, "openstack-regions", "", "Comma separated list of OpenStack regions to discover load balancers from. The names of the discovered services are qualified with the region. If empty, the region is read from clouds.yaml or the OS_REGION_NAME environment variable, and names are not qualified.")
+	flag.StringVar(&openstackEndpointInterface, "openstack-endpoint-interface", "", "The interface of the OpenStack API endpoints to use: public, internal or admin. Defaults to the clouds.yaml interface or the OS_INTERFACE environment variable, or public if neither is set.")
+	flag.BoolVar(&openstackResolveHostnames, "openstack-resolve-hostnames", true, "Resolve pool members whose address is a hostname to IP addresses. If false, these members are counted as invalid endpoints.")
+	flag.DurationVar(&openstackDNSTTL, "openstack-dns-ttl", 5*time.Minute, "The time to cache the IP addresses of pool member hostnames.")
+	flag.DurationVar(&openstackDNSMaxStale, "openstack-dns-max-stale", 10*time.Minute, "The maximum time after they expired that the cached IP addresses of a pool member hostname are used when resolving it fails.")
+	flag.StringVar(&subnetZones, "subnet-zones", "", "Comma separated list of subnet IDs and the availability zones they belong to, such as subnet1=az1,subnet2=az2. The discovered endpoints carry the zones of the subnets of their pool members. Cannot be used with --openstack-status-tree.")
+	flag.StringVar(&nameTemplate, "name-template", translator.DefaultNameTemplate, "The template of the names of the discovered services and endpoints, using the {{.Backend}}, {{.Namespace}} and {{.Name}} fields. Names longer than 63 characters are shortened.")
+	flag.StringVar(&ipFamily, "ip-family", "", "The only IP family of the pool members to discover: IPv4 or IPv6. If empty, members of all families are discovered.")
+	flag.BoolVar(&driftResync, "drift-resync", false, "Sync again the discovered services and endpoints that two consecutive reconciliations find out of sync with the backend.")
+	flag.IntVar(&maxDeletions, "max-deletions", 0, "The number of discovered services and endpoints that a reconciliation can delete. If a reconciliation would delete more, its deletions are paused until a reconciliation deletes few enough objects, or the deletions are released. Set to 0 to disable.")
+	flag.IntVar(&maxDeletionPercent, "max-deletion-percent", 0, "The percentage of the discovered services and endpoints that a reconciliation can delete. If a reconciliation would delete more, its deletions are paused until a reconciliation deletes few enough objects, or the deletions are released. Set to 0 to disable.")
+	flag.DurationVar(&endpointsGracePeriod, "endpoints-grace-period", 0, "The time members removed from pools are kept as not ready addresses of the discovered endpoints, unless they come back. Removed members are dropped by the first reconciliation after the end of the period. Set to 0 to remove them right away.")
+	flag.DurationVar(&backendDegradedAfter, "backend-degraded-after", 15*time.Second, "The time the calls to the OpenStack APIs must fail for some projects, without a reconciliation that lists every project, before the backend is considered degraded.")
+	flag.DurationVar(&backendUnreachableAfter, "backend-unreachable-after", 5*time.Minute, "The time the calls to the OpenStack APIs must fail for every project before the backend is considered unreachable, and --unreachable-endpoints-policy applies. Set to 0 to never consider it unreachable.")
+	flag.StringVar(&unreachablePolicy, "unreachable-endpoints-policy", "keep", "What happens to the discovered endpoints while the backend is unreachable: keep them as they are, move their addresses to not-ready, or remove their addresses.")
+	flag.StringVar(&probeType, "probe", "none", "The probe of the members of the discovered endpoints: none, tcp or http.")
+	flag.StringVar(&probePath, "probe-path", "/", "The path of the HTTP probes.")
+	flag.DurationVar(&probeInterval, "probe-interval", 0, "The interval of time between probes of the members of the discovered endpoints. Members that fail their probe are moved to the not ready addresses by the next reconciliation. Set to 0 to disable probes.")
+	flag.DurationVar(&probeTimeout, "probe-timeout", 2*time.Second, "The time after which a probe fails.")
+	flag.IntVar(&probeFailureThreshold, "probe-failure-threshold", 3, "The number of consecutive failed probes after which an address is not ready.")
 	flag.Parse()
 }
 
@@ -88,7 +144,12 @@ func main() {
 	}
 
 	log = logrus.New()
-	log.Formatter = util.GetFormatter()
+	// Every log entry carries the backend
+	formatter, err := util.NewFormatter(logFormat, logrus.Fields{util.FieldBackend: backendName, util.FieldBackendType: "openstack"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Formatter = formatter
 	if debug {
 		log.Level = logrus.DebugLevel
 	}
@@ -123,75 +184,43 @@ func main() {
 		log.Fatal("Failed to create kubernetes client", err)
 	}
 
-	username := os.Getenv("OS_USERNAME")
-	if username == "" {
-		log.Fatal("The OpenStack username must be provided using the OS_USERNAME environment variable.")
-	}
-	password := os.Getenv("OS_PASSWORD")
-	if password == "" {
-		log.Fatal("The OpenStack password must be provided using the OS_PASSWORD environment variable.")
-	}
-	identityEndpoint := os.Getenv("OS_AUTH_URL")
-	if identityEndpoint == "" {
-		log.Fatal("The OpenStack Authentication URL must be provided using the OS_AUTH_URL environment variable.")
+	family, err := translator.ParseIPFamily(ipFamily)
+	if err != nil {
+		log.Fatal(err)
 	}
-	tenantName := os.Getenv("OS_TENANT_NAME")
-	if tenantName == "" {
-		log.Fatal("The OpenStack tenant name must be provided using the OS_TENANT_NAME environment variable")
+
+	zones, err := openstack.ParseSubnetZones(subnetZones)
+	if err != nil {
+		log.Fatal(err)
 	}
-	userDomainName := os.Getenv("OS_USER_DOMAIN_NAME")
-	if userDomainName == "" {
-		log.Warnf("The OS_USER_DOMAIN_NAME environment variable was not set. Using %q as the OpenStack user domain name.", defaultUserDomainName)
-		userDomainName = defaultUserDomainName
+	// Status trees do not report the subnets of members
+	if len(zones) > 0 && openstackStatusTree {
+		log.Fatal("--subnet-zones cannot be used with --openstack-status-tree")
 	}
 
-	// Create and configure client
-	osClient, err := gopheropenstack.NewClient(identityEndpoint)
+	names, err := translator.ParseNameTemplate(nameTemplate)
 	if err != nil {
-		log.Fatalf("Failed to create OpenStack client: %v", err)
+		log.Fatal(err)
 	}
+	log.Infof("Name template: %s", names)
 
-	transport := &openstack.LogRoundTripper{
-		RoundTripper: http.DefaultTransport,
-		Log:          log,
-		BackendName:  backendName,
-		Metrics:      &discovererMetrics,
+	healthPolicy, err := health.ParsePolicy(unreachablePolicy)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if openstackCertificateAuthorityFile != "" {
-		transport.RoundTripper = httpTransportWithCA(log, openstackCertificateAuthorityFile)
+	defaultProbe, err := probe.ParseDefault(probeType, probePath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if openstackProjectWatchlist == "" {
 		log.Infof("The OpenStack Watchlist is empty. Syncing all load balancers on the OpenStack cluster.")
 	}
 
-	osClient.HTTPClient = http.Client{
-		Transport: transport,
-		Timeout:   httpClientTimeout,
-	}
-
-	osAuthOptions := gophercloud.AuthOptions{
-		IdentityEndpoint: identityEndpoint,
-		Username:         username,
-		Password:         password,
-		DomainName:       userDomainName,
-		TenantName:       tenantName,
-		AllowReauth:      true,
-	}
-
-	if err := gopheropenstack.Authenticate(osClient, osAuthOptions); err != nil {
-		log.Fatalf("Failed to authenticate with OpenStack: %v", err)
-	}
-
-	identity, err := openstack.NewIdentityV3(osClient)
+	osConfig, lbv2, identity, err := newOpenStackListers()
 	if err != nil {
-		log.Fatalf("Failed to create Identity V3 API client: %v", err)
-	}
-
-	lbv2, err := openstack.NewLoadBalancerV2(osClient)
-	if err != nil {
-		log.Fatalf("Failed to create Network V2 API client: %v", err)
+		log.Fatal(err)
 	}
 
 	reconciler = openstack.NewReconciler(
@@ -205,11 +234,49 @@ func main() {
 		numProcessThreads,
 		discovererMetrics,
 	)
+	if openstackResolveHostnames {
+		reconciler.Resolver = openstack.NewCachingResolver(openstackDNSTTL, openstackDNSMaxStale, dnsLookupTimeout)
+	}
+	reconciler.IPFamily = family
+	reconciler.SubnetZones = zones
+	reconciler.NameTemplate = names
+	reconciler.DriftResync = driftResync
+	reconciler.Brake.MaxDeletions = maxDeletions
+	reconciler.Brake.MaxDeletionPercent = maxDeletionPercent
+	reconciler.Grace.Period = endpointsGracePeriod
+	reconciler.Health.DegradedAfter = backendDegradedAfter
+	reconciler.Health.UnreachableAfter = backendUnreachableAfter
+	reconciler.Health.Policy = healthPolicy
+	reconciler.Prober.Default = defaultProbe
+	reconciler.Prober.Interval = probeInterval
+	reconciler.Prober.Timeout = probeTimeout
+	reconciler.Prober.FailureThreshold = probeFailureThreshold
 	stopCh := signals.SetupSignalHandler()
 
+	if adminListenAddress != "" {
+		go func() {
+			// The admin routes change the state of the discoverer, so they
+			// are not served with the metrics, which are scraped from outside
+			// the pod
+			mux := http.NewServeMux()
+			// Expose the log level, which a PUT changes
+			mux.Handle("/debug/loglevel", util.LogLevelHandler(log))
+			// Expose the held deletions, which a POST releases
+			mux.Handle("/debug/deletions", reconciler.Brake)
+			log.Info("Listening for admin requests on: ", adminListenAddress)
+			if err := http.ListenAndServe(adminListenAddress, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	go func() {
 		// Expose the registered metrics via HTTP.
 		http.Handle("/metrics", promhttp.HandlerFor(discovererMetrics.Registry, promhttp.HandlerOpts{}))
+		// Expose the services and endpoints that could not be synced
+		http.Handle("/debug/invalid", reconciler.Invalid)
+		// Expose the services and endpoints that differ from the backend
+		http.Handle("/debug/drift", reconciler.Drift)
 		srv := &http.Server{Addr: fmt.Sprintf(":%d", prometheusListenPort)}
 		log.Info("Listening for Prometheus metrics on port: ", prometheusListenPort)
 		if err := srv.ListenAndServe(); err != nil {
@@ -227,6 +294,12 @@ func main() {
 	log.Info("Starting reconciler")
 	go reconciler.Run(stopCh)
 
+	if files := credentialFiles(osConfig); credentialsReloadInterval > 0 && len(files) > 0 {
+		log.Infof("Watching credential files %v for changes", files)
+		watcher := reload.NewWatcher(files, credentialsReloadInterval, reloadListers, log, discovererMetrics)
+		go watcher.Run(stopCh)
+	}
+
 	go func() {
 		http.HandleFunc("/healthz", healthzHandler)
 		log.Fatal(http.ListenAndServe("127.0.0.1:8000", nil))
@@ -238,8 +311,123 @@ func main() {
 	log.Info("Stopped OpenStack discoverer")
 }
 
+// newOpenStackListers loads the OpenStack configuration, authenticates with
+// OpenStack and returns the clients used by the reconciler
+func newOpenStackListers() (*openstack.Config, map[string]openstack.LoadBalancerLister, openstack.ProjectLister, error) {
+	osConfig, err := openstack.LoadConfig(openstackCloudsFile, openstackCloud, os.Getenv, log)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to load OpenStack configuration: %v", err)
+	}
+	if openstackEndpointInterface != "" {
+		osConfig.Interface = openstackEndpointInterface
+		if err := osConfig.Validate(); err != nil {
+			return nil, nil, nil, fmt.Errorf("Failed to load OpenStack configuration: %v", err)
+		}
+	}
+	log.Infof("OpenStack authentication method: %s", osConfig.AuthMethod())
+
+	// Create and configure client
+	osClient, err := gopheropenstack.NewClient(osConfig.AuthURL)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to create OpenStack client: %v", err)
+	}
+
+	transport := &openstack.LogRoundTripper{
+		RoundTripper: http.DefaultTransport,
+		Log:          log,
+		BackendName:  backendName,
+		Metrics:      &discovererMetrics,
+	}
+
+	if caFile := caCertFile(osConfig); caFile != "" {
+		transport.RoundTripper, err = httpTransportWithCA(caFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	osClient.HTTPClient = http.Client{
+		Transport: transport,
+		Timeout:   httpClientTimeout,
+	}
+
+	if err := gopheropenstack.Authenticate(osClient, osConfig.AuthOptions()); err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to authenticate with OpenStack: %v", err)
+	}
+
+	// An empty region means the region of the configuration is used and the
+	// names of the discovered services are not qualified
+	regions := []string{""}
+	if strings.TrimSpace(openstackRegions) != "" {
+		regions = nil
+		for _, region := range strings.Split(openstackRegions, ",") {
+			if region = strings.TrimSpace(region); region != "" {
+				regions = append(regions, region)
+			}
+		}
+	}
+
+	// Keystone is usually deployed in a single region, so the identity API of
+	// the first region is used
+	identity, err := openstack.NewIdentityV3(osClient, osConfig.EndpointOpts(regions[0]))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Failed to create Identity V3 API client: %v", err)
+	}
+
+	lbv2 := map[string]openstack.LoadBalancerLister{}
+	for _, region := range regions {
+		eo := osConfig.EndpointOpts(region)
+		log.Infof("Using the %s endpoints of OpenStack region %q", eo.Availability, eo.Region)
+		var lister openstack.LoadBalancerLister
+		if openstackStatusTree {
+			log.Info("Using the load balancer status tree to discover pools and members")
+			lister, err = openstack.NewStatusTreeLoadBalancerV2(osClient, eo)
+		} else {
+			lister, err = openstack.NewLoadBalancerV2(osClient, eo)
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Failed to create Network V2 API client for region %q: %v", eo.Region, err)
+		}
+		lbv2[region] = lister
+	}
+	return osConfig, lbv2, identity, nil
+}
+
+// reloadListers re-authenticates with OpenStack and replaces the clients used
+// by the reconciler. The current clients are kept if anything fails.
+func reloadListers() error {
+	_, lbv2, identity, err := newOpenStackListers()
+	if err != nil {
+		return err
+	}
+	reconciler.SetListers(lbv2, identity)
+	return nil
+}
+
+// caCertFile returns the certificate authority file of the OpenStack API. The
+// flag takes precedence over the clouds.yaml file and OS_CACERT.
+func caCertFile(osConfig *openstack.Config) string {
+	if openstackCertificateAuthorityFile != "" {
+		return openstackCertificateAuthorityFile
+	}
+	return osConfig.CACertFile
+}
+
+// credentialFiles returns the files that are watched for credential changes
+func credentialFiles(osConfig *openstack.Config) []string {
+	var files []string
+	if osConfig.CloudsFile != "" {
+		files = append(files, osConfig.CloudsFile)
+	}
+	if caFile := caCertFile(osConfig); caFile != "" {
+		files = append(files, caFile)
+	}
+	return append(files, osConfig.SecretFiles...)
+}
+
 func healthzHandler(w http.ResponseWriter, r *http.Request) {
-	_, err := reconciler.ProjectLister.ListProjects()
+	_, projectLister := reconciler.Listers()
+	_, err := projectLister.ListProjects()
 	if err != nil {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "FAIL")
@@ -250,14 +438,14 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
-func httpTransportWithCA(log *logrus.Logger, caFile string) http.RoundTripper {
+func httpTransportWithCA(caFile string) (http.RoundTripper, error) {
 	ca, err := ioutil.ReadFile(caFile)
 	if err != nil {
-		log.Fatalf("Error reading certificate authority for OpenStack: %v", err)
+		return nil, fmt.Errorf("Error reading certificate authority for OpenStack: %v", err)
 	}
 	pool := x509.NewCertPool()
 	if ok := pool.AppendCertsFromPEM(ca); !ok {
-		log.Fatalf("Failed to add certificate authority to CA pool. Verify certificate is a valid, PEM-encoded certificate.")
+		return nil, fmt.Errorf("Failed to add certificate authority to CA pool. Verify certificate is a valid, PEM-encoded certificate.")
 	}
 	// Use default transport with CA
 	// TODO(abrand): Is there a better way to do this?
@@ -275,5 +463,5 @@ func httpTransportWithCA(log *logrus.Logger, caFile string) http.RoundTripper {
 		TLSClientConfig: &tls.Config{
 			RootCAs: pool,
 		},
-	}
+	}, nil
 }
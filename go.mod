@@ -30,4 +30,5 @@ require (
 	k8s.io/apimachinery v0.0.0-20190817020851-f2f3a405f61d
 	k8s.io/client-go v0.0.0-20190819141724-e14f31a72a77
 	mvdan.cc/unparam v0.0.0-20190720180237-d51796306d8f // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
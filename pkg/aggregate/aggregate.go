@@ -0,0 +1,170 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aggregate maintains services that combine the endpoints of the
+// services discovered from several backends for the same application
+package aggregate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// LabelAggregate is the key of the label that contains the aggregation
+	// key of an aggregate service and its endpoints
+	LabelAggregate = translator.GimbalLabelAggregate
+	// LabelBackendPrefix is the prefix of the labels that name the backends
+	// that contribute to an aggregate service, such as
+	// "backend.gimbal.projectcontour.io/cluster1: true"
+	LabelBackendPrefix = "backend.gimbal.projectcontour.io/"
+	// AnnotationBackends is the key of the annotation that lists the backends
+	// that contribute to an aggregate service
+	AnnotationBackends = "gimbal.projectcontour.io/backends"
+)
+
+// Key selects the discovered services that are aggregated together. Services
+// of the same namespace are aggregated if they have the same value of the
+// label, or the same upstream name if the label is empty.
+type Key struct {
+	Label string
+}
+
+// Of returns the aggregation key of the discovered service. Services without
+// the label, and ExternalName services, are not aggregated.
+func (k Key) Of(svc *v1.Service) (string, bool) {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return "", false
+	}
+	label := k.Label
+	if label == "" {
+		label = translator.GimbalLabelService
+	}
+	value, ok := svc.Labels[label]
+	return value, ok && value != ""
+}
+
+// Aggregate returns the aggregate services and endpoints of the discovered
+// services and endpoints of a namespace. The aggregate of the services with
+// a key is named "<prefix>-<key>". Services only contribute to an aggregate
+// once they have endpoints.
+func Aggregate(key Key, prefix string, services []*v1.Service, endpoints []*v1.Endpoints) ([]*v1.Service, []*v1.Endpoints) {
+	endpointsByName := map[string]*v1.Endpoints{}
+	for _, ep := range endpoints {
+		endpointsByName[ep.Name] = ep
+	}
+
+	groups := map[string][]*v1.Service{}
+	for _, svc := range services {
+		k, ok := key.Of(svc)
+		if !ok || endpointsByName[svc.Name] == nil {
+			continue
+		}
+		groups[k] = append(groups[k], svc)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var svcs []*v1.Service
+	var eps []*v1.Endpoints
+	for _, k := range keys {
+		members := groups[k]
+		// The first backend wins port conflicts
+		sort.Slice(members, func(i, j int) bool {
+			bi, bj := members[i].Labels[translator.GimbalLabelBackend], members[j].Labels[translator.GimbalLabelBackend]
+			if bi != bj {
+				return bi < bj
+			}
+			return members[i].Name < members[j].Name
+		})
+		svc, ep := aggregate(k, prefix, members, endpointsByName)
+		svcs = append(svcs, svc)
+		eps = append(eps, ep)
+	}
+	return svcs, eps
+}
+
+// aggregate returns the aggregate service and endpoints of the given members
+func aggregate(key, prefix string, members []*v1.Service, endpoints map[string]*v1.Endpoints) (*v1.Service, *v1.Endpoints) {
+	meta := metav1.ObjectMeta{
+		Namespace:   members[0].Namespace,
+		Name:        Name(prefix, key),
+		Labels:      map[string]string{LabelAggregate: translator.ShortenKubernetesLabelValue(key)},
+		Annotations: map[string]string{},
+	}
+	var backends []string
+	for _, m := range members {
+		backend := m.Labels[translator.GimbalLabelBackend]
+		if !containsString(backends, backend) {
+			backends = append(backends, backend)
+		}
+		if len(validation.IsQualifiedName(LabelBackendPrefix+backend)) == 0 {
+			meta.Labels[LabelBackendPrefix+backend] = "true"
+		}
+	}
+	meta.Annotations[AnnotationBackends] = strings.Join(backends, ",")
+
+	svc := &v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			ClusterIP: "None",
+			Type:      v1.ServiceTypeClusterIP,
+		},
+	}
+	// Ports must have unique names, and unique ports and protocols
+	names := map[string]bool{}
+	ports := map[string]bool{}
+	for _, m := range members {
+		for _, p := range m.Spec.Ports {
+			port := fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+			if names[p.Name] || ports[port] {
+				continue
+			}
+			names[p.Name] = true
+			ports[port] = true
+			svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: p.Name, Port: p.Port, Protocol: p.Protocol, TargetPort: p.TargetPort})
+		}
+	}
+
+	ep := &v1.Endpoints{ObjectMeta: *meta.DeepCopy()}
+	for _, m := range members {
+		for _, s := range endpoints[m.Name].Subsets {
+			ep.Subsets = append(ep.Subsets, *s.DeepCopy())
+		}
+	}
+	return svc, ep
+}
+
+// Name returns the name of the aggregate of the services with the given key
+func Name(prefix, key string) string {
+	return translator.BuildDiscoveredName(prefix, key)
+}
+
+func containsString(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
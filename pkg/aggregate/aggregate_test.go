@@ -0,0 +1,108 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func discoveredService(backend, name string, labels map[string]string, ports ...v1.ServicePort) *v1.Service {
+	l := map[string]string{
+		"gimbal.projectcontour.io/backend": backend,
+		"gimbal.projectcontour.io/service": name,
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: backend + "-" + name, Labels: l},
+		Spec:       v1.ServiceSpec{ClusterIP: "None", Ports: ports},
+	}
+}
+
+func discoveredEndpoints(backend, name string, ips ...string) *v1.Endpoints {
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team1",
+			Name:      backend + "-" + name,
+			Labels: map[string]string{
+				"gimbal.projectcontour.io/backend": backend,
+				"gimbal.projectcontour.io/service": name,
+			},
+		},
+	}
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}}}
+	for _, ip := range ips {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip})
+	}
+	ep.Subsets = []v1.EndpointSubset{subset}
+	return ep
+}
+
+func TestAggregate(t *testing.T) {
+	http := v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}
+	services := []*v1.Service{
+		discoveredService("cluster2", "kuard", map[string]string{"app": "kuard"}, http),
+		discoveredService("cluster1", "kuard", map[string]string{"app": "kuard"}, http, v1.ServicePort{Name: "admin", Port: 9000, Protocol: v1.ProtocolTCP}),
+		discoveredService("openstack", "kuard-lb", map[string]string{"app": "kuard"}, v1.ServicePort{Name: "port-80", Port: 80, Protocol: v1.ProtocolTCP}),
+		// no endpoints yet
+		discoveredService("cluster3", "kuard", nil, http),
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-db", Labels: map[string]string{"gimbal.projectcontour.io/service": "db"}},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"},
+		},
+	}
+	endpoints := []*v1.Endpoints{
+		discoveredEndpoints("cluster1", "kuard", "10.0.0.1"),
+		discoveredEndpoints("cluster2", "kuard", "10.1.0.1", "10.1.0.2"),
+		discoveredEndpoints("openstack", "kuard-lb", "192.168.0.1"),
+	}
+
+	t.Run("upstream name", func(t *testing.T) {
+		svcs, eps := Aggregate(Key{}, "all", services, endpoints)
+		assert.Len(t, svcs, 2)
+		assert.Len(t, eps, 2)
+
+		svc := svcs[0]
+		assert.Equal(t, "all-kuard", svc.Name)
+		assert.Equal(t, "team1", svc.Namespace)
+		assert.Equal(t, map[string]string{
+			"gimbal.projectcontour.io/aggregate":        "kuard",
+			"backend.gimbal.projectcontour.io/cluster1": "true",
+			"backend.gimbal.projectcontour.io/cluster2": "true",
+		}, svc.Labels)
+		assert.Equal(t, "cluster1,cluster2", svc.Annotations["gimbal.projectcontour.io/backends"])
+		assert.Equal(t, "None", svc.Spec.ClusterIP)
+		assert.Equal(t, []v1.ServicePort{http, {Name: "admin", Port: 9000, Protocol: v1.ProtocolTCP}}, svc.Spec.Ports)
+
+		assert.Equal(t, "all-kuard", eps[0].Name)
+		assert.Equal(t, svc.Labels, eps[0].Labels)
+		assert.Equal(t, []v1.EndpointSubset{endpoints[0].Subsets[0], endpoints[1].Subsets[0]}, eps[0].Subsets)
+
+		assert.Equal(t, "all-kuard-lb", svcs[1].Name)
+	})
+
+	t.Run("label", func(t *testing.T) {
+		svcs, eps := Aggregate(Key{Label: "app"}, "all", services, endpoints)
+		assert.Len(t, svcs, 1)
+		assert.Equal(t, "cluster1,cluster2,openstack", svcs[0].Annotations["gimbal.projectcontour.io/backends"])
+		// the port of the OpenStack service clashes with the http port
+		assert.Equal(t, []v1.ServicePort{http, {Name: "admin", Port: 9000, Protocol: v1.ProtocolTCP}}, svcs[0].Spec.Ports)
+		assert.Len(t, eps[0].Subsets, 3)
+	})
+}
@@ -0,0 +1,259 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"fmt"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller watches the services and endpoints discovered in the Gimbal
+// cluster, and keeps the aggregate services and endpoints of each namespace
+// in sync with them
+type Controller struct {
+	Logger *logrus.Logger
+	// Key selects the discovered services that are aggregated together
+	Key Key
+	// Prefix is the prefix of the names of the aggregate services
+	Prefix string
+
+	syncqueue sync.Queue
+	// namespaces is the queue of the namespaces whose aggregates must be
+	// reconciled
+	namespaces workqueue.RateLimitingInterface
+	synced     []cache.InformerSynced
+
+	serviceLister            listers.ServiceLister
+	endpointsLister          listers.EndpointsLister
+	aggregateServiceLister   listers.ServiceLister
+	aggregateEndpointsLister listers.EndpointsLister
+}
+
+// NewController returns a controller that aggregates the services and
+// endpoints of the discovered informer factory into the ones of the aggregate
+// informer factory, which must be limited to the discovered and aggregate
+// objects respectively. See DiscoveredSelector and AggregateSelector.
+func NewController(log *logrus.Logger, gimbalKubeClient kubernetes.Interface, discovered, aggregates kubeinformers.SharedInformerFactory,
+	key Key, prefix string, threadiness int, metrics localmetrics.DiscovererMetrics) *Controller {
+
+	c := &Controller{
+		Logger:     log,
+		Key:        key,
+		Prefix:     prefix,
+		syncqueue:  sync.NewQueue(log, gimbalKubeClient, threadiness, metrics),
+		namespaces: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "namespaces"),
+	}
+
+	// Any change of a discovered or aggregate object reconciles its namespace
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueue(new)
+		},
+		DeleteFunc: c.enqueue,
+	}
+	for _, factory := range []kubeinformers.SharedInformerFactory{discovered, aggregates} {
+		factory.Core().V1().Services().Informer().AddEventHandler(handler)
+		factory.Core().V1().Endpoints().Informer().AddEventHandler(handler)
+		c.synced = append(c.synced, factory.Core().V1().Services().Informer().HasSynced, factory.Core().V1().Endpoints().Informer().HasSynced)
+	}
+	c.serviceLister = discovered.Core().V1().Services().Lister()
+	c.endpointsLister = discovered.Core().V1().Endpoints().Lister()
+	c.aggregateServiceLister = aggregates.Core().V1().Services().Lister()
+	c.aggregateEndpointsLister = aggregates.Core().V1().Endpoints().Lister()
+	return c
+}
+
+// DiscoveredSelector is the label selector of the discovered objects
+const DiscoveredSelector = translator.GimbalLabelBackend
+
+// AggregateSelector is the label selector of the aggregate objects
+const AggregateSelector = LabelAggregate
+
+// WithSelector returns an informer factory option that limits the informers
+// to the objects that match the label selector
+func WithSelector(selector string) kubeinformers.SharedInformerOption {
+	return kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = selector
+	})
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.namespaces.Add(object.GetNamespace())
+}
+
+// Run waits for the caches to sync, and reconciles the namespaces until the
+// stop channel is closed
+func (c *Controller) Run(stopCh <-chan struct{}) error {
+	defer runtime.HandleCrash()
+	defer c.namespaces.ShutDown()
+
+	c.Logger.Infof("Waiting for informer caches to sync")
+	if ok := cache.WaitForCacheSync(stopCh, c.synced...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync")
+	}
+
+	// Start the sync queue
+	go c.syncqueue.Run(stopCh)
+	go wait.Until(c.runWorker, time.Second, stopCh)
+
+	c.Logger.Infof("Started workers")
+	<-stopCh
+	c.Logger.Infof("Shutting down workers")
+	return nil
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextNamespace() {
+	}
+}
+
+func (c *Controller) processNextNamespace() bool {
+	item, quit := c.namespaces.Get()
+	if quit {
+		return false
+	}
+	defer c.namespaces.Done(item)
+
+	if err := c.reconcile(item.(string)); err != nil {
+		c.Logger.Errorf("error aggregating services in namespace %q: %v", item, err)
+		c.namespaces.AddRateLimited(item)
+		return true
+	}
+	c.namespaces.Forget(item)
+	return true
+}
+
+// reconcile enqueues the actions that bring the aggregate services and
+// endpoints of the namespace in sync with its discovered ones
+func (c *Controller) reconcile(namespace string) error {
+	services, err := c.serviceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	endpoints, err := c.endpointsLister.Endpoints(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	currentServices, err := c.aggregateServiceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	currentEndpoints, err := c.aggregateEndpointsLister.Endpoints(namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	desiredServices, desiredEndpoints := Aggregate(c.Key, c.Prefix, services, endpoints)
+	desired := map[string]bool{}
+	// kept holds the invalid aggregates, whose existing copies are kept
+	// until they are valid again
+	kept := map[string]bool{}
+	for i, svc := range desiredServices {
+		if problems := validation.ValidateService(svc); len(problems) > 0 {
+			c.Logger.Warnf("skipping invalid aggregate service %s/%s: %v", svc.Namespace, svc.Name, problems)
+			kept[svc.Name] = true
+			continue
+		}
+		ep, problems := validation.ValidateEndpoints(desiredEndpoints[i])
+		if ep == nil {
+			c.Logger.Warnf("skipping invalid aggregate endpoints %s/%s: %v", svc.Namespace, svc.Name, problems)
+			kept[svc.Name] = true
+			continue
+		}
+		desired[svc.Name] = true
+
+		switch current := findService(currentServices, svc.Name); {
+		case current == nil:
+			c.syncqueue.Enqueue(sync.AddServiceAction(svc))
+		case !serviceEqual(current, svc):
+			c.syncqueue.Enqueue(sync.UpdateServiceAction(svc))
+		}
+		switch current := findEndpoints(currentEndpoints, ep.Name); {
+		case current == nil:
+			c.syncqueue.Enqueue(sync.AddEndpointsAction(ep, ep.Name))
+		case !endpointsEqual(current, ep):
+			c.syncqueue.Enqueue(sync.UpdateEndpointsAction(ep, ep.Name))
+		}
+	}
+
+	// Aggregates without discovered services are deleted
+	for _, svc := range currentServices {
+		if !desired[svc.Name] && !kept[svc.Name] {
+			c.syncqueue.Enqueue(sync.DeleteServiceAction(svc))
+		}
+	}
+	for _, ep := range currentEndpoints {
+		if !desired[ep.Name] && !kept[ep.Name] {
+			c.syncqueue.Enqueue(sync.DeleteEndpointsAction(ep, ep.Name))
+		}
+	}
+	return nil
+}
+
+func findService(services []*v1.Service, name string) *v1.Service {
+	for _, svc := range services {
+		if svc.Name == name {
+			return svc
+		}
+	}
+	return nil
+}
+
+func findEndpoints(endpoints []*v1.Endpoints, name string) *v1.Endpoints {
+	for _, ep := range endpoints {
+		if ep.Name == name {
+			return ep
+		}
+	}
+	return nil
+}
+
+// serviceEqual compares an existing aggregate service with the desired one,
+// with the defaults that the API server sets
+func serviceEqual(current, desired *v1.Service) bool {
+	return len(sync.ServiceDiff(desired, current)) == 0
+}
+
+// endpointsEqual compares existing aggregate endpoints with the desired ones.
+// The API server regroups the subsets of the endpoints it stores, so the
+// addresses are compared regardless of their subsets.
+func endpointsEqual(current, desired *v1.Endpoints) bool {
+	return len(sync.EndpointsDiff(desired, current)) == 0
+}
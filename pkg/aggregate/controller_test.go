@@ -0,0 +1,149 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcile(t *testing.T) {
+	http := v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}
+	stale := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "all-old", Labels: map[string]string{LabelAggregate: "old"}},
+	}
+	client := fake.NewSimpleClientset(
+		discoveredService("cluster1", "kuard", nil, http),
+		discoveredEndpoints("cluster1", "kuard", "10.0.0.1"),
+		discoveredService("cluster2", "kuard", nil, http),
+		discoveredEndpoints("cluster2", "kuard", "10.1.0.1"),
+		stale,
+	)
+	discovered := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(DiscoveredSelector))
+	aggregates := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(AggregateSelector))
+	metrics := localmetrics.NewMetrics("aggregator", "gimbal")
+	c := NewController(logrus.New(), client, discovered, aggregates, Key{}, "all", 1, metrics)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	discovered.Start(stopCh)
+	aggregates.Start(stopCh)
+	discovered.WaitForCacheSync(stopCh)
+	aggregates.WaitForCacheSync(stopCh)
+
+	require.NoError(t, c.reconcile("team1"))
+	processQueue(t, c, client)
+
+	svc, err := client.CoreV1().Services("team1").Get("all-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "cluster1,cluster2", svc.Annotations[AnnotationBackends])
+	ep, err := client.CoreV1().Endpoints("team1").Get("all-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, ep.Subsets, 2)
+
+	// the aggregate without discovered services is deleted
+	_, err = client.CoreV1().Services("team1").Get("all-old", metav1.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestReconcileRepackedEndpoints(t *testing.T) {
+	http := v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}
+	client := fake.NewSimpleClientset(
+		discoveredService("cluster1", "kuard", nil, http),
+		discoveredEndpoints("cluster1", "kuard", "10.0.0.1"),
+		discoveredService("cluster2", "kuard", nil, http),
+		discoveredEndpoints("cluster2", "kuard", "10.1.0.1"),
+	)
+	discovered := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(DiscoveredSelector))
+	aggregates := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(AggregateSelector))
+	metrics := localmetrics.NewMetrics("aggregator", "gimbal")
+	c := NewController(logrus.New(), client, discovered, aggregates, Key{}, "all", 1, metrics)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	discovered.Start(stopCh)
+	aggregates.Start(stopCh)
+	discovered.WaitForCacheSync(stopCh)
+	aggregates.WaitForCacheSync(stopCh)
+
+	require.NoError(t, c.reconcile("team1"))
+	processQueue(t, c, client)
+
+	// The API server merges the subsets that have the same ports
+	ep, err := client.CoreV1().Endpoints("team1").Get("all-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, ep.Subsets, 2)
+	ep.Subsets = []v1.EndpointSubset{{
+		Addresses: append(ep.Subsets[0].Addresses, ep.Subsets[1].Addresses...),
+		Ports:     ep.Subsets[0].Ports,
+	}}
+	_, err = client.CoreV1().Endpoints("team1").Update(ep)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond) // Give the informer time to see the update
+
+	// The repacked endpoints are not written again
+	require.NoError(t, c.reconcile("team1"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, c.syncqueue.Workqueue.Len())
+}
+
+func TestReconcileInvalidAggregate(t *testing.T) {
+	existing := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "all-kuard", Labels: map[string]string{LabelAggregate: "kuard"}},
+		Spec:       v1.ServiceSpec{ClusterIP: "None", Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+	}
+	client := fake.NewSimpleClientset(
+		discoveredService("cluster1", "kuard", nil, v1.ServicePort{Name: "http", Port: 0, Protocol: v1.ProtocolTCP}),
+		discoveredEndpoints("cluster1", "kuard", "10.0.0.1"),
+		existing,
+	)
+	discovered := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(DiscoveredSelector))
+	aggregates := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, WithSelector(AggregateSelector))
+	metrics := localmetrics.NewMetrics("aggregator", "gimbal")
+	c := NewController(logrus.New(), client, discovered, aggregates, Key{}, "all", 1, metrics)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	discovered.Start(stopCh)
+	aggregates.Start(stopCh)
+	discovered.WaitForCacheSync(stopCh)
+	aggregates.WaitForCacheSync(stopCh)
+
+	// the existing copy of the invalid aggregate is kept
+	require.NoError(t, c.reconcile("team1"))
+	processQueue(t, c, client)
+	svc, err := client.CoreV1().Services("team1").Get("all-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, existing.Spec.Ports, svc.Spec.Ports)
+}
+
+// processQueue syncs the actions in the queue of the controller
+func processQueue(t *testing.T, c *Controller, client *fake.Clientset) {
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	for c.syncqueue.Workqueue.Len() > 0 {
+		item, _ := c.syncqueue.Workqueue.Get()
+		assert.NoError(t, item.(sync.Action).Sync(client, logrus.New()))
+		c.syncqueue.Workqueue.Done(item)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package brake holds back the deletions of discovered services and endpoints
+// when a backend would lose too many of them at once.
+package brake
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	gosync "sync"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	"github.com/sirupsen/logrus"
+)
+
+// Deletion identifies the discovered object of a held deletion
+type Deletion struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func deletionOf(action sync.Action) Deletion {
+	meta := action.ObjectMeta()
+	return Deletion{Kind: sync.Kind(action), Namespace: meta.Namespace, Name: meta.Name}
+}
+
+// Brake pauses the deletions of the discovered objects of a backend when too
+// many of them would be deleted at once, which is more likely caused by an
+// incomplete list from the backend than by objects that were removed. The
+// deletions are held until the backend recovers, or until an operator
+// releases them.
+type Brake struct {
+	// MaxDeletions is the number of objects that can be deleted at once. If
+	// zero, the number is not limited.
+	MaxDeletions int
+	// MaxDeletionPercent is the percentage of the objects of the backend
+	// that can be deleted at once. If zero, the percentage is not limited.
+	MaxDeletionPercent int
+	// Window is the period of time over which the deletions that are made
+	// one at a time are counted together
+	Window time.Duration
+
+	mu gosync.Mutex
+	// held holds the deletions that are paused, by object
+	held map[Deletion]sync.Action
+	// deleted holds the times of the deletions made one at a time within
+	// the window
+	deleted []time.Time
+	enqueue func(sync.Action)
+	logger  *logrus.Logger
+	metrics localmetrics.DiscovererMetrics
+	now     func() time.Time
+}
+
+// NewBrake returns a brake that does not limit deletions until its limits
+// are set. Released deletions are passed to enqueue.
+func NewBrake(enqueue func(sync.Action), logger *logrus.Logger, metrics localmetrics.DiscovererMetrics) *Brake {
+	return &Brake{
+		Window:  time.Minute,
+		held:    map[Deletion]sync.Action{},
+		enqueue: enqueue,
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+	}
+}
+
+// exceeds returns whether deleting the given number of objects out of the
+// total number of objects of the backend is too many
+func (b *Brake) exceeds(deletions, total int) bool {
+	if b.MaxDeletions > 0 && deletions > b.MaxDeletions {
+		return true
+	}
+	return b.MaxDeletionPercent > 0 && deletions*100 > b.MaxDeletionPercent*total
+}
+
+// Check returns the deletions of a sync cycle that can proceed, given the
+// total number of objects of the backend that existed before the cycle. If
+// they are too many, none is returned, and they are held in place of the
+// deletions held by the previous cycle. Deletions resume with the first cycle
+// whose deletions are few enough.
+func (b *Brake) Check(total int, deletions []sync.Action) []sync.Action {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(deletions) == 0 || !b.exceeds(len(deletions), total) {
+		if len(b.held) > 0 {
+			b.logger.Infof("resuming deletions, %d deletions are no longer held", len(b.held))
+			b.setHeld(map[Deletion]sync.Action{})
+		}
+		return deletions
+	}
+	held := map[Deletion]sync.Action{}
+	for _, action := range deletions {
+		held[deletionOf(action)] = action
+	}
+	if len(b.held) == 0 {
+		b.logger.Errorf("pausing deletions, %d of the %d discovered objects would be deleted at once", len(deletions), total)
+	} else {
+		b.logger.Warnf("deletions are paused, holding %d deletions", len(deletions))
+	}
+	b.setHeld(held)
+	return nil
+}
+
+// Delete returns whether a deletion that is made on its own can proceed,
+// given the number of objects of the backend that remain. The deletions made
+// within the window are counted together. If they are too many, the deletion
+// is held, and so are the following ones until the held objects are all
+// discovered again, or the deletions are released.
+func (b *Brake) Delete(remaining int, action sync.Action) bool {
+	if b.MaxDeletions <= 0 && b.MaxDeletionPercent <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.held) > 0 {
+		b.held[deletionOf(action)] = action
+		b.setHeld(b.held)
+		return false
+	}
+	now := b.now()
+	var deleted []time.Time
+	for _, t := range b.deleted {
+		if now.Sub(t) < b.Window {
+			deleted = append(deleted, t)
+		}
+	}
+	deleted = append(deleted, now)
+	if b.exceeds(len(deleted), remaining+len(deleted)) {
+		b.logger.Errorf("pausing deletions, %d discovered objects would be deleted within %s", len(deleted), b.Window)
+		b.deleted = nil
+		b.setHeld(map[Deletion]sync.Action{deletionOf(action): action})
+		return false
+	}
+	b.deleted = deleted
+	return true
+}
+
+// Cancel drops the held deletion of the object of the action, which is about
+// to be written again. Deletions resume once no deletion is held.
+func (b *Brake) Cancel(action sync.Action) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := deletionOf(action)
+	if _, ok := b.held[key]; !ok {
+		return
+	}
+	delete(b.held, key)
+	if len(b.held) == 0 {
+		b.logger.Infof("resuming deletions, the objects of the held deletions were discovered again")
+	}
+	b.setHeld(b.held)
+}
+
+// Release resumes deletions and performs the held ones, which are returned
+func (b *Brake) Release() []Deletion {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := []Deletion{}
+	for key, action := range b.held {
+		res = append(res, key)
+		b.enqueue(action)
+	}
+	sortDeletions(res)
+	if len(res) > 0 {
+		b.logger.Warnf("releasing %d held deletions", len(res))
+	}
+	b.deleted = nil
+	b.setHeld(map[Deletion]sync.Action{})
+	return res
+}
+
+// Held returns the held deletions, sorted by namespace, kind and name
+func (b *Brake) Held() []Deletion {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	res := []Deletion{}
+	for key := range b.held {
+		res = append(res, key)
+	}
+	sortDeletions(res)
+	return res
+}
+
+// ServeHTTP writes the held deletions as JSON. A POST releases them, and
+// writes the released deletions.
+func (b *Brake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var deletions []Deletion
+	switch r.Method {
+	case http.MethodGet:
+		deletions = b.Held()
+	case http.MethodPost:
+		deletions = b.Release()
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(deletions); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// setHeld replaces the held deletions and updates the metrics
+func (b *Brake) setHeld(held map[Deletion]sync.Action) {
+	b.held = held
+	counts := map[string]int{}
+	for key := range held {
+		counts[key.Kind]++
+	}
+	b.metrics.DeletionsPausedMetric(len(held) > 0)
+	for _, kind := range []string{validation.KindService, validation.KindEndpoints} {
+		b.metrics.HeldDeletionsMetric(kind, counts[kind])
+	}
+}
+
+func sortDeletions(deletions []Deletion) {
+	sort.Slice(deletions, func(i, j int) bool {
+		a, b := deletions[i], deletions[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+}
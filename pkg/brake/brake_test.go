@@ -0,0 +1,180 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package brake
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/metrics/metricstest"
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func deleteService(name string) sync.Action {
+	return sync.DeleteServiceAction(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: name}})
+}
+
+func deleteEndpoints(name string) sync.Action {
+	return sync.DeleteEndpointsAction(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: name}}, name)
+}
+
+func newTestBrake() (*Brake, localmetrics.DiscovererMetrics, *[]sync.Action) {
+	metrics := metricstest.NewMetrics()
+	var enqueued []sync.Action
+	b := NewBrake(func(action sync.Action) { enqueued = append(enqueued, action) }, logrus.New(), metrics)
+	return b, metrics, &enqueued
+}
+
+func TestCheck(t *testing.T) {
+	b, metrics, enqueued := newTestBrake()
+	deletions := []sync.Action{deleteService("us-east-a"), deleteEndpoints("us-east-a"), deleteService("us-east-b")}
+
+	// Deletions are not limited by default
+	assert.Equal(t, deletions, b.Check(3, deletions))
+
+	// Deletions over a limit are all held
+	b.MaxDeletions = 2
+	assert.Empty(t, b.Check(10, deletions))
+	assert.Equal(t, []Deletion{
+		{Kind: validation.KindEndpoints, Namespace: "team1", Name: "us-east-a"},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-a"},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-b"},
+	}, b.Held())
+	assert.Equal(t, 1, gauge(t, metrics, localmetrics.DiscovererDeletionsPausedGauge, ""))
+	assert.Equal(t, 2, gauge(t, metrics, localmetrics.DiscovererHeldDeletionsGauge, validation.KindService))
+	assert.Equal(t, 1, gauge(t, metrics, localmetrics.DiscovererHeldDeletionsGauge, validation.KindEndpoints))
+
+	// The next cycle replaces the held deletions
+	b.MaxDeletions = 0
+	b.MaxDeletionPercent = 50
+	assert.Empty(t, b.Check(4, deletions))
+	assert.Len(t, b.Held(), 3)
+
+	// Deletions resume with a cycle whose deletions are few enough
+	assert.Equal(t, deletions[:2], b.Check(4, deletions[:2]))
+	assert.Empty(t, b.Held())
+	assert.Equal(t, 0, gauge(t, metrics, localmetrics.DiscovererDeletionsPausedGauge, ""))
+	assert.Equal(t, 0, gauge(t, metrics, localmetrics.DiscovererHeldDeletionsGauge, validation.KindService))
+	assert.Empty(t, *enqueued)
+
+	// Released deletions are performed
+	assert.Empty(t, b.Check(4, deletions))
+	assert.Len(t, b.Release(), 3)
+	assert.ElementsMatch(t, deletions, *enqueued)
+	assert.Empty(t, b.Held())
+	assert.Equal(t, 0, gauge(t, metrics, localmetrics.DiscovererDeletionsPausedGauge, ""))
+}
+
+func TestDelete(t *testing.T) {
+	b, _, enqueued := newTestBrake()
+	now, clock := metricstest.Clock()
+	b.now = clock
+	b.MaxDeletions = 2
+
+	// Deletions within the window are counted together
+	assert.True(t, b.Delete(10, deleteService("us-east-a")))
+	*now = now.Add(30 * time.Second)
+	assert.True(t, b.Delete(9, deleteService("us-east-b")))
+	*now = now.Add(31 * time.Second)
+	assert.True(t, b.Delete(8, deleteService("us-east-c")))
+	assert.False(t, b.Delete(7, deleteService("us-east-d")))
+
+	// Once paused, every deletion is held
+	*now = now.Add(time.Hour)
+	assert.False(t, b.Delete(6, deleteService("us-east-e")))
+	assert.Len(t, b.Held(), 2)
+
+	// Deletions resume once the held objects are written again
+	b.Cancel(sync.AddServiceAction(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "us-east-d"}}))
+	assert.Equal(t, []Deletion{{Kind: validation.KindService, Namespace: "team1", Name: "us-east-e"}}, b.Held())
+	b.Cancel(sync.UpdateServiceAction(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "us-east-e"}}))
+	assert.Empty(t, b.Held())
+	assert.True(t, b.Delete(7, deleteService("us-east-f")))
+	assert.Empty(t, *enqueued)
+
+	// Percentages are of the remaining objects and the ones deleted within
+	// the window
+	b.MaxDeletions = 0
+	b.MaxDeletionPercent = 20
+	assert.True(t, b.Delete(8, deleteService("us-east-g")))
+	assert.False(t, b.Delete(7, deleteService("us-east-h")))
+}
+
+func TestServeHTTP(t *testing.T) {
+	b, _, enqueued := newTestBrake()
+	b.MaxDeletions = 1
+	b.Check(10, []sync.Action{deleteService("us-east-a"), deleteService("us-east-b")})
+
+	held := func(method string) (int, []Deletion) {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest(method, "/debug/deletions", nil))
+		var deletions []Deletion
+		if rec.Code == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(rec.Body).Decode(&deletions))
+		}
+		return rec.Code, deletions
+	}
+	want := []Deletion{
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-a"},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-b"},
+	}
+
+	code, deletions := held(http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, want, deletions)
+	assert.Empty(t, *enqueued)
+
+	code, _ = held(http.MethodDelete)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	code, deletions = held(http.MethodPost)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, want, deletions)
+	assert.Len(t, *enqueued, 2)
+
+	code, deletions = held(http.MethodGet)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, deletions)
+}
+
+func gauge(t *testing.T, metrics localmetrics.DiscovererMetrics, name, kind string) int {
+	mfs, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["kind"] == kind {
+				return int(m.GetGauge().GetValue())
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,188 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package drift compares the services and endpoints that a discoverer
+// derives from its backend with the ones that exist in Gimbal, and reports
+// the objects that differ.
+package drift
+
+import (
+	"sort"
+
+	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Reason is the reason why a discovered object differs from the backend
+type Reason string
+
+const (
+	// ReasonMissing is the reason of the objects that are discovered from
+	// the backend, but do not exist in Gimbal
+	ReasonMissing Reason = "Missing"
+	// ReasonExtra is the reason of the objects that exist in Gimbal, but are
+	// no longer discovered from the backend
+	ReasonExtra Reason = "Extra"
+	// ReasonMismatched is the reason of the objects that exist in Gimbal,
+	// but whose fields differ from the ones discovered from the backend
+	ReasonMismatched Reason = "Mismatched"
+)
+
+// Reasons holds all the reasons
+var Reasons = []Reason{ReasonMissing, ReasonExtra, ReasonMismatched}
+
+// Object is a discovered service or endpoints resource that differs from the
+// backend
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Reason    Reason `json:"reason"`
+	// Fields holds the fields that differ, if the object is mismatched
+	Fields []string `json:"fields,omitempty"`
+	// Edited is true if the object is mismatched because it was edited in
+	// Gimbal since it was last written by the discoverer
+	Edited bool `json:"edited,omitempty"`
+
+	// action syncs the object again
+	action sync.Action
+}
+
+// State holds the services and endpoints of a backend, either the ones that
+// are discovered from the backend or the ones that exist in Gimbal
+type State struct {
+	Services  []v1.Service
+	Endpoints []v1.Endpoints
+	// UpstreamNames maps the desired endpoints to the names of their
+	// upstream services, which label the endpoints metrics. The name of the
+	// origin of the endpoints is used if they are not in the map.
+	UpstreamNames map[types.NamespacedName]string
+}
+
+type objectKey struct {
+	kind, namespace, name string
+}
+
+// Compare returns the objects that differ between the desired state, which is
+// discovered from the backend, and the current state in Gimbal. The objects
+// are sorted by namespace, kind and name.
+func Compare(desired, current State) []Object {
+	var res []Object
+
+	services := map[objectKey]*v1.Service{}
+	for i := range current.Services {
+		svc := &current.Services[i]
+		services[objectKey{validation.KindService, svc.Namespace, svc.Name}] = svc
+	}
+	for i := range desired.Services {
+		svc := &desired.Services[i]
+		key := objectKey{validation.KindService, svc.Namespace, svc.Name}
+		existing, ok := services[key]
+		delete(services, key)
+		switch {
+		case !ok:
+			res = append(res, newObject(key, ReasonMissing, nil, sync.AddServiceAction(svc.DeepCopy())))
+		default:
+			if fields := sync.ServiceDiff(svc, existing); len(fields) > 0 {
+				o := newObject(key, ReasonMismatched, fields, sync.UpdateServiceAction(svc.DeepCopy()))
+				o.Edited = sync.ServiceEdited(existing)
+				res = append(res, o)
+			}
+		}
+	}
+	for key, svc := range services {
+		res = append(res, newObject(key, ReasonExtra, nil, sync.DeleteServiceAction(svc.DeepCopy())))
+	}
+
+	endpoints := map[objectKey]*v1.Endpoints{}
+	for i := range current.Endpoints {
+		ep := &current.Endpoints[i]
+		endpoints[objectKey{validation.KindEndpoints, ep.Namespace, ep.Name}] = ep
+	}
+	for i := range desired.Endpoints {
+		ep := &desired.Endpoints[i]
+		key := objectKey{validation.KindEndpoints, ep.Namespace, ep.Name}
+		existing, ok := endpoints[key]
+		delete(endpoints, key)
+		upstreamName := desired.upstreamName(ep)
+		switch {
+		case !ok:
+			res = append(res, newObject(key, ReasonMissing, nil, sync.AddEndpointsAction(ep.DeepCopy(), upstreamName)))
+		default:
+			if fields := sync.EndpointsDiff(ep, existing); len(fields) > 0 {
+				o := newObject(key, ReasonMismatched, fields, sync.UpdateEndpointsAction(ep.DeepCopy(), upstreamName))
+				o.Edited = sync.EndpointsEdited(existing)
+				res = append(res, o)
+			}
+		}
+	}
+	for key, ep := range endpoints {
+		res = append(res, newObject(key, ReasonExtra, nil, sync.DeleteEndpointsAction(ep.DeepCopy(), desired.upstreamName(ep))))
+	}
+
+	sortObjects(res)
+	return res
+}
+
+// upstreamName returns the name of the upstream service of the endpoints
+func (s State) upstreamName(ep *v1.Endpoints) string {
+	if name, ok := s.UpstreamNames[types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}]; ok {
+		return name
+	}
+	origin, _ := translator.GetOriginIdentity(ep.Annotations)
+	return origin.Name
+}
+
+func newObject(key objectKey, reason Reason, fields []string, action sync.Action) Object {
+	return Object{Kind: key.kind, Namespace: key.namespace, Name: key.name, Reason: reason, Fields: fields, action: action}
+}
+
+func sortObjects(objects []Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Namespace != objects[j].Namespace {
+			return objects[i].Namespace < objects[j].Namespace
+		}
+		if objects[i].Kind != objects[j].Kind {
+			return objects[i].Kind < objects[j].Kind
+		}
+		return objects[i].Name < objects[j].Name
+	})
+}
+
+// Actions returns the actions that sync the objects again: missing and
+// mismatched objects are written with their desired state, and extra objects
+// are deleted.
+func Actions(objects []Object) []sync.Action {
+	res := make([]sync.Action, 0, len(objects))
+	for _, o := range objects {
+		if o.action != nil {
+			res = append(res, o.action)
+		}
+	}
+	return res
+}
+
+// Edited returns the objects that were edited in Gimbal since they were last
+// written by the discoverer
+func Edited(objects []Object) []Object {
+	var res []Object
+	for _, o := range objects {
+		if o.Edited {
+			res = append(res, o)
+		}
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drift
+
+import (
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestCompare(t *testing.T) {
+	labels := map[string]string{translator.GimbalLabelBackend: "us-east"}
+	service := func(name string, ports ...v1.ServicePort) v1.Service {
+		return v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: name, Labels: labels},
+			Spec:       v1.ServiceSpec{ClusterIP: "None", Ports: ports},
+		}
+	}
+	endpoints := func(name string, subsets ...v1.EndpointSubset) v1.Endpoints {
+		return v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: name, Labels: labels}, Subsets: subsets}
+	}
+
+	desiredSvc := service("us-east-a", v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(80)})
+	desiredSvc.Spec.Type = v1.ServiceTypeClusterIP
+	desiredSvc.Annotations = map[string]string{"owner": "team1"}
+	// The API server defaults the type, protocol and target port, and the
+	// last sync time is set when the service is written
+	currentSvc := service("us-east-a", v1.ServicePort{Name: "http", Port: 80})
+	currentSvc.Annotations = map[string]string{"owner": "team1", translator.GimbalAnnotationLastSyncTime: "2000-01-01T10:00:00Z"}
+	editedSvc := service("us-east-b", v1.ServicePort{Name: "http", Port: 8080})
+	editedSvc.Annotations = map[string]string{"owner": "team2"}
+
+	ports := []v1.EndpointPort{{Name: "http", Port: 8080}}
+	desiredEp := endpoints("us-east-a", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+		Ports:     ports,
+	})
+	// The same addresses grouped into different subsets
+	currentEp := endpoints("us-east-a",
+		v1.EndpointSubset{Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}}, Ports: ports},
+		v1.EndpointSubset{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}, Ports: ports},
+	)
+	notReadyEp := endpoints("us-east-b", v1.EndpointSubset{NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}, Ports: ports})
+
+	desired := State{
+		Services:      []v1.Service{desiredSvc, service("us-east-b", v1.ServicePort{Name: "http", Port: 80}), service("us-east-c")},
+		Endpoints:     []v1.Endpoints{desiredEp, endpoints("us-east-b", desiredEp.Subsets...)},
+		UpstreamNames: map[types.NamespacedName]string{{Namespace: "team1", Name: "us-east-a"}: "a"},
+	}
+	current := State{
+		Services:  []v1.Service{currentSvc, editedSvc, service("us-east-d")},
+		Endpoints: []v1.Endpoints{currentEp, notReadyEp, endpoints("us-east-d")},
+	}
+
+	got := Compare(desired, current)
+	assert.Len(t, Actions(got), 5)
+	for i := range got {
+		got[i].action = nil
+	}
+	assert.Equal(t, []Object{
+		{Kind: validation.KindEndpoints, Namespace: "team1", Name: "us-east-b", Reason: ReasonMismatched, Fields: []string{"subsets"}},
+		{Kind: validation.KindEndpoints, Namespace: "team1", Name: "us-east-d", Reason: ReasonExtra},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-b", Reason: ReasonMismatched, Fields: []string{"metadata.annotations", "spec.ports"}},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-c", Reason: ReasonMissing},
+		{Kind: validation.KindService, Namespace: "team1", Name: "us-east-d", Reason: ReasonExtra},
+	}, got)
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drift
+
+import (
+	"encoding/json"
+	"net/http"
+	gosync "sync"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/validation"
+)
+
+// Store holds the discovered objects of a backend that differ from the
+// backend, and reports them in metrics and over HTTP. An object is reported
+// once two consecutive checks of its namespace find it, so that changes that
+// are still being synced are not reported.
+type Store struct {
+	mu gosync.Mutex
+	// found holds the objects of each namespace found by the last check
+	found map[string]map[objectKey]Object
+	// reported holds the objects of each namespace found by the last two
+	// checks
+	reported map[string][]Object
+	metrics  localmetrics.DiscovererMetrics
+}
+
+// NewStore returns an empty store that reports to the given metrics
+func NewStore(metrics localmetrics.DiscovererMetrics) *Store {
+	return &Store{
+		found:    map[string]map[objectKey]Object{},
+		reported: map[string][]Object{},
+		metrics:  metrics,
+	}
+}
+
+// ReplaceNamespace records the objects found by a check of the namespace,
+// which must belong to the namespace, and returns the ones that are reported
+// because the previous check found them too
+func (s *Store) ReplaceNamespace(namespace string, objects []Object) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replaceNamespace(namespace, objects)
+}
+
+// Replace records the objects found by a check of all namespaces, and returns
+// the ones that are reported because the previous check found them too
+func (s *Store) Replace(objects []Object) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byNamespace := map[string][]Object{}
+	for namespace := range s.found {
+		byNamespace[namespace] = nil
+	}
+	for _, o := range objects {
+		byNamespace[o.Namespace] = append(byNamespace[o.Namespace], o)
+	}
+	var res []Object
+	for namespace, objects := range byNamespace {
+		res = append(res, s.replaceNamespace(namespace, objects)...)
+	}
+	sortObjects(res)
+	return res
+}
+
+func (s *Store) replaceNamespace(namespace string, objects []Object) []Object {
+	previous := s.found[namespace]
+	found := map[objectKey]Object{}
+	var reported []Object
+	for _, o := range objects {
+		key := objectKey{o.Kind, o.Namespace, o.Name}
+		found[key] = o
+		if _, ok := previous[key]; ok {
+			reported = append(reported, o)
+		}
+	}
+	if len(found) == 0 {
+		delete(s.found, namespace)
+	} else {
+		s.found[namespace] = found
+	}
+	if len(reported) == 0 {
+		delete(s.reported, namespace)
+	} else {
+		s.reported[namespace] = reported
+	}
+	s.writeMetrics(namespace, reported)
+	return reported
+}
+
+// List returns the reported objects, sorted by namespace, kind and name
+func (s *Store) List() []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []Object{}
+	for _, objects := range s.reported {
+		res = append(res, objects...)
+	}
+	sortObjects(res)
+	return res
+}
+
+// ServeHTTP writes the reported objects as JSON
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.List()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeMetrics sets the number of reported objects of the namespace for each
+// kind and reason
+func (s *Store) writeMetrics(namespace string, reported []Object) {
+	counts := map[string]map[Reason]int{validation.KindService: {}, validation.KindEndpoints: {}}
+	for _, o := range reported {
+		if counts[o.Kind] == nil {
+			counts[o.Kind] = map[Reason]int{}
+		}
+		counts[o.Kind][o.Reason]++
+	}
+	for _, kind := range []string{validation.KindService, validation.KindEndpoints} {
+		for _, reason := range Reasons {
+			s.metrics.DiscovererDriftObjectsMetric(namespace, kind, string(reason), counts[kind][reason])
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package drift
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	metrics := localmetrics.NewMetrics("openstack", "us-east")
+	metrics.RegisterPrometheus(false)
+	s := NewStore(metrics)
+
+	missing := Object{Kind: validation.KindService, Namespace: "team1", Name: "us-east-a", Reason: ReasonMissing}
+	extra := Object{Kind: validation.KindEndpoints, Namespace: "team1", Name: "us-east-b", Reason: ReasonExtra}
+	mismatched := Object{Kind: validation.KindService, Namespace: "team2", Name: "us-east-a", Reason: ReasonMismatched, Fields: []string{"spec.ports"}}
+
+	// Objects are reported once two consecutive checks find them
+	assert.Empty(t, s.ReplaceNamespace("team1", []Object{missing}))
+	assert.Empty(t, s.List())
+	assert.Equal(t, []Object{missing}, s.ReplaceNamespace("team1", []Object{missing, extra}))
+	assert.Equal(t, 1, driftObjects(t, metrics, "team1", validation.KindService, ReasonMissing))
+	assert.Equal(t, 0, driftObjects(t, metrics, "team1", validation.KindEndpoints, ReasonExtra))
+
+	// Namespaces that are not found by a check of all namespaces are cleared
+	assert.Empty(t, s.Replace([]Object{mismatched}))
+	assert.Equal(t, []Object{mismatched}, s.Replace([]Object{mismatched}))
+	assert.Equal(t, 0, driftObjects(t, metrics, "team1", validation.KindService, ReasonMissing))
+	assert.Equal(t, 1, driftObjects(t, metrics, "team2", validation.KindService, ReasonMismatched))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/drift", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var got []Object
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, []Object{mismatched}, got)
+}
+
+func driftObjects(t *testing.T, metrics localmetrics.DiscovererMetrics, namespace, kind string, reason Reason) int {
+	mfs, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != localmetrics.DiscovererDriftObjectsGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["namespace"] == namespace && labels["kind"] == kind && labels["reason"] == string(reason) {
+				return int(m.GetGauge().GetValue())
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// gimbalPrefix is the prefix of the labels and annotations that are added by
+// Gimbal, which are not compared
+const gimbalPrefix = "gimbal.projectcontour.io/"
+
+// Difference is a field of a discovered service, or of its endpoints, that
+// does not match the upstream service of a Kubernetes backend. Values are
+// empty when the field only exists on one side.
+type Difference struct {
+	Field    string `json:"field"`
+	Gimbal   string `json:"gimbal"`
+	Upstream string `json:"upstream"`
+}
+
+// Diff compares the discovered service with the given name, and its
+// endpoints, with the upstream service and endpoints they come from. Names,
+// target ports and the labels and annotations added by Gimbal are not
+// compared, since the discoverer changes them.
+func Diff(client, upstream kubernetes.Interface, namespace, name string) ([]Difference, error) {
+	svc, err := getDiscoveredService(client, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	origin := resolve(svc).Origin
+	if origin.LoadBalancerID != "" {
+		return nil, fmt.Errorf("service %s/%s was discovered from OpenStack, only services discovered from Kubernetes can be compared", svc.Namespace, svc.Name)
+	}
+	upstreamSvc, err := upstream.CoreV1().Services(origin.Namespace).Get(origin.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get upstream service: %v", err)
+	}
+
+	var diffs []Difference
+	add := func(field, gimbal, upstream string) {
+		if gimbal != upstream {
+			diffs = append(diffs, Difference{Field: field, Gimbal: gimbal, Upstream: upstream})
+		}
+	}
+	if svc.Spec.Type == v1.ServiceTypeExternalName || upstreamSvc.Spec.Type == v1.ServiceTypeExternalName {
+		add("spec.type", string(svc.Spec.Type), string(upstreamSvc.Spec.Type))
+		add("spec.externalName", svc.Spec.ExternalName, upstreamSvc.Spec.ExternalName)
+	}
+	diffMap(add, "metadata.labels", svc.Labels, upstreamSvc.Labels)
+	diffMap(add, "metadata.annotations", svc.Annotations, upstreamSvc.Annotations)
+	diffMap(add, "spec.ports", servicePorts(svc.Spec.Ports), servicePorts(upstreamSvc.Spec.Ports))
+
+	ep, err := getEndpoints(client, svc.Namespace, svc.Name)
+	if err != nil {
+		return nil, err
+	}
+	upstreamEp, err := getEndpoints(upstream, origin.Namespace, origin.Name)
+	if err != nil {
+		return nil, fmt.Errorf("could not get upstream endpoints: %v", err)
+	}
+	if ep == nil || upstreamEp == nil {
+		add("endpoints", exists(ep != nil), exists(upstreamEp != nil))
+	} else {
+		diffMap(add, "endpoints.addresses", endpointAddresses(ep), endpointAddresses(upstreamEp))
+	}
+	return diffs, nil
+}
+
+// diffMap adds a difference for each key whose value differs. Keys added by
+// Gimbal are skipped.
+func diffMap(add func(field, gimbal, upstream string), field string, gimbal, upstream map[string]string) {
+	keys := map[string]bool{}
+	for k := range gimbal {
+		keys[k] = true
+	}
+	for k := range upstream {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		if !strings.HasPrefix(k, gimbalPrefix) {
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		add(fmt.Sprintf("%s[%s]", field, k), gimbal[k], upstream[k])
+	}
+}
+
+// servicePorts returns the port and protocol of the service ports, by name
+func servicePorts(ports []v1.ServicePort) map[string]string {
+	m := map[string]string{}
+	for _, p := range ports {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = v1.ProtocolTCP
+		}
+		m[p.Name] = fmt.Sprintf("%d/%s", p.Port, protocol)
+	}
+	return m
+}
+
+// endpointAddresses returns whether each address of the endpoints is ready,
+// by address and port
+func endpointAddresses(ep *v1.Endpoints) map[string]string {
+	m := map[string]string{}
+	for _, s := range ep.Subsets {
+		for _, p := range s.Ports {
+			for _, a := range s.Addresses {
+				m[fmt.Sprintf("%s %s:%d", valueOrNone(p.Name), a.IP, p.Port)] = "ready"
+			}
+			for _, a := range s.NotReadyAddresses {
+				m[fmt.Sprintf("%s %s:%d", valueOrNone(p.Name), a.IP, p.Port)] = "not ready"
+			}
+		}
+	}
+	return m
+}
+
+func getEndpoints(client kubernetes.Interface, namespace, name string) (*v1.Endpoints, error) {
+	ep, err := client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return ep, err
+}
+
+func exists(ok bool) string {
+	if ok {
+		return "exists"
+	}
+	return ""
+}
+
+// PrintDifferences writes the differences as a table
+func PrintDifferences(w io.Writer, diffs []Difference) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tGIMBAL\tUPSTREAM")
+	for _, d := range diffs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Field, valueOrNone(d.Gimbal), valueOrNone(d.Upstream))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiff(t *testing.T) {
+	upstreamSvc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "team1",
+			Name:        "kuard",
+			Labels:      map[string]string{"app": "kuard", "tier": "web"},
+			Annotations: map[string]string{"owner": "team1"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      v1.ServiceTypeClusterIP,
+			ClusterIP: "10.96.0.10",
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+				{Name: "https", Port: 443, TargetPort: intstr.FromInt(8443)},
+			},
+		},
+	}
+	upstreamEp := discoveredEndpoints(upstreamSvc, []string{"10.0.0.1", "10.0.0.2"}, nil)
+
+	svc := discoveredService("team1", "us-east-kuard", translator.OriginIdentity{Backend: "us-east", Namespace: "team1", Name: "kuard"})
+	svc.Labels["app"] = "kuard"
+	svc.Annotations["owner"] = "team2"
+	svc.Spec = v1.ServiceSpec{
+		Type:      v1.ServiceTypeClusterIP,
+		ClusterIP: "None",
+		Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
+	}
+	ep := discoveredEndpoints(svc, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+
+	client := fake.NewSimpleClientset(svc, ep)
+	upstream := fake.NewSimpleClientset(upstreamSvc, upstreamEp)
+	got, err := Diff(client, upstream, "", "us-east-kuard")
+	require.NoError(t, err)
+	assert.Equal(t, []Difference{
+		{Field: "metadata.labels[tier]", Upstream: "web"},
+		{Field: "metadata.annotations[owner]", Gimbal: "team2", Upstream: "team1"},
+		{Field: "spec.ports[https]", Upstream: "443/TCP"},
+		{Field: "endpoints.addresses[http 10.0.0.2:8080]", Gimbal: "not ready", Upstream: "ready"},
+	}, got)
+
+	// The same service
+	client = fake.NewSimpleClientset(svc, discoveredEndpoints(svc, []string{"10.0.0.1", "10.0.0.2"}, nil))
+	svc.Labels["tier"] = "web"
+	svc.Annotations["owner"] = "team1"
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Name: "https", Port: 443, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8443)})
+	client = fake.NewSimpleClientset(svc, discoveredEndpoints(svc, []string{"10.0.0.1", "10.0.0.2"}, nil))
+	got, err = Diff(client, upstream, "team1", "us-east-kuard")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Endpoints that were not discovered
+	client = fake.NewSimpleClientset(svc)
+	got, err = Diff(client, upstream, "team1", "us-east-kuard")
+	require.NoError(t, err)
+	assert.Equal(t, []Difference{{Field: "endpoints", Upstream: "exists"}}, got)
+
+	// Services of OpenStack backends cannot be compared
+	lb := discoveredService("team1", "openstack-5a5c3d9e", translator.OriginIdentity{Backend: "openstack", Namespace: "team1", Name: "5a5c3d9e", LoadBalancerID: "5A5C3D9E"})
+	_, err = Diff(fake.NewSimpleClientset(lb), upstream, "team1", "openstack-5a5c3d9e")
+	assert.Error(t, err)
+}
@@ -0,0 +1,168 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Inspection describes a discovered service, its endpoints and its origin
+type Inspection struct {
+	Resolved
+	Type                  string              `json:"type"`
+	ExternalName          string              `json:"externalName,omitempty"`
+	Ports                 []v1.ServicePort    `json:"ports,omitempty"`
+	Status                string              `json:"status"`
+	Subsets               []v1.EndpointSubset `json:"subsets,omitempty"`
+	Labels                map[string]string   `json:"labels,omitempty"`
+	Annotations           map[string]string   `json:"annotations,omitempty"`
+	LastSyncTime          string              `json:"lastSyncTime,omitempty"`
+	EndpointsLastSyncTime string              `json:"endpointsLastSyncTime,omitempty"`
+}
+
+// Inspect returns the discovered service with the given name. If the
+// namespace is empty, the service is searched in all namespaces, and must
+// only exist in one.
+func Inspect(client kubernetes.Interface, namespace, name string) (*Inspection, error) {
+	svc, err := getDiscoveredService(client, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inspection{
+		Resolved:     resolve(svc),
+		Type:         string(svc.Spec.Type),
+		ExternalName: svc.Spec.ExternalName,
+		Ports:        svc.Spec.Ports,
+		Labels:       svc.Labels,
+		Annotations:  svc.Annotations,
+		LastSyncTime: svc.Annotations[translator.GimbalAnnotationLastSyncTime],
+	}
+	ep, err := client.CoreV1().Endpoints(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		ep = nil
+	case err != nil:
+		return nil, err
+	default:
+		i.Subsets = ep.Subsets
+		i.EndpointsLastSyncTime = ep.Annotations[translator.GimbalAnnotationLastSyncTime]
+	}
+	i.Status = status(countAddresses(ep))
+	return i, nil
+}
+
+// getDiscoveredService returns the discovered service with the given name. If
+// the namespace is empty, the service is searched in all namespaces.
+func getDiscoveredService(client kubernetes.Interface, namespace, name string) (*v1.Service, error) {
+	if namespace != "" {
+		svc, err := client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := svc.Labels[translator.GimbalLabelBackend]; !ok {
+			return nil, fmt.Errorf("service %s/%s was not discovered by Gimbal", namespace, name)
+		}
+		return svc, nil
+	}
+
+	svcs, err := client.CoreV1().Services("").List(metav1.ListOptions{LabelSelector: translator.GimbalLabelBackend})
+	if err != nil {
+		return nil, err
+	}
+	var found []*v1.Service
+	for i := range svcs.Items {
+		if svcs.Items[i].Name == name {
+			found = append(found, &svcs.Items[i])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("discovered service %q not found", name)
+	case 1:
+		return found[0], nil
+	}
+	var namespaces []string
+	for _, svc := range found {
+		namespaces = append(namespaces, svc.Namespace)
+	}
+	sort.Strings(namespaces)
+	return nil, fmt.Errorf("discovered service %q exists in namespaces %s, use --namespace to choose one", name, strings.Join(namespaces, ", "))
+}
+
+// PrintInspection writes the inspection in a human readable form
+func PrintInspection(w io.Writer, i *Inspection) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s\n", i.Name)
+	fmt.Fprintf(tw, "Namespace:\t%s\n", i.Namespace)
+	fmt.Fprintf(tw, "Backend:\t%s\n", i.Origin.Backend)
+	origin := fmt.Sprintf("%s/%s", i.Origin.Namespace, i.Origin.Name)
+	if i.Partial {
+		origin += " (from labels)"
+	}
+	fmt.Fprintf(tw, "Origin:\t%s\n", origin)
+	if i.Origin.LoadBalancerID != "" {
+		fmt.Fprintf(tw, "Load balancer:\t%s (%s)\n", valueOrNone(i.Origin.LoadBalancerName), i.Origin.LoadBalancerID)
+		fmt.Fprintf(tw, "Project ID:\t%s\n", valueOrNone(i.Origin.ProjectID))
+		if i.Origin.Region != "" {
+			fmt.Fprintf(tw, "Region:\t%s\n", i.Origin.Region)
+		}
+		if i.Origin.L7PolicyID != "" {
+			fmt.Fprintf(tw, "L7 policy:\t%s\n", i.Origin.L7PolicyID)
+		}
+	}
+	fmt.Fprintf(tw, "Type:\t%s\n", i.Type)
+	if i.ExternalName != "" {
+		fmt.Fprintf(tw, "External name:\t%s\n", i.ExternalName)
+	}
+	for n, p := range i.Ports {
+		label := ""
+		if n == 0 {
+			label = "Ports:"
+		}
+		fmt.Fprintf(tw, "%s\t%s %d/%s -> %s\n", label, valueOrNone(p.Name), p.Port, p.Protocol, p.TargetPort.String())
+	}
+	fmt.Fprintf(tw, "Status:\t%s\n", i.Status)
+	for n, s := range i.Subsets {
+		label := ""
+		if n == 0 {
+			label = "Endpoints:"
+		}
+		var ports []string
+		for _, p := range s.Ports {
+			ports = append(ports, fmt.Sprintf("%s %d/%s", valueOrNone(p.Name), p.Port, p.Protocol))
+		}
+		fmt.Fprintf(tw, "%s\tready: %s; not ready: %s; ports: %s\n", label, addresses(s.Addresses), addresses(s.NotReadyAddresses), strings.Join(ports, ", "))
+	}
+	fmt.Fprintf(tw, "Last sync:\t%s\n", valueOrNone(i.LastSyncTime))
+	fmt.Fprintf(tw, "Endpoints last sync:\t%s\n", valueOrNone(i.EndpointsLastSyncTime))
+	return tw.Flush()
+}
+
+func addresses(as []v1.EndpointAddress) string {
+	var ips []string
+	for _, a := range as {
+		ips = append(ips, a.IP)
+	}
+	return valueOrNone(strings.Join(ips, ","))
+}
@@ -0,0 +1,72 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestInspect(t *testing.T) {
+	lb := translator.OriginIdentity{Backend: "openstack", Namespace: "team1", Name: "5a5c3d9e", LoadBalancerID: "5A5C3D9E", LoadBalancerName: "stocks", ProjectID: "p1"}
+	svc := discoveredService("team1", "openstack-5a5c3d9e", lb)
+	svc.Annotations[translator.GimbalAnnotationLastSyncTime] = "2000-01-01T10:00:00Z"
+	svc.Spec = v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}}}
+	ep := discoveredEndpoints(svc, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+	ep.Annotations[translator.GimbalAnnotationLastSyncTime] = "2000-01-01T10:00:01Z"
+	other := discoveredService("team2", "openstack-5a5c3d9e", translator.OriginIdentity{Backend: "openstack", Namespace: "team2", Name: "5a5c3d9e"})
+	client := fake.NewSimpleClientset(svc, ep, other)
+
+	_, err := Inspect(client, "", "openstack-5a5c3d9e")
+	assert.EqualError(t, err, `discovered service "openstack-5a5c3d9e" exists in namespaces team1, team2, use --namespace to choose one`)
+	_, err = Inspect(client, "", "missing")
+	assert.Error(t, err)
+
+	got, err := Inspect(client, "team1", "openstack-5a5c3d9e")
+	require.NoError(t, err)
+	assert.Equal(t, lb, got.Origin)
+	assert.Equal(t, StatusReady, got.Status)
+	assert.Equal(t, "2000-01-01T10:00:00Z", got.LastSyncTime)
+	assert.Equal(t, "2000-01-01T10:00:01Z", got.EndpointsLastSyncTime)
+	assert.Equal(t, ep.Subsets, got.Subsets)
+
+	var buf bytes.Buffer
+	require.NoError(t, PrintInspection(&buf, got))
+	assert.Equal(t, `Name:                openstack-5a5c3d9e
+Namespace:           team1
+Backend:             openstack
+Origin:              team1/5a5c3d9e
+Load balancer:       stocks (5A5C3D9E)
+Project ID:          p1
+Type:                ClusterIP
+Ports:               http 80/TCP -> 8080
+Status:              Ready
+Endpoints:           ready: 10.0.0.1; not ready: 10.0.0.2; ports: http 8080/TCP
+Last sync:           2000-01-01T10:00:00Z
+Endpoints last sync: 2000-01-01T10:00:01Z
+`, buf.String())
+
+	// Endpoints that were not discovered yet
+	got, err = Inspect(client, "team2", "openstack-5a5c3d9e")
+	require.NoError(t, err)
+	assert.Equal(t, StatusNoEndpoints, got.Status)
+	assert.Empty(t, got.Subsets)
+}
@@ -0,0 +1,127 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// StatusReady is the status of services with ready endpoint addresses
+	StatusReady = "Ready"
+	// StatusNotReady is the status of services whose endpoint addresses are
+	// all not ready
+	StatusNotReady = "NotReady"
+	// StatusNoEndpoints is the status of services without endpoint addresses
+	StatusNoEndpoints = "NoEndpoints"
+)
+
+// Summary is a discovered service and the number of its endpoint addresses
+type Summary struct {
+	Namespace         string `json:"namespace"`
+	Name              string `json:"name"`
+	Backend           string `json:"backend"`
+	Type              string `json:"type"`
+	Ports             int    `json:"ports"`
+	ReadyEndpoints    int    `json:"readyEndpoints"`
+	NotReadyEndpoints int    `json:"notReadyEndpoints"`
+	Status            string `json:"status"`
+	LastSyncTime      string `json:"lastSyncTime,omitempty"`
+}
+
+// List returns the discovered services of the backend and namespace, sorted
+// by namespace and name. If the backend or the namespace is empty, the
+// services of all backends or namespaces are returned.
+func List(client kubernetes.Interface, backend, namespace string) ([]Summary, error) {
+	selector := translator.GimbalLabelBackend
+	if backend != "" {
+		selector = fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, translator.ShortenKubernetesLabelValue(backend))
+	}
+	svcs, err := client.CoreV1().Services(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	eps, err := client.CoreV1().Endpoints(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	endpoints := map[string]*v1.Endpoints{}
+	for i, ep := range eps.Items {
+		endpoints[ep.Namespace+"/"+ep.Name] = &eps.Items[i]
+	}
+
+	var summaries []Summary
+	for _, svc := range svcs.Items {
+		s := Summary{
+			Namespace:    svc.Namespace,
+			Name:         svc.Name,
+			Backend:      resolve(&svc).Origin.Backend,
+			Type:         string(svc.Spec.Type),
+			Ports:        len(svc.Spec.Ports),
+			LastSyncTime: svc.Annotations[translator.GimbalAnnotationLastSyncTime],
+		}
+		s.ReadyEndpoints, s.NotReadyEndpoints = countAddresses(endpoints[svc.Namespace+"/"+svc.Name])
+		s.Status = status(s.ReadyEndpoints, s.NotReadyEndpoints)
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Namespace != summaries[j].Namespace {
+			return summaries[i].Namespace < summaries[j].Namespace
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+// countAddresses returns the number of ready and not ready addresses of the
+// endpoints, which may be nil
+func countAddresses(ep *v1.Endpoints) (ready, notReady int) {
+	if ep == nil {
+		return 0, 0
+	}
+	for _, s := range ep.Subsets {
+		ready += len(s.Addresses)
+		notReady += len(s.NotReadyAddresses)
+	}
+	return ready, notReady
+}
+
+func status(ready, notReady int) string {
+	switch {
+	case ready > 0:
+		return StatusReady
+	case notReady > 0:
+		return StatusNotReady
+	}
+	return StatusNoEndpoints
+}
+
+// PrintSummaries writes the discovered services as a table
+func PrintSummaries(w io.Writer, summaries []Summary) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tBACKEND\tTYPE\tPORTS\tENDPOINTS\tSTATUS\tLAST SYNC")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d/%d\t%s\t%s\n", s.Namespace, s.Name, s.Backend, s.Type, s.Ports,
+			s.ReadyEndpoints, s.ReadyEndpoints+s.NotReadyEndpoints, s.Status, valueOrNone(s.LastSyncTime))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,98 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func discoveredEndpoints(svc *v1.Service, ready, notReady []string) *v1.Endpoints {
+	ep := &v1.Endpoints{ObjectMeta: *svc.ObjectMeta.DeepCopy()}
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}}}
+	for _, ip := range ready {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip})
+	}
+	for _, ip := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, v1.EndpointAddress{IP: ip})
+	}
+	ep.Subsets = []v1.EndpointSubset{subset}
+	return ep
+}
+
+func TestList(t *testing.T) {
+	kuard := discoveredService("team1", "us-east-kuard", translator.OriginIdentity{Backend: "us-east", Namespace: "team1", Name: "kuard"})
+	kuard.Annotations[translator.GimbalAnnotationLastSyncTime] = "2000-01-01T10:00:00Z"
+	kuard.Spec = v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, Ports: []v1.ServicePort{{Name: "http", Port: 80}}}
+	stocks := discoveredService("team2", "us-west-stocks", translator.OriginIdentity{Backend: "us-west", Namespace: "team2", Name: "stocks"})
+	stocks.Spec.Type = v1.ServiceTypeClusterIP
+	down := discoveredService("team1", "us-west-down", translator.OriginIdentity{Backend: "us-west", Namespace: "team1", Name: "down"})
+	down.Spec.Type = v1.ServiceTypeClusterIP
+
+	client := fake.NewSimpleClientset(
+		kuard, discoveredEndpoints(kuard, []string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.3"}),
+		down, discoveredEndpoints(down, nil, []string{"10.0.0.4"}),
+		stocks,
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "local"}},
+	)
+
+	got, err := List(client, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []Summary{
+		{Namespace: "team1", Name: "us-east-kuard", Backend: "us-east", Type: "ClusterIP", Ports: 1, ReadyEndpoints: 2, NotReadyEndpoints: 1, Status: StatusReady, LastSyncTime: "2000-01-01T10:00:00Z"},
+		{Namespace: "team1", Name: "us-west-down", Backend: "us-west", Type: "ClusterIP", NotReadyEndpoints: 1, Status: StatusNotReady},
+		{Namespace: "team2", Name: "us-west-stocks", Backend: "us-west", Type: "ClusterIP", Status: StatusNoEndpoints},
+	}, got)
+
+	got, err = List(client, "us-west", "team2")
+	require.NoError(t, err)
+	assert.Equal(t, []Summary{
+		{Namespace: "team2", Name: "us-west-stocks", Backend: "us-west", Type: "ClusterIP", Status: StatusNoEndpoints},
+	}, got)
+
+	var buf bytes.Buffer
+	require.NoError(t, Print(&buf, FormatTable, got, func(w io.Writer) error { return PrintSummaries(w, got) }))
+	assert.Equal(t, `NAMESPACE  NAME            BACKEND  TYPE       PORTS  ENDPOINTS  STATUS       LAST SYNC
+team2      us-west-stocks  us-west  ClusterIP  0      0/0        NoEndpoints  <none>
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, Print(&buf, FormatYAML, got, nil))
+	assert.Equal(t, `- backend: us-west
+  name: us-west-stocks
+  namespace: team2
+  notReadyEndpoints: 0
+  ports: 0
+  readyEndpoints: 0
+  status: NoEndpoints
+  type: ClusterIP
+`, buf.String())
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, name := range []string{"table", "JSON", "yaml"} {
+		_, err := ParseFormat(name)
+		assert.NoError(t, err)
+	}
+	_, err := ParseFormat("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gimbalctl contains the commands of gimbalctl, which helps operators
+// inspect the services and endpoints discovered into a Gimbal cluster
+package gimbalctl
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Resolved is a discovered service and the upstream object it comes from
+type Resolved struct {
+	Namespace string                    `json:"namespace"`
+	Name      string                    `json:"name"`
+	Origin    translator.OriginIdentity `json:"origin"`
+	// Partial is true if the service has no origin annotations, in which
+	// case the origin is read from its labels. Long label values are
+	// shortened, so the origin may not be the full one.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Resolve returns the origins of the discovered services with the given
+// name. If the namespace is empty, the services of all namespaces are
+// returned.
+func Resolve(client kubernetes.Interface, namespace, name string) ([]Resolved, error) {
+	return find(client, namespace, func(r Resolved) bool {
+		return r.Name == name
+	})
+}
+
+// Lookup returns the discovered services that come from the upstream objects
+// with the given name. OpenStack load balancers are also matched by ID and by
+// name. If the backend or the namespace is empty, the services of all
+// backends or namespaces are returned.
+func Lookup(client kubernetes.Interface, backend, namespace, name string) ([]Resolved, error) {
+	return find(client, namespace, func(r Resolved) bool {
+		if backend != "" && r.Origin.Backend != backend {
+			return false
+		}
+		return r.Origin.Name == name || (r.Origin.L7PolicyID == "" && (r.Origin.LoadBalancerID == name || r.Origin.LoadBalancerName == name))
+	})
+}
+
+// find returns the discovered services of the namespace that match, sorted by
+// namespace and name
+func find(client kubernetes.Interface, namespace string, match func(Resolved) bool) ([]Resolved, error) {
+	svcs, err := client.CoreV1().Services(namespace).List(metav1.ListOptions{LabelSelector: translator.GimbalLabelBackend})
+	if err != nil {
+		return nil, err
+	}
+	var resolved []Resolved
+	for i := range svcs.Items {
+		if r := resolve(&svcs.Items[i]); match(r) {
+			resolved = append(resolved, r)
+		}
+	}
+	sort.Slice(resolved, func(i, j int) bool {
+		if resolved[i].Namespace != resolved[j].Namespace {
+			return resolved[i].Namespace < resolved[j].Namespace
+		}
+		return resolved[i].Name < resolved[j].Name
+	})
+	return resolved, nil
+}
+
+// resolve returns the origin of the discovered service
+func resolve(svc *v1.Service) Resolved {
+	r := Resolved{Namespace: svc.Namespace, Name: svc.Name}
+	if origin, ok := translator.GetOriginIdentity(svc.Annotations); ok {
+		r.Origin = origin
+		return r
+	}
+	r.Partial = true
+	r.Origin = translator.OriginIdentity{
+		Backend:          svc.Labels[translator.GimbalLabelBackend],
+		Namespace:        svc.Namespace,
+		Name:             svc.Labels[translator.GimbalLabelService],
+		LoadBalancerID:   svc.Labels[translator.GimbalLabelLoadBalancerID],
+		LoadBalancerName: svc.Labels[translator.GimbalLabelLoadBalancerName],
+	}
+	return r
+}
+
+// PrintResolved writes the discovered services and their origins as a table
+func PrintResolved(w io.Writer, resolved []Resolved) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tNAME\tBACKEND\tORIGIN NAMESPACE\tORIGIN NAME\tLOAD BALANCER\tPROJECT ID")
+	for _, r := range resolved {
+		name := r.Origin.Name
+		if r.Partial {
+			name += " (from labels)"
+		}
+		lb := r.Origin.LoadBalancerID
+		if r.Origin.LoadBalancerName != "" {
+			lb = fmt.Sprintf("%s (%s)", r.Origin.LoadBalancerName, r.Origin.LoadBalancerID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Namespace, r.Name, r.Origin.Backend, r.Origin.Namespace, name, valueOrNone(lb), valueOrNone(r.Origin.ProjectID))
+	}
+	return tw.Flush()
+}
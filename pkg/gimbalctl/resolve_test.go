@@ -0,0 +1,102 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gimbalctl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func discoveredService(namespace, name string, origin translator.OriginIdentity) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        name,
+			Labels:      translator.AddGimbalLabels(origin.Backend, origin.Name, nil),
+			Annotations: translator.AddOriginAnnotations(nil, origin),
+		},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	long := translator.OriginIdentity{Backend: "us-east-cluster", Namespace: "team1", Name: "the-really-long-kube-service-name-that-is-exactly-63-characters"}
+	lb := translator.OriginIdentity{Backend: "openstack", Namespace: "team1", Name: "5a5c3d9e", LoadBalancerID: "5A5C3D9E", LoadBalancerName: "stocks", ProjectID: "p1"}
+	l7 := translator.OriginIdentity{Backend: "openstack", Namespace: "team1", Name: "5a5c3d9e-policy-1", LoadBalancerID: "5A5C3D9E", LoadBalancerName: "stocks", L7PolicyID: "policy-1"}
+	other := translator.OriginIdentity{Backend: "us-west", Namespace: "team2", Name: "stocks"}
+	// Discovered by a previous version, without origin annotations
+	old := discoveredService("team2", "us-east-kuard", translator.OriginIdentity{Backend: "us-east", Name: "kuard"})
+	old.Annotations = nil
+
+	client := fake.NewSimpleClientset(
+		discoveredService("team1", "us-east-cluster-the-really-long-kube-serv1feeec", long),
+		discoveredService("team1", "openstack-5a5c3d9e", lb),
+		discoveredService("team1", "openstack-5a5c3d9e-policy-1", l7),
+		discoveredService("team2", "us-west-stocks", other),
+		old,
+		// Not discovered
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "openstack-5a5c3d9e-local"}},
+	)
+
+	got, err := Resolve(client, "", "us-east-cluster-the-really-long-kube-serv1feeec")
+	require.NoError(t, err)
+	assert.Equal(t, []Resolved{{Namespace: "team1", Name: "us-east-cluster-the-really-long-kube-serv1feeec", Origin: long}}, got)
+
+	got, err = Resolve(client, "team2", "us-east-kuard")
+	require.NoError(t, err)
+	assert.Equal(t, []Resolved{{Namespace: "team2", Name: "us-east-kuard", Origin: translator.OriginIdentity{Backend: "us-east", Namespace: "team2", Name: "kuard"}, Partial: true}}, got)
+
+	got, err = Resolve(client, "team2", "openstack-5a5c3d9e")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = Resolve(client, "", "openstack-5a5c3d9e-local")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	// Load balancers are matched by name, and their L7 policies are not
+	got, err = Lookup(client, "", "", "stocks")
+	require.NoError(t, err)
+	assert.Equal(t, []Resolved{
+		{Namespace: "team1", Name: "openstack-5a5c3d9e", Origin: lb},
+		{Namespace: "team2", Name: "us-west-stocks", Origin: other},
+	}, got)
+
+	got, err = Lookup(client, "openstack", "", "stocks")
+	require.NoError(t, err)
+	assert.Equal(t, []Resolved{{Namespace: "team1", Name: "openstack-5a5c3d9e", Origin: lb}}, got)
+
+	got, err = Lookup(client, "", "team1", "5a5c3d9e-policy-1")
+	require.NoError(t, err)
+	assert.Equal(t, []Resolved{{Namespace: "team1", Name: "openstack-5a5c3d9e-policy-1", Origin: l7}}, got)
+}
+
+func TestPrintResolved(t *testing.T) {
+	var buf bytes.Buffer
+	err := PrintResolved(&buf, []Resolved{
+		{Namespace: "team1", Name: "openstack-5a5c3d9e", Origin: translator.OriginIdentity{Backend: "openstack", Namespace: "team1", Name: "5a5c3d9e", LoadBalancerID: "5A5C3D9E", LoadBalancerName: "stocks", ProjectID: "p1"}},
+		{Namespace: "team2", Name: "us-east-kuard", Origin: translator.OriginIdentity{Backend: "us-east", Namespace: "team2", Name: "kuard"}, Partial: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `NAMESPACE  NAME                BACKEND    ORIGIN NAMESPACE  ORIGIN NAME          LOAD BALANCER      PROJECT ID
+team1      openstack-5a5c3d9e  openstack  team1             5a5c3d9e             stocks (5A5C3D9E)  p1
+team2      us-east-kuard       us-east    team2             kuard (from labels)  <none>             <none>
+`, buf.String())
+}
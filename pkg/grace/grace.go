@@ -0,0 +1,225 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grace keeps the addresses that are removed from discovered
+// endpoints as not ready addresses for a grace period.
+package grace
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// addressKey identifies an address of endpoints by its IP and the ports of
+// its subset
+type addressKey struct {
+	ip    string
+	ports string
+}
+
+type address struct {
+	address v1.EndpointAddress
+	ports   []v1.EndpointPort
+}
+
+type graced struct {
+	address
+	until time.Time
+}
+
+// Tracker keeps the addresses that are removed from discovered endpoints as
+// not ready addresses until their grace period ends, so that members that
+// flap do not churn the endpoints. An address that comes back before the end
+// of its grace period is ready again.
+type Tracker struct {
+	// Period is the time removed addresses are kept as not ready. If zero,
+	// removed addresses are removed right away.
+	Period time.Duration
+
+	mu gosync.Mutex
+	// last holds the addresses of each endpoints when they were last
+	// synced, without the addresses in grace
+	last map[types.NamespacedName]map[addressKey]address
+	// grace holds the removed addresses of each endpoints that are in grace
+	grace map[types.NamespacedName]map[addressKey]graced
+	// resync, if not nil, is called with the namespace and upstream name of
+	// endpoints once the grace period of one of their addresses ends
+	resync  func(namespace, upstreamName string)
+	metrics localmetrics.DiscovererMetrics
+	now     func() time.Time
+}
+
+// NewTracker returns a tracker that does not keep removed addresses until
+// its period is set. If resync is not nil, it is called when grace periods
+// end, so that the endpoints are synced without the addresses.
+func NewTracker(resync func(namespace, upstreamName string), metrics localmetrics.DiscovererMetrics) *Tracker {
+	return &Tracker{
+		last:    map[types.NamespacedName]map[addressKey]address{},
+		grace:   map[types.NamespacedName]map[addressKey]graced{},
+		resync:  resync,
+		metrics: metrics,
+		now:     time.Now,
+	}
+}
+
+// Apply records the addresses of the endpoints that are about to be synced,
+// and returns the endpoints with the removed addresses that are in grace
+// added as not ready addresses. The grace period of the addresses that were
+// removed since the previous call starts.
+func (t *Tracker) Apply(ep *v1.Endpoints, upstreamName string) *v1.Endpoints {
+	if t.Period <= 0 {
+		return ep
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}
+	current := addresses(ep)
+	now := t.now()
+	inGrace := t.grace[key]
+	if inGrace == nil {
+		inGrace = map[addressKey]graced{}
+	}
+	started := false
+	for k, a := range t.last[key] {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		if _, ok := inGrace[k]; !ok {
+			inGrace[k] = graced{address: a, until: now.Add(t.Period)}
+			started = true
+		}
+	}
+	for k, g := range inGrace {
+		if _, ok := current[k]; ok || !now.Before(g.until) {
+			delete(inGrace, k)
+		}
+	}
+	t.last[key] = current
+	if len(inGrace) == 0 {
+		delete(t.grace, key)
+	} else {
+		t.grace[key] = inGrace
+	}
+	t.metrics.GraceAddressesMetric(ep.Namespace, ep.Name, len(inGrace))
+
+	if started && t.resync != nil {
+		namespace := ep.Namespace
+		time.AfterFunc(t.Period, func() { t.resync(namespace, upstreamName) })
+	}
+	return withGrace(ep, inGrace)
+}
+
+// WithGrace returns the endpoints with the removed addresses that are in
+// grace added as not ready addresses, without recording their addresses
+func (t *Tracker) WithGrace(ep *v1.Endpoints) *v1.Endpoints {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return withGrace(ep, t.grace[types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}])
+}
+
+// Forget drops the addresses of endpoints that are deleted
+func (t *Tracker) Forget(namespace, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.forget(types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// RetainNamespace drops the addresses of the endpoints of the namespace that
+// are not named
+func (t *Tracker) RetainNamespace(namespace string, names []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	retained := map[string]bool{}
+	for _, name := range names {
+		retained[name] = true
+	}
+	for key := range t.last {
+		if key.Namespace == namespace && !retained[key.Name] {
+			t.forget(key)
+		}
+	}
+}
+
+func (t *Tracker) forget(key types.NamespacedName) {
+	if _, ok := t.grace[key]; ok {
+		t.metrics.GraceAddressesMetric(key.Namespace, key.Name, 0)
+	}
+	delete(t.last, key)
+	delete(t.grace, key)
+}
+
+// addresses returns the ready and not ready addresses of the endpoints
+func addresses(ep *v1.Endpoints) map[addressKey]address {
+	res := map[addressKey]address{}
+	for _, s := range ep.Subsets {
+		ports := portsKey(s.Ports)
+		for _, list := range [][]v1.EndpointAddress{s.Addresses, s.NotReadyAddresses} {
+			for _, a := range list {
+				res[addressKey{ip: a.IP, ports: ports}] = address{address: a, ports: s.Ports}
+			}
+		}
+	}
+	return res
+}
+
+func portsKey(ports []v1.EndpointPort) string {
+	var res []string
+	for _, p := range ports {
+		res = append(res, p.Name+" "+strconv.Itoa(int(p.Port))+"/"+string(p.Protocol))
+	}
+	sort.Strings(res)
+	return strings.Join(res, ",")
+}
+
+// withGrace returns a copy of the endpoints with the given addresses added as
+// not ready addresses of the subsets with their ports
+func withGrace(ep *v1.Endpoints, inGrace map[addressKey]graced) *v1.Endpoints {
+	if len(inGrace) == 0 {
+		return ep
+	}
+	keys := make([]addressKey, 0, len(inGrace))
+	for k := range inGrace {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ports != keys[j].ports {
+			return keys[i].ports < keys[j].ports
+		}
+		return keys[i].ip < keys[j].ip
+	})
+
+	res := ep.DeepCopy()
+	for _, k := range keys {
+		g := inGrace[k]
+		i := 0
+		for ; i < len(res.Subsets); i++ {
+			if reflect.DeepEqual(res.Subsets[i].Ports, g.ports) {
+				break
+			}
+		}
+		if i == len(res.Subsets) {
+			res.Subsets = append(res.Subsets, v1.EndpointSubset{Ports: g.ports})
+		}
+		res.Subsets[i].NotReadyAddresses = append(res.Subsets[i].NotReadyAddresses, g.address.address)
+	}
+	return res
+}
@@ -0,0 +1,157 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grace
+
+import (
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/metrics/metricstest"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var httpPorts = []v1.EndpointPort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}
+
+func endpoints(subsets ...v1.EndpointSubset) *v1.Endpoints {
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "us-east-a"},
+		Subsets:    subsets,
+	}
+}
+
+func subset(ports []v1.EndpointPort, ready []string, notReady []string) v1.EndpointSubset {
+	s := v1.EndpointSubset{Ports: ports}
+	for _, ip := range ready {
+		s.Addresses = append(s.Addresses, v1.EndpointAddress{IP: ip})
+	}
+	for _, ip := range notReady {
+		s.NotReadyAddresses = append(s.NotReadyAddresses, v1.EndpointAddress{IP: ip})
+	}
+	return s
+}
+
+func newTestTracker(period time.Duration, resync func(namespace, upstreamName string)) (*Tracker, localmetrics.DiscovererMetrics, *time.Time) {
+	metrics := metricstest.NewMetrics()
+	t := NewTracker(resync, metrics)
+	t.Period = period
+	now, clock := metricstest.Clock()
+	t.now = clock
+	return t, metrics, now
+}
+
+func TestApply(t *testing.T) {
+	tracker, metrics, now := newTestTracker(time.Minute, nil)
+	both := endpoints(subset(httpPorts, []string{"10.0.0.1", "10.0.0.2"}, nil))
+	one := endpoints(subset(httpPorts, []string{"10.0.0.1"}, nil))
+
+	assert.Equal(t, both, tracker.Apply(both, "upname"))
+
+	// Removed addresses are not ready during their grace period
+	withGrace := endpoints(subset(httpPorts, []string{"10.0.0.1"}, []string{"10.0.0.2"}))
+	assert.Equal(t, withGrace, tracker.Apply(one, "upname"))
+	assert.Equal(t, withGrace, tracker.WithGrace(one))
+	assert.Equal(t, 1, graceAddresses(t, metrics, "team1", "us-east-a"))
+	assert.Empty(t, one.Subsets[0].NotReadyAddresses)
+	*now = now.Add(30 * time.Second)
+	assert.Equal(t, withGrace, tracker.Apply(one, "upname"))
+
+	// Addresses that come back are ready again
+	assert.Equal(t, both, tracker.Apply(both, "upname"))
+	assert.Equal(t, 0, graceAddresses(t, metrics, "team1", "us-east-a"))
+
+	// Removed addresses are removed once their grace period ends
+	assert.Equal(t, withGrace, tracker.Apply(one, "upname"))
+	*now = now.Add(time.Minute)
+	assert.Equal(t, one, tracker.Apply(one, "upname"))
+	assert.Equal(t, 0, graceAddresses(t, metrics, "team1", "us-east-a"))
+
+	// Addresses that are no longer ready upstream are not removed
+	notReady := endpoints(subset(httpPorts, nil, []string{"10.0.0.1"}))
+	assert.Equal(t, notReady, tracker.Apply(notReady, "upname"))
+	assert.Equal(t, 0, graceAddresses(t, metrics, "team1", "us-east-a"))
+
+	// Addresses whose ports are gone are kept in a subset of their own
+	tracker.Forget("team1", "us-east-a")
+	tracker.Apply(both, "upname")
+	httpsPorts := []v1.EndpointPort{{Name: "https", Port: 443, Protocol: v1.ProtocolTCP}}
+	https := endpoints(subset(httpsPorts, []string{"10.0.0.1"}, nil))
+	assert.Equal(t, endpoints(
+		subset(httpsPorts, []string{"10.0.0.1"}, nil),
+		subset(httpPorts, nil, []string{"10.0.0.1", "10.0.0.2"}),
+	), tracker.Apply(https, "upname"))
+}
+
+func TestApplyDisabled(t *testing.T) {
+	tracker, _, _ := newTestTracker(0, nil)
+	tracker.Apply(endpoints(subset(httpPorts, []string{"10.0.0.1", "10.0.0.2"}, nil)), "upname")
+	one := endpoints(subset(httpPorts, []string{"10.0.0.1"}, nil))
+	assert.Equal(t, one, tracker.Apply(one, "upname"))
+}
+
+func TestApplyResync(t *testing.T) {
+	resynced := make(chan string, 1)
+	tracker, _, _ := newTestTracker(10*time.Millisecond, func(namespace, upstreamName string) {
+		resynced <- namespace + "/" + upstreamName
+	})
+	tracker.Apply(endpoints(subset(httpPorts, []string{"10.0.0.1", "10.0.0.2"}, nil)), "upname")
+	tracker.Apply(endpoints(subset(httpPorts, []string{"10.0.0.1"}, nil)), "upname")
+	select {
+	case got := <-resynced:
+		assert.Equal(t, "team1/upname", got)
+	case <-time.After(time.Second):
+		t.Fatal("endpoints were not synced again at the end of the grace period")
+	}
+}
+
+func TestRetainNamespace(t *testing.T) {
+	tracker, metrics, _ := newTestTracker(time.Minute, nil)
+	tracker.Apply(endpoints(subset(httpPorts, []string{"10.0.0.1", "10.0.0.2"}, nil)), "upname")
+	tracker.Apply(endpoints(subset(httpPorts, []string{"10.0.0.1"}, nil)), "upname")
+
+	tracker.RetainNamespace("team2", nil)
+	assert.Equal(t, 1, graceAddresses(t, metrics, "team1", "us-east-a"))
+	tracker.RetainNamespace("team1", []string{"us-east-a"})
+	assert.Equal(t, 1, graceAddresses(t, metrics, "team1", "us-east-a"))
+	tracker.RetainNamespace("team1", nil)
+	assert.Equal(t, 0, graceAddresses(t, metrics, "team1", "us-east-a"))
+
+	// The endpoints start over once they are forgotten
+	one := endpoints(subset(httpPorts, []string{"10.0.0.1"}, nil))
+	assert.Equal(t, one, tracker.Apply(one, "upname"))
+}
+
+func graceAddresses(t *testing.T, metrics localmetrics.DiscovererMetrics, namespace, name string) int {
+	mfs, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != localmetrics.DiscovererGraceAddressesGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["namespace"] == namespace && labels["name"] == name {
+				return int(m.GetGauge().GetValue())
+			}
+		}
+	}
+	return 0
+}
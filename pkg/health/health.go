@@ -0,0 +1,311 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package health tracks whether the API of a backend can be reached, so that
+// the objects discovered from it are not kept as if they were up to date.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	gosync "sync"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// State is the health of a backend
+type State string
+
+const (
+	// StateHealthy is the state of a backend whose API calls succeed
+	StateHealthy State = "Healthy"
+	// StateDegraded is the state of a backend whose API calls have failed for
+	// the degraded delay, either partially, or for less than the unreachable
+	// delay
+	StateDegraded State = "Degraded"
+	// StateUnreachable is the state of a backend whose API calls have all
+	// failed for longer than the unreachable delay
+	StateUnreachable State = "Unreachable"
+)
+
+// States lists the health states
+var States = []State{StateHealthy, StateDegraded, StateUnreachable}
+
+// Policy is what happens to the discovered endpoints of an unreachable
+// backend
+type Policy string
+
+const (
+	// PolicyKeep keeps the endpoints as they were last discovered
+	PolicyKeep Policy = "keep"
+	// PolicyNotReady moves the addresses of the endpoints to their not ready
+	// addresses
+	PolicyNotReady Policy = "not-ready"
+	// PolicyRemove removes the addresses of the endpoints
+	PolicyRemove Policy = "remove"
+)
+
+// ParsePolicy parses the policy of the endpoints of unreachable backends
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyKeep, PolicyNotReady, PolicyRemove:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown unreachable endpoints policy %q, must be one of %s, %s or %s", s, PolicyKeep, PolicyNotReady, PolicyRemove)
+}
+
+// Backend tracks the health of a backend from the results of its API calls.
+// A backend is healthy until its calls have failed for the degraded delay,
+// without a call that succeeds, so that a single failure that is retried is
+// ignored. It is then degraded, and becomes unreachable once its calls have
+// all failed for the unreachable delay. A call that succeeds makes it healthy
+// again.
+type Backend struct {
+	// DegradedAfter is the time the calls to the backend must fail, at least
+	// partially, before the backend is degraded
+	DegradedAfter time.Duration
+	// UnreachableAfter is the time the calls to the backend must fail before
+	// the backend is unreachable. If zero, the backend is never unreachable.
+	UnreachableAfter time.Duration
+	// Policy is applied to the discovered endpoints while the backend is
+	// unreachable
+	Policy Policy
+
+	mu    gosync.Mutex
+	state State
+	// troubledSince is the time of the first call that failed, at least
+	// partially, since the last call that succeeded, or zero if the last
+	// call succeeded
+	troubledSince time.Time
+	// failingSince is the time of the first call of the ongoing failures,
+	// or zero if the last call succeeded
+	failingSince time.Time
+	// onChange, if not nil, is called with the new state when the state
+	// changes
+	onChange func(State)
+	logger   *logrus.Logger
+	metrics  localmetrics.DiscovererMetrics
+	now      func() time.Time
+}
+
+// NewBackend returns the health of a healthy backend that keeps its endpoints
+// when it is unreachable
+func NewBackend(logger *logrus.Logger, metrics localmetrics.DiscovererMetrics) *Backend {
+	b := &Backend{
+		DegradedAfter:    15 * time.Second,
+		UnreachableAfter: 5 * time.Minute,
+		Policy:           PolicyKeep,
+		state:            StateHealthy,
+		logger:           logger,
+		metrics:          metrics,
+		now:              time.Now,
+	}
+	b.writeMetrics()
+	return b
+}
+
+// Notify calls the given function with the new state each time the state of
+// the backend changes
+func (b *Backend) Notify(onChange func(State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = onChange
+}
+
+// State returns the health of the backend
+func (b *Backend) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Succeeded records that the calls to the backend succeeded
+func (b *Backend) Succeeded() {
+	b.mu.Lock()
+	b.troubledSince = time.Time{}
+	b.failingSince = time.Time{}
+	changed := b.setState(StateHealthy, nil)
+	b.mu.Unlock()
+	b.changed(changed)
+}
+
+// PartiallyFailed records that some calls to the backend failed, while others
+// succeeded, which means that the backend can be reached
+func (b *Backend) PartiallyFailed(err error) {
+	b.mu.Lock()
+	now := b.now()
+	b.trouble(now, err)
+	b.failingSince = time.Time{}
+	changed := b.setState(b.failingState(now), err)
+	b.mu.Unlock()
+	b.changed(changed)
+}
+
+// Failed records that the calls to the backend failed
+func (b *Backend) Failed(err error) {
+	b.mu.Lock()
+	now := b.now()
+	b.trouble(now, err)
+	if b.failingSince.IsZero() {
+		b.failingSince = now
+		if b.UnreachableAfter > 0 {
+			// The backend becomes unreachable even if no call is made
+			// until then
+			time.AfterFunc(b.UnreachableAfter, func() { b.evaluate(err) })
+		}
+	}
+	changed := b.setState(b.failingState(now), err)
+	b.mu.Unlock()
+	b.changed(changed)
+}
+
+// trouble records the first of the calls that fail, at least partially
+func (b *Backend) trouble(now time.Time, err error) {
+	if !b.troubledSince.IsZero() {
+		return
+	}
+	b.troubledSince = now
+	if b.DegradedAfter > 0 {
+		// The backend is degraded even if no call is made until then
+		time.AfterFunc(b.DegradedAfter, func() { b.evaluate(err) })
+	}
+}
+
+// evaluate updates the state of a backend whose calls are failing
+func (b *Backend) evaluate(err error) {
+	b.mu.Lock()
+	if b.troubledSince.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+	changed := b.setState(b.failingState(b.now()), err)
+	b.mu.Unlock()
+	b.changed(changed)
+}
+
+// failingState returns the state of a backend whose calls are failing, at
+// least partially. A healthy backend stays healthy until the calls have failed
+// for the degraded delay.
+func (b *Backend) failingState(now time.Time) State {
+	switch {
+	case !b.failingSince.IsZero() && b.UnreachableAfter > 0 && now.Sub(b.failingSince) >= b.UnreachableAfter:
+		return StateUnreachable
+	case b.state == StateHealthy && now.Sub(b.troubledSince) < b.DegradedAfter:
+		return StateHealthy
+	}
+	return StateDegraded
+}
+
+// setState changes the state of the backend, and returns whether it changed
+func (b *Backend) setState(state State, err error) bool {
+	if state == b.state {
+		return false
+	}
+	b.state = state
+	switch state {
+	case StateHealthy:
+		b.logger.Infof("backend is healthy")
+	case StateDegraded:
+		b.logger.Warnf("backend is degraded: %v", err)
+	case StateUnreachable:
+		b.logger.Errorf("backend is unreachable, its calls failed for %s: %v", b.UnreachableAfter, err)
+	}
+	b.writeMetrics()
+	return true
+}
+
+func (b *Backend) changed(changed bool) {
+	if !changed {
+		return
+	}
+	b.mu.Lock()
+	state, onChange := b.state, b.onChange
+	b.mu.Unlock()
+	if onChange != nil {
+		onChange(state)
+	}
+}
+
+func (b *Backend) writeMetrics() {
+	for _, state := range States {
+		b.metrics.BackendHealthMetric(string(state), state == b.state)
+	}
+}
+
+// Annotate sets the annotation of the health of the backend on a discovered
+// object that is about to be written
+func (b *Backend) Annotate(meta *metav1.ObjectMeta) {
+	annotations := map[string]string{}
+	for k, v := range meta.Annotations {
+		annotations[k] = v
+	}
+	annotations[translator.GimbalAnnotationBackendHealth] = string(b.State())
+	meta.Annotations = annotations
+}
+
+// ApplyPolicy returns the discovered endpoints as they must be written given
+// the health of the backend. The policy only applies while the backend is
+// unreachable.
+func (b *Backend) ApplyPolicy(ep *v1.Endpoints) *v1.Endpoints {
+	if b.State() != StateUnreachable {
+		return ep
+	}
+	switch b.Policy {
+	case PolicyNotReady:
+		res := ep.DeepCopy()
+		for i, s := range res.Subsets {
+			res.Subsets[i].NotReadyAddresses = append(s.NotReadyAddresses, s.Addresses...)
+			res.Subsets[i].Addresses = nil
+		}
+		return res
+	case PolicyRemove:
+		res := ep.DeepCopy()
+		res.Subsets = nil
+		return res
+	}
+	return ep
+}
+
+// WrapTransport returns a round tripper that records the results of the calls
+// to the backend made through the given one. Errors and server errors are
+// failures, and authorization errors are partial failures.
+func (b *Backend) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return roundTripper{backend: b, rt: rt}
+}
+
+type roundTripper struct {
+	backend *Backend
+	rt      http.RoundTripper
+}
+
+func (rt roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := rt.rt.RoundTrip(req)
+	switch {
+	case req.Context().Err() != nil:
+		// The call was canceled, such as a watch that is stopped
+	case err != nil:
+		rt.backend.Failed(err)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		rt.backend.Failed(fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status))
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		rt.backend.PartiallyFailed(fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status))
+	default:
+		rt.backend.Succeeded()
+	}
+	return resp, err
+}
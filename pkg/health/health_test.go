@@ -0,0 +1,266 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/metrics/metricstest"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestBackend(onChange func(State)) (*Backend, localmetrics.DiscovererMetrics, *time.Time) {
+	metrics := metricstest.NewMetrics()
+	b := NewBackend(logrus.New(), metrics)
+	b.Notify(onChange)
+	b.DegradedAfter = 0
+	b.UnreachableAfter = time.Hour
+	now, clock := metricstest.Clock()
+	b.now = clock
+	return b, metrics, now
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, s := range []string{"keep", "not-ready", "remove"} {
+		p, err := ParsePolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, Policy(s), p)
+	}
+	_, err := ParsePolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestStates(t *testing.T) {
+	var changes []State
+	b, metrics, now := newTestBackend(func(s State) { changes = append(changes, s) })
+	assert.Equal(t, StateHealthy, b.State())
+	assert.Equal(t, StateHealthy, currentState(t, metrics))
+
+	// Failures degrade the backend until they last for the unreachable delay
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, b.State())
+	*now = now.Add(30 * time.Minute)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, b.State())
+	*now = now.Add(30 * time.Minute)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateUnreachable, b.State())
+	assert.Equal(t, StateUnreachable, currentState(t, metrics))
+
+	// A backend that answers is not unreachable
+	b.PartiallyFailed(errors.New("forbidden"))
+	assert.Equal(t, StateDegraded, b.State())
+	*now = now.Add(time.Hour)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, b.State())
+
+	b.Succeeded()
+	assert.Equal(t, StateHealthy, b.State())
+	assert.Equal(t, StateHealthy, currentState(t, metrics))
+	assert.Equal(t, []State{StateDegraded, StateUnreachable, StateDegraded, StateHealthy}, changes)
+}
+
+func TestDegradedAfter(t *testing.T) {
+	var changes []State
+	b, _, now := newTestBackend(func(s State) { changes = append(changes, s) })
+	b.DegradedAfter = time.Minute
+
+	// A failure that is retried before the degraded delay is ignored
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateHealthy, b.State())
+	*now = now.Add(30 * time.Second)
+	b.Succeeded()
+	assert.Equal(t, StateHealthy, b.State())
+	assert.Empty(t, changes)
+
+	// Failures, partial or not, degrade the backend once they last for the
+	// degraded delay
+	b.PartiallyFailed(errors.New("forbidden"))
+	*now = now.Add(30 * time.Second)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateHealthy, b.State())
+	*now = now.Add(30 * time.Second)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, b.State())
+	assert.Equal(t, []State{StateDegraded}, changes)
+}
+
+func TestDegradedWithoutCalls(t *testing.T) {
+	changed := make(chan State, 1)
+	b, _, _ := newTestBackend(func(s State) { changed <- s })
+	b.DegradedAfter = 50 * time.Millisecond
+	b.now = time.Now
+
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateHealthy, b.State())
+	select {
+	case s := <-changed:
+		assert.Equal(t, StateDegraded, s)
+	case <-time.After(time.Second):
+		t.Fatal("backend did not become degraded")
+	}
+}
+
+func TestUnreachableWithoutCalls(t *testing.T) {
+	changed := make(chan State, 2)
+	b, _, _ := newTestBackend(func(s State) { changed <- s })
+	b.UnreachableAfter = 50 * time.Millisecond
+	b.now = time.Now
+
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, <-changed)
+	select {
+	case s := <-changed:
+		assert.Equal(t, StateUnreachable, s)
+	case <-time.After(time.Second):
+		t.Fatal("backend did not become unreachable")
+	}
+
+	// Zero never makes the backend unreachable
+	b, _, now := newTestBackend(nil)
+	b.UnreachableAfter = 0
+	b.Failed(errors.New("connection refused"))
+	*now = now.Add(24 * time.Hour)
+	b.Failed(errors.New("connection refused"))
+	assert.Equal(t, StateDegraded, b.State())
+}
+
+func TestAnnotate(t *testing.T) {
+	b, _, _ := newTestBackend(nil)
+	annotations := map[string]string{"foo": "bar"}
+	meta := metav1.ObjectMeta{Annotations: annotations}
+
+	b.Annotate(&meta)
+	assert.Equal(t, map[string]string{"foo": "bar", translator.GimbalAnnotationBackendHealth: "Healthy"}, meta.Annotations)
+	assert.Equal(t, map[string]string{"foo": "bar"}, annotations)
+
+	b.Failed(errors.New("connection refused"))
+	b.Annotate(&meta)
+	assert.Equal(t, "Degraded", meta.Annotations[translator.GimbalAnnotationBackendHealth])
+}
+
+func TestApplyPolicy(t *testing.T) {
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-nginx"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 80}},
+		}},
+	}
+	notReady := &v1.Endpoints{
+		ObjectMeta: ep.ObjectMeta,
+		Subsets: []v1.EndpointSubset{{
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 80}},
+		}},
+	}
+	removed := &v1.Endpoints{ObjectMeta: ep.ObjectMeta}
+
+	tests := []struct {
+		name        string
+		policy      Policy
+		unreachable bool
+		expected    *v1.Endpoints
+	}{
+		{name: "healthy", policy: PolicyRemove, expected: ep},
+		{name: "keep", policy: PolicyKeep, unreachable: true, expected: ep},
+		{name: "not ready", policy: PolicyNotReady, unreachable: true, expected: notReady},
+		{name: "remove", policy: PolicyRemove, unreachable: true, expected: removed},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, now := newTestBackend(nil)
+			b.Policy = tc.policy
+			if tc.unreachable {
+				b.Failed(errors.New("connection refused"))
+				*now = now.Add(time.Hour)
+				b.Failed(errors.New("connection refused"))
+			}
+			assert.Equal(t, tc.expected, b.ApplyPolicy(ep))
+			assert.Len(t, ep.Subsets[0].Addresses, 1)
+		})
+	}
+}
+
+func TestWrapTransport(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	b, _, _ := newTestBackend(nil)
+	client := &http.Client{Transport: b.WrapTransport(http.DefaultTransport)}
+	get := func() {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	status = http.StatusServiceUnavailable
+	get()
+	assert.Equal(t, StateDegraded, b.State())
+
+	status = http.StatusOK
+	get()
+	assert.Equal(t, StateHealthy, b.State())
+
+	status = http.StatusForbidden
+	get()
+	assert.Equal(t, StateDegraded, b.State())
+
+	status = http.StatusNotFound
+	get()
+	assert.Equal(t, StateHealthy, b.State())
+
+	server.Close()
+	get()
+	assert.Equal(t, StateDegraded, b.State())
+}
+
+func currentState(t *testing.T, metrics localmetrics.DiscovererMetrics) State {
+	mfs, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var current State
+	for _, mf := range mfs {
+		if mf.GetName() != localmetrics.DiscovererBackendHealthGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() != 1 {
+				continue
+			}
+			for _, l := range m.Label {
+				if l.GetName() == "state" {
+					current = State(l.GetValue())
+				}
+			}
+		}
+	}
+	return current
+}
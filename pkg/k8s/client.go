@@ -19,6 +19,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
 )
 
 // NewClient returns a Kubernetes client using the given config. If no config is
@@ -45,6 +46,19 @@ func NewClientWithQPS(kubeCfgFile string, logger *logrus.Logger, qps float32, bu
 	return kubernetes.NewForConfig(config)
 }
 
+// NewClientWithTransport returns a Kubernetes client using the given config,
+// whose calls go through the round tripper returned by wrap. If no config is
+// provided, assumes it is running inside a Kubernetes cluster and uses the
+// in-cluster config.
+func NewClientWithTransport(kubeCfgFile string, logger *logrus.Logger, wrap transport.WrapperFunc) (kubernetes.Interface, error) {
+	config, err := buildConfig(kubeCfgFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	config.WrapTransport = transport.Wrappers(config.WrapTransport, wrap)
+	return kubernetes.NewForConfig(config)
+}
+
 func buildConfig(kubeCfgFile string, logger *logrus.Logger) (*rest.Config, error) {
 	if kubeCfgFile != "" {
 		logger.Infof("Using OutOfCluster k8s config with kubeConfigFile: %s", kubeCfgFile)
@@ -15,17 +15,32 @@ package k8s
 
 import (
 	"fmt"
+	"reflect"
+	gosync "sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/projectcontour/gimbal/pkg/brake"
+	"github.com/projectcontour/gimbal/pkg/drift"
+	"github.com/projectcontour/gimbal/pkg/grace"
+	"github.com/projectcontour/gimbal/pkg/health"
+	"github.com/projectcontour/gimbal/pkg/probe"
 	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/util"
+	"github.com/projectcontour/gimbal/pkg/validation"
 
 	"github.com/sirupsen/logrus"
 
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
 	"github.com/projectcontour/gimbal/pkg/sync"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeinformers "k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
 	listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
@@ -44,106 +59,870 @@ type Controller struct {
 	syncqueue       sync.Queue
 	servicesSynced  cache.InformerSynced
 	endpointsSynced cache.InformerSynced
+	nodesSynced     cache.InformerSynced
+	// listersMu guards the listers, which are replaced when the informer
+	// factory is replaced
+	listersMu       gosync.RWMutex
 	serviceLister   listers.ServiceLister
 	endpointsLister listers.EndpointsLister
-	metrics         localmetrics.DiscovererMetrics
+	// nodeLister is nil unless endpoints are built from node addresses, or
+	// carry the locality of the nodes
+	nodeLister listers.NodeLister
+	// upstreamObjects counts the services and endpoints of the backend
+	// cluster. It is updated by the event handlers of the informer factory
+	// of the listers, and read with atomic operations.
+	upstreamObjects *int64
+	// factories numbers the informer factories whose events are handled,
+	// and activeFactory is the one of the listers. The events of the other
+	// factories are ignored, so that objects are not handled by two
+	// factories while one replaces the other.
+	factories     int
+	activeFactory int
+	metrics       localmetrics.DiscovererMetrics
+	// IPFamily is the only IP family of the endpoint addresses that are
+	// discovered. If empty, addresses of all families are discovered.
+	IPFamily translator.IPFamily
+	// NameTemplate builds the names of the discovered services and
+	// endpoints. If nil, they are named "<backend>-<service>".
+	NameTemplate *translator.NameTemplate
+	// Invalid holds the services and endpoints that were not synced, or only
+	// partially, because of validation problems
+	Invalid *validation.Store
+	// Drift holds the discovered services and endpoints that differ from
+	// the backend, which are found by periodic drift checks
+	Drift *drift.Store
+	// DriftCheckInterval is the interval between drift checks. If zero,
+	// drift is not checked.
+	DriftCheckInterval time.Duration
+	// DriftResync syncs again the objects that drift checks report
+	DriftResync bool
+	// Brake pauses deletions when too many discovered objects would be
+	// deleted within its window, such as after a relist that lost objects
+	Brake *brake.Brake
+	// Grace keeps the addresses removed from upstream endpoints as not ready
+	// addresses of the discovered endpoints for a grace period
+	Grace *grace.Tracker
+	// Health tracks whether the backend cluster can be reached. It is
+	// annotated on the discovered objects, and its policy is applied to the
+	// discovered endpoints.
+	Health *health.Backend
+	// Prober moves the addresses of the discovered endpoints that cannot be
+	// reached from Gimbal to their not ready addresses
+	Prober *probe.Prober
 
+	// healthChanges holds a pending change of the health of the backend. The
+	// changes that happen while the objects are synced again are coalesced.
+	healthChanges chan struct{}
+
+	endpointsPolicy EndpointsPolicy
+	// topology enables the locality metadata of the discovered endpoints
+	topology    bool
 	backendName string
 }
 
-// NewController returns a new NewController
+// NewController returns a new NewController. The endpoints policy selects
+// where the endpoints of each type of service come from. If topology is true,
+// the discovered endpoints carry the region and zone of the nodes of their
+// addresses. The health of the backend is typically updated by the client of
+// the informer factory.
 func NewController(log *logrus.Logger, gimbalKubeClient kubernetes.Interface, kubeInformerFactory kubeinformers.SharedInformerFactory,
-	backendName string, threadiness int, metrics localmetrics.DiscovererMetrics) *Controller {
-
-	// obtain references to shared index informers for the services types.
-	serviceInformer := kubeInformerFactory.Core().V1().Services()
-	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints()
+	backendName string, threadiness int, metrics localmetrics.DiscovererMetrics, endpointsPolicy EndpointsPolicy, topology bool,
+	backendHealth *health.Backend) *Controller {
 
 	c := &Controller{
 		Logger:          log,
 		syncqueue:       sync.NewQueue(log, gimbalKubeClient, threadiness, metrics),
-		servicesSynced:  serviceInformer.Informer().HasSynced,
-		endpointsSynced: endpointsInformer.Informer().HasSynced,
 		backendName:     backendName,
-		serviceLister:   serviceInformer.Lister(),
-		endpointsLister: endpointsInformer.Lister(),
 		metrics:         metrics,
+		Invalid:         validation.NewStore(metrics),
+		Drift:           drift.NewStore(metrics),
+		Health:          backendHealth,
+		healthChanges:   make(chan struct{}, 1),
+		endpointsPolicy: endpointsPolicy,
+		topology:        topology,
 	}
+	c.Brake = brake.NewBrake(c.syncqueue.Enqueue, log, metrics)
+	c.Grace = grace.NewTracker(c.resyncDiscoveredEndpoints, metrics)
+	c.Prober = probe.NewProber(c.resyncDiscoveredEndpoints, log, metrics)
+	c.Health.Notify(c.healthChanged)
+
+	serviceInformer, endpointsInformer, nodeInformer, upstreamObjects := c.addEventHandlers(kubeInformerFactory, c.activeFactory)
+	c.servicesSynced = serviceInformer.Informer().HasSynced
+	c.endpointsSynced = endpointsInformer.Informer().HasSynced
+	c.serviceLister = serviceInformer.Lister()
+	c.endpointsLister = endpointsInformer.Lister()
+	c.upstreamObjects = upstreamObjects
+	if nodeInformer != nil {
+		c.nodesSynced = nodeInformer.Informer().HasSynced
+		c.nodeLister = nodeInformer.Lister()
+	}
+
+	return c
+}
+
+// addEventHandlers registers the controller event handlers with the service
+// and endpoints informers of the given factory, and returns the count of the
+// objects that the handlers saw. The handlers ignore the events until the
+// factory with the given number is the active one. The node informer is only
+// returned if endpoints are built from node addresses, or carry the locality
+// of the nodes.
+func (c *Controller) addEventHandlers(kubeInformerFactory kubeinformers.SharedInformerFactory, factory int) (coreinformers.ServiceInformer, coreinformers.EndpointsInformer, coreinformers.NodeInformer, *int64) {
+	// obtain references to shared index informers for the services types.
+	serviceInformer := kubeInformerFactory.Core().V1().Services()
+	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints()
+	upstreamObjects := new(int64)
 
 	// Set up an event handler for when Service resources change.
 	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
+			atomic.AddInt64(upstreamObjects, 1)
+			if !c.active(factory) {
+				return
+			}
 			c.addService(obj.(*v1.Service))
 		},
 		UpdateFunc: func(old, new interface{}) {
-			c.updateService(new.(*v1.Service))
+			if !c.active(factory) {
+				return
+			}
+			c.updateService(old.(*v1.Service), new.(*v1.Service))
 		},
 		DeleteFunc: func(obj interface{}) {
-			c.deleteService(obj.(*v1.Service))
+			atomic.AddInt64(upstreamObjects, -1)
+			if !c.active(factory) {
+				return
+			}
+			if service, ok := deletedObject(obj).(*v1.Service); ok {
+				c.deleteService(service)
+			}
 		},
 	})
 
 	// Set up an event handler for when Endpoint resources change.
 	endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
+			atomic.AddInt64(upstreamObjects, 1)
+			if !c.active(factory) {
+				return
+			}
 			c.addEndpoints(obj.(*v1.Endpoints))
 		},
 		UpdateFunc: func(old, new interface{}) {
-			c.updateEndpoints(new.(*v1.Endpoints))
+			if !c.active(factory) {
+				return
+			}
+			c.updateEndpoints(old.(*v1.Endpoints), new.(*v1.Endpoints))
 		},
 		DeleteFunc: func(obj interface{}) {
-			c.deleteEndpoints(obj.(*v1.Endpoints))
+			atomic.AddInt64(upstreamObjects, -1)
+			if !c.active(factory) {
+				return
+			}
+			if endpoints, ok := deletedObject(obj).(*v1.Endpoints); ok {
+				c.deleteEndpoints(endpoints)
+			}
 		},
 	})
 
-	return c
+	var nodeInformer coreinformers.NodeInformer
+	if c.endpointsPolicy.NeedsNodes() || c.topology {
+		nodeInformer = kubeInformerFactory.Core().V1().Nodes()
+		// Set up an event handler for when Node resources change.
+		nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if !c.active(factory) {
+					return
+				}
+				c.addNode(obj.(*v1.Node))
+			},
+			UpdateFunc: func(old, new interface{}) {
+				if !c.active(factory) {
+					return
+				}
+				c.updateNode(old.(*v1.Node), new.(*v1.Node))
+			},
+			DeleteFunc: func(obj interface{}) {
+				if !c.active(factory) {
+					return
+				}
+				c.deleteNode(obj)
+			},
+		})
+	}
+
+	return serviceInformer, endpointsInformer, nodeInformer, upstreamObjects
+}
+
+// deletedObject returns the last known state of a deleted object. Objects that
+// a relist finds deleted are wrapped in a tombstone.
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// enqueue adds the action to the sync queue. Deletions go through the brake,
+// and other actions drop the held deletion of their object and record the
+// health of the backend.
+func (c *Controller) enqueue(action sync.Action) {
+	if !sync.IsDelete(action) {
+		c.Brake.Cancel(action)
+		c.Health.Annotate(action.ObjectMeta())
+	} else if !c.Brake.Delete(c.upstreamCount(), action) {
+		c.Logger.WithFields(sync.LogFields(action)).Warnf("holding deletion of %s %s/%s while deletions are paused", sync.Kind(action), action.ObjectMeta().Namespace, action.ObjectMeta().Name)
+		return
+	}
+	c.syncqueue.Enqueue(action)
+}
+
+// discoveredEndpoints returns the endpoints to sync for valid discovered
+// endpoints, given the grace periods of their addresses, the probe configured
+// by their upstream service, and the health of the backend
+func (c *Controller) discoveredEndpoints(valid *v1.Endpoints, upstreamName string) *v1.Endpoints {
+	var annotations map[string]string
+	serviceLister, _, _ := c.listers()
+	if service, err := serviceLister.Services(valid.Namespace).Get(upstreamName); err == nil {
+		annotations = service.Annotations
+	}
+	return c.Health.ApplyPolicy(c.Prober.Apply(c.Grace.Apply(valid, upstreamName), upstreamName, annotations))
+}
+
+// upstreamCount returns the number of services and endpoints in the backend
+// cluster. It is kept up to date by the event handlers, so that deletions do
+// not list the whole backend.
+func (c *Controller) upstreamCount() int {
+	c.listersMu.RLock()
+	defer c.listersMu.RUnlock()
+	if c.upstreamObjects == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(c.upstreamObjects))
+}
+
+// active returns whether the events of the informer factory with the given
+// number are handled
+func (c *Controller) active(factory int) bool {
+	c.listersMu.RLock()
+	defer c.listersMu.RUnlock()
+	return c.activeFactory == factory
+}
+
+// ReplaceInformerFactory starts watching the backend cluster using the given
+// informer factory, which is typically built from reloaded credentials. The
+// factory is started with the given stop channel, and the controller switches
+// to its listers once the caches are synced. Until then, the events of the
+// new factory are ignored, and the previous factory keeps being handled. The
+// objects of both are then compared, and the objects that were added, updated
+// or deleted during the switch are synced. The caller is responsible for
+// stopping the previous factory once this returns successfully, and for
+// closing stopCh if it fails.
+func (c *Controller) ReplaceInformerFactory(kubeInformerFactory kubeinformers.SharedInformerFactory, stopCh <-chan struct{}, timeout time.Duration) error {
+	c.listersMu.Lock()
+	c.factories++
+	factory := c.factories
+	c.listersMu.Unlock()
+
+	serviceInformer, endpointsInformer, nodeInformer, upstreamObjects := c.addEventHandlers(kubeInformerFactory, factory)
+	kubeInformerFactory.Start(stopCh)
+
+	// Stop waiting for the caches after the timeout
+	syncStopCh := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-stopCh:
+		case <-timer.C:
+		case <-done:
+		}
+		close(syncStopCh)
+	}()
+
+	synced := []cache.InformerSynced{serviceInformer.Informer().HasSynced, endpointsInformer.Informer().HasSynced}
+	if nodeInformer != nil {
+		synced = append(synced, nodeInformer.Informer().HasSynced)
+	}
+	if ok := cache.WaitForCacheSync(syncStopCh, synced...); !ok {
+		return fmt.Errorf("failed to wait for backend caches to sync")
+	}
+
+	oldServiceLister, oldEndpointsLister, _ := c.listers()
+	c.listersMu.Lock()
+	c.serviceLister = serviceInformer.Lister()
+	c.endpointsLister = endpointsInformer.Lister()
+	c.upstreamObjects = upstreamObjects
+	if nodeInformer != nil {
+		c.nodeLister = nodeInformer.Lister()
+	}
+	c.activeFactory = factory
+	c.listersMu.Unlock()
+
+	c.syncReplaced(oldServiceLister, oldEndpointsLister)
+	return nil
+}
+
+// syncReplaced syncs the objects of the current listers, given the objects of
+// the listers they replaced. The objects that are no longer listed were
+// deleted while neither factory was handled, and are deleted.
+func (c *Controller) syncReplaced(oldServiceLister listers.ServiceLister, oldEndpointsLister listers.EndpointsLister) {
+	serviceLister, endpointsLister, _ := c.listers()
+	oldServices, err := oldServiceLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing services: %v", err)
+		return
+	}
+	services, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing services: %v", err)
+		return
+	}
+	oldEndpoints, err := oldEndpointsLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing endpoints: %v", err)
+		return
+	}
+	endpoints, err := endpointsLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing endpoints: %v", err)
+		return
+	}
+
+	previous := map[types.NamespacedName]*v1.Service{}
+	for _, service := range oldServices {
+		previous[types.NamespacedName{Namespace: service.Namespace, Name: service.Name}] = service
+	}
+	for _, service := range services {
+		key := types.NamespacedName{Namespace: service.Namespace, Name: service.Name}
+		if old, ok := previous[key]; ok {
+			c.updateService(old, service)
+			delete(previous, key)
+		} else {
+			c.addService(service)
+		}
+	}
+	for _, service := range previous {
+		c.deleteService(service)
+	}
+
+	previousEndpoints := map[types.NamespacedName]*v1.Endpoints{}
+	for _, ep := range oldEndpoints {
+		previousEndpoints[types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}] = ep
+	}
+	for _, ep := range endpoints {
+		key := types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}
+		if old, ok := previousEndpoints[key]; ok {
+			c.updateEndpoints(old, ep)
+			delete(previousEndpoints, key)
+		} else {
+			c.addEndpoints(ep)
+		}
+	}
+	for _, ep := range previousEndpoints {
+		c.deleteEndpoints(ep)
+	}
+}
+
+// listers returns the current listers. The node lister is nil unless
+// endpoints are built from node addresses, or carry the locality of the nodes.
+func (c *Controller) listers() (listers.ServiceLister, listers.EndpointsLister, listers.NodeLister) {
+	c.listersMu.RLock()
+	defer c.listersMu.RUnlock()
+	return c.serviceLister, c.endpointsLister, c.nodeLister
+}
+
+// translate returns the discovered service of the upstream service, and its
+// discovered endpoints and the problems of the addresses that were left out of
+// them, if they are not copied from the upstream endpoints
+func (c *Controller) translate(service *v1.Service) (*v1.Service, *v1.Endpoints, []validation.Problem) {
+	source := c.endpointsPolicy.Source(service)
+	svc := translateService(service, c.backendName, c.NameTemplate, source)
+
+	var ep *v1.Endpoints
+	var problems []validation.Problem
+	var families []translator.IPFamily
+	switch source {
+	case EndpointsSourcePods:
+		families = c.serviceIPFamilies(service)
+	case EndpointsSourceIngress, EndpointsSourceNodePort:
+		nodes := c.nodes()
+		if localTraffic(service, source) {
+			nodes = localNodes(nodes, c.upstreamEndpoints(service))
+		}
+		ep, problems = translateServiceEndpoints(service, c.backendName, c.NameTemplate, source, nodes)
+		ep.Subsets = translator.FilterSubsets(ep.Subsets, c.IPFamily)
+		c.setTopology(ep)
+		families = translator.SubsetsIPFamilies(ep.Subsets)
+	}
+	svc.Annotations = translator.AddIPFamilyAnnotations(svc.Annotations, families)
+	return svc, ep, problems
+}
+
+// upstreamEndpoints returns the upstream endpoints of the service, or nil if
+// it has none
+func (c *Controller) upstreamEndpoints(service *v1.Service) *v1.Endpoints {
+	_, endpointsLister, _ := c.listers()
+	endpoints, err := endpointsLister.Endpoints(service.GetNamespace()).Get(service.GetName())
+	if err != nil {
+		return nil
+	}
+	return endpoints
+}
+
+// nodes returns the upstream nodes, if endpoints are built from node
+// addresses
+func (c *Controller) nodes() []*v1.Node {
+	_, _, nodeLister := c.listers()
+	if nodeLister == nil {
+		return nil
+	}
+	nodes, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing nodes: %v", err)
+		return nil
+	}
+	return nodes
+}
+
+// nodeChanged returns whether the node changed in a way that changes the
+// endpoints built from the node addresses
+func nodeChanged(old, node *v1.Node) bool {
+	return nodeReady(old) != nodeReady(node) || nodeAddress(old) != nodeAddress(node)
+}
+
+// Nodes that are not ready are not used
+func (c *Controller) addNode(node *v1.Node) {
+	if nodeReady(node) {
+		c.resyncNodePortServices()
+	}
+	if c.topology {
+		c.resyncNodeEndpoints(node.GetName())
+	}
+}
+
+func (c *Controller) updateNode(old, node *v1.Node) {
+	localityChanged := c.topology && nodeLocality(old) != nodeLocality(node)
+	if localityChanged || nodeChanged(old, node) {
+		c.resyncNodePortServices()
+	}
+	if localityChanged {
+		c.resyncNodeEndpoints(node.GetName())
+	}
+}
+
+// The endpoints of pods that ran on a deleted node are updated when the pods
+// are deleted
+func (c *Controller) deleteNode(obj interface{}) {
+	if node, ok := obj.(*v1.Node); !ok || nodeReady(node) {
+		c.resyncNodePortServices()
+	}
+}
+
+// resyncNodePortServices syncs again the services whose endpoints are built
+// from the node addresses, after the nodes changed
+func (c *Controller) resyncNodePortServices() {
+	if !c.endpointsPolicy.NeedsNodes() {
+		return
+	}
+	serviceLister, _, _ := c.listers()
+	services, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing services: %v", err)
+		return
+	}
+	for _, service := range services {
+		if c.endpointsPolicy.Source(service) == EndpointsSourceNodePort {
+			c.updateService(service, service)
+		}
+	}
+}
+
+// healthChanged records a change of the health of the backend. It is called
+// by the calls to the backend, which are not held up by the resync.
+func (c *Controller) healthChanged(health.State) {
+	select {
+	case c.healthChanges <- struct{}{}:
+	default:
+		// A resync is already pending, and syncs the latest health
+	}
+}
+
+// runHealthResyncs syncs again all the objects after each change of the
+// health of the backend, until stopCh is closed
+func (c *Controller) runHealthResyncs(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-c.healthChanges:
+			c.resyncHealth(c.Health.State())
+		}
+	}
+}
+
+// resyncHealth syncs again all the services and endpoints after the health of
+// the backend changed, so that they record it, and their endpoints follow the
+// unreachable endpoints policy
+func (c *Controller) resyncHealth(state health.State) {
+	c.Logger.Infof("backend is %s, syncing all services and endpoints again", state)
+	serviceLister, endpointsLister, _ := c.listers()
+	services, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing services: %v", err)
+		return
+	}
+	for _, service := range services {
+		c.updateService(service, service)
+	}
+	endpoints, err := endpointsLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing endpoints: %v", err)
+		return
+	}
+	for _, ep := range endpoints {
+		c.updateEndpoints(ep, ep)
+	}
+}
+
+// resyncNodeEndpoints syncs again the upstream endpoints that have addresses
+// on the node, after its locality changed
+func (c *Controller) resyncNodeEndpoints(nodeName string) {
+	_, endpointsLister, _ := c.listers()
+	endpoints, err := endpointsLister.List(labels.Everything())
+	if err != nil {
+		c.Logger.Errorf("error listing endpoints: %v", err)
+		return
+	}
+	for _, ep := range endpoints {
+		if onNode(ep, nodeName) {
+			c.updateEndpoints(ep, ep)
+		}
+	}
+}
+
+// onNode returns whether the endpoints have an address on the node
+func onNode(ep *v1.Endpoints, nodeName string) bool {
+	for _, s := range ep.Subsets {
+		for _, addresses := range [][]v1.EndpointAddress{s.Addresses, s.NotReadyAddresses} {
+			for _, a := range addresses {
+				if a.NodeName != nil && *a.NodeName == nodeName {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// setTopology sets the locality metadata of the discovered endpoints from the
+// labels of the nodes of their addresses, if enabled
+func (c *Controller) setTopology(ep *v1.Endpoints) {
+	if !c.topology {
+		return
+	}
+	_, _, nodeLister := c.listers()
+	translator.SetTopology(ep, func(a v1.EndpointAddress) translator.Locality {
+		if a.NodeName == nil || nodeLister == nil {
+			return translator.Locality{}
+		}
+		node, err := nodeLister.Get(*a.NodeName)
+		if err != nil {
+			return translator.Locality{}
+		}
+		return nodeLocality(node)
+	})
+}
+
+// upstreamService returns the upstream service of the endpoints, if it exists
+func (c *Controller) upstreamService(endpoints *v1.Endpoints) (*v1.Service, bool) {
+	serviceLister, _, _ := c.listers()
+	service, err := serviceLister.Services(endpoints.GetNamespace()).Get(endpoints.GetName())
+	if err != nil {
+		return nil, false
+	}
+	return service, true
+}
+
+// skipService returns whether the upstream service is not discovered, which
+// is the case of the services of the types that the policy skips, and of
+// services without a selector and without endpoints, whose endpoints are
+// managed by hand or by another controller
+func (c *Controller) skipService(service *v1.Service) bool {
+	source := c.endpointsPolicy.Source(service)
+	if source == EndpointsSourceSkip {
+		return true
+	}
+	if len(service.Spec.Selector) > 0 || source != EndpointsSourcePods {
+		return false
+	}
+	_, endpointsLister, _ := c.listers()
+	_, err := endpointsLister.Endpoints(service.GetNamespace()).Get(service.GetName())
+	return err != nil
 }
 
 func (c *Controller) addService(service *v1.Service) {
 	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.AddServiceAction(svc))
 		c.writeServiceMetrics(service)
+		if c.skipService(service) {
+			c.Logger.WithFields(logrus.Fields{util.FieldNamespace: service.GetNamespace(), util.FieldName: service.GetName()}).Debugf("skipping service %s/%s", service.GetNamespace(), service.GetName())
+			return
+		}
+		svc, ep, problems := c.translate(service)
+		if c.validateService(service, svc) {
+			c.enqueue(sync.AddServiceAction(svc))
+		}
+		if ep != nil {
+			if valid := c.validateEndpoints(service.GetName(), ep, problems...); valid != nil {
+				c.enqueue(sync.AddEndpointsAction(c.discoveredEndpoints(valid, service.GetName()), service.GetName()))
+			}
+		}
 	}
 }
 
-func (c *Controller) updateService(service *v1.Service) {
+func (c *Controller) updateService(old, service *v1.Service) {
 	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.UpdateServiceAction(svc))
 		c.writeServiceMetrics(service)
+		svc, ep, problems := c.translate(service)
+		if c.skipService(service) {
+			c.Logger.WithFields(logrus.Fields{util.FieldNamespace: service.GetNamespace(), util.FieldName: service.GetName()}).Debugf("skipping service %s/%s", service.GetNamespace(), service.GetName())
+			// Services that were already skipped were never discovered, and
+			// deleting them again would count against the brake on every
+			// resync
+			if c.skipService(old) {
+				return
+			}
+			c.Invalid.Delete(validation.KindService, svc.Namespace, svc.Name)
+			c.enqueue(sync.DeleteServiceAction(svc))
+			// The service may have been discovered with another type
+			if c.endpointsPolicy.Source(service) == EndpointsSourceSkip {
+				c.deleteDiscoveredEndpoints(service)
+			}
+			return
+		}
+		if c.validateService(service, svc) {
+			c.enqueue(sync.UpdateServiceAction(svc))
+		}
+		if ep != nil {
+			if valid := c.validateEndpoints(service.GetName(), ep, problems...); valid != nil {
+				c.enqueue(sync.UpdateEndpointsAction(c.discoveredEndpoints(valid, service.GetName()), service.GetName()))
+			}
+			return
+		}
+
+		// The endpoints of the service no longer come from the service, such
+		// as when its type changes
+		if c.endpointsPolicy.Source(old) != c.endpointsPolicy.Source(service) {
+			c.resyncEndpoints(service)
+		}
+	}
+}
+
+// resyncEndpoints syncs the upstream endpoints of the service again, or
+// deletes the discovered endpoints if the service has no upstream endpoints
+func (c *Controller) resyncEndpoints(service *v1.Service) {
+	_, endpointsLister, _ := c.listers()
+	endpoints, err := endpointsLister.Endpoints(service.GetNamespace()).Get(service.GetName())
+	if err == nil && c.endpointsPolicy.Source(service) == EndpointsSourcePods {
+		c.updateEndpoints(endpoints, endpoints)
+		return
 	}
+	c.deleteDiscoveredEndpoints(service)
+}
+
+// resyncDiscoveredEndpoints syncs the upstream endpoints, or the endpoints
+// built from the upstream service, again at the end of the grace period of one
+// of their addresses, or when one of their addresses starts or stops failing
+// its probe
+func (c *Controller) resyncDiscoveredEndpoints(namespace, upstreamName string) {
+	serviceLister, endpointsLister, _ := c.listers()
+	service, err := serviceLister.Services(namespace).Get(upstreamName)
+	if err == nil && c.endpointsPolicy.Source(service) != EndpointsSourcePods {
+		c.updateService(service, service)
+		return
+	}
+	if endpoints, err := endpointsLister.Endpoints(namespace).Get(upstreamName); err == nil {
+		c.updateEndpoints(endpoints, endpoints)
+	}
+}
+
+// deleteDiscoveredEndpoints deletes the discovered endpoints of the service
+func (c *Controller) deleteDiscoveredEndpoints(service *v1.Service) {
+	ep, _ := translateServiceEndpoints(service, c.backendName, c.NameTemplate, endpointsSourceNone, nil)
+	c.Invalid.Delete(validation.KindEndpoints, ep.Namespace, ep.Name)
+	c.Grace.Forget(ep.Namespace, ep.Name)
+	c.Prober.Forget(ep.Namespace, ep.Name)
+	c.enqueue(sync.DeleteEndpointsAction(ep, service.GetName()))
+}
+
+// serviceIPFamilies returns the IP families of the discovered endpoints of
+// the service, if any
+func (c *Controller) serviceIPFamilies(service *v1.Service) []translator.IPFamily {
+	_, endpointsLister, _ := c.listers()
+	endpoints, err := endpointsLister.Endpoints(service.GetNamespace()).Get(service.GetName())
+	if err != nil {
+		return nil
+	}
+	return translator.SubsetsIPFamilies(translator.FilterSubsets(endpoints.Subsets, c.IPFamily))
+}
+
+// updateServiceIPFamilies updates the discovered service of the endpoints, so
+// that its IP families match the given ones. Services are not discovered
+// before they exist in the backend cluster.
+func (c *Controller) updateServiceIPFamilies(service *v1.Service, families []translator.IPFamily) {
+	svc := translateService(service, c.backendName, c.NameTemplate, EndpointsSourcePods)
+	svc.Annotations = translator.AddIPFamilyAnnotations(svc.Annotations, families)
+	if c.validateService(service, svc) {
+		c.enqueue(sync.UpdateServiceAction(svc))
+	}
+}
+
+// validateService records the validation problems of the translated service,
+// and returns whether it can be synced
+func (c *Controller) validateService(upstream, svc *v1.Service) bool {
+	problems := validation.ValidateService(svc)
+	c.Invalid.Set(validation.Object{
+		Kind:         validation.KindService,
+		Namespace:    svc.Namespace,
+		Name:         svc.Name,
+		UpstreamName: upstream.Name,
+		Problems:     problems,
+	})
+	c.metrics.DiscovererInvalidServicesMetric(svc.Namespace, c.Invalid.Count(validation.KindService, svc.Namespace))
+	if len(problems) > 0 {
+		c.Logger.WithFields(logrus.Fields{util.FieldKind: validation.KindService, util.FieldNamespace: svc.Namespace, util.FieldName: svc.Name}).Warnf("skipping invalid service %s/%s: %v", svc.Namespace, svc.Name, problems)
+		return false
+	}
+	return true
+}
+
+// validateEndpoints records the validation problems of the translated
+// endpoints, along with the given problems of the addresses that were left out
+// by the translation, and returns them without the addresses that cannot be
+// routed to. If the endpoints cannot be synced, nil is returned.
+func (c *Controller) validateEndpoints(upstreamName string, ep *v1.Endpoints, skipped ...validation.Problem) *v1.Endpoints {
+	valid, problems := validation.ValidateEndpoints(ep)
+	problems = append(problems, skipped...)
+	c.Invalid.Set(validation.Object{
+		Kind:         validation.KindEndpoints,
+		Namespace:    ep.Namespace,
+		Name:         ep.Name,
+		UpstreamName: upstreamName,
+		Problems:     problems,
+	})
+	c.metrics.DiscovererInvalidEndpointsMetric(ep.Namespace, upstreamName, validation.CountReason(problems, validation.ReasonInvalidAddress))
+	log := c.Logger.WithFields(logrus.Fields{util.FieldKind: validation.KindEndpoints, util.FieldNamespace: ep.Namespace, util.FieldName: ep.Name})
+	switch {
+	case valid == nil:
+		log.Warnf("skipping invalid endpoints %s/%s: %v", ep.Namespace, ep.Name, problems)
+	case len(problems) > 0:
+		log.Warnf("skipping invalid addresses of endpoints %s/%s: %v", ep.Namespace, ep.Name, problems)
+	}
+	return valid
 }
 
 func (c *Controller) deleteService(service *v1.Service) {
 	if !skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) {
-		svc := translateService(service, c.backendName)
-		c.syncqueue.Enqueue(sync.DeleteServiceAction(svc))
+		svc := translateService(service, c.backendName, c.NameTemplate, c.endpointsPolicy.Source(service))
+		c.Invalid.Delete(validation.KindService, svc.Namespace, svc.Name)
+		c.metrics.DiscovererInvalidServicesMetric(svc.Namespace, c.Invalid.Count(validation.KindService, svc.Namespace))
+		c.enqueue(sync.DeleteServiceAction(svc))
 		c.writeServiceMetrics(service)
+		// Endpoints that are not copied from the upstream endpoints are not
+		// deleted with them
+		if c.endpointsPolicy.Source(service) != EndpointsSourcePods {
+			c.deleteDiscoveredEndpoints(service)
+		}
+	}
+}
+
+// resyncLocalTraffic syncs the service again after its upstream endpoints
+// changed, if its endpoints are the nodes that run its pods
+func (c *Controller) resyncLocalTraffic(service *v1.Service) {
+	if localTraffic(service, c.endpointsPolicy.Source(service)) {
+		c.updateService(service, service)
+	}
+}
+
+// podEndpoints returns whether the discovered endpoints are copied from the
+// upstream endpoints, and the upstream service if it exists
+func (c *Controller) podEndpoints(endpoints *v1.Endpoints) (*v1.Service, bool) {
+	service, ok := c.upstreamService(endpoints)
+	if !ok {
+		return nil, true
 	}
+	return service, c.endpointsPolicy.Source(service) == EndpointsSourcePods
 }
 
 func (c *Controller) addEndpoints(endpoints *v1.Endpoints) {
 	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.AddEndpointsAction(ep, endpoints.GetName()))
 		c.writeEndpointsMetrics(endpoints)
+		service, ok := c.podEndpoints(endpoints)
+		if !ok {
+			c.resyncLocalTraffic(service)
+			return
+		}
+		ep := translateEndpoints(endpoints, c.backendName, c.NameTemplate)
+		ep.Subsets = translator.FilterSubsets(ep.Subsets, c.IPFamily)
+		c.setTopology(ep)
+		valid := c.validateEndpoints(endpoints.GetName(), ep)
+		if valid == nil {
+			return
+		}
+		c.enqueue(sync.AddEndpointsAction(c.discoveredEndpoints(valid, endpoints.GetName()), endpoints.GetName()))
+		// The service may have been discovered before its endpoints, or
+		// skipped if it has no selector
+		families := translator.SubsetsIPFamilies(valid.Subsets)
+		if service != nil && (len(families) > 0 || len(service.Spec.Selector) == 0) {
+			c.updateServiceIPFamilies(service, families)
+		}
 	}
 }
 
-func (c *Controller) updateEndpoints(endpoints *v1.Endpoints) {
+func (c *Controller) updateEndpoints(old, endpoints *v1.Endpoints) {
 	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.UpdateEndpointsAction(ep, endpoints.GetName()))
 		c.writeEndpointsMetrics(endpoints)
+		service, ok := c.podEndpoints(endpoints)
+		if !ok {
+			c.resyncLocalTraffic(service)
+			return
+		}
+		ep := translateEndpoints(endpoints, c.backendName, c.NameTemplate)
+		ep.Subsets = translator.FilterSubsets(ep.Subsets, c.IPFamily)
+		c.setTopology(ep)
+		valid := c.validateEndpoints(endpoints.GetName(), ep)
+		if valid == nil {
+			return
+		}
+		c.enqueue(sync.UpdateEndpointsAction(c.discoveredEndpoints(valid, endpoints.GetName()), endpoints.GetName()))
+		families := translator.SubsetsIPFamilies(valid.Subsets)
+		if service != nil && !reflect.DeepEqual(families, translator.SubsetsIPFamilies(translator.FilterSubsets(old.Subsets, c.IPFamily))) {
+			c.updateServiceIPFamilies(service, families)
+		}
 	}
 }
 
 func (c *Controller) deleteEndpoints(endpoints *v1.Endpoints) {
 	if !skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
-		ep := translateEndpoints(endpoints, c.backendName)
-		c.syncqueue.Enqueue(sync.DeleteEndpointsAction(ep, endpoints.GetName()))
 		c.writeEndpointsMetrics(endpoints)
+		service, ok := c.podEndpoints(endpoints)
+		if !ok {
+			c.resyncLocalTraffic(service)
+			return
+		}
+		ep := translateEndpoints(endpoints, c.backendName, c.NameTemplate)
+		ep.Subsets = translator.FilterSubsets(ep.Subsets, c.IPFamily)
+		c.Invalid.Delete(validation.KindEndpoints, ep.Namespace, ep.Name)
+		c.Grace.Forget(ep.Namespace, ep.Name)
+		c.Prober.Forget(ep.Namespace, ep.Name)
+		c.enqueue(sync.DeleteEndpointsAction(ep, endpoints.GetName()))
+		// A service without selector is not discovered without endpoints
+		if service != nil && len(service.Spec.Selector) == 0 {
+			svc := translateService(service, c.backendName, c.NameTemplate, EndpointsSourcePods)
+			c.Invalid.Delete(validation.KindService, svc.Namespace, svc.Name)
+			c.enqueue(sync.DeleteServiceAction(svc))
+		}
 	}
 }
 
@@ -154,16 +933,21 @@ func skipProcessing(name, namespace string, labels map[string]string) bool {
 }
 
 func (c *Controller) writeServiceMetrics(svc *v1.Service) {
-	upstreamServices, err := c.serviceLister.Services(svc.GetNamespace()).List(labels.Everything())
+	serviceLister, _, _ := c.listers()
+	upstreamServices, err := serviceLister.Services(svc.GetNamespace()).List(labels.Everything())
 	if err != nil {
 		c.Logger.Error("Could not get service metrics: ", err)
 		return
 	}
-	upstreamServicesCount := len(upstreamServices)
-	// The discoverer does not replicate the kubernetes service in the default namespace.
-	// Thus, don't count it as a service that is a "candidate" for replication.
-	if svc.GetNamespace() == "default" && containsService("kubernetes", upstreamServices) {
-		upstreamServicesCount--
+	upstreamServicesCount := 0
+	for _, s := range upstreamServices {
+		// The discoverer does not replicate the kubernetes service in the default namespace,
+		// nor the services of the types that are skipped.
+		// Thus, don't count them as services that are "candidates" for replication.
+		if (s.GetNamespace() == "default" && s.GetName() == kubesystemService) || c.endpointsPolicy.Source(s) == EndpointsSourceSkip {
+			continue
+		}
+		upstreamServicesCount++
 	}
 	c.metrics.DiscovererUpstreamServicesMetric(svc.GetNamespace(), upstreamServicesCount)
 }
@@ -172,6 +956,147 @@ func (c *Controller) writeEndpointsMetrics(ep *v1.Endpoints) {
 	c.metrics.DiscovererUpstreamEndpointsMetric(ep.GetNamespace(), ep.GetName(), sync.SumEndpoints(ep))
 }
 
+// checkDrift compares the services and endpoints discovered from the backend
+// with the ones that exist in Gimbal, and records the ones that differ.
+// Objects that were edited by hand are synced again right away; if enabled,
+// the other reported objects are synced again too. Drift is not checked while
+// the backend is not healthy, since the informer caches may be stale.
+func (c *Controller) checkDrift() {
+	if state := c.Health.State(); state != health.StateHealthy {
+		c.Logger.Debugf("skipping drift check, backend is %s", state)
+		return
+	}
+	desired, ignored, err := c.desiredState()
+	if err != nil {
+		c.Logger.Errorf("error checking drift: %v", err)
+		return
+	}
+	current, err := c.currentState()
+	if err != nil {
+		c.Logger.Errorf("error checking drift: %v", err)
+		return
+	}
+	current = withoutIgnored(current, ignored)
+
+	found := drift.Compare(desired, current)
+	edited := drift.Edited(found)
+	if len(edited) > 0 {
+		c.Logger.Warnf("found %d discovered objects that were edited by hand, reverting", len(edited))
+		for _, action := range drift.Actions(edited) {
+			c.enqueue(action)
+		}
+	}
+
+	reported := c.Drift.Replace(found)
+	if len(reported) == 0 {
+		return
+	}
+	c.Logger.Warnf("found %d discovered objects that differ from the backend", len(reported))
+	if c.DriftResync {
+		// Edited objects were already queued above.
+		var unedited []drift.Object
+		for _, o := range reported {
+			if !o.Edited {
+				unedited = append(unedited, o)
+			}
+		}
+		for _, action := range drift.Actions(unedited) {
+			c.enqueue(action)
+		}
+	}
+}
+
+// desiredState returns the services and endpoints discovered from the
+// backend. Objects that are not synced because of validation problems are
+// returned separately, by kind, so that whatever exists in Gimbal for them is
+// not reported.
+func (c *Controller) desiredState() (drift.State, map[string]map[types.NamespacedName]bool, error) {
+	state := drift.State{UpstreamNames: map[types.NamespacedName]string{}}
+	ignored := map[string]map[types.NamespacedName]bool{validation.KindService: {}, validation.KindEndpoints: {}}
+	addEndpoints := func(upstreamName string, ep *v1.Endpoints) {
+		key := types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}
+		valid, _ := validation.ValidateEndpoints(ep)
+		if valid == nil {
+			ignored[validation.KindEndpoints][key] = true
+			return
+		}
+		state.Endpoints = append(state.Endpoints, *c.Prober.WithProbes(c.Grace.WithGrace(valid)))
+		state.UpstreamNames[key] = upstreamName
+	}
+
+	serviceLister, endpointsLister, _ := c.listers()
+	services, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		return drift.State{}, nil, fmt.Errorf("error listing backend services: %v", err)
+	}
+	for _, service := range services {
+		if skipProcessing(service.GetName(), service.GetNamespace(), service.ObjectMeta.Labels) || c.skipService(service) {
+			continue
+		}
+		svc, ep, _ := c.translate(service)
+		if len(validation.ValidateService(svc)) > 0 {
+			ignored[validation.KindService][types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}] = true
+		} else {
+			state.Services = append(state.Services, *svc)
+		}
+		if ep != nil {
+			addEndpoints(service.GetName(), ep)
+		}
+	}
+
+	endpoints, err := endpointsLister.List(labels.Everything())
+	if err != nil {
+		return drift.State{}, nil, fmt.Errorf("error listing backend endpoints: %v", err)
+	}
+	for _, endpoints := range endpoints {
+		if skipProcessing(endpoints.GetName(), endpoints.GetNamespace(), endpoints.ObjectMeta.Labels) {
+			continue
+		}
+		if _, ok := c.podEndpoints(endpoints); !ok {
+			continue
+		}
+		ep := translateEndpoints(endpoints, c.backendName, c.NameTemplate)
+		ep.Subsets = translator.FilterSubsets(ep.Subsets, c.IPFamily)
+		c.setTopology(ep)
+		addEndpoints(endpoints.GetName(), ep)
+	}
+	return state, ignored, nil
+}
+
+// currentState returns the services and endpoints of the backend that exist
+// in Gimbal
+func (c *Controller) currentState() (drift.State, error) {
+	client := c.syncqueue.KubeClient.CoreV1()
+	opts := metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, c.backendName)}
+	services, err := client.Services(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		c.metrics.GenericMetricError("ListServices")
+		return drift.State{}, fmt.Errorf("error listing services: %v", err)
+	}
+	endpoints, err := client.Endpoints(metav1.NamespaceAll).List(opts)
+	if err != nil {
+		c.metrics.GenericMetricError("ListEndpoints")
+		return drift.State{}, fmt.Errorf("error listing endpoints: %v", err)
+	}
+	return drift.State{Services: services.Items, Endpoints: endpoints.Items}, nil
+}
+
+// withoutIgnored returns the state without the ignored objects
+func withoutIgnored(state drift.State, ignored map[string]map[types.NamespacedName]bool) drift.State {
+	res := drift.State{}
+	for _, svc := range state.Services {
+		if !ignored[validation.KindService][types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}] {
+			res.Services = append(res.Services, svc)
+		}
+	}
+	for _, ep := range state.Endpoints {
+		if !ignored[validation.KindEndpoints][types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}] {
+			res.Endpoints = append(res.Endpoints, ep)
+		}
+	}
+	return res
+}
+
 // Run gets the party started
 func (c *Controller) Run(stopCh <-chan struct{}) error {
 	defer runtime.HandleCrash()
@@ -188,9 +1113,26 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 	if ok := cache.WaitForCacheSync(stopCh, c.endpointsSynced); !ok {
 		return fmt.Errorf("failed to wait for backend endpoints caches to sync")
 	}
+	if c.nodesSynced != nil {
+		c.Logger.Infof("Waiting for backend nodes informer caches to sync")
+		if ok := cache.WaitForCacheSync(stopCh, c.nodesSynced); !ok {
+			return fmt.Errorf("failed to wait for backend nodes caches to sync")
+		}
+	}
 
 	// Start the sync queue
 	go c.syncqueue.Run(stopCh)
+	go c.runHealthResyncs(stopCh)
+
+	if c.Prober.Interval > 0 {
+		c.Logger.Infof("Probing discovered addresses every %v", c.Prober.Interval)
+		go c.Prober.Run(stopCh)
+	}
+
+	if c.DriftCheckInterval > 0 {
+		c.Logger.Infof("Checking drift every %v", c.DriftCheckInterval)
+		go wait.Until(c.checkDrift, c.DriftCheckInterval, stopCh)
+	}
 
 	c.Logger.Infof("Started workers")
 	<-stopCh
@@ -198,12 +1140,3 @@ func (c *Controller) Run(stopCh <-chan struct{}) error {
 
 	return nil
 }
-
-func containsService(name string, services []*v1.Service) bool {
-	for _, s := range services {
-		if s.Name == name {
-			return true
-		}
-	}
-	return false
-}
@@ -14,19 +14,31 @@
 package k8s
 
 import (
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/projectcontour/gimbal/pkg/brake"
+	"github.com/projectcontour/gimbal/pkg/drift"
+	"github.com/projectcontour/gimbal/pkg/grace"
+	"github.com/projectcontour/gimbal/pkg/health"
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/probe"
 	"github.com/projectcontour/gimbal/pkg/sync"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
 	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 )
 
@@ -48,6 +60,7 @@ var serviceTests = []struct {
 						Port: 80,
 					},
 				},
+				Selector: map[string]string{"app": "test"},
 			},
 		},
 		expected:              1,
@@ -65,6 +78,7 @@ var serviceTests = []struct {
 						Port: 80,
 					},
 				},
+				Selector: map[string]string{"app": "test"},
 			},
 		},
 		expected:              0,
@@ -82,6 +96,7 @@ var serviceTests = []struct {
 						Port: 80,
 					},
 				},
+				Selector: map[string]string{"app": "test"},
 			},
 		},
 		expected:              0,
@@ -104,6 +119,7 @@ var serviceTests = []struct {
 						Port: 80,
 					},
 				},
+				Selector: map[string]string{"app": "test"},
 			},
 		},
 		expected:              0,
@@ -121,6 +137,7 @@ var serviceTests = []struct {
 						Port: 80,
 					},
 				},
+				Selector: map[string]string{"app": "test"},
 			},
 		},
 		expected:              1,
@@ -212,7 +229,7 @@ func TestUpdateServiceQueue(t *testing.T) {
 	for _, tc := range serviceTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.updateService(tc.service)
+			c.updateService(tc.service, tc.service)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -245,7 +262,7 @@ func TestUpdateEndpointsQueue(t *testing.T) {
 	for _, tc := range endpointTests {
 		t.Run(tc.name, func(t *testing.T) {
 			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
-			c.updateEndpoints(tc.endpoint)
+			c.updateEndpoints(tc.endpoint, tc.endpoint)
 			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
 			got := c.syncqueue.Workqueue.Len()
 			assert.Equal(t, tc.expected, got)
@@ -317,6 +334,7 @@ func TestServicesMetrics(t *testing.T) {
 				serviceLister:   informer.Core().V1().Services().Lister(),
 				endpointsLister: informer.Core().V1().Endpoints().Lister(),
 				metrics:         metrics,
+				Invalid:         validation.NewStore(metrics),
 			}
 
 			// Call informer before starting!
@@ -353,7 +371,7 @@ func TestServicesMetrics(t *testing.T) {
 func getDefaultController(metrics localmetrics.DiscovererMetrics) *Controller {
 	client := fake.NewSimpleClientset()
 	informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
-	return &Controller{
+	c := &Controller{
 		Logger: logrus.New(),
 		syncqueue: sync.Queue{
 			Logger:      logrus.New(),
@@ -364,5 +382,888 @@ func getDefaultController(metrics localmetrics.DiscovererMetrics) *Controller {
 		serviceLister:   informer.Core().V1().Services().Lister(),
 		endpointsLister: informer.Core().V1().Endpoints().Lister(),
 		metrics:         metrics,
+		Invalid:         validation.NewStore(metrics),
+		Drift:           drift.NewStore(metrics),
+		backendName:     "cluster1",
 	}
+	c.Brake = brake.NewBrake(c.syncqueue.Enqueue, c.Logger, metrics)
+	c.Grace = grace.NewTracker(c.resyncDiscoveredEndpoints, metrics)
+	c.Prober = probe.NewProber(c.resyncDiscoveredEndpoints, c.Logger, metrics)
+	c.Health = health.NewBackend(c.Logger, metrics)
+	c.healthChanges = make(chan struct{}, 1)
+	c.Health.Notify(c.healthChanged)
+	return c
+}
+
+func TestReplaceInformerFactory(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kuard", Namespace: "team1"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}, Selector: map[string]string{"app": "kuard"}},
+	}
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(svc), time.Second*0)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	err := c.ReplaceInformerFactory(informer, stopCh, 5*time.Second)
+	assert.NoError(t, err)
+
+	services, err := c.serviceLister.Services("team1").List(labels.Everything())
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	// The existing service is queued for replication
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	assert.Equal(t, 1, c.syncqueue.Workqueue.Len())
+}
+
+func TestReplaceInformerFactoryDeletions(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+
+	service := func(name string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team1"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}, Selector: map[string]string{"app": name}},
+		}
+	}
+	queued := func() []sync.Action {
+		time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+		var actions []sync.Action
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			actions = append(actions, item.(sync.Action))
+			c.syncqueue.Workqueue.Done(item)
+		}
+		return actions
+	}
+
+	oldClient := fake.NewSimpleClientset(service("a"), service("b"))
+	oldStopCh := make(chan struct{})
+	defer close(oldStopCh)
+	require.NoError(t, c.ReplaceInformerFactory(kubeinformers.NewSharedInformerFactory(oldClient, time.Second*0), oldStopCh, 5*time.Second))
+	assert.Len(t, queued(), 2)
+
+	// The service deleted while the factory is replaced is deleted
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	require.NoError(t, c.ReplaceInformerFactory(kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(service("b")), time.Second*0), stopCh, 5*time.Second))
+	actions := queued()
+	require.Len(t, actions, 2)
+	var deleted []string
+	for _, action := range actions {
+		if sync.IsDelete(action) {
+			deleted = append(deleted, action.ObjectMeta().Name)
+		}
+	}
+	assert.Equal(t, []string{"cluster1-a"}, deleted)
+
+	// The events of the replaced factory are ignored
+	_, err := oldClient.CoreV1().Services("team1").Create(service("c"))
+	require.NoError(t, err)
+	assert.Empty(t, queued())
+}
+
+func TestReplaceInformerFactoryStopped(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+	serviceLister := c.serviceLister
+
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(), time.Second*0)
+	stopCh := make(chan struct{})
+	close(stopCh)
+	err := c.ReplaceInformerFactory(informer, stopCh, 5*time.Second)
+	assert.Error(t, err)
+	assert.Equal(t, serviceLister, c.serviceLister)
+}
+
+func TestEndpointsIPFamilies(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	old := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	dualStack := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+
+	tests := []struct {
+		name              string
+		ipFamily          translator.IPFamily
+		expectedAddresses []v1.EndpointAddress
+		// the IP families of the service, if it is updated
+		expectedFamilies string
+	}{
+		{
+			name:              "all families",
+			expectedAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}},
+			expectedFamilies:  "IPv4,IPv6",
+		},
+		{
+			name:              "IPv4 only",
+			ipFamily:          translator.IPv4,
+			expectedAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+			c.IPFamily = tc.ipFamily
+			client := fake.NewSimpleClientset(service, dualStack)
+			informer := kubeinformers.NewSharedInformerFactory(client, time.Second*0)
+			c.serviceLister = informer.Core().V1().Services().Lister()
+			c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			informer.Start(stopCh)
+			informer.WaitForCacheSync(stopCh)
+
+			// the service is discovered with the families of its endpoints
+			c.addService(service)
+			c.updateEndpoints(old, dualStack)
+			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+
+			gimbalClient := fake.NewSimpleClientset()
+			for c.syncqueue.Workqueue.Len() > 0 {
+				item, _ := c.syncqueue.Workqueue.Get()
+				assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+				c.syncqueue.Workqueue.Done(item)
+			}
+
+			ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAddresses, ep.Subsets[0].Addresses)
+
+			svc, err := gimbalClient.CoreV1().Services("default").Get("cluster1-test", metav1.GetOptions{})
+			assert.NoError(t, err)
+			if tc.expectedFamilies == "" {
+				assert.Equal(t, "IPv4", svc.Annotations["gimbal.projectcontour.io/ip-families"])
+				assert.Equal(t, "SingleStack", svc.Annotations["gimbal.projectcontour.io/ip-family-policy"])
+				return
+			}
+			assert.Equal(t, tc.expectedFamilies, svc.Annotations["gimbal.projectcontour.io/ip-families"])
+			assert.Equal(t, "PreferDualStack", svc.Annotations["gimbal.projectcontour.io/ip-family-policy"])
+		})
+	}
+}
+
+func TestInvalidObjects(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+
+	// a service without ports is not synced
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}, Spec: v1.ServiceSpec{Selector: map[string]string{"app": "test"}}}
+	c.addService(service)
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	assert.Equal(t, 0, c.syncqueue.Workqueue.Len())
+	invalid := c.Invalid.List()
+	assert.Len(t, invalid, 1)
+	assert.Equal(t, validation.KindService, invalid[0].Kind)
+	assert.Equal(t, "cluster1-test", invalid[0].Name)
+	assert.Equal(t, "test", invalid[0].UpstreamName)
+	assert.Equal(t, validation.ReasonNoPorts, invalid[0].Problems[0].Reason)
+
+	// unroutable addresses are removed from the endpoints
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "127.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	c.addEndpoints(endpoints)
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	assert.Equal(t, 1, c.syncqueue.Workqueue.Len())
+	item, _ := c.syncqueue.Workqueue.Get()
+	gimbalClient := fake.NewSimpleClientset()
+	assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+	ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, ep.Subsets[0].Addresses)
+	assert.Equal(t, 1, c.Invalid.Count(validation.KindEndpoints, "default"))
+
+	// deleted objects are no longer invalid
+	c.deleteService(service)
+	c.deleteEndpoints(endpoints)
+	assert.Empty(t, c.Invalid.List())
+}
+
+func TestServiceTypes(t *testing.T) {
+	nodeName := "node1"
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	ports := []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}}
+	policy := EndpointsPolicy{v1.ServiceTypeLoadBalancer: EndpointsSourceIngress, v1.ServiceTypeNodePort: EndpointsSourceNodePort}
+
+	tests := []struct {
+		name              string
+		service           *v1.Service
+		expectedType      v1.ServiceType
+		expectedAddresses []v1.EndpointAddress
+		expectedPort      int32
+	}{
+		{
+			name: "service without selector and endpoints",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec:       v1.ServiceSpec{Ports: ports},
+			},
+		},
+		{
+			name: "external name",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"},
+			},
+			expectedType: v1.ServiceTypeExternalName,
+		},
+		{
+			name: "load balancer ingress",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: ports, Selector: map[string]string{"app": "test"}},
+				Status:     v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}}}},
+			},
+			expectedType:      v1.ServiceTypeClusterIP,
+			expectedAddresses: []v1.EndpointAddress{{IP: "192.0.2.10"}},
+			expectedPort:      80,
+		},
+		{
+			name: "node port",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: ports, Selector: map[string]string{"app": "test"}},
+			},
+			expectedType:      v1.ServiceTypeClusterIP,
+			expectedAddresses: []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &nodeName}},
+			expectedPort:      30080,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+			c.endpointsPolicy = policy
+			informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(tc.service, node), time.Second*0)
+			c.serviceLister = informer.Core().V1().Services().Lister()
+			c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+			c.nodeLister = informer.Core().V1().Nodes().Lister()
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			informer.Start(stopCh)
+			informer.WaitForCacheSync(stopCh)
+
+			c.addService(tc.service)
+			time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+
+			gimbalClient := fake.NewSimpleClientset()
+			for c.syncqueue.Workqueue.Len() > 0 {
+				item, _ := c.syncqueue.Workqueue.Get()
+				assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+				c.syncqueue.Workqueue.Done(item)
+			}
+
+			svc, err := gimbalClient.CoreV1().Services("default").Get("cluster1-test", metav1.GetOptions{})
+			if tc.expectedType == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedType, svc.Spec.Type)
+
+			ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+			if tc.expectedAddresses == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAddresses, ep.Subsets[0].Addresses)
+			assert.Equal(t, tc.expectedPort, ep.Subsets[0].Ports[0].Port)
+		})
+	}
+}
+
+func TestOverlayNetwork(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+	nodePort := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kuard", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:     v1.ServiceTypeNodePort,
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}},
+			Selector: map[string]string{"app": "kuard"},
+		},
+	}
+	clusterIP := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Ports:    []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			Selector: map[string]string{"app": "internal"},
+		},
+	}
+
+	policy, err := OverlayEndpointsPolicy(nil)
+	require.NoError(t, err)
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.endpointsPolicy = policy
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(nodePort, clusterIP, node), time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	c.nodeLister = informer.Core().V1().Nodes().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	process := func() {
+		time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+	}
+
+	// the ClusterIP service is skipped
+	c.addService(nodePort)
+	c.addService(clusterIP)
+	process()
+	services, err := gimbalClient.CoreV1().Services("default").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, services.Items, 1)
+	assert.Equal(t, "cluster1-kuard", services.Items[0].Name)
+	ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ep.Subsets[0].Addresses[0].IP)
+
+	// the endpoints are emptied when the node is no longer ready
+	notReady := node.DeepCopy()
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+	require.True(t, nodeChanged(node, notReady))
+	require.NoError(t, informer.Core().V1().Nodes().Informer().GetStore().Update(notReady))
+	c.resyncNodePortServices()
+	// The fake client does not remove fields with merge patches
+	gimbalClient = fake.NewSimpleClientset()
+	process()
+	ep, err = gimbalClient.CoreV1().Endpoints("default").Get("cluster1-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, ep.Subsets)
+}
+
+func TestLocalTrafficPolicy(t *testing.T) {
+	node := func(name, ip string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: v1.NodeStatus{
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+			},
+		}
+	}
+	node1, node2 := "node1", "node2"
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "kuard", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeNodePort,
+			Ports:                 []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, NodePort: 30080}},
+			Selector:              map[string]string{"app": "kuard"},
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeLocal,
+		},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "kuard", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.1.0.1", NodeName: &node2}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+
+	policy, err := OverlayEndpointsPolicy(nil)
+	require.NoError(t, err)
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.endpointsPolicy = policy
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(service, endpoints, node(node1, "10.0.0.1"), node(node2, "10.0.0.2")), time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	c.nodeLister = informer.Core().V1().Nodes().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	var gimbalClient *fake.Clientset
+	process := func() {
+		// The fake client does not remove fields with merge patches
+		gimbalClient = fake.NewSimpleClientset()
+		time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+	}
+
+	// only the node that runs the pod is an endpoint
+	c.addService(service)
+	process()
+	ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.2", NodeName: &node2}}, ep.Subsets[0].Addresses)
+
+	// the endpoints follow the pod when it moves to another node
+	moved := endpoints.DeepCopy()
+	moved.Subsets[0].Addresses[0].NodeName = &node1
+	require.NoError(t, informer.Core().V1().Endpoints().Informer().GetStore().Update(moved))
+	c.updateEndpoints(endpoints, moved)
+	process()
+	ep, err = gimbalClient.CoreV1().Endpoints("default").Get("cluster1-kuard", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &node1}}, ep.Subsets[0].Addresses)
+
+	// the upstream endpoints are not copied
+	_, err = gimbalClient.CoreV1().Endpoints("default").Get("kuard", metav1.GetOptions{})
+	assert.Error(t, err)
+}
+
+func TestEndpointsTopology(t *testing.T) {
+	nodeName := "node1"
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: nodeName,
+			Labels: map[string]string{
+				"topology.kubernetes.io/region":            "us-east",
+				"failure-domain.beta.kubernetes.io/zone":   "us-east-1a",
+				"failure-domain.beta.kubernetes.io/region": "ignored",
+			},
+		},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &nodeName}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.topology = true
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(endpoints, node), time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	c.nodeLister = informer.Core().V1().Nodes().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	process := func() {
+		time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+	}
+
+	c.addEndpoints(endpoints)
+	process()
+	ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east", ep.Labels["gimbal.projectcontour.io/region"])
+	assert.Equal(t, "us-east-1a", ep.Labels["gimbal.projectcontour.io/zone"])
+	assert.Equal(t, "10.0.0.1=us-east/us-east-1a", ep.Annotations["gimbal.projectcontour.io/localities"])
+
+	// the endpoints are synced again when the zone of the node changes
+	moved := node.DeepCopy()
+	moved.Labels["failure-domain.beta.kubernetes.io/zone"] = "us-east-1b"
+	require.NoError(t, informer.Core().V1().Nodes().Informer().GetStore().Update(moved))
+	c.updateNode(node, moved)
+	process()
+	ep, err = gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1b", ep.Labels["gimbal.projectcontour.io/zone"])
+	assert.Equal(t, "10.0.0.1=us-east/us-east-1b", ep.Annotations["gimbal.projectcontour.io/localities"])
+}
+
+func TestCheckDrift(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Labels: map[string]string{"app": "test"}},
+		Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "test"}, Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(service, endpoints), time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	c.syncqueue.KubeClient = gimbalClient
+	syncQueue := func() {
+		time.Sleep(100 * time.Millisecond) // Give the rate limited queue time to add the actions
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+	}
+	c.addService(service)
+	c.addEndpoints(endpoints)
+	syncQueue()
+
+	// Objects that were synced do not drift
+	c.checkDrift()
+	c.checkDrift()
+	assert.Empty(t, c.Drift.List())
+
+	// Objects edited by hand are reverted by the next check
+	svc, err := gimbalClient.CoreV1().Services("default").Get("cluster1-test", metav1.GetOptions{})
+	require.NoError(t, err)
+	svc.Labels["app"] = "edited"
+	_, err = gimbalClient.CoreV1().Services("default").Update(svc)
+	require.NoError(t, err)
+	c.checkDrift()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, c.syncqueue.Workqueue.Len())
+	syncQueue()
+	svc, err = gimbalClient.CoreV1().Services("default").Get("cluster1-test", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "test", svc.Labels["app"])
+	c.checkDrift()
+	assert.Empty(t, c.Drift.List())
+
+	// Delete and add discovered objects by hand
+	require.NoError(t, gimbalClient.CoreV1().Endpoints("default").Delete("cluster1-test", &metav1.DeleteOptions{}))
+	_, err = gimbalClient.CoreV1().Services("team1").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1-old", Namespace: "team1", Labels: map[string]string{translator.GimbalLabelBackend: "cluster1"}},
+	})
+	require.NoError(t, err)
+
+	// Drift is reported by the second check
+	c.checkDrift()
+	assert.Empty(t, c.Drift.List())
+	c.checkDrift()
+	got := c.Drift.List()
+	for i := range got {
+		got[i] = drift.Object{Kind: got[i].Kind, Namespace: got[i].Namespace, Name: got[i].Name, Reason: got[i].Reason, Fields: got[i].Fields}
+	}
+	assert.Equal(t, []drift.Object{
+		{Kind: validation.KindEndpoints, Namespace: "default", Name: "cluster1-test", Reason: drift.ReasonMissing},
+		{Kind: validation.KindService, Namespace: "team1", Name: "cluster1-old", Reason: drift.ReasonExtra},
+	}, got)
+	assert.Equal(t, 0, c.syncqueue.Workqueue.Len())
+
+	// The reported objects are synced again
+	c.DriftResync = true
+	c.checkDrift()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, c.syncqueue.Workqueue.Len())
+	syncQueue()
+	c.checkDrift()
+	assert.Empty(t, c.Drift.List())
+	_, err = gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+	assert.NoError(t, err)
+}
+
+func TestDeletionBrake(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+	c.Brake.MaxDeletions = 2
+
+	var services []runtime.Object
+	for _, name := range []string{"a", "b", "c", "d"} {
+		services = append(services, &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team1"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}, Selector: map[string]string{"app": name}},
+		})
+	}
+	client := fake.NewSimpleClientset(services...)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	require.NoError(t, c.ReplaceInformerFactory(kubeinformers.NewSharedInformerFactory(client, time.Second*0), stopCh, 5*time.Second))
+	waitFor := func(cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The deletions past the limit are held
+	for _, name := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, client.CoreV1().Services("team1").Delete(name, &metav1.DeleteOptions{}))
+	}
+	waitFor(func() bool { return len(c.Brake.Held()) == 2 })
+	assert.Equal(t, []brake.Deletion{
+		{Kind: validation.KindService, Namespace: "team1", Name: "cluster1-c"},
+		{Kind: validation.KindService, Namespace: "team1", Name: "cluster1-d"},
+	}, c.Brake.Held())
+
+	// A held deletion is dropped when its service comes back
+	_, err := client.CoreV1().Services("team1").Create(services[2].(*v1.Service))
+	require.NoError(t, err)
+	waitFor(func() bool { return len(c.Brake.Held()) == 1 })
+	assert.Equal(t, []brake.Deletion{{Kind: validation.KindService, Namespace: "team1", Name: "cluster1-d"}}, c.Brake.Held())
+}
+
+func TestResyncSkippedServices(t *testing.T) {
+	metrics := localmetrics.NewMetrics("backendtype", "backend")
+	metrics.RegisterPrometheus(false)
+	c := getDefaultController(metrics)
+	policy, err := OverlayEndpointsPolicy(nil)
+	require.NoError(t, err)
+	c.endpointsPolicy = policy
+	c.Brake.MaxDeletions = 2
+
+	var services []*v1.Service
+	var objects []runtime.Object
+	for _, name := range []string{"a", "b", "c"} {
+		service := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team1"},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}, Selector: map[string]string{"app": name}},
+		}
+		services = append(services, service)
+		objects = append(objects, service)
+	}
+	informer := kubeinformers.NewSharedInformerFactory(fake.NewSimpleClientset(objects...), time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	// Resyncs of services that were never discovered delete nothing
+	for i := 0; i < 2; i++ {
+		for _, service := range services {
+			c.updateService(service, service)
+		}
+	}
+	c.resyncHealth(health.StateHealthy)
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	assert.Equal(t, 0, c.syncqueue.Workqueue.Len())
+	assert.Empty(t, c.Brake.Held())
+
+	// A service that becomes skipped is deleted
+	nodePort := services[0].DeepCopy()
+	nodePort.Spec.Type = v1.ServiceTypeNodePort
+	c.updateService(nodePort, services[0])
+	time.Sleep(100 * time.Millisecond) // Give queue time to process (huh?)
+	assert.Equal(t, 2, c.syncqueue.Workqueue.Len())
+	assert.Empty(t, c.Brake.Held())
+}
+
+func TestDeletedObject(t *testing.T) {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "kuard", Namespace: "team1"}}
+	assert.Equal(t, svc, deletedObject(svc))
+	// Objects that a relist finds deleted are wrapped in a tombstone
+	assert.Equal(t, svc, deletedObject(cache.DeletedFinalStateUnknown{Key: "team1/kuard", Obj: svc}))
+}
+
+func TestEndpointsGrace(t *testing.T) {
+	ports := []v1.EndpointPort{{Name: "http", Port: 8080}}
+	both := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets:    []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}}, Ports: ports}},
+	}
+	one := both.DeepCopy()
+	one.Subsets[0].Addresses = one.Subsets[0].Addresses[:1]
+
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.Grace.Period = 200 * time.Millisecond
+	upstreamClient := fake.NewSimpleClientset(both)
+	informer := kubeinformers.NewSharedInformerFactory(upstreamClient, time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	syncQueue := func() *v1.Endpoints {
+		time.Sleep(100 * time.Millisecond) // Give the rate limited queue time to add the actions
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+		ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+		require.NoError(t, err)
+		return ep
+	}
+	c.addEndpoints(both)
+	syncQueue()
+
+	// The removed address is not ready during its grace period
+	_, err := upstreamClient.CoreV1().Endpoints("default").Update(one)
+	require.NoError(t, err)
+	c.updateEndpoints(both, one)
+	ep := syncQueue()
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, ep.Subsets[0].Addresses)
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.2"}}, ep.Subsets[0].NotReadyAddresses)
+
+	// The endpoints are synced again without the address once its grace
+	// period ends
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 1, c.syncqueue.Workqueue.Len())
+	discovered := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "cluster1-test", Namespace: "default"}}
+	assert.Equal(t, discovered, c.Grace.WithGrace(discovered))
+}
+
+func TestBackendHealth(t *testing.T) {
+	upstream := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.Health.DegradedAfter = 0
+	c.Health.UnreachableAfter = 100 * time.Millisecond
+	c.Health.Policy = health.PolicyNotReady
+	upstreamClient := fake.NewSimpleClientset(upstream)
+	informer := kubeinformers.NewSharedInformerFactory(upstreamClient, time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+	go c.runHealthResyncs(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	syncQueue := func() *v1.Endpoints {
+		time.Sleep(100 * time.Millisecond) // Give the resync and the rate limited queue time to add the actions
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+		ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+		require.NoError(t, err)
+		return ep
+	}
+	c.addEndpoints(upstream)
+	ep := syncQueue()
+	assert.Equal(t, "Healthy", ep.Annotations[translator.GimbalAnnotationBackendHealth])
+
+	// The endpoints are synced again with each change of health, and their
+	// addresses are not ready once the backend is unreachable
+	c.Health.Failed(errors.New("connection refused"))
+	ep = syncQueue()
+	assert.Equal(t, "Degraded", ep.Annotations[translator.GimbalAnnotationBackendHealth])
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, ep.Subsets[0].Addresses)
+	time.Sleep(100 * time.Millisecond)
+	ep = syncQueue()
+	assert.Equal(t, "Unreachable", ep.Annotations[translator.GimbalAnnotationBackendHealth])
+	// The fake client does not remove the ready addresses from the patched
+	// endpoints
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, ep.Subsets[0].NotReadyAddresses)
+
+	c.Health.Succeeded()
+	ep = syncQueue()
+	assert.Equal(t, "Healthy", ep.Annotations[translator.GimbalAnnotationBackendHealth])
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, ep.Subsets[0].Addresses)
+}
+
+func TestHealthChangesCoalesced(t *testing.T) {
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+
+	// The changes do not wait for a resync, and a single resync is pending
+	c.healthChanged(health.StateDegraded)
+	c.healthChanged(health.StateHealthy)
+	c.healthChanged(health.StateDegraded)
+	assert.Len(t, c.healthChanges, 1)
+}
+
+func TestEndpointsProbe(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Annotations: map[string]string{probe.GimbalAnnotationProbe: "tcp"}},
+		Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "test"}, Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	upstream := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			// An address of TEST-NET-1, which cannot be reached
+			Addresses: []v1.EndpointAddress{{IP: "192.0.2.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+
+	c := getDefaultController(localmetrics.NewMetrics("backendtype", "backend"))
+	c.Prober.Interval = 50 * time.Millisecond
+	c.Prober.Timeout = 20 * time.Millisecond
+	c.Prober.FailureThreshold = 1
+	upstreamClient := fake.NewSimpleClientset(service, upstream)
+	informer := kubeinformers.NewSharedInformerFactory(upstreamClient, time.Second*0)
+	c.serviceLister = informer.Core().V1().Services().Lister()
+	c.endpointsLister = informer.Core().V1().Endpoints().Lister()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informer.Start(stopCh)
+	informer.WaitForCacheSync(stopCh)
+
+	gimbalClient := fake.NewSimpleClientset()
+	syncQueue := func() *v1.Endpoints {
+		time.Sleep(100 * time.Millisecond) // Give the rate limited queue time to add the actions
+		for c.syncqueue.Workqueue.Len() > 0 {
+			item, _ := c.syncqueue.Workqueue.Get()
+			assert.NoError(t, item.(sync.Action).Sync(gimbalClient, logrus.New()))
+			c.syncqueue.Workqueue.Done(item)
+		}
+		ep, err := gimbalClient.CoreV1().Endpoints("default").Get("cluster1-test", metav1.GetOptions{})
+		require.NoError(t, err)
+		return ep
+	}
+	c.addEndpoints(upstream)
+	ep := syncQueue()
+	assert.Equal(t, []v1.EndpointAddress{{IP: "192.0.2.1"}}, ep.Subsets[0].Addresses)
+
+	// The endpoints are synced again once the address fails its probe
+	go c.Prober.Run(stopCh)
+	time.Sleep(100 * time.Millisecond)
+	ep = syncQueue()
+	// The fake client does not remove the ready addresses from the patched
+	// endpoints
+	assert.Equal(t, []v1.EndpointAddress{{IP: "192.0.2.1"}}, ep.Subsets[0].NotReadyAddresses)
+	discovered := ep.DeepCopy()
+	discovered.Subsets[0].NotReadyAddresses = nil
+	assert.Empty(t, c.Prober.WithProbes(discovered).Subsets[0].Addresses)
 }
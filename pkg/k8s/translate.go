@@ -14,43 +14,345 @@
 package k8s
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// EndpointsSource is where the addresses of the endpoints of a discovered
+// service come from
+type EndpointsSource string
+
+const (
+	// EndpointsSourcePods copies the pod addresses of the upstream endpoints
+	EndpointsSourcePods EndpointsSource = "pods"
+	// EndpointsSourceIngress builds the endpoints from the load balancer
+	// ingress addresses and the ports of the upstream service
+	EndpointsSourceIngress EndpointsSource = "ingress"
+	// EndpointsSourceNodePort builds the endpoints from the addresses of the
+	// ready upstream nodes and the node ports of the upstream service
+	EndpointsSourceNodePort EndpointsSource = "node-port"
+	// EndpointsSourceSkip skips the services, which are not discovered
+	EndpointsSourceSkip EndpointsSource = "skip"
+
+	// ExternalName services have no endpoints
+	endpointsSourceNone EndpointsSource = "none"
 )
 
-func translateService(svc *v1.Service, backendName string) *v1.Service {
+// EndpointsPolicy maps service types to the source of their endpoints. Pod
+// addresses are used for the types that are not in the policy.
+type EndpointsPolicy map[v1.ServiceType]EndpointsSource
+
+// the endpoints sources that each service type supports
+var endpointsSources = map[v1.ServiceType][]EndpointsSource{
+	v1.ServiceTypeClusterIP:    {EndpointsSourcePods, EndpointsSourceSkip},
+	v1.ServiceTypeNodePort:     {EndpointsSourcePods, EndpointsSourceNodePort, EndpointsSourceSkip},
+	v1.ServiceTypeLoadBalancer: {EndpointsSourcePods, EndpointsSourceIngress, EndpointsSourceNodePort, EndpointsSourceSkip},
+}
+
+// overlayEndpointsPolicy is the policy of backends whose pods cannot be
+// routed to, such as clusters with an overlay network
+var overlayEndpointsPolicy = EndpointsPolicy{
+	v1.ServiceTypeClusterIP:    EndpointsSourceSkip,
+	v1.ServiceTypeNodePort:     EndpointsSourceNodePort,
+	v1.ServiceTypeLoadBalancer: EndpointsSourceIngress,
+}
+
+// ParseEndpointsPolicy parses a comma separated list of service types and
+// endpoints sources, such as "LoadBalancer=ingress,NodePort=node-port"
+func ParseEndpointsPolicy(policy string) (EndpointsPolicy, error) {
+	res := EndpointsPolicy{}
+	for _, entry := range strings.Split(policy, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid endpoints policy %q: must be of the form <service type>=<endpoints source>", entry)
+		}
+		serviceType := v1.ServiceType(strings.TrimSpace(parts[0]))
+		source := EndpointsSource(strings.TrimSpace(parts[1]))
+		sources, ok := endpointsSources[serviceType]
+		if !ok {
+			return nil, fmt.Errorf("invalid endpoints policy %q: unsupported service type %q", entry, serviceType)
+		}
+		if !containsSource(sources, source) {
+			return nil, fmt.Errorf("invalid endpoints policy %q: the endpoints of %s services can only come from %v", entry, serviceType, sources)
+		}
+		res[serviceType] = source
+	}
+	return res, nil
+}
+
+// OverlayEndpointsPolicy returns the policy of backends whose pods cannot be
+// routed to from Gimbal, such as clusters with an overlay network. The
+// endpoints of LoadBalancer services are their ingress addresses, the ones of
+// NodePort services are the node addresses, and ClusterIP services are
+// skipped, unless the given policy says otherwise. Pod addresses cannot be
+// used.
+func OverlayEndpointsPolicy(policy EndpointsPolicy) (EndpointsPolicy, error) {
+	res := EndpointsPolicy{}
+	for serviceType, source := range overlayEndpointsPolicy {
+		res[serviceType] = source
+	}
+	for serviceType, source := range policy {
+		if source == EndpointsSourcePods {
+			return nil, fmt.Errorf("invalid endpoints policy: the endpoints of %s services cannot come from pods on an overlay network", serviceType)
+		}
+		res[serviceType] = source
+	}
+	return res, nil
+}
+
+func containsSource(sources []EndpointsSource, source EndpointsSource) bool {
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Source returns the source of the endpoints of the upstream service
+func (p EndpointsPolicy) Source(svc *v1.Service) EndpointsSource {
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		return endpointsSourceNone
+	}
+	serviceType := svc.Spec.Type
+	// The API server defaults the type to ClusterIP
+	if serviceType == "" {
+		serviceType = v1.ServiceTypeClusterIP
+	}
+	if source, ok := p[serviceType]; ok {
+		return source
+	}
+	return EndpointsSourcePods
+}
+
+// NeedsNodes returns whether endpoints are built from node addresses
+func (p EndpointsPolicy) NeedsNodes() bool {
+	for _, source := range p {
+		if source == EndpointsSourceNodePort {
+			return true
+		}
+	}
+	return false
+}
+
+// translateService returns the discovered service of the upstream service.
+// ExternalName services are mirrored as is, and other services are translated
+// into headless services whose target ports match the endpoints built from
+// the given source.
+func translateService(svc *v1.Service, backendName string, names *translator.NameTemplate, source EndpointsSource) *v1.Service {
 	newService := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace:   svc.Namespace,
-			Name:        translator.BuildDiscoveredName(backendName, svc.Name),
+			Name:        names.Name(backendName, svc.Namespace, svc.Name),
 			Labels:      translator.AddGimbalLabels(backendName, svc.ObjectMeta.Name, svc.ObjectMeta.Labels),
-			Annotations: svc.Annotations,
+			Annotations: translator.AddOriginAnnotations(svc.Annotations, originIdentity(backendName, svc.ObjectMeta)),
 		},
 		Spec: v1.ServiceSpec{
 			ClusterIP: "None",
 			Type:      v1.ServiceTypeClusterIP,
 		},
 	}
+	if source == endpointsSourceNone {
+		newService.Spec = v1.ServiceSpec{
+			Type:         v1.ServiceTypeExternalName,
+			ExternalName: svc.Spec.ExternalName,
+		}
+	}
 
 	for _, port := range svc.Spec.Ports {
-		newService.Spec.Ports = append(newService.Spec.Ports, v1.ServicePort{
-			Name: port.Name,
-			Port: port.Port,
-		})
+		p := translateServicePort(port)
+		switch source {
+		case EndpointsSourceIngress:
+			p.TargetPort = intstr.FromInt(int(port.Port))
+		case EndpointsSourceNodePort:
+			if port.NodePort == 0 {
+				continue
+			}
+			p.TargetPort = intstr.FromInt(int(port.NodePort))
+		}
+		newService.Spec.Ports = append(newService.Spec.Ports, p)
 	}
 	return newService
 }
 
-func translateEndpoints(endpoints *v1.Endpoints, backendName string) *v1.Endpoints {
+// originIdentity returns the identity of the upstream service or endpoints
+func originIdentity(backendName string, meta metav1.ObjectMeta) translator.OriginIdentity {
+	return translator.OriginIdentity{Backend: backendName, Namespace: meta.Namespace, Name: meta.Name}
+}
+
+// translateServicePort copies the name, port, protocol and target port of the
+// upstream service port. Endpoints are copied as is, so the endpoint ports
+// keep matching the service ports by name, and a named target port keeps
+// resolving to the port of each endpoint. The application protocol, if any,
+// is carried by the service annotations. Defaults are set the same way the
+// API server sets them, so that the translated port does not differ from the
+// one that exists in Gimbal.
+func translateServicePort(port v1.ServicePort) v1.ServicePort {
+	p := v1.ServicePort{
+		Name:       port.Name,
+		Port:       port.Port,
+		Protocol:   port.Protocol,
+		TargetPort: port.TargetPort,
+	}
+	if p.Protocol == "" {
+		p.Protocol = v1.ProtocolTCP
+	}
+	if p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == 0 {
+		p.TargetPort = intstr.FromInt(int(p.Port))
+	}
+	return p
+}
+
+func translateEndpoints(endpoints *v1.Endpoints, backendName string, names *translator.NameTemplate) *v1.Endpoints {
 	newEndpoint := &v1.Endpoints{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace:   endpoints.Namespace,
-			Name:        translator.BuildDiscoveredName(backendName, endpoints.Name),
+			Name:        names.Name(backendName, endpoints.Namespace, endpoints.Name),
 			Labels:      translator.AddGimbalLabels(backendName, endpoints.ObjectMeta.Name, endpoints.ObjectMeta.Labels),
-			Annotations: endpoints.Annotations,
+			Annotations: translator.AddOriginAnnotations(endpoints.Annotations, originIdentity(backendName, endpoints.ObjectMeta)),
 		},
 		Subsets: endpoints.Subsets,
 	}
 	return newEndpoint
 }
+
+// translateServiceEndpoints builds the endpoints of the upstream service from
+// its load balancer ingress addresses or the addresses of the given nodes,
+// depending on the source. Only ready nodes are used. Ingress hostnames cannot
+// be endpoint addresses, so they are left out, and a problem is returned for
+// each of them.
+func translateServiceEndpoints(svc *v1.Service, backendName string, names *translator.NameTemplate, source EndpointsSource, nodes []*v1.Node) (*v1.Endpoints, []validation.Problem) {
+	newEndpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   svc.Namespace,
+			Name:        names.Name(backendName, svc.Namespace, svc.Name),
+			Labels:      translator.AddGimbalLabels(backendName, svc.ObjectMeta.Name, svc.ObjectMeta.Labels),
+			Annotations: translator.AddOriginAnnotations(nil, originIdentity(backendName, svc.ObjectMeta)),
+		},
+	}
+
+	var subset v1.EndpointSubset
+	var problems []validation.Problem
+	switch source {
+	case EndpointsSourceIngress:
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP == "" {
+				problems = append(problems, validation.Problem{
+					Reason:  validation.ReasonInvalidAddress,
+					Message: fmt.Sprintf("skipping load balancer ingress hostname %q, which is not an IP address; use the node-port endpoints source for this service type", ingress.Hostname),
+				})
+				continue
+			}
+			subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ingress.IP})
+		}
+	case EndpointsSourceNodePort:
+		for _, node := range nodes {
+			if ip := nodeAddress(node); ip != "" && nodeReady(node) {
+				name := node.Name
+				subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip, NodeName: &name})
+			}
+		}
+	}
+
+	for _, port := range svc.Spec.Ports {
+		p := translateServicePort(port)
+		if source == EndpointsSourceNodePort {
+			if port.NodePort == 0 {
+				continue
+			}
+			p.Port = port.NodePort
+		}
+		subset.Ports = append(subset.Ports, v1.EndpointPort{Name: p.Name, Port: p.Port, Protocol: p.Protocol})
+	}
+
+	if len(subset.Addresses) > 0 && len(subset.Ports) > 0 {
+		newEndpoints.Subsets = []v1.EndpointSubset{subset}
+	}
+	return newEndpoints, problems
+}
+
+// localTraffic returns whether the node ports of the service only route to
+// the pods that run on the node, so that its endpoints must only contain the
+// nodes that run a ready pod of the service
+func localTraffic(svc *v1.Service, source EndpointsSource) bool {
+	return source == EndpointsSourceNodePort && svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// localNodes returns the nodes that run a ready pod of the service, according
+// to its upstream endpoints, which may be nil
+func localNodes(nodes []*v1.Node, endpoints *v1.Endpoints) []*v1.Node {
+	if endpoints == nil {
+		return nil
+	}
+	local := map[string]bool{}
+	for _, s := range endpoints.Subsets {
+		for _, a := range s.Addresses {
+			if a.NodeName != nil {
+				local[*a.NodeName] = true
+			}
+		}
+	}
+	var res []*v1.Node
+	for _, node := range nodes {
+		if local[node.Name] {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+// nodeAddress returns the internal IP address of the node, or its external
+// IP address if it has no internal one
+func nodeAddress(node *v1.Node) string {
+	for _, addressType := range []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP} {
+		for _, a := range node.Status.Addresses {
+			if a.Type == addressType {
+				return a.Address
+			}
+		}
+	}
+	return ""
+}
+
+// nodeReady returns whether the node is ready to receive traffic
+func nodeReady(node *v1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// the labels that contain the region and zone of a node, newest first
+var (
+	nodeRegionLabels = []string{"topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"}
+	nodeZoneLabels   = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+)
+
+// nodeLocality returns the region and zone of the node, from its labels
+func nodeLocality(node *v1.Node) translator.Locality {
+	return translator.Locality{
+		Region: firstLabel(node.Labels, nodeRegionLabels),
+		Zone:   firstLabel(node.Labels, nodeZoneLabels),
+	}
+}
+
+func firstLabel(labels map[string]string, keys []string) string {
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
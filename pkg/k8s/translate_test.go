@@ -16,6 +16,7 @@ package k8s
 import (
 	"testing"
 
+	"github.com/projectcontour/gimbal/pkg/validation"
 	"github.com/stretchr/testify/assert"
 
 	v1 "k8s.io/api/core/v1"
@@ -52,11 +53,11 @@ func TestTranslateService(t *testing.T) {
 					Namespace:   "default",
 					Name:        "cluster1-kuard",
 					Labels:      map[string]string{"app": "kuard", "gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "kuard"},
-					Annotations: map[string]string{"foo": "bar"},
+					Annotations: map[string]string{"foo": "bar", "gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "kuard"},
 				},
 				Spec: v1.ServiceSpec{
 					ClusterIP: "None",
-					Ports:     []v1.ServicePort{{Name: "foo", Port: 80}}, //, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
+					Ports:     []v1.ServicePort{{Name: "foo", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)}},
 					Type:      v1.ServiceTypeClusterIP,
 				},
 			},
@@ -86,22 +87,85 @@ func TestTranslateService(t *testing.T) {
 					Namespace:   "default",
 					Name:        "cluster1-kuard",
 					Labels:      map[string]string{"app": "kuard", "gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "kuard"},
-					Annotations: map[string]string{"foo": "bar"},
+					Annotations: map[string]string{"foo": "bar", "gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "kuard"},
 				},
 				Spec: v1.ServiceSpec{
 					ClusterIP: "None",
 					Ports: []v1.ServicePort{
-						{Name: "foo", Port: 80},
-						{Name: "bar", Port: 8080},
+						{Name: "foo", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+						{Name: "bar", Port: 8080, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
 					},
 					Type: v1.ServiceTypeClusterIP,
 				},
 			},
 		},
+		{
+			name:        "udp and sctp service",
+			backendName: "cluster1",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "dns",
+				},
+				Spec: v1.ServiceSpec{
+					ClusterIP: "10.99.179.252",
+					Ports: []v1.ServicePort{
+						{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(5353)},
+						{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(5353)},
+						{Name: "sctp", Port: 9999, Protocol: v1.ProtocolSCTP, TargetPort: intstr.FromString("sctp")},
+					},
+					Type: v1.ServiceTypeClusterIP,
+				},
+			},
+			expected: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "cluster1-dns",
+					Labels:      map[string]string{"gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "dns"},
+					Annotations: map[string]string{"gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "dns"},
+				},
+				Spec: v1.ServiceSpec{
+					ClusterIP: "None",
+					Ports: []v1.ServicePort{
+						{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(5353)},
+						{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(5353)},
+						{Name: "sctp", Port: 9999, Protocol: v1.ProtocolSCTP, TargetPort: intstr.FromString("sctp")},
+					},
+					Type: v1.ServiceTypeClusterIP,
+				},
+			},
+		},
+		{
+			name:        "port without protocol and target port",
+			backendName: "cluster1",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "kuard",
+				},
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Name: "foo", Port: 80}},
+					Type:  v1.ServiceTypeClusterIP,
+				},
+			},
+			expected: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "cluster1-kuard",
+					Labels:      map[string]string{"gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "kuard"},
+					Annotations: map[string]string{"gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "kuard"},
+				},
+				Spec: v1.ServiceSpec{
+					ClusterIP: "None",
+					Ports:     []v1.ServicePort{{Name: "foo", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(80)}},
+					Type:      v1.ServiceTypeClusterIP,
+				},
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := translateService(tc.service, tc.backendName)
+			got := translateService(tc.service, tc.backendName, nil, EndpointsSourcePods)
 			assert.EqualValues(t, tc.expected, got)
 		})
 	}
@@ -137,7 +201,7 @@ func TestTranslateEndpoints(t *testing.T) {
 					Namespace:   "default",
 					Name:        "cluster1-kuard",
 					Labels:      map[string]string{"app": "kuard", "gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "kuard"},
-					Annotations: map[string]string{"foo": "bar"},
+					Annotations: map[string]string{"foo": "bar", "gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "kuard"},
 				},
 				Subsets: []v1.EndpointSubset{
 					{
@@ -147,11 +211,247 @@ func TestTranslateEndpoints(t *testing.T) {
 				},
 			},
 		},
+		{
+			// A service with a named target port whose pods listen on
+			// different ports
+			name:        "mixed endpoint ports",
+			backendName: "cluster1",
+			endpoints: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "kuard",
+				},
+				Subsets: []v1.EndpointSubset{
+					{
+						Addresses: []v1.EndpointAddress{{IP: "172.17.0.4"}},
+						Ports:     []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+					},
+					{
+						Addresses: []v1.EndpointAddress{{IP: "172.17.0.7"}},
+						Ports:     []v1.EndpointPort{{Name: "http", Port: 9090, Protocol: v1.ProtocolTCP}},
+					},
+				},
+			},
+			expected: &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "cluster1-kuard",
+					Labels:      map[string]string{"gimbal.projectcontour.io/backend": "cluster1", "gimbal.projectcontour.io/service": "kuard"},
+					Annotations: map[string]string{"gimbal.projectcontour.io/origin-backend": "cluster1", "gimbal.projectcontour.io/origin-namespace": "default", "gimbal.projectcontour.io/origin-name": "kuard"},
+				},
+				Subsets: []v1.EndpointSubset{
+					{
+						Addresses: []v1.EndpointAddress{{IP: "172.17.0.4"}},
+						Ports:     []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+					},
+					{
+						Addresses: []v1.EndpointAddress{{IP: "172.17.0.7"}},
+						Ports:     []v1.EndpointPort{{Name: "http", Port: 9090, Protocol: v1.ProtocolTCP}},
+					},
+				},
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := translateEndpoints(tc.endpoints, tc.backendName)
+			got := translateEndpoints(tc.endpoints, tc.backendName, nil)
 			assert.EqualValues(t, tc.expected, got)
 		})
 	}
 }
+
+func TestParseEndpointsPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		expected  EndpointsPolicy
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			policy:   "",
+			expected: EndpointsPolicy{},
+		},
+		{
+			name:     "ingress and node port",
+			policy:   "LoadBalancer=ingress, NodePort=node-port",
+			expected: EndpointsPolicy{v1.ServiceTypeLoadBalancer: EndpointsSourceIngress, v1.ServiceTypeNodePort: EndpointsSourceNodePort},
+		},
+		{
+			name:      "missing source",
+			policy:    "LoadBalancer",
+			expectErr: true,
+		},
+		{
+			name:      "unsupported service type",
+			policy:    "ExternalName=pods",
+			expectErr: true,
+		},
+		{
+			name:      "unsupported source",
+			policy:    "ClusterIP=node-port",
+			expectErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseEndpointsPolicy(tc.policy)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestTranslateServiceSources(t *testing.T) {
+	ports := []v1.ServicePort{
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080), NodePort: 30080},
+		{Name: "admin", Port: 9000, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(9000)},
+	}
+	tests := []struct {
+		name     string
+		service  *v1.Service
+		source   EndpointsSource
+		expected v1.ServiceSpec
+	}{
+		{
+			name: "external name",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"},
+			},
+			source:   endpointsSourceNone,
+			expected: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"},
+		},
+		{
+			name: "load balancer ingress",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kuard"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, Ports: ports},
+			},
+			source: EndpointsSourceIngress,
+			expected: v1.ServiceSpec{
+				ClusterIP: "None",
+				Type:      v1.ServiceTypeClusterIP,
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(80)},
+					{Name: "admin", Port: 9000, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(9000)},
+				},
+			},
+		},
+		{
+			name: "node port",
+			service: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kuard"},
+				Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: ports},
+			},
+			source: EndpointsSourceNodePort,
+			expected: v1.ServiceSpec{
+				ClusterIP: "None",
+				Type:      v1.ServiceTypeClusterIP,
+				Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(30080)}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := translateService(tc.service, "cluster1", nil, tc.source)
+			assert.Equal(t, tc.expected, got.Spec)
+		})
+	}
+}
+
+func TestTranslateServiceEndpoints(t *testing.T) {
+	node := func(name, ip string, ready v1.ConditionStatus) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: v1.NodeStatus{
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "203.0.113.1"}, {Type: v1.NodeInternalIP, Address: ip}},
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+			},
+		}
+	}
+	node1, node2 := "node1", "node2"
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kuard"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(8080), NodePort: 30080}},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}, {Hostname: "lb.example.com"}}},
+		},
+	}
+	nodes := []*v1.Node{node(node1, "10.0.0.1", v1.ConditionTrue), node(node2, "10.0.0.2", v1.ConditionTrue), node("node3", "10.0.0.3", v1.ConditionFalse)}
+
+	tests := []struct {
+		name     string
+		source   EndpointsSource
+		nodes    []*v1.Node
+		expected []v1.EndpointSubset
+		problems int
+	}{
+		{
+			name:   "ingress",
+			source: EndpointsSourceIngress,
+			expected: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "192.0.2.10"}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+			}},
+			problems: 1,
+		},
+		{
+			name:   "ready nodes",
+			source: EndpointsSourceNodePort,
+			nodes:  nodes,
+			expected: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &node1}, {IP: "10.0.0.2", NodeName: &node2}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 30080, Protocol: v1.ProtocolTCP}},
+			}},
+		},
+		{
+			name:   "no nodes",
+			source: EndpointsSourceNodePort,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, problems := translateServiceEndpoints(service, "cluster1", nil, tc.source, tc.nodes)
+			assert.Equal(t, "cluster1-kuard", got.Name)
+			assert.Equal(t, tc.expected, got.Subsets)
+			assert.Len(t, problems, tc.problems)
+			assert.Equal(t, tc.problems, validation.CountReason(problems, validation.ReasonInvalidAddress))
+		})
+	}
+}
+
+func TestLocalNodes(t *testing.T) {
+	node1, node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	name1, name2 := "node1", "node2"
+	endpoints := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.1.0.1", NodeName: &name2}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.1.0.2", NodeName: &name1}},
+		}},
+	}
+
+	assert.Equal(t, []*v1.Node{node2}, localNodes([]*v1.Node{node1, node2}, endpoints))
+	assert.Empty(t, localNodes([]*v1.Node{node1, node2}, nil))
+}
+
+func TestOverlayEndpointsPolicy(t *testing.T) {
+	got, err := OverlayEndpointsPolicy(EndpointsPolicy{v1.ServiceTypeLoadBalancer: EndpointsSourceNodePort})
+	assert.NoError(t, err)
+	assert.Equal(t, EndpointsPolicy{
+		v1.ServiceTypeClusterIP:    EndpointsSourceSkip,
+		v1.ServiceTypeNodePort:     EndpointsSourceNodePort,
+		v1.ServiceTypeLoadBalancer: EndpointsSourceNodePort,
+	}, got)
+	assert.True(t, got.NeedsNodes())
+
+	_, err = OverlayEndpointsPolicy(EndpointsPolicy{v1.ServiceTypeClusterIP: EndpointsSourcePods})
+	assert.Error(t, err)
+}
@@ -45,7 +45,18 @@ const (
 	DiscovererUpstreamEndpointsGauge        = "gimbal_discoverer_upstream_endpoints_total"
 	DiscovererReplicatedEndpointsGauge      = "gimbal_discoverer_replicated_endpoints_total"
 	DiscovererInvalidEndpointsGauge         = "gimbal_discoverer_invalid_endpoints_total"
+	DiscovererInvalidObjectsGauge           = "gimbal_discoverer_invalid_objects_total"
 	DiscovererInfoGauge                     = "gimbal_discoverer_info"
+	DiscovererCredentialsReloadTotal        = "gimbal_discoverer_credentials_reload_total"
+	DiscovererCredentialsReloadTimestamp    = "gimbal_discoverer_credentials_reload_timestamp"
+	DiscovererNameCollisionsTotal           = "gimbal_discoverer_name_collisions_total"
+	DiscovererDriftObjectsGauge             = "gimbal_discoverer_drift_objects_total"
+	DiscovererRevertedEditsTotal            = "gimbal_discoverer_reverted_edits_total"
+	DiscovererDeletionsPausedGauge          = "gimbal_discoverer_deletions_paused"
+	DiscovererHeldDeletionsGauge            = "gimbal_discoverer_held_deletions_total"
+	DiscovererGraceAddressesGauge           = "gimbal_discoverer_grace_addresses_total"
+	DiscovererBackendHealthGauge            = "gimbal_discoverer_backend_health"
+	DiscovererProbeFailingAddressesGauge    = "gimbal_discoverer_probe_failing_addresses_total"
 )
 
 // NewMetrics returns a map of Prometheus metrics
@@ -155,6 +166,13 @@ func NewMetrics(BackendType, BackendName string) DiscovererMetrics {
 				},
 				[]string{"backendname", "namespace", "servicename", "backendtype"},
 			),
+			DiscovererInvalidObjectsGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererInvalidObjectsGauge,
+					Help: "Total number of services and endpoints with validation problems, by reason",
+				},
+				[]string{"backendname", "namespace", "kind", "reason", "backendtype"},
+			),
 			DiscovererInfoGauge: prometheus.NewGaugeVec(
 				prometheus.GaugeOpts{
 					Name: DiscovererInfoGauge,
@@ -162,6 +180,76 @@ func NewMetrics(BackendType, BackendName string) DiscovererMetrics {
 				},
 				[]string{"backendname", "version", "backendtype"},
 			),
+			DiscovererCredentialsReloadTotal: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererCredentialsReloadTotal,
+					Help: "Number of times the backend credentials were reloaded",
+				},
+				[]string{"backendname", "backendtype", "result"},
+			),
+			DiscovererCredentialsReloadTimestamp: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererCredentialsReloadTimestamp,
+					Help: "Timestamp of the last successful reload of the backend credentials",
+				},
+				[]string{"backendname", "backendtype"},
+			),
+			DiscovererNameCollisionsTotal: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererNameCollisionsTotal,
+					Help: "Number of writes refused because an object with the same name comes from a different origin",
+				},
+				[]string{"backendname", "namespace", "kind", "backendtype"},
+			),
+			DiscovererDriftObjectsGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererDriftObjectsGauge,
+					Help: "Total number of discovered services and endpoints that differ from the backend, by reason",
+				},
+				[]string{"backendname", "namespace", "kind", "reason", "backendtype"},
+			),
+			DiscovererRevertedEditsTotal: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: DiscovererRevertedEditsTotal,
+					Help: "Number of writes that reverted manual edits of discovered services and endpoints",
+				},
+				[]string{"backendname", "namespace", "kind", "backendtype"},
+			),
+			DiscovererDeletionsPausedGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererDeletionsPausedGauge,
+					Help: "Whether the deletions of discovered services and endpoints are paused because too many would be deleted at once",
+				},
+				[]string{"backendname", "backendtype"},
+			),
+			DiscovererHeldDeletionsGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererHeldDeletionsGauge,
+					Help: "Total number of deletions of discovered services and endpoints that are held while deletions are paused",
+				},
+				[]string{"backendname", "kind", "backendtype"},
+			),
+			DiscovererGraceAddressesGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererGraceAddressesGauge,
+					Help: "Total number of addresses removed from discovered endpoints that are kept as not ready during their grace period",
+				},
+				[]string{"backendname", "namespace", "name", "backendtype"},
+			),
+			DiscovererBackendHealthGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererBackendHealthGauge,
+					Help: "Health of the backend, which is 1 for the current state and 0 for the others",
+				},
+				[]string{"backendname", "state", "backendtype"},
+			),
+			DiscovererProbeFailingAddressesGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: DiscovererProbeFailingAddressesGauge,
+					Help: "Total number of addresses of discovered endpoints that are not ready because they fail their probe",
+				},
+				[]string{"backendname", "namespace", "name", "backendtype"},
+			),
 		},
 	}
 }
@@ -269,6 +357,24 @@ func (d *DiscovererMetrics) DiscovererInvalidServicesMetric(namespace string, to
 	}
 }
 
+// DiscovererInvalidEndpointsMetric records the total number of upstream
+// endpoints that could not be replicated
+func (d *DiscovererMetrics) DiscovererInvalidEndpointsMetric(namespace, serviceName string, totalEp int) {
+	m, ok := d.Metrics[DiscovererInvalidEndpointsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, serviceName, d.BackendType).Set(float64(totalEp))
+	}
+}
+
+// DiscovererInvalidObjectsMetric records the total number of services or
+// endpoints that have validation problems with the given reason
+func (d *DiscovererMetrics) DiscovererInvalidObjectsMetric(namespace, kind, reason string, total int) {
+	m, ok := d.Metrics[DiscovererInvalidObjectsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, kind, reason, d.BackendType).Set(float64(total))
+	}
+}
+
 // DiscovererUpstreamEndpointsMetric records the total upstream endpoints in the backend
 func (d *DiscovererMetrics) DiscovererUpstreamEndpointsMetric(namespace, serviceName string, totalEp int) {
 	m, ok := d.Metrics[DiscovererUpstreamEndpointsGauge].(*prometheus.GaugeVec)
@@ -292,3 +398,97 @@ func (d *DiscovererMetrics) DiscovererInfoMetric(version string) {
 		m.WithLabelValues(d.BackendName, version, d.BackendType).Set(1)
 	}
 }
+
+// CredentialsReloadMetric records the result of a backend credentials reload
+func (d *DiscovererMetrics) CredentialsReloadMetric(success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+		if m, ok := d.Metrics[DiscovererCredentialsReloadTimestamp].(*prometheus.GaugeVec); ok {
+			m.WithLabelValues(d.BackendName, d.BackendType).Set(float64(time.Now().Unix()))
+		}
+	}
+	m, ok := d.Metrics[DiscovererCredentialsReloadTotal].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, d.BackendType, result).Inc()
+	}
+}
+
+// NameCollisionMetric records a write that was refused because an object with
+// the same name comes from a different origin
+func (d *DiscovererMetrics) NameCollisionMetric(namespace, kind string) {
+	m, ok := d.Metrics[DiscovererNameCollisionsTotal].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, kind, d.BackendType).Inc()
+	}
+}
+
+// DiscovererDriftObjectsMetric records the total number of discovered
+// services or endpoints that differ from the backend for the given reason
+func (d *DiscovererMetrics) DiscovererDriftObjectsMetric(namespace, kind, reason string, total int) {
+	m, ok := d.Metrics[DiscovererDriftObjectsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, kind, reason, d.BackendType).Set(float64(total))
+	}
+}
+
+// RevertedEditsMetric records a write that reverted manual edits of a
+// discovered service or endpoints
+func (d *DiscovererMetrics) RevertedEditsMetric(namespace, kind string) {
+	m, ok := d.Metrics[DiscovererRevertedEditsTotal].(*prometheus.CounterVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, kind, d.BackendType).Inc()
+	}
+}
+
+// DeletionsPausedMetric records whether the deletions of discovered services
+// and endpoints are paused
+func (d *DiscovererMetrics) DeletionsPausedMetric(paused bool) {
+	m, ok := d.Metrics[DiscovererDeletionsPausedGauge].(*prometheus.GaugeVec)
+	if ok {
+		value := 0.0
+		if paused {
+			value = 1
+		}
+		m.WithLabelValues(d.BackendName, d.BackendType).Set(value)
+	}
+}
+
+// HeldDeletionsMetric records the total number of held deletions of
+// discovered services or endpoints
+func (d *DiscovererMetrics) HeldDeletionsMetric(kind string, total int) {
+	m, ok := d.Metrics[DiscovererHeldDeletionsGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, kind, d.BackendType).Set(float64(total))
+	}
+}
+
+// GraceAddressesMetric records the total number of removed addresses of the
+// discovered endpoints that are in their grace period
+func (d *DiscovererMetrics) GraceAddressesMetric(namespace, name string, total int) {
+	m, ok := d.Metrics[DiscovererGraceAddressesGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, name, d.BackendType).Set(float64(total))
+	}
+}
+
+// BackendHealthMetric records whether the backend is in the given health state
+func (d *DiscovererMetrics) BackendHealthMetric(state string, current bool) {
+	m, ok := d.Metrics[DiscovererBackendHealthGauge].(*prometheus.GaugeVec)
+	if ok {
+		value := 0.0
+		if current {
+			value = 1
+		}
+		m.WithLabelValues(d.BackendName, state, d.BackendType).Set(value)
+	}
+}
+
+// ProbeFailingAddressesMetric records the total number of addresses of the
+// discovered endpoints that fail their probe
+func (d *DiscovererMetrics) ProbeFailingAddressesMetric(namespace, name string, total int) {
+	m, ok := d.Metrics[DiscovererProbeFailingAddressesGauge].(*prometheus.GaugeVec)
+	if ok {
+		m.WithLabelValues(d.BackendName, namespace, name, d.BackendType).Set(float64(total))
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metricstest helps testing the packages that write discoverer
+// metrics
+package metricstest
+
+import (
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+)
+
+// NewMetrics returns discoverer metrics registered to their own registry, so
+// that tests can read them back
+func NewMetrics() localmetrics.DiscovererMetrics {
+	metrics := localmetrics.NewMetrics("openstack", "us-east")
+	metrics.RegisterPrometheus(false)
+	return metrics
+}
+
+// Clock returns a pinned time, and a function that returns it, which replaces
+// time.Now in tests. Tests move the time forward through the returned pointer.
+func Clock() (*time.Time, func() time.Time) {
+	now := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	return &now, func() time.Time { return now }
+}
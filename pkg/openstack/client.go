@@ -20,6 +20,7 @@ import (
 	"github.com/gophercloud/gophercloud"
 	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
@@ -30,9 +31,10 @@ type IdentityV3Client struct {
 	client *gophercloud.ServiceClient
 }
 
-// NewIdentityV3 returns a client of the Keystone v3 API
-func NewIdentityV3(provider *gophercloud.ProviderClient) (*IdentityV3Client, error) {
-	c, err := gopheropenstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
+// NewIdentityV3 returns a client of the Keystone v3 API found in the service
+// catalog using the given endpoint options
+func NewIdentityV3(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*IdentityV3Client, error) {
+	c, err := gopheropenstack.NewIdentityV3(provider, eo)
 	if err != nil {
 		return nil, err
 	}
@@ -54,8 +56,9 @@ type LoadBalancerV2Client struct {
 }
 
 // NewLoadBalancerV2 returns a client of the Load Balancer as a Service v2 API
-func NewLoadBalancerV2(provider *gophercloud.ProviderClient) (*LoadBalancerV2Client, error) {
-	net, err := gopheropenstack.NewNetworkV2(provider, gophercloud.EndpointOpts{})
+// found in the service catalog using the given endpoint options
+func NewLoadBalancerV2(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*LoadBalancerV2Client, error) {
+	net, err := gopheropenstack.NewNetworkV2(provider, eo)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +67,42 @@ func NewLoadBalancerV2(provider *gophercloud.ProviderClient) (*LoadBalancerV2Cli
 
 // ListLoadBalancers returns the load balancers that exist in the given project
 func (c LoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalancers.LoadBalancer, error) {
-	lbPage, err := loadbalancers.List(c.client, loadbalancers.ListOpts{TenantID: projectID}).AllPages()
+	return listLoadBalancers(c.client, projectID)
+}
+
+// ListPools returns all load balancer pools that exist in the given project
+func (c LoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error) {
+	page, err := pools.List(c.client, pools.ListOpts{TenantID: projectID}).AllPages()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list listener pools: %v", err)
+	}
+
+	ps, err := pools.ExtractPools(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed extract listener pools: %v", err)
+	}
+
+	// add members to each pool
+	for i := range ps {
+		pool := &ps[i]
+		page, err = pools.ListMembers(c.client, pool.ID, pools.ListMembersOpts{TenantID: projectID}).AllPages()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list members of pool ID %q: %v", pool.ID, err)
+		}
+		m, err := pools.ExtractMembers(page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract members of pool ID %q: %v", pool.ID, err)
+		}
+		pool.Members = m
+	}
+
+	return ps, nil
+}
+
+// listLoadBalancers returns the load balancers that exist in the given project,
+// hydrated with their listeners
+func listLoadBalancers(client *gophercloud.ServiceClient, projectID string) ([]loadbalancers.LoadBalancer, error) {
+	lbPage, err := loadbalancers.List(client, loadbalancers.ListOpts{TenantID: projectID}).AllPages()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list load balancers: %v", err)
 	}
@@ -74,7 +112,7 @@ func (c LoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalance
 		return nil, fmt.Errorf("failed to extract load balancers: %v", err)
 	}
 
-	lisPage, err := listeners.List(c.client, listeners.ListOpts{TenantID: projectID}).AllPages()
+	lisPage, err := listeners.List(client, listeners.ListOpts{TenantID: projectID}).AllPages()
 	if err != nil {
 		return nil, fmt.Errorf("failed to list load balancer listeners: %v", err)
 	}
@@ -84,47 +122,80 @@ func (c LoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalance
 		return nil, fmt.Errorf("failed to extract load balancer listeners: %v", err)
 	}
 
+	policies, err := listL7Policies(client, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	// hydrate each listener with the L7 policies that redirect to a pool
+	byListener := map[string][]l7policies.L7Policy{}
+	for _, p := range policies {
+		byListener[p.ListenerID] = append(byListener[p.ListenerID], p)
+	}
+	for i := range lis {
+		lis[i].L7Policies = byListener[lis[i].ID]
+	}
+
+	// index the listeners by load balancer ID so that each load balancer can
+	// be hydrated without scanning the full listener list
+	byLoadBalancer := map[string][]listeners.Listener{}
+	for _, l := range lis {
+		for _, id := range l.Loadbalancers {
+			byLoadBalancer[id.ID] = append(byLoadBalancer[id.ID], l)
+		}
+	}
+
 	// hydrate each load balancer resource with its listeners
 	for i := range lbs {
-		lb := &lbs[i]
-		var listeners []listeners.Listener
-		for _, l := range lis {
-			for _, id := range l.Loadbalancers {
-				if id.ID == lb.ID {
-					listeners = append(listeners, l)
-				}
-			}
-		}
-		lb.Listeners = listeners
+		lbs[i].Listeners = byLoadBalancer[lbs[i].ID]
 	}
 	return lbs, nil
 }
 
-// ListPools returns all load balancer pools that exist in the given project
-func (c LoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error) {
-	page, err := pools.List(c.client, pools.ListOpts{TenantID: projectID}).AllPages()
+// listL7Policies returns the L7 policies that redirect requests to a pool in
+// the given project, with their rules. An empty list is returned if the API
+// does not support L7 policies.
+func listL7Policies(client *gophercloud.ServiceClient, projectID string) ([]l7policies.L7Policy, error) {
+	page, err := l7policies.List(client, l7policies.ListOpts{TenantID: projectID, Action: string(l7policies.ActionRedirectToPool)}).AllPages()
+	if _, ok := err.(gophercloud.ErrDefault404); ok {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to list listener pools: %v", err)
+		return nil, fmt.Errorf("failed to list L7 policies: %v", err)
 	}
 
-	ps, err := pools.ExtractPools(page)
+	ps, err := l7policies.ExtractL7Policies(page)
 	if err != nil {
-		return nil, fmt.Errorf("failed extract listener pools: %v", err)
+		return nil, fmt.Errorf("failed to extract L7 policies: %v", err)
 	}
 
-	// add members to each pool
+	// The list embeds the rules of each policy. Some APIs only embed the IDs
+	// of the rules, in which case the rules of the policy are listed.
 	for i := range ps {
-		pool := &ps[i]
-		page, err = pools.ListMembers(c.client, pool.ID, pools.ListMembersOpts{TenantID: projectID}).AllPages()
+		policy := &ps[i]
+		if rulesEmbedded(policy.Rules) {
+			continue
+		}
+		page, err = l7policies.ListRules(client, policy.ID, l7policies.ListRulesOpts{}).AllPages()
 		if err != nil {
-			return nil, fmt.Errorf("failed to list members of pool ID %q: %v", pool.ID, err)
+			return nil, fmt.Errorf("failed to list rules of L7 policy ID %q: %v", policy.ID, err)
 		}
-		m, err := pools.ExtractMembers(page)
+		r, err := l7policies.ExtractRules(page)
 		if err != nil {
-			return nil, fmt.Errorf("failed to extract members of pool ID %q: %v", pool.ID, err)
+			return nil, fmt.Errorf("failed to extract rules of L7 policy ID %q: %v", policy.ID, err)
 		}
-		pool.Members = m
+		policy.Rules = r
 	}
-
 	return ps, nil
 }
+
+// rulesEmbedded returns whether the rules of a listed L7 policy are complete,
+// rather than only their IDs
+func rulesEmbedded(rules []l7policies.Rule) bool {
+	for _, r := range rules {
+		if r.RuleType == "" {
+			return false
+		}
+	}
+	return true
+}
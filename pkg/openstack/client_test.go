@@ -70,7 +70,7 @@ func lbaasClientFromEnv(t *testing.T) LoadBalancerV2Client {
 	if err != nil {
 		t.Fatalf("failed to get openstack client: %v", err)
 	}
-	lbv2, err := NewLoadBalancerV2(osClient)
+	lbv2, err := NewLoadBalancerV2(osClient, gophercloud.EndpointOpts{})
 	if err != nil {
 		t.Fatalf("failed to get LBaaS v2 client: %v", err)
 	}
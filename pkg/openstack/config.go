@@ -0,0 +1,345 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultUserDomainName = "Default"
+
+// Config holds the settings used to authenticate with an OpenStack cluster.
+// It can be loaded from a clouds.yaml file and from the standard OS_*
+// environment variables.
+type Config struct {
+	AuthURL string `json:"auth_url"`
+
+	// Password authentication
+	Username string `json:"username"`
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+
+	UserDomainName string `json:"user_domain_name"`
+	UserDomainID   string `json:"user_domain_id"`
+
+	// Project scope. The project domain defaults to the user domain.
+	ProjectName       string `json:"project_name"`
+	ProjectID         string `json:"project_id"`
+	ProjectDomainName string `json:"project_domain_name"`
+	ProjectDomainID   string `json:"project_domain_id"`
+
+	// Keystone application credential authentication
+	ApplicationCredentialID     string `json:"application_credential_id"`
+	ApplicationCredentialName   string `json:"application_credential_name"`
+	ApplicationCredentialSecret string `json:"application_credential_secret"`
+
+	// Token authentication
+	Token string `json:"token"`
+
+	// RegionName is the region of the OpenStack API endpoints
+	RegionName string `json:"-"`
+	// Interface is the interface of the OpenStack API endpoints: public,
+	// internal or admin
+	Interface string `json:"-"`
+
+	// CACertFile is the path to the certificate authority of the OpenStack API
+	CACertFile string `json:"-"`
+	// CloudsFile is the path to the clouds.yaml file the configuration was
+	// read from, if any
+	CloudsFile string `json:"-"`
+	// SecretFiles are the paths to the files the secrets were read from,
+	// using the *_FILE environment variables
+	SecretFiles []string `json:"-"`
+}
+
+// clouds is the subset of the clouds.yaml format understood by the discoverer
+type clouds struct {
+	Clouds map[string]struct {
+		Auth       Config `json:"auth"`
+		RegionName string `json:"region_name"`
+		Interface  string `json:"interface"`
+		CACert     string `json:"cacert"`
+	} `json:"clouds"`
+}
+
+// envVars maps the environment variables to the Config fields they set. When
+// more than one variable sets the same field, the first one that is set wins.
+var envVars = []struct {
+	names []string
+	field func(*Config) *string
+}{
+	{[]string{"OS_AUTH_URL"}, func(c *Config) *string { return &c.AuthURL }},
+	{[]string{"OS_USERNAME"}, func(c *Config) *string { return &c.Username }},
+	{[]string{"OS_USER_ID"}, func(c *Config) *string { return &c.UserID }},
+	{[]string{"OS_PASSWORD"}, func(c *Config) *string { return &c.Password }},
+	{[]string{"OS_USER_DOMAIN_NAME"}, func(c *Config) *string { return &c.UserDomainName }},
+	{[]string{"OS_USER_DOMAIN_ID"}, func(c *Config) *string { return &c.UserDomainID }},
+	{[]string{"OS_PROJECT_NAME", "OS_TENANT_NAME"}, func(c *Config) *string { return &c.ProjectName }},
+	{[]string{"OS_PROJECT_ID", "OS_TENANT_ID"}, func(c *Config) *string { return &c.ProjectID }},
+	{[]string{"OS_PROJECT_DOMAIN_NAME"}, func(c *Config) *string { return &c.ProjectDomainName }},
+	{[]string{"OS_PROJECT_DOMAIN_ID"}, func(c *Config) *string { return &c.ProjectDomainID }},
+	{[]string{"OS_APPLICATION_CREDENTIAL_ID"}, func(c *Config) *string { return &c.ApplicationCredentialID }},
+	{[]string{"OS_APPLICATION_CREDENTIAL_NAME"}, func(c *Config) *string { return &c.ApplicationCredentialName }},
+	{[]string{"OS_APPLICATION_CREDENTIAL_SECRET"}, func(c *Config) *string { return &c.ApplicationCredentialSecret }},
+	{[]string{"OS_TOKEN", "OS_AUTH_TOKEN"}, func(c *Config) *string { return &c.Token }},
+	{[]string{"OS_REGION_NAME"}, func(c *Config) *string { return &c.RegionName }},
+	{[]string{"OS_INTERFACE", "OS_ENDPOINT_TYPE"}, func(c *Config) *string { return &c.Interface }},
+	{[]string{"OS_CACERT"}, func(c *Config) *string { return &c.CACertFile }},
+}
+
+// secretEnvVars are the environment variables of secrets, which can also be
+// read from the file named by the variable with a _FILE suffix, such as
+// OS_PASSWORD_FILE, so that the secrets can be mounted from a Kubernetes secret
+// and reloaded when it changes
+var secretEnvVars = map[string]bool{
+	"OS_PASSWORD":                      true,
+	"OS_APPLICATION_CREDENTIAL_SECRET": true,
+	"OS_TOKEN":                         true,
+	"OS_AUTH_TOKEN":                    true,
+}
+
+// LoadConfig returns the OpenStack configuration. If a cloud name is given,
+// either as an argument or using the OS_CLOUD environment variable, the
+// configuration of that cloud is read from the clouds.yaml file. The standard
+// OS_* environment variables override the values found in clouds.yaml.
+func LoadConfig(cloudsFile, cloud string, getenv func(string) string, log *logrus.Logger) (*Config, error) {
+	if cloud == "" {
+		cloud = getenv("OS_CLOUD")
+	}
+
+	c := &Config{}
+	if cloud != "" {
+		if cloudsFile == "" {
+			cloudsFile = findCloudsFile(getenv)
+		}
+		if cloudsFile == "" {
+			return nil, fmt.Errorf("cloud %q was requested, but no clouds.yaml file was found", cloud)
+		}
+		log.Infof("Using OpenStack cloud %q from %s", cloud, cloudsFile)
+		var err error
+		c, err = loadCloud(cloudsFile, cloud)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range envVars {
+		for _, name := range v.names {
+			if value := getenv(name); value != "" {
+				*v.field(c) = value
+				break
+			}
+			if file := getenv(name + "_FILE"); secretEnvVars[name] && file != "" {
+				value, err := ioutil.ReadFile(file)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s_FILE: %v", name, err)
+				}
+				*v.field(c) = strings.TrimSpace(string(value))
+				c.SecretFiles = append(c.SecretFiles, file)
+				break
+			}
+		}
+	}
+
+	if c.Username != "" && c.UserDomainName == "" && c.UserDomainID == "" {
+		log.Warnf("The OpenStack user domain was not set. Using %q as the OpenStack user domain name.", defaultUserDomainName)
+		c.UserDomainName = defaultUserDomainName
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// findCloudsFile returns the first clouds.yaml file that exists in the
+// standard locations
+func findCloudsFile(getenv func(string) string) string {
+	candidates := []string{getenv("OS_CLIENT_CONFIG_FILE"), "clouds.yaml"}
+	if home := getenv("HOME"); home != "" {
+		candidates = append(candidates, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	candidates = append(candidates, "/etc/openstack/clouds.yaml")
+	for _, f := range candidates {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+func loadCloud(cloudsFile, cloud string) (*Config, error) {
+	data, err := ioutil.ReadFile(cloudsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clouds file: %v", err)
+	}
+	var cs clouds
+	if err := yaml.Unmarshal(data, &cs); err != nil {
+		return nil, fmt.Errorf("failed to parse clouds file %q: %v", cloudsFile, err)
+	}
+	entry, ok := cs.Clouds[cloud]
+	if !ok {
+		return nil, fmt.Errorf("cloud %q not found in clouds file %q", cloud, cloudsFile)
+	}
+	c := entry.Auth
+	c.RegionName = entry.RegionName
+	c.Interface = entry.Interface
+	c.CACertFile = entry.CACert
+	c.CloudsFile = cloudsFile
+	return &c, nil
+}
+
+// Validate returns an error if the configuration does not contain the
+// settings required by one of the supported authentication methods
+func (c *Config) Validate() error {
+	if c.AuthURL == "" {
+		return fmt.Errorf("the OpenStack authentication URL must be provided using the OS_AUTH_URL environment variable")
+	}
+	if c.UserDomainName != "" && c.UserDomainID != "" {
+		return fmt.Errorf("only one of OS_USER_DOMAIN_NAME and OS_USER_DOMAIN_ID can be provided")
+	}
+	if c.ProjectDomainName != "" && c.ProjectDomainID != "" {
+		return fmt.Errorf("only one of OS_PROJECT_DOMAIN_NAME and OS_PROJECT_DOMAIN_ID can be provided")
+	}
+	if _, err := availability(c.Interface); err != nil {
+		return err
+	}
+
+	switch c.AuthMethod() {
+	case "v3applicationcredential":
+		if c.ApplicationCredentialSecret == "" {
+			return fmt.Errorf("the OpenStack application credential secret must be provided using the OS_APPLICATION_CREDENTIAL_SECRET or OS_APPLICATION_CREDENTIAL_SECRET_FILE environment variable")
+		}
+		if c.ApplicationCredentialID == "" && c.Username == "" && c.UserID == "" {
+			return fmt.Errorf("an OpenStack application credential name requires the OS_USERNAME or OS_USER_ID environment variable")
+		}
+		return nil
+	case "password":
+		if c.Username == "" && c.UserID == "" {
+			return fmt.Errorf("the OpenStack username must be provided using the OS_USERNAME or OS_USER_ID environment variable")
+		}
+		if c.Password == "" {
+			return fmt.Errorf("the OpenStack password must be provided using the OS_PASSWORD or OS_PASSWORD_FILE environment variable")
+		}
+		if c.ProjectName == "" && c.ProjectID == "" {
+			return fmt.Errorf("the OpenStack project must be provided using the OS_PROJECT_NAME, OS_TENANT_NAME, OS_PROJECT_ID or OS_TENANT_ID environment variable")
+		}
+	}
+
+	if c.ProjectID == "" && c.ProjectName != "" &&
+		c.ProjectDomainName == "" && c.ProjectDomainID == "" && c.UserDomainName == "" && c.UserDomainID == "" {
+		return fmt.Errorf("the domain of OpenStack project %q must be provided using the OS_PROJECT_DOMAIN_NAME or OS_PROJECT_DOMAIN_ID environment variable", c.ProjectName)
+	}
+	return nil
+}
+
+// AuthMethod returns the authentication method used by the configuration:
+// "v3applicationcredential", "token" or "password"
+func (c *Config) AuthMethod() string {
+	switch {
+	case c.ApplicationCredentialID != "" || c.ApplicationCredentialName != "":
+		return "v3applicationcredential"
+	case c.Token != "":
+		return "token"
+	default:
+		return "password"
+	}
+}
+
+// AuthOptions returns the gophercloud authentication options of the
+// configuration
+func (c *Config) AuthOptions() gophercloud.AuthOptions {
+	opts := gophercloud.AuthOptions{
+		IdentityEndpoint: c.AuthURL,
+		AllowReauth:      true,
+	}
+
+	switch c.AuthMethod() {
+	case "v3applicationcredential":
+		// Application credentials are scoped to the project they were
+		// created in, so no scope is sent.
+		opts.ApplicationCredentialID = c.ApplicationCredentialID
+		opts.ApplicationCredentialName = c.ApplicationCredentialName
+		opts.ApplicationCredentialSecret = c.ApplicationCredentialSecret
+		opts.Username = c.Username
+		opts.UserID = c.UserID
+		opts.DomainName = c.UserDomainName
+		opts.DomainID = c.UserDomainID
+		return opts
+	case "token":
+		opts.TokenID = c.Token
+	default:
+		opts.Username = c.Username
+		opts.UserID = c.UserID
+		opts.Password = c.Password
+		opts.DomainName = c.UserDomainName
+		opts.DomainID = c.UserDomainID
+	}
+
+	if c.ProjectID != "" {
+		opts.Scope = &gophercloud.AuthScope{ProjectID: c.ProjectID}
+	} else if c.ProjectName != "" {
+		opts.Scope = &gophercloud.AuthScope{ProjectName: c.ProjectName}
+		switch {
+		case c.ProjectDomainID != "":
+			opts.Scope.DomainID = c.ProjectDomainID
+		case c.ProjectDomainName != "":
+			opts.Scope.DomainName = c.ProjectDomainName
+		default:
+			opts.Scope.DomainID = c.UserDomainID
+			opts.Scope.DomainName = c.UserDomainName
+		}
+	}
+	return opts
+}
+
+// EndpointOpts returns the options used to find the OpenStack API endpoints
+// of the given region in the service catalog. The region of the configuration
+// is used if the given region is empty.
+func (c *Config) EndpointOpts(region string) gophercloud.EndpointOpts {
+	if region == "" {
+		region = c.RegionName
+	}
+	// The interface was checked by Validate
+	a, _ := availability(c.Interface)
+	return gophercloud.EndpointOpts{
+		Region:       region,
+		Availability: a,
+	}
+}
+
+// availability returns the gophercloud availability of the given endpoint
+// interface. Both the "public" and "publicURL" forms are accepted.
+func availability(iface string) (gophercloud.Availability, error) {
+	switch strings.TrimSuffix(strings.ToLower(iface), "url") {
+	case "", "public":
+		return gophercloud.AvailabilityPublic, nil
+	case "internal":
+		return gophercloud.AvailabilityInternal, nil
+	case "admin":
+		return gophercloud.AvailabilityAdmin, nil
+	}
+	return "", fmt.Errorf("invalid OpenStack endpoint interface %q: must be one of public, internal or admin", iface)
+}
@@ -0,0 +1,352 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCloudsYAML = `
+clouds:
+  prod:
+    auth:
+      auth_url: https://keystone.prod:5000/v3
+      username: gimbal
+      password: s3cr3t
+      user_domain_id: default
+      project_id: 0c7a2b7b8f4f4bb1
+    region_name: RegionOne
+    interface: internal
+    cacert: /etc/ssl/prod-ca.pem
+  appcred:
+    auth:
+      auth_url: https://keystone.prod:5000/v3
+      application_credential_id: 21dced0fd20347869b93710d2b98aae0
+      application_credential_secret: secret
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gimbal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cloudsFile := filepath.Join(dir, "clouds.yaml")
+	if err := ioutil.WriteFile(cloudsFile, []byte(testCloudsYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("abc123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		cloudsFile     string
+		cloud          string
+		env            map[string]string
+		expected       gophercloud.AuthOptions
+		expectedCA     string
+		expectedClouds string
+		expectedFiles  []string
+		expectedErr    bool
+	}{
+		{
+			name: "username and password with tenant name",
+			env: map[string]string{
+				"OS_AUTH_URL":    "https://keystone:5000/v3",
+				"OS_USERNAME":    "admin",
+				"OS_PASSWORD":    "abc123",
+				"OS_TENANT_NAME": "gimbal",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone:5000/v3",
+				Username:         "admin",
+				Password:         "abc123",
+				DomainName:       "Default",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectName: "gimbal", DomainName: "Default"},
+			},
+		},
+		{
+			name: "project ID and domain IDs",
+			env: map[string]string{
+				"OS_AUTH_URL":       "https://keystone:5000/v3",
+				"OS_USERNAME":       "admin",
+				"OS_PASSWORD":       "abc123",
+				"OS_USER_DOMAIN_ID": "default",
+				"OS_PROJECT_ID":     "0c7a2b7b8f4f4bb1",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone:5000/v3",
+				Username:         "admin",
+				Password:         "abc123",
+				DomainID:         "default",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectID: "0c7a2b7b8f4f4bb1"},
+			},
+		},
+		{
+			name: "project in a different domain",
+			env: map[string]string{
+				"OS_AUTH_URL":            "https://keystone:5000/v3",
+				"OS_USERNAME":            "admin",
+				"OS_PASSWORD":            "abc123",
+				"OS_USER_DOMAIN_NAME":    "users",
+				"OS_PROJECT_NAME":        "gimbal",
+				"OS_PROJECT_DOMAIN_NAME": "projects",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone:5000/v3",
+				Username:         "admin",
+				Password:         "abc123",
+				DomainName:       "users",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectName: "gimbal", DomainName: "projects"},
+			},
+		},
+		{
+			name: "application credential",
+			env: map[string]string{
+				"OS_AUTH_URL":                      "https://keystone:5000/v3",
+				"OS_APPLICATION_CREDENTIAL_ID":     "21dced0fd20347869b93710d2b98aae0",
+				"OS_APPLICATION_CREDENTIAL_SECRET": "secret",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint:            "https://keystone:5000/v3",
+				ApplicationCredentialID:     "21dced0fd20347869b93710d2b98aae0",
+				ApplicationCredentialSecret: "secret",
+				AllowReauth:                 true,
+			},
+		},
+		{
+			name: "application credential name requires a user",
+			env: map[string]string{
+				"OS_AUTH_URL":                      "https://keystone:5000/v3",
+				"OS_APPLICATION_CREDENTIAL_NAME":   "gimbal",
+				"OS_APPLICATION_CREDENTIAL_SECRET": "secret",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "application credential without secret",
+			env: map[string]string{
+				"OS_AUTH_URL":                  "https://keystone:5000/v3",
+				"OS_APPLICATION_CREDENTIAL_ID": "21dced0fd20347869b93710d2b98aae0",
+			},
+			expectedErr: true,
+		},
+		{
+			name: "token",
+			env: map[string]string{
+				"OS_AUTH_URL":   "https://keystone:5000/v3",
+				"OS_TOKEN":      "gAAAAABc",
+				"OS_PROJECT_ID": "0c7a2b7b8f4f4bb1",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone:5000/v3",
+				TokenID:          "gAAAAABc",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectID: "0c7a2b7b8f4f4bb1"},
+			},
+		},
+		{
+			name: "token with project name and no domain",
+			env: map[string]string{
+				"OS_AUTH_URL":     "https://keystone:5000/v3",
+				"OS_TOKEN":        "gAAAAABc",
+				"OS_PROJECT_NAME": "gimbal",
+			},
+			expectedErr: true,
+		},
+		{
+			name:        "missing auth url",
+			env:         map[string]string{"OS_USERNAME": "admin", "OS_PASSWORD": "abc123", "OS_TENANT_NAME": "gimbal"},
+			expectedErr: true,
+		},
+		{
+			name:        "missing password",
+			env:         map[string]string{"OS_AUTH_URL": "https://keystone:5000/v3", "OS_USERNAME": "admin", "OS_TENANT_NAME": "gimbal"},
+			expectedErr: true,
+		},
+		{
+			name:        "missing project",
+			env:         map[string]string{"OS_AUTH_URL": "https://keystone:5000/v3", "OS_USERNAME": "admin", "OS_PASSWORD": "abc123"},
+			expectedErr: true,
+		},
+		{
+			name: "both user domain name and ID",
+			env: map[string]string{
+				"OS_AUTH_URL":         "https://keystone:5000/v3",
+				"OS_USERNAME":         "admin",
+				"OS_PASSWORD":         "abc123",
+				"OS_TENANT_NAME":      "gimbal",
+				"OS_USER_DOMAIN_NAME": "Default",
+				"OS_USER_DOMAIN_ID":   "default",
+			},
+			expectedErr: true,
+		},
+		{
+			name:       "clouds.yaml",
+			cloudsFile: cloudsFile,
+			cloud:      "prod",
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone.prod:5000/v3",
+				Username:         "gimbal",
+				Password:         "s3cr3t",
+				DomainID:         "default",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectID: "0c7a2b7b8f4f4bb1"},
+			},
+			expectedCA:     "/etc/ssl/prod-ca.pem",
+			expectedClouds: cloudsFile,
+		},
+		{
+			name:       "clouds.yaml overridden by the environment",
+			cloudsFile: cloudsFile,
+			env:        map[string]string{"OS_CLOUD": "prod", "OS_PASSWORD": "rotated"},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone.prod:5000/v3",
+				Username:         "gimbal",
+				Password:         "rotated",
+				DomainID:         "default",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectID: "0c7a2b7b8f4f4bb1"},
+			},
+			expectedCA:     "/etc/ssl/prod-ca.pem",
+			expectedClouds: cloudsFile,
+		},
+		{
+			name: "clouds.yaml from OS_CLIENT_CONFIG_FILE",
+			env:  map[string]string{"OS_CLIENT_CONFIG_FILE": cloudsFile, "OS_CLOUD": "appcred"},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint:            "https://keystone.prod:5000/v3",
+				ApplicationCredentialID:     "21dced0fd20347869b93710d2b98aae0",
+				ApplicationCredentialSecret: "secret",
+				AllowReauth:                 true,
+			},
+			expectedClouds: cloudsFile,
+		},
+		{
+			name: "password from a file",
+			env: map[string]string{
+				"OS_AUTH_URL":      "https://keystone:5000/v3",
+				"OS_USERNAME":      "admin",
+				"OS_PASSWORD_FILE": passwordFile,
+				"OS_TENANT_NAME":   "gimbal",
+			},
+			expected: gophercloud.AuthOptions{
+				IdentityEndpoint: "https://keystone:5000/v3",
+				Username:         "admin",
+				Password:         "abc123",
+				DomainName:       "Default",
+				AllowReauth:      true,
+				Scope:            &gophercloud.AuthScope{ProjectName: "gimbal", DomainName: "Default"},
+			},
+			expectedFiles: []string{passwordFile},
+		},
+		{
+			name: "missing password file",
+			env: map[string]string{
+				"OS_AUTH_URL":      "https://keystone:5000/v3",
+				"OS_USERNAME":      "admin",
+				"OS_PASSWORD_FILE": filepath.Join(dir, "missing"),
+				"OS_TENANT_NAME":   "gimbal",
+			},
+			expectedErr: true,
+		},
+		{
+			name:        "unknown cloud",
+			cloudsFile:  cloudsFile,
+			cloud:       "staging",
+			expectedErr: true,
+		},
+		{
+			name:        "missing clouds file",
+			cloudsFile:  filepath.Join(dir, "missing.yaml"),
+			cloud:       "prod",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			getenv := func(key string) string { return tc.env[key] }
+			c, err := LoadConfig(tc.cloudsFile, tc.cloud, getenv, logrus.New())
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.expected, c.AuthOptions())
+			assert.Equal(t, tc.expectedCA, c.CACertFile)
+			assert.Equal(t, tc.expectedClouds, c.CloudsFile)
+			assert.Equal(t, tc.expectedFiles, c.SecretFiles)
+		})
+	}
+}
+
+func TestEndpointOpts(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		region      string
+		expected    gophercloud.EndpointOpts
+		expectedErr bool
+	}{
+		{
+			name:     "defaults",
+			expected: gophercloud.EndpointOpts{Availability: gophercloud.AvailabilityPublic},
+		},
+		{
+			name:     "region and interface from the configuration",
+			config:   Config{RegionName: "RegionOne", Interface: "internal"},
+			expected: gophercloud.EndpointOpts{Region: "RegionOne", Availability: gophercloud.AvailabilityInternal},
+		},
+		{
+			name:     "region argument overrides the configuration",
+			config:   Config{RegionName: "RegionOne", Interface: "adminURL"},
+			region:   "RegionTwo",
+			expected: gophercloud.EndpointOpts{Region: "RegionTwo", Availability: gophercloud.AvailabilityAdmin},
+		},
+		{
+			name:        "invalid interface",
+			config:      Config{Interface: "private"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.AuthURL = "https://keystone:5000/v3"
+			tc.config.Token = "gAAAAABc"
+			err := tc.config.Validate()
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tc.config.EndpointOpts(tc.region))
+		})
+	}
+}
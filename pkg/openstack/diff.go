@@ -14,8 +14,7 @@
 package openstack
 
 import (
-	"reflect"
-
+	"github.com/projectcontour/gimbal/pkg/sync"
 	"k8s.io/api/core/v1"
 )
 
@@ -96,10 +95,12 @@ func serviceEquals(o1, o2 *v1.Service) bool {
 		o1.GetNamespace() == o2.GetNamespace()
 }
 
+// serviceEqualsDetail compares the full desired state of the services, so
+// that manual edits of the labels, annotations and spec are reverted
 func serviceEqualsDetail(o1, o2 *v1.Service) bool {
 	return o1.GetName() == o2.GetName() &&
 		o1.GetNamespace() == o2.GetNamespace() &&
-		reflect.DeepEqual(o1.Spec.Ports, o2.Spec.Ports)
+		len(sync.ServiceDiff(o1, o2)) == 0
 }
 
 func endpointEquals(o1, o2 *Endpoints) bool {
@@ -107,8 +108,10 @@ func endpointEquals(o1, o2 *Endpoints) bool {
 		o1.endpoints.GetNamespace() == o2.endpoints.GetNamespace()
 }
 
+// endpointEqualsDetail compares the full desired state of the endpoints, so
+// that manual edits of the labels, annotations and addresses are reverted
 func endpointEqualsDetail(o1, o2 *Endpoints) bool {
 	return o1.endpoints.GetName() == o2.endpoints.GetName() &&
 		o1.endpoints.GetNamespace() == o2.endpoints.GetNamespace() &&
-		reflect.DeepEqual(o1.endpoints.Subsets, o2.endpoints.Subsets)
+		len(sync.EndpointsDiff(&o1.endpoints, &o2.endpoints)) == 0
 }
@@ -103,6 +103,67 @@ func TestDiffServices(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "service with new IP family",
+			current: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "finance",
+						Name:        "production",
+						Annotations: map[string]string{"gimbal.projectcontour.io/ip-families": "IPv4", "gimbal.projectcontour.io/ip-family-policy": "SingleStack"},
+					},
+				},
+			},
+			desired: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "finance",
+						Name:        "production",
+						Annotations: map[string]string{"gimbal.projectcontour.io/ip-families": "IPv4,IPv6", "gimbal.projectcontour.io/ip-family-policy": "PreferDualStack"},
+					},
+				},
+			},
+			expectedUpdate: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "finance",
+						Name:        "production",
+						Annotations: map[string]string{"gimbal.projectcontour.io/ip-families": "IPv4,IPv6", "gimbal.projectcontour.io/ip-family-policy": "PreferDualStack"},
+					},
+				},
+			},
+		},
+		{
+			name: "edited service",
+			current: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   "finance",
+						Name:        "production",
+						Labels:      map[string]string{"gimbal.projectcontour.io/backend": "openstack", "team": "edited"},
+						Annotations: map[string]string{"gimbal.projectcontour.io/last-sync-time": "2000-01-01T10:00:00Z"},
+					},
+				},
+			},
+			desired: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "finance",
+						Name:      "production",
+						Labels:    map[string]string{"gimbal.projectcontour.io/backend": "openstack"},
+					},
+				},
+			},
+			expectedUpdate: []v1.Service{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "finance",
+						Name:      "production",
+						Labels:    map[string]string{"gimbal.projectcontour.io/backend": "openstack"},
+					},
+				},
+			},
+		},
 		{
 			name: "deleted service",
 			current: []v1.Service{
@@ -252,6 +313,45 @@ func TestDiffEndpoints(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "endpoint with new locality",
+			current: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace:   "finance",
+							Name:        "production",
+							Annotations: map[string]string{"gimbal.projectcontour.io/localities": "1.2.3.4=dfw/az1"},
+						},
+					},
+					upstreamName: "upname",
+				},
+			},
+			desired: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace:   "finance",
+							Name:        "production",
+							Annotations: map[string]string{"gimbal.projectcontour.io/localities": "1.2.3.4=dfw/az2"},
+						},
+					},
+					upstreamName: "upname",
+				},
+			},
+			expectedUpdate: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace:   "finance",
+							Name:        "production",
+							Annotations: map[string]string{"gimbal.projectcontour.io/localities": "1.2.3.4=dfw/az2"},
+						},
+					},
+					upstreamName: "upname",
+				},
+			},
+		},
 		{
 			name: "updated endpoint",
 			current: []Endpoints{
@@ -336,6 +436,42 @@ func TestDiffEndpoints(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "edited endpoint",
+			current: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace:   "finance",
+							Name:        "production",
+							Annotations: map[string]string{"owner": "edited"},
+						},
+					},
+				},
+			},
+			desired: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace: "finance",
+							Name:      "production",
+						},
+					},
+					upstreamName: "upname",
+				},
+			},
+			expectedUpdate: []Endpoints{
+				{
+					endpoints: v1.Endpoints{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace: "finance",
+							Name:      "production",
+						},
+					},
+					upstreamName: "upname",
+				},
+			},
+		},
 		{
 			name: "deleted service",
 			current: []Endpoints{
@@ -15,10 +15,19 @@ package openstack
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	gosync "sync"
 	"time"
 
+	"github.com/projectcontour/gimbal/pkg/brake"
+	"github.com/projectcontour/gimbal/pkg/drift"
+	"github.com/projectcontour/gimbal/pkg/grace"
+	"github.com/projectcontour/gimbal/pkg/health"
+	"github.com/projectcontour/gimbal/pkg/probe"
 	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/util"
+	"github.com/projectcontour/gimbal/pkg/validation"
 
 	"github.com/gophercloud/gophercloud/openstack/identity/v3/projects"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
@@ -28,6 +37,7 @@ import (
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -45,8 +55,14 @@ type LoadBalancerLister interface {
 // cluster as Services and Endpoints. The Reconciler runs on a configurable
 // interval.
 type Reconciler struct {
-	LoadBalancerLister
-	ProjectLister
+	// listersMu guards the listers, which are replaced when the OpenStack
+	// credentials are reloaded
+	listersMu gosync.RWMutex
+	// loadBalancerListers holds a lister for each region. The names of the
+	// services discovered in a region are qualified with the region, unless
+	// the region is empty.
+	loadBalancerListers map[string]LoadBalancerLister
+	projectLister       ProjectLister
 
 	// BackendName is the name of the OpenStack cluster
 	BackendName               string
@@ -58,6 +74,45 @@ type Reconciler struct {
 	SyncPeriod time.Duration
 	Logger     *logrus.Logger
 	syncqueue  sync.Queue
+	// Resolver resolves pool members whose address is a hostname. If nil,
+	// these members are counted as invalid endpoints.
+	Resolver Resolver
+	// IPFamily is the only IP family of the pool members that are
+	// discovered. If empty, members of all families are discovered.
+	IPFamily translator.IPFamily
+	// SubnetZones maps subnet IDs to availability zones. The discovered
+	// endpoints carry the zones of the subnets of their members.
+	SubnetZones map[string]string
+	// NameTemplate builds the names of the discovered services and
+	// endpoints. If nil, they are named "<backend>-<service>".
+	NameTemplate *translator.NameTemplate
+	// Invalid holds the services and endpoints that were not synced, or only
+	// partially, because of validation problems
+	Invalid *validation.Store
+	// Drift holds the discovered services and endpoints that differ from
+	// the backend, which are found by every reconciliation
+	Drift *drift.Store
+	// DriftResync syncs again the objects that drift checks report, even if
+	// the reconciliation does not update them
+	DriftResync bool
+	// Brake pauses the deletions of a reconciliation that would delete too
+	// many of the discovered objects
+	Brake *brake.Brake
+	// Grace keeps the members removed from pools as not ready addresses of
+	// the discovered endpoints for a grace period
+	Grace *grace.Tracker
+	// Health tracks whether the OpenStack APIs can be reached. It is
+	// annotated on the discovered objects, and its policy is applied to the
+	// discovered endpoints.
+	Health *health.Backend
+	// Prober moves the members that cannot be reached from Gimbal to the not
+	// ready addresses of the discovered endpoints. Load balancers have no
+	// annotations, so all members get its default probe.
+	Prober *probe.Prober
+	// markedHealth is the health of the backend that the discovered objects
+	// last recorded. It is empty until the first reconciliation, which
+	// updates all of them.
+	markedHealth health.State
 
 	Metrics localmetrics.DiscovererMetrics
 }
@@ -66,28 +121,63 @@ type Reconciler struct {
 type Endpoints struct {
 	endpoints    v1.Endpoints
 	upstreamName string
+	// problems holds a problem for each upstream member that could not be
+	// translated into an endpoint address
+	problems []validation.Problem
 }
 
-// NewReconciler returns an OpenStack reconciler
-func NewReconciler(backendName, openstackProjectWatchlist string, gimbalKubeClient kubernetes.Interface, syncPeriod time.Duration, lbLister LoadBalancerLister,
-	projectLister ProjectLister, log *logrus.Logger, queueWorkers int, metrics localmetrics.DiscovererMetrics) Reconciler {
+// NewReconciler returns an OpenStack reconciler. The load balancer listers are
+// keyed by region.
+func NewReconciler(backendName, openstackProjectWatchlist string, gimbalKubeClient kubernetes.Interface, syncPeriod time.Duration, lbListers map[string]LoadBalancerLister,
+	projectLister ProjectLister, log *logrus.Logger, queueWorkers int, metrics localmetrics.DiscovererMetrics) *Reconciler {
 
-	return Reconciler{
+	r := &Reconciler{
 		BackendName:               backendName,
 		GimbalKubeClient:          gimbalKubeClient,
 		SyncPeriod:                syncPeriod,
-		LoadBalancerLister:        lbLister,
-		ProjectLister:             projectLister,
+		loadBalancerListers:       lbListers,
+		projectLister:             projectLister,
 		Logger:                    log,
 		Metrics:                   metrics,
 		syncqueue:                 sync.NewQueue(log, gimbalKubeClient, queueWorkers, metrics),
 		OpenstackProjectWatchlist: openstackProjectWatchlist,
+		Invalid:                   validation.NewStore(metrics),
+		Drift:                     drift.NewStore(metrics),
 	}
+	r.Brake = brake.NewBrake(r.syncqueue.Enqueue, log, metrics)
+	// Every reconciliation syncs the endpoints again, so they do not need
+	// to be synced at the end of grace periods
+	r.Grace = grace.NewTracker(nil, metrics)
+	// Likewise, the results of probes are synced by the next reconciliation
+	r.Prober = probe.NewProber(nil, log, metrics)
+	r.Health = health.NewBackend(log, metrics)
+	return r
+}
+
+// SetListers replaces the clients used to list OpenStack projects and load
+// balancers. The new clients are used starting with the next reconciliation.
+func (r *Reconciler) SetListers(lbListers map[string]LoadBalancerLister, projectLister ProjectLister) {
+	r.listersMu.Lock()
+	defer r.listersMu.Unlock()
+	r.loadBalancerListers = lbListers
+	r.projectLister = projectLister
+}
+
+// Listers returns the clients used to list OpenStack projects and load
+// balancers. The load balancer listers are keyed by region.
+func (r *Reconciler) Listers() (map[string]LoadBalancerLister, ProjectLister) {
+	r.listersMu.RLock()
+	defer r.listersMu.RUnlock()
+	return r.loadBalancerListers, r.projectLister
 }
 
 // Run starts the reconciler
 func (r *Reconciler) Run(stop <-chan struct{}) {
 	go r.syncqueue.Run(stop)
+	if r.Prober.Interval > 0 {
+		r.Logger.Infof("Probing discovered members every %v", r.Prober.Interval)
+		go r.Prober.Run(stop)
+	}
 
 	ticker := time.NewTicker(r.SyncPeriod)
 	defer ticker.Stop()
@@ -113,11 +203,22 @@ func (r *Reconciler) reconcile() {
 
 	log := r.Logger
 	log.Info("reconciling load balancers")
+	lbListers, projectLister := r.Listers()
+	regions := make([]string, 0, len(lbListers))
+	for region := range lbListers {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
 	// Get all the openstack tenants that must be synced
-	projects, err := r.ProjectLister.ListProjects()
+	projects, err := projectLister.ListProjects()
 	if err != nil {
 		r.Metrics.GenericMetricError("ListProjects")
 		log.Errorf("error listing OpenStack projects: %v", err)
+		r.Health.Failed(err)
+		if r.healthChanged() {
+			r.markHealth(metav1.NamespaceAll)
+		}
 		return
 	}
 
@@ -128,29 +229,66 @@ func (r *Reconciler) reconcile() {
 		watchlist = strings.Split(openstackProjectWatchlist, ",")
 	}
 
+	// List every project before syncing any, so that the objects of all
+	// projects record the same health of the backend
+	var listings []projectListing
+	var failedProjects []string
+	var listErr error
 	for _, project := range projects {
 		projectName := project.Name
 		if !contains(watchlist, projectName) && len(watchlist) > 0 {
 			continue
 		}
-
-		// Get load balancers that are defined in the project
-		loadbalancers, err := r.ListLoadBalancers(project.ID)
+		listing, err := r.listProject(project.ID, projectName, regions, lbListers)
 		if err != nil {
-			r.Metrics.GenericMetricError("ListLoadBalancers")
-			log.Errorf("error reconciling project %q: %v", projectName, err)
+			failedProjects = append(failedProjects, projectName)
+			listErr = err
 			continue
 		}
+		listings = append(listings, listing)
+	}
 
-		totalUpstreamServices := len(loadbalancers)
-		totalInvalidServices := totalUpstreamServices - len(loadbalancers)
+	// The backend is unreachable once all of its projects fail to be listed
+	switch {
+	case len(failedProjects) == 0:
+		r.Health.Succeeded()
+	case len(listings) == 0:
+		r.Health.Failed(listErr)
+	default:
+		r.Health.PartiallyFailed(listErr)
+	}
+	healthChanged := r.healthChanged()
+	if healthChanged {
+		for _, projectName := range failedProjects {
+			r.markHealth(projectName)
+		}
+	}
 
-		// Get all pools defined in the project
-		pools, err := r.ListPools(project.ID)
-		if err != nil {
-			r.Metrics.GenericMetricError("ListPools")
-			log.Errorf("error reconciling project %q: %v", projectName, err)
-			continue
+	// The deletions of all projects go through the brake together
+	var deletions []sync.Action
+	totalDiscovered := 0
+	for _, listing := range listings {
+		projectName := listing.name
+
+		desiredSvcs, desiredEndpoints, invalid, kept := r.validate(listing.services, listing.endpoints, listing.listenerProblems)
+		r.Invalid.ReplaceNamespace(projectName, invalid)
+		for i := range desiredSvcs {
+			r.Health.Annotate(&desiredSvcs[i].ObjectMeta)
+		}
+		endpointsNames := make([]string, 0, len(desiredEndpoints))
+		for i := range desiredEndpoints {
+			ep := &desiredEndpoints[i]
+			ep.endpoints = *r.Health.ApplyPolicy(r.Prober.Apply(r.Grace.Apply(&ep.endpoints, ep.upstreamName), ep.upstreamName, nil))
+			r.Health.Annotate(&ep.endpoints.ObjectMeta)
+			endpointsNames = append(endpointsNames, ep.endpoints.Name)
+		}
+		r.Grace.RetainNamespace(projectName, endpointsNames)
+		r.Prober.RetainNamespace(projectName, endpointsNames)
+		totalInvalidServices := 0
+		for _, o := range invalid {
+			if o.Kind == validation.KindService {
+				totalInvalidServices++
+			}
 		}
 
 		// Get all services and endpoints that exist in the corresponding namespace
@@ -158,46 +296,215 @@ func (r *Reconciler) reconcile() {
 		currentServices, err := r.GimbalKubeClient.CoreV1().Services(projectName).List(metav1.ListOptions{LabelSelector: clusterLabelSelector})
 		if err != nil {
 			r.Metrics.GenericMetricError("ListServicesInNamespace")
-			log.Errorf("error listing services in namespace %q: %v", projectName, err)
+			log.WithField(util.FieldNamespace, projectName).Errorf("error listing services in namespace %q: %v", projectName, err)
 			continue
 		}
 
 		currentk8sEndpoints, err := r.GimbalKubeClient.CoreV1().Endpoints(projectName).List(metav1.ListOptions{LabelSelector: clusterLabelSelector})
 		if err != nil {
 			r.Metrics.GenericMetricError("ListEndpointsInNamespace")
-			log.Errorf("error listing endpoints in namespace:%q: %v", projectName, err)
+			log.WithField(util.FieldNamespace, projectName).Errorf("error listing endpoints in namespace %q: %v", projectName, err)
 			continue
 		}
 
+		totalDiscovered += len(currentServices.Items) + len(currentk8sEndpoints.Items)
+
+		// The existing copies of the objects that are not synced because of
+		// their problems are left as they are
+		var currentSvcs []v1.Service
+		for _, svc := range currentServices.Items {
+			if !kept[svc.Name] {
+				currentSvcs = append(currentSvcs, svc)
+			}
+		}
 		// Convert the k8s list to type []Endpoints so make comparison easier
 		currentEndpoints := []Endpoints{}
+		var currentk8sEps []v1.Endpoints
 		for _, v := range currentk8sEndpoints.Items {
-			currentEndpoints = append(currentEndpoints, Endpoints{endpoints: v, upstreamName: ""})
+			if !kept[v.Name] {
+				currentEndpoints = append(currentEndpoints, Endpoints{endpoints: v, upstreamName: ""})
+				currentk8sEps = append(currentk8sEps, v)
+			}
 		}
 
-		// Reconcile current state with desired state
-		desiredSvcs := kubeServices(r.BackendName, projectName, loadbalancers)
-		r.reconcileSvcs(desiredSvcs, currentServices.Items)
+		r.checkDrift(projectName, desiredSvcs, desiredEndpoints, currentSvcs, currentk8sEps)
 
-		desiredEndpoints := kubeEndpoints(r.BackendName, projectName, loadbalancers, pools)
-		r.reconcileEndpoints(desiredEndpoints, currentEndpoints)
+		// Reconcile current state with desired state. Existing objects are
+		// all updated when the health of the backend changed.
+		deletions = append(deletions, r.reconcileSvcs(desiredSvcs, currentSvcs, healthChanged)...)
+		deletions = append(deletions, r.reconcileEndpoints(desiredEndpoints, currentEndpoints, healthChanged)...)
 
 		// Log upstream /invalid services to prometheus
-		r.Metrics.DiscovererUpstreamServicesMetric(projectName, totalUpstreamServices)
+		r.Metrics.DiscovererUpstreamServicesMetric(projectName, listing.totalUpstreamServices)
 		r.Metrics.DiscovererInvalidServicesMetric(projectName, totalInvalidServices)
 
 		for _, ep := range desiredEndpoints {
 			totalUpstreamEndpoints := sync.SumEndpoints(&ep.endpoints)
 			r.Metrics.DiscovererUpstreamEndpointsMetric(projectName, ep.upstreamName, totalUpstreamEndpoints)
+			r.Metrics.DiscovererInvalidEndpointsMetric(projectName, ep.upstreamName, validation.CountReason(ep.problems, validation.ReasonInvalidAddress))
 		}
 	}
 
+	// The deletions are checked against the objects of every project, so
+	// none are made while a project cannot be listed. They are found again
+	// by the next cycle.
+	if len(failedProjects) > 0 {
+		if len(deletions) > 0 {
+			log.Warnf("skipping %d deletions, projects %v could not be listed", len(deletions), failedProjects)
+		}
+		deletions = nil
+	} else {
+		deletions = r.Brake.Check(totalDiscovered, deletions)
+	}
+	for _, action := range deletions {
+		r.syncqueue.Enqueue(action)
+	}
+
 	// Log to Prometheus the cycle duration
 	r.Metrics.CycleDurationMetric(time.Since(start))
 }
 
-func (r *Reconciler) reconcileSvcs(desiredSvcs, currentSvcs []v1.Service) {
+// projectListing holds the services and endpoints discovered from the load
+// balancers and pools of a project in every region
+type projectListing struct {
+	name                  string
+	services              []v1.Service
+	endpoints             []Endpoints
+	totalUpstreamServices int
+	// listenerProblems holds the problems of the unsupported listeners of
+	// each service
+	listenerProblems map[string][]validation.Problem
+}
+
+// listProject gets the load balancers and pools that are defined in the
+// project in every region. An error is returned if any region fails, so that
+// the services of that region are not deleted.
+func (r *Reconciler) listProject(projectID, projectName string, regions []string, lbListers map[string]LoadBalancerLister) (projectListing, error) {
+	log := r.Logger
+	listing := projectListing{name: projectName, listenerProblems: map[string][]validation.Problem{}}
+	for _, region := range regions {
+		lbLister := lbListers[region]
+		loadbalancers, err := lbLister.ListLoadBalancers(projectID)
+		if err != nil {
+			r.Metrics.GenericMetricError("ListLoadBalancers")
+			log.WithFields(logrus.Fields{util.FieldProject: projectName, util.FieldRegion: region}).Errorf("error reconciling project %q in region %q: %v", projectName, region, err)
+			return projectListing{}, err
+		}
+
+		// Get all pools defined in the project
+		pools, err := lbLister.ListPools(projectID)
+		if err != nil {
+			r.Metrics.GenericMetricError("ListPools")
+			log.WithFields(logrus.Fields{util.FieldProject: projectName, util.FieldRegion: region}).Errorf("error reconciling project %q in region %q: %v", projectName, region, err)
+			return projectListing{}, err
+		}
+
+		if r.Resolver != nil {
+			pools = resolveMembers(pools, r.Resolver, log)
+		}
+		pools = filterMembers(pools, r.IPFamily)
+
+		for _, lb := range loadbalancers {
+			name := r.NameTemplate.Name(r.BackendName, projectName, serviceName(lb, region))
+			for id, err := range unsupportedListeners(lb) {
+				log.WithFields(logrus.Fields{util.FieldProject: projectName, util.FieldRegion: region}).Warnf("skipping listener %q of load balancer %q in project %q: %v", id, lb.ID, projectName, err)
+				listing.listenerProblems[name] = append(listing.listenerProblems[name], validation.Problem{
+					Reason:  validation.ReasonUnsupportedListener,
+					Message: fmt.Sprintf("listener %q: %v", id, err),
+				})
+			}
+		}
+		services := kubeServices(r.BackendName, r.NameTemplate, projectName, region, loadbalancers, pools)
+		// Load balancers with L7 policies have more than one service
+		listing.totalUpstreamServices += len(services)
+		listing.services = append(listing.services, services...)
+		endpoints := kubeEndpoints(r.BackendName, r.NameTemplate, projectName, region, loadbalancers, pools)
+		setTopology(endpoints, region, pools, r.SubnetZones)
+		listing.endpoints = append(listing.endpoints, endpoints...)
+	}
+	return listing, nil
+}
+
+// healthChanged returns whether the health of the backend changed since the
+// discovered objects last recorded it
+func (r *Reconciler) healthChanged() bool {
+	state := r.Health.State()
+	if state == r.markedHealth {
+		return false
+	}
+	r.markedHealth = state
+	return true
+}
+
+// markHealth records the health of the backend on the services and endpoints
+// discovered in the namespace, or in all namespaces, whose projects could not
+// be listed. Their endpoints follow the unreachable endpoints policy.
+func (r *Reconciler) markHealth(namespace string) {
+	clusterLabelSelector := fmt.Sprintf("%s=%s", translator.GimbalLabelBackend, r.BackendName)
+	services, err := r.GimbalKubeClient.CoreV1().Services(namespace).List(metav1.ListOptions{LabelSelector: clusterLabelSelector})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListServicesInNamespace")
+		r.Logger.Errorf("error listing services in namespace %q: %v", namespace, err)
+		return
+	}
+	endpoints, err := r.GimbalKubeClient.CoreV1().Endpoints(namespace).List(metav1.ListOptions{LabelSelector: clusterLabelSelector})
+	if err != nil {
+		r.Metrics.GenericMetricError("ListEndpointsInNamespace")
+		r.Logger.Errorf("error listing endpoints in namespace %q: %v", namespace, err)
+		return
+	}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		r.Health.Annotate(&svc.ObjectMeta)
+		r.syncqueue.Enqueue(sync.UpdateServiceAction(svc))
+	}
+	for i := range endpoints.Items {
+		ep := r.Health.ApplyPolicy(&endpoints.Items[i])
+		r.Health.Annotate(&ep.ObjectMeta)
+		origin, _ := translator.GetOriginIdentity(ep.Annotations)
+		r.syncqueue.Enqueue(sync.UpdateEndpointsAction(ep, origin.Name))
+	}
+}
+
+// checkDrift records the services and endpoints of the project that differ
+// between the backend and Gimbal. If enabled, the reported objects are synced
+// again, except for deletions, which are left to the reconciliation so that
+// they go through the brake.
+func (r *Reconciler) checkDrift(projectName string, desiredSvcs []v1.Service, desiredEndpoints []Endpoints, currentSvcs []v1.Service, currentEndpoints []v1.Endpoints) {
+	desired := drift.State{Services: desiredSvcs, UpstreamNames: map[types.NamespacedName]string{}}
+	for _, ep := range desiredEndpoints {
+		desired.Endpoints = append(desired.Endpoints, ep.endpoints)
+		desired.UpstreamNames[types.NamespacedName{Namespace: ep.endpoints.Namespace, Name: ep.endpoints.Name}] = ep.upstreamName
+	}
+	current := drift.State{Services: currentSvcs, Endpoints: currentEndpoints}
+
+	reported := r.Drift.ReplaceNamespace(projectName, drift.Compare(desired, current))
+	if len(reported) == 0 {
+		return
+	}
+	r.Logger.WithField(util.FieldProject, projectName).Warnf("found %d discovered objects in project %q that differ from the backend", len(reported), projectName)
+	if r.DriftResync {
+		for _, action := range drift.Actions(reported) {
+			if !sync.IsDelete(action) {
+				r.syncqueue.Enqueue(action)
+			}
+		}
+	}
+}
+
+// reconcileSvcs syncs the services that must be added or updated, and returns
+// the deletions of the services that no longer exist in the backend. If force
+// is true, all the existing services are updated.
+func (r *Reconciler) reconcileSvcs(desiredSvcs, currentSvcs []v1.Service, force bool) []sync.Action {
 	add, up, del := diffServices(desiredSvcs, currentSvcs)
+	if force {
+		up = nil
+		for _, svc := range desiredSvcs {
+			if containsSvc(svc, currentSvcs) {
+				up = append(up, svc)
+			}
+		}
+	}
 	for _, svc := range add {
 		s := svc
 		r.syncqueue.Enqueue(sync.AddServiceAction(&s))
@@ -206,14 +513,27 @@ func (r *Reconciler) reconcileSvcs(desiredSvcs, currentSvcs []v1.Service) {
 		s := svc
 		r.syncqueue.Enqueue(sync.UpdateServiceAction(&s))
 	}
+	var deletions []sync.Action
 	for _, svc := range del {
 		s := svc
-		r.syncqueue.Enqueue(sync.DeleteServiceAction(&s))
+		deletions = append(deletions, sync.DeleteServiceAction(&s))
 	}
+	return deletions
 }
 
-func (r *Reconciler) reconcileEndpoints(desired []Endpoints, current []Endpoints) {
+// reconcileEndpoints syncs the endpoints that must be added or updated, and
+// returns the deletions of the endpoints that no longer exist in the backend.
+// If force is true, all the existing endpoints are updated.
+func (r *Reconciler) reconcileEndpoints(desired []Endpoints, current []Endpoints, force bool) []sync.Action {
 	add, up, del := diffEndpoints(desired, current)
+	if force {
+		up = nil
+		for _, ep := range desired {
+			if containsEndpoint(ep, current) {
+				up = append(up, ep)
+			}
+		}
+	}
 	for _, ep := range add {
 		e := ep
 		r.syncqueue.Enqueue(sync.AddEndpointsAction(&e.endpoints, e.upstreamName))
@@ -222,10 +542,12 @@ func (r *Reconciler) reconcileEndpoints(desired []Endpoints, current []Endpoints
 		e := ep
 		r.syncqueue.Enqueue(sync.UpdateEndpointsAction(&e.endpoints, e.upstreamName))
 	}
+	var deletions []sync.Action
 	for _, ep := range del {
 		e := ep
-		r.syncqueue.Enqueue(sync.DeleteEndpointsAction(&e.endpoints, e.upstreamName))
+		deletions = append(deletions, sync.DeleteEndpointsAction(&e.endpoints, e.upstreamName))
 	}
+	return deletions
 }
 
 func contains(s []string, e string) bool {
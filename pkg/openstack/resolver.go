@@ -0,0 +1,187 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"context"
+	"net"
+	gosync "sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/sirupsen/logrus"
+)
+
+// maxConcurrentLookups is the number of hostnames that are resolved at the
+// same time
+const maxConcurrentLookups = 8
+
+// Resolver resolves the hostname of a pool member to IP addresses
+type Resolver interface {
+	LookupIP(host string) ([]net.IP, error)
+}
+
+// CachingResolver is a Resolver that caches the addresses of each hostname
+// for a fixed TTL. If a lookup fails, the addresses that were last resolved
+// for the hostname are returned for at most MaxStale after they expired, so
+// that a short DNS outage does not remove endpoints from Gimbal. Entries that
+// are older than that are evicted, so hostnames that are no longer looked up
+// do not stay in the cache.
+type CachingResolver struct {
+	TTL      time.Duration
+	MaxStale time.Duration
+	Timeout  time.Duration
+
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now    func() time.Time
+
+	mu        gosync.Mutex
+	cache     map[string]cachedAddresses
+	lastEvict time.Time
+}
+
+type cachedAddresses struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewCachingResolver returns a resolver that uses the system DNS resolver,
+// caches the results for the given TTL and serves them for at most maxStale
+// after they expired if a lookup fails
+func NewCachingResolver(ttl, maxStale, timeout time.Duration) *CachingResolver {
+	return &CachingResolver{
+		TTL:      ttl,
+		MaxStale: maxStale,
+		Timeout:  timeout,
+		lookup:   net.DefaultResolver.LookupIPAddr,
+		now:      time.Now,
+		cache:    map[string]cachedAddresses{},
+	}
+}
+
+// LookupIP returns the IP addresses of the given host
+func (r *CachingResolver) LookupIP(host string) ([]net.IP, error) {
+	now := r.now()
+	r.mu.Lock()
+	r.evict(now)
+	cached, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	addrs, err := r.lookup(ctx, host)
+	if err != nil {
+		if ok && now.Before(cached.expires.Add(r.MaxStale)) {
+			return cached.ips, nil
+		}
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	r.mu.Lock()
+	r.cache[host] = cachedAddresses{ips: ips, expires: r.now().Add(r.TTL)}
+	r.mu.Unlock()
+	return ips, nil
+}
+
+// evict removes the entries that can no longer be served, not even as stale
+// addresses. The cache is scanned at most once per TTL. The caller must hold
+// r.mu.
+func (r *CachingResolver) evict(now time.Time) {
+	if now.Before(r.lastEvict.Add(r.TTL)) {
+		return
+	}
+	r.lastEvict = now
+	for host, cached := range r.cache {
+		if !now.Before(cached.expires.Add(r.MaxStale)) {
+			delete(r.cache, host)
+		}
+	}
+}
+
+// resolveMembers returns the pools with the members whose address is a
+// hostname replaced by one member for each IP address of the hostname.
+// Members that cannot be resolved are kept as is, and are later counted as
+// invalid endpoints. Hostnames are resolved in parallel, so that a few slow
+// lookups do not stall the reconciliation.
+func resolveMembers(ps []pools.Pool, r Resolver, log *logrus.Logger) []pools.Pool {
+	resolved := lookupHosts(ps, r, log)
+	res := make([]pools.Pool, 0, len(ps))
+	for _, p := range ps {
+		var members []pools.Member
+		for _, m := range p.Members {
+			ips, ok := resolved[m.Address]
+			if !ok {
+				members = append(members, m)
+				continue
+			}
+			for _, ip := range ips {
+				rm := m
+				rm.Address = ip.String()
+				members = append(members, rm)
+			}
+		}
+		p.Members = members
+		res = append(res, p)
+	}
+	return res
+}
+
+// lookupHosts resolves the hostnames of the pool members, with at most
+// maxConcurrentLookups lookups running at the same time. Hostnames that
+// cannot be resolved are left out of the result.
+func lookupHosts(ps []pools.Pool, r Resolver, log *logrus.Logger) map[string][]net.IP {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, p := range ps {
+		for _, m := range p.Members {
+			if m.Address == "" || net.ParseIP(m.Address) != nil || seen[m.Address] {
+				continue
+			}
+			seen[m.Address] = true
+			hosts = append(hosts, m.Address)
+		}
+	}
+
+	ips := make([][]net.IP, len(hosts))
+	errs := make([]error, len(hosts))
+	var wg gosync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentLookups)
+	for i, host := range hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host string) {
+			defer wg.Done()
+			ips[i], errs[i] = r.LookupIP(host)
+			<-sem
+		}(i, host)
+	}
+	wg.Wait()
+
+	resolved := make(map[string][]net.IP, len(hosts))
+	for i, host := range hosts {
+		if errs[i] != nil {
+			log.Warnf("error resolving member address %q: %v", host, errs[i])
+			continue
+		}
+		resolved[host] = ips[i]
+	}
+	return resolved
+}
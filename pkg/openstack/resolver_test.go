@@ -0,0 +1,130 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingResolver(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	lookups := 0
+	var lookupErr error
+	addrs := []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}
+
+	r := NewCachingResolver(time.Minute, 5*time.Minute, time.Second)
+	r.now = func() time.Time { return now }
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups++
+		return addrs, lookupErr
+	}
+
+	ips, err := r.LookupIP("backend.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ips)
+	assert.Equal(t, 1, lookups)
+
+	// Cached until the TTL expires
+	addrs = []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}}
+	ips, _ = r.LookupIP("backend.example.com")
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ips)
+	assert.Equal(t, 1, lookups)
+
+	now = now.Add(2 * time.Minute)
+	ips, _ = r.LookupIP("backend.example.com")
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.2")}, ips)
+	assert.Equal(t, 2, lookups)
+
+	// Stale addresses are returned if the lookup fails
+	now = now.Add(2 * time.Minute)
+	lookupErr = errors.New("no such host")
+	ips, err = r.LookupIP("backend.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.2")}, ips)
+
+	// Stale addresses are not returned after MaxStale
+	now = now.Add(5 * time.Minute)
+	_, err = r.LookupIP("backend.example.com")
+	assert.Error(t, err)
+
+	// Unknown hosts fail
+	_, err = r.LookupIP("unknown.example.com")
+	assert.Error(t, err)
+}
+
+func TestCachingResolverEvict(t *testing.T) {
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewCachingResolver(time.Minute, 5*time.Minute, time.Second)
+	r.now = func() time.Time { return now }
+	r.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+	}
+
+	r.LookupIP("old.example.com")
+	now = now.Add(5 * time.Minute)
+	r.LookupIP("new.example.com")
+	assert.Len(t, r.cache, 2)
+
+	// old.example.com is evicted once it can no longer be served as stale
+	now = now.Add(2 * time.Minute)
+	r.LookupIP("new.example.com")
+	assert.Len(t, r.cache, 1)
+	assert.Contains(t, r.cache, "new.example.com")
+}
+
+type fakeResolver map[string][]net.IP
+
+func (f fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	ips, ok := f[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return ips, nil
+}
+
+func TestResolveMembers(t *testing.T) {
+	r := fakeResolver{
+		"backend.example.com": {net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")},
+	}
+	ps := []pools.Pool{
+		pool("pool-1", "TCP", "lb-1",
+			poolmember("10.0.0.1", 8080),
+			poolmember("backend.example.com", 8080),
+			poolmember("unknown.example.com", 8080)),
+		pool("pool-2", "TCP", "lb-1",
+			poolmember("backend.example.com", 8443)),
+	}
+
+	got := resolveMembers(ps, r, logrus.New())
+	assert.Equal(t, []pools.Pool{
+		pool("pool-1", "TCP", "lb-1",
+			poolmember("10.0.0.1", 8080),
+			poolmember("10.0.0.2", 8080),
+			poolmember("10.0.0.3", 8080),
+			poolmember("unknown.example.com", 8080)),
+		pool("pool-2", "TCP", "lb-1",
+			poolmember("10.0.0.2", 8443),
+			poolmember("10.0.0.3", 8443)),
+	}, got)
+	// The pools that were passed in are not modified
+	assert.Equal(t, "backend.example.com", ps[0].Members[1].Address)
+}
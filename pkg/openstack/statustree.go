@@ -0,0 +1,167 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"fmt"
+	gosync "sync"
+
+	"github.com/gophercloud/gophercloud"
+	gopheropenstack "github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+)
+
+// StatusTreeLoadBalancerV2Client is a client of the OpenStack LBaaS v2 API
+// that discovers pools and members using the load balancer status tree.
+//
+// The LoadBalancerV2Client issues one request per pool to list its members.
+// This client instead issues one request per load balancer, which returns the
+// listeners, pools and members of the load balancer along with their operating
+// status.
+type StatusTreeLoadBalancerV2Client struct {
+	client *gophercloud.ServiceClient
+
+	mu gosync.Mutex
+	// pools holds the pools found in the status trees fetched by the last
+	// call to ListLoadBalancers, keyed by project ID.
+	pools map[string][]pools.Pool
+}
+
+// NewStatusTreeLoadBalancerV2 returns a client of the Load Balancer as a
+// Service v2 API that uses the load balancer status tree. The API is found in
+// the service catalog using the given endpoint options.
+func NewStatusTreeLoadBalancerV2(provider *gophercloud.ProviderClient, eo gophercloud.EndpointOpts) (*StatusTreeLoadBalancerV2Client, error) {
+	net, err := gopheropenstack.NewNetworkV2(provider, eo)
+	if err != nil {
+		return nil, err
+	}
+	return newStatusTreeLoadBalancerV2(net), nil
+}
+
+func newStatusTreeLoadBalancerV2(client *gophercloud.ServiceClient) *StatusTreeLoadBalancerV2Client {
+	return &StatusTreeLoadBalancerV2Client{client: client, pools: map[string][]pools.Pool{}}
+}
+
+// ListLoadBalancers returns the load balancers that exist in the given
+// project. The pools found in the status tree of each load balancer are kept
+// so that a subsequent call to ListPools does not have to query the API again.
+func (c *StatusTreeLoadBalancerV2Client) ListLoadBalancers(projectID string) ([]loadbalancers.LoadBalancer, error) {
+	lbs, err := listLoadBalancers(c.client, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ps []pools.Pool
+	seen := map[string]bool{}
+	for i := range lbs {
+		lb := &lbs[i]
+		res := loadbalancers.GetStatuses(c.client, lb.ID)
+		tree, err := res.Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get status tree of load balancer ID %q: %v", lb.ID, err)
+		}
+		weighted, err := weightedMembers(res.Result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get status tree of load balancer ID %q: %v", lb.ID, err)
+		}
+		if tree == nil || tree.Loadbalancer == nil {
+			continue
+		}
+		lb.OperatingStatus = tree.Loadbalancer.OperatingStatus
+		lb.Pools = nil
+		for _, l := range tree.Loadbalancer.Listeners {
+			for _, p := range l.Pools {
+				// A pool can be shared by more than one listener of the
+				// same load balancer.
+				if seen[p.ID] {
+					continue
+				}
+				seen[p.ID] = true
+				p.Loadbalancers = []pools.LoadBalancerID{{ID: lb.ID}}
+				for k := range p.Members {
+					if !weighted[p.Members[k].ID] {
+						p.Members[k].Weight = 1
+					}
+				}
+				lb.Pools = append(lb.Pools, p)
+				ps = append(ps, p)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.pools[projectID] = ps
+	c.mu.Unlock()
+
+	return lbs, nil
+}
+
+// ListPools returns all load balancer pools that are attached to a listener in
+// the given project. The pools found by the previous call to ListLoadBalancers
+// for the same project are returned if available.
+func (c *StatusTreeLoadBalancerV2Client) ListPools(projectID string) ([]pools.Pool, error) {
+	if ps, ok := c.takePools(projectID); ok {
+		return ps, nil
+	}
+	if _, err := c.ListLoadBalancers(projectID); err != nil {
+		return nil, err
+	}
+	ps, _ := c.takePools(projectID)
+	return ps, nil
+}
+
+// weightedMembers returns the IDs of the members that have a weight in the
+// status tree. Status trees usually leave out the weight of members, which
+// must not be mistaken for a weight of zero, as those members would not be
+// discovered.
+func weightedMembers(r gophercloud.Result) (map[string]bool, error) {
+	var s struct {
+		Statuses struct {
+			Loadbalancer struct {
+				Listeners []struct {
+					Pools []struct {
+						Members []struct {
+							ID     string `json:"id"`
+							Weight *int   `json:"weight"`
+						} `json:"members"`
+					} `json:"pools"`
+				} `json:"listeners"`
+			} `json:"loadbalancer"`
+		} `json:"statuses"`
+	}
+	if err := r.ExtractInto(&s); err != nil {
+		return nil, err
+	}
+	res := map[string]bool{}
+	for _, l := range s.Statuses.Loadbalancer.Listeners {
+		for _, p := range l.Pools {
+			for _, m := range p.Members {
+				if m.Weight != nil {
+					res[m.ID] = true
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// takePools removes and returns the pools kept for the given project
+func (c *StatusTreeLoadBalancerV2Client) takePools(projectID string) ([]pools.Pool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps, ok := c.pools[projectID]
+	delete(c.pools, projectID)
+	return ps, ok
+}
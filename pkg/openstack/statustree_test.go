@@ -0,0 +1,273 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLBaaS is a fake OpenStack LBaaS v2 API that serves a fixed number of
+// load balancers, each with the given number of listeners. Each listener has
+// its own pool with the given number of members, and the given number of L7
+// policies that redirect to it. The policies embed their rules, or only the
+// IDs of their rules.
+type fakeLBaaS struct {
+	numLoadBalancers, numListeners, numMembers, numL7Policies int
+	ruleIDsOnly                                               bool
+	calls                                                     int64
+}
+
+func (f *fakeLBaaS) lbID(i int) string           { return fmt.Sprintf("lb-%d", i) }
+func (f *fakeLBaaS) poolID(i, j int) string      { return fmt.Sprintf("pool-%d-%d", i, j) }
+func (f *fakeLBaaS) listenerPort(j int) int      { return 80 + j }
+func (f *fakeLBaaS) memberIP(i, j, k int) string { return fmt.Sprintf("10.%d.%d.%d", i, j, k) }
+
+func (f *fakeLBaaS) member(i, j, k int) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               fmt.Sprintf("member-%d-%d-%d", i, j, k),
+		"address":          f.memberIP(i, j, k),
+		"protocol_port":    8080,
+		"weight":           1,
+		"operating_status": "ONLINE",
+	}
+}
+
+// statusMember returns the member as found in a status tree, which has no
+// weight
+func (f *fakeLBaaS) statusMember(i, j, k int) map[string]interface{} {
+	m := f.member(i, j, k)
+	delete(m, "weight")
+	return m
+}
+
+func (f *fakeLBaaS) rule(policyID string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           "rule-" + policyID,
+		"type":         "PATH",
+		"compare_type": "STARTS_WITH",
+		"value":        "/" + policyID,
+	}
+}
+
+func (f *fakeLBaaS) members(i, j int) []map[string]interface{} {
+	var ms []map[string]interface{}
+	for k := 0; k < f.numMembers; k++ {
+		ms = append(ms, f.member(i, j, k))
+	}
+	return ms
+}
+
+func (f *fakeLBaaS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&f.calls, 1)
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2.0/lbaas/"), "/")
+	parts := strings.Split(path, "/")
+
+	var body interface{}
+	switch {
+	case path == "loadbalancers":
+		var lbs []map[string]interface{}
+		for i := 0; i < f.numLoadBalancers; i++ {
+			lbs = append(lbs, map[string]interface{}{"id": f.lbID(i), "name": f.lbID(i)})
+		}
+		body = map[string]interface{}{"loadbalancers": lbs}
+	case path == "listeners":
+		var ls []map[string]interface{}
+		for i := 0; i < f.numLoadBalancers; i++ {
+			for j := 0; j < f.numListeners; j++ {
+				ls = append(ls, map[string]interface{}{
+					"id":              fmt.Sprintf("listener-%d-%d", i, j),
+					"protocol":        "TCP",
+					"protocol_port":   f.listenerPort(j),
+					"default_pool_id": f.poolID(i, j),
+					"loadbalancers":   []map[string]string{{"id": f.lbID(i)}},
+				})
+			}
+		}
+		body = map[string]interface{}{"listeners": ls}
+	case path == "l7policies":
+		ps := []map[string]interface{}{}
+		for i := 0; i < f.numLoadBalancers; i++ {
+			for j := 0; j < f.numListeners; j++ {
+				for k := 0; k < f.numL7Policies; k++ {
+					id := fmt.Sprintf("policy-%d-%d-%d", i, j, k)
+					rule := f.rule(id)
+					if f.ruleIDsOnly {
+						rule = map[string]interface{}{"id": rule["id"]}
+					}
+					ps = append(ps, map[string]interface{}{
+						"id":               id,
+						"listener_id":      fmt.Sprintf("listener-%d-%d", i, j),
+						"action":           "REDIRECT_TO_POOL",
+						"redirect_pool_id": f.poolID(i, j),
+						"rules":            []map[string]interface{}{rule},
+					})
+				}
+			}
+		}
+		body = map[string]interface{}{"l7policies": ps}
+	case len(parts) == 3 && parts[0] == "l7policies" && parts[2] == "rules":
+		body = map[string]interface{}{"rules": []map[string]interface{}{f.rule(parts[1])}}
+	case path == "pools":
+		var ps []map[string]interface{}
+		for i := 0; i < f.numLoadBalancers; i++ {
+			for j := 0; j < f.numListeners; j++ {
+				ps = append(ps, map[string]interface{}{
+					"id":            f.poolID(i, j),
+					"protocol":      "TCP",
+					"loadbalancers": []map[string]string{{"id": f.lbID(i)}},
+				})
+			}
+		}
+		body = map[string]interface{}{"pools": ps}
+	case len(parts) == 3 && parts[0] == "pools" && parts[2] == "members":
+		var i, j int
+		fmt.Sscanf(parts[1], "pool-%d-%d", &i, &j)
+		body = map[string]interface{}{"members": f.members(i, j)}
+	case len(parts) == 3 && parts[0] == "loadbalancers" && parts[2] == "statuses":
+		var i int
+		fmt.Sscanf(parts[1], "lb-%d", &i)
+		var ls []map[string]interface{}
+		for j := 0; j < f.numListeners; j++ {
+			var ms []map[string]interface{}
+			for k := 0; k < f.numMembers; k++ {
+				ms = append(ms, f.statusMember(i, j, k))
+			}
+			ls = append(ls, map[string]interface{}{
+				"id":    fmt.Sprintf("listener-%d-%d", i, j),
+				"pools": []map[string]interface{}{{"id": f.poolID(i, j), "members": ms}},
+			})
+		}
+		body = map[string]interface{}{"statuses": map[string]interface{}{
+			"loadbalancer": map[string]interface{}{"id": f.lbID(i), "operating_status": "ONLINE", "listeners": ls},
+		}}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func fakeServiceClient(url string) *gophercloud.ServiceClient {
+	return &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{TokenID: "token"},
+		Endpoint:       url + "/",
+		ResourceBase:   url + "/v2.0/",
+	}
+}
+
+func TestStatusTreeLoadBalancerV2Client(t *testing.T) {
+	fake := &fakeLBaaS{numLoadBalancers: 3, numListeners: 2, numMembers: 3}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	perPool := LoadBalancerV2Client{fakeServiceClient(srv.URL)}
+	wantLBs, err := perPool.ListLoadBalancers("project")
+	assert.NoError(t, err)
+	wantPools, err := perPool.ListPools("project")
+	assert.NoError(t, err)
+	perPoolCalls := atomic.SwapInt64(&fake.calls, 0)
+
+	tree := newStatusTreeLoadBalancerV2(fakeServiceClient(srv.URL))
+	gotLBs, err := tree.ListLoadBalancers("project")
+	assert.NoError(t, err)
+	gotPools, err := tree.ListPools("project")
+	assert.NoError(t, err)
+	treeCalls := atomic.SwapInt64(&fake.calls, 0)
+
+	// Both clients must produce the same Kubernetes endpoints
+	want := kubeEndpoints("us-east", nil, "finance", "", wantLBs, wantPools)
+	got := kubeEndpoints("us-east", nil, "finance", "", gotLBs, gotPools)
+	assert.Equal(t, len(want), len(got))
+	for i := range want {
+		assert.Equal(t, want[i].endpoints.Name, got[i].endpoints.Name)
+		assert.NotEmpty(t, got[i].endpoints.Subsets)
+		assert.ElementsMatch(t, want[i].endpoints.Subsets, got[i].endpoints.Subsets)
+	}
+
+	// lbs + listeners + l7 policies + pools + one member list per pool
+	assert.Equal(t, int64(4+3*2), perPoolCalls)
+	// lbs + listeners + l7 policies + one status tree per load balancer
+	assert.Equal(t, int64(3+3), treeCalls)
+
+	// Pools are only kept until the next call to ListPools
+	_, err = tree.ListPools("project")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3+3), atomic.SwapInt64(&fake.calls, 0))
+}
+
+func TestListL7Policies(t *testing.T) {
+	for _, ruleIDsOnly := range []bool{false, true} {
+		fake := &fakeLBaaS{numLoadBalancers: 2, numListeners: 2, numMembers: 1, numL7Policies: 2, ruleIDsOnly: ruleIDsOnly}
+		srv := httptest.NewServer(fake)
+
+		ps, err := listL7Policies(fakeServiceClient(srv.URL), "project")
+		assert.NoError(t, err)
+		assert.Len(t, ps, 2*2*2)
+		for _, p := range ps {
+			if assert.Len(t, p.Rules, 1) {
+				assert.Equal(t, "/"+p.ID, p.Rules[0].Value)
+			}
+		}
+		calls := atomic.LoadInt64(&fake.calls)
+		srv.Close()
+
+		if ruleIDsOnly {
+			// the rules of each policy are listed
+			assert.Equal(t, int64(1+2*2*2), calls)
+		} else {
+			// the rules are embedded in the list of policies
+			assert.Equal(t, int64(1), calls)
+		}
+	}
+}
+
+func benchmarkLister(b *testing.B, newLister func(*gophercloud.ServiceClient) LoadBalancerLister) {
+	fake := &fakeLBaaS{numLoadBalancers: 50, numListeners: 2, numMembers: 5}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	lister := newLister(fakeServiceClient(srv.URL))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := lister.ListLoadBalancers("project"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := lister.ListPools("project"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&fake.calls))/float64(b.N), "calls/op")
+}
+
+func BenchmarkLoadBalancerV2Client(b *testing.B) {
+	benchmarkLister(b, func(c *gophercloud.ServiceClient) LoadBalancerLister {
+		return LoadBalancerV2Client{c}
+	})
+}
+
+func BenchmarkStatusTreeLoadBalancerV2Client(b *testing.B) {
+	benchmarkLister(b, func(c *gophercloud.ServiceClient) LoadBalancerLister {
+		return newStatusTreeLoadBalancerV2(c)
+	})
+}
@@ -14,12 +14,17 @@
 package openstack
 
 import (
+	"fmt"
+	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
 
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
@@ -28,137 +33,611 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-// returns a kubernetes service for each load balancer in the slice
-func kubeServices(backendName, tenantName string, lbs []loadbalancers.LoadBalancer) []v1.Service {
+// returns a kubernetes service for each load balancer in the slice, plus one
+// for each L7 policy that redirects requests to a pool. If a region is given,
+// the names of the services are qualified with the region. The pools are used
+// to find the target port of each service port, and the IP families of the
+// service.
+func kubeServices(backendName string, names *translator.NameTemplate, tenantName, region string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool) []v1.Service {
 	var svcs []v1.Service
 	for _, lb := range lbs {
 		svc := v1.Service{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: tenantName,
-				Name:      translator.BuildDiscoveredName(backendName, serviceName(lb)),
-				Labels:    translator.AddGimbalLabels(backendName, serviceName(lb), loadbalancerLabels(lb)),
+				Name:      names.Name(backendName, tenantName, serviceName(lb, region)),
+				Labels:    translator.AddGimbalLabels(backendName, serviceName(lb, region), loadbalancerLabels(lb, region)),
 			},
 			Spec: v1.ServiceSpec{
 				Type:      v1.ServiceTypeClusterIP,
 				ClusterIP: "None",
 			},
 		}
-		for _, l := range lb.Listeners {
-			svc.Spec.Ports = append(svc.Spec.Ports, servicePort(&l))
+		ls := supportedListeners(lb)
+		for _, l := range ls {
+			svc.Spec.Ports = append(svc.Spec.Ports, servicePort(&l, findPool(ps, l.DefaultPoolID)))
 		}
+		svc.Annotations = translator.AddIPFamilyAnnotations(appProtocolAnnotations(nil, ls...), listenerIPFamilies(ls, ps))
+		svc.Annotations = translator.AddOriginAnnotations(svc.Annotations, originIdentity(backendName, tenantName, region, lb, nil))
 		svcs = append(svcs, svc)
+
+		for _, l := range ls {
+			for _, policy := range redirectPolicies(&l) {
+				name := l7ServiceName(lb, region, policy)
+				annotations := translator.AddIPFamilyAnnotations(appProtocolAnnotations(l7PolicyAnnotations(policy), l), poolIPFamilies(&l, findPool(ps, policy.RedirectPoolID)))
+				svcs = append(svcs, v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   tenantName,
+						Name:        names.Name(backendName, tenantName, name),
+						Labels:      translator.AddGimbalLabels(backendName, name, l7PolicyLabels(lb, region, policy)),
+						Annotations: translator.AddOriginAnnotations(annotations, originIdentity(backendName, tenantName, region, lb, &policy)),
+					},
+					Spec: v1.ServiceSpec{
+						Type:      v1.ServiceTypeClusterIP,
+						ClusterIP: "None",
+						Ports:     []v1.ServicePort{servicePort(&l, findPool(ps, policy.RedirectPoolID))},
+					},
+				})
+			}
+		}
 	}
 	return svcs
 }
 
-// returns a kubernetes endpoints resource for each load balancer in the slice
-func kubeEndpoints(backendName, tenantName string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool) []Endpoints {
+// returns a kubernetes endpoints resource for each load balancer in the slice,
+// plus one for each L7 policy that redirects requests to a pool. If a region
+// is given, the names of the endpoints are qualified with the region.
+func kubeEndpoints(backendName string, names *translator.NameTemplate, tenantName, region string, lbs []loadbalancers.LoadBalancer, ps []pools.Pool) []Endpoints {
 	endpoints := []Endpoints{}
 	for _, lb := range lbs {
 		ep := v1.Endpoints{
 			ObjectMeta: metav1.ObjectMeta{
 				Namespace: tenantName,
-				Name:      translator.BuildDiscoveredName(backendName, serviceName(lb)),
-				Labels:    translator.AddGimbalLabels(backendName, serviceName(lb), loadbalancerLabels(lb)),
+				Name:      names.Name(backendName, tenantName, serviceName(lb, region)),
+				Labels:    translator.AddGimbalLabels(backendName, serviceName(lb, region), loadbalancerLabels(lb, region)),
 			},
 		}
-		for _, l := range lb.Listeners {
-			// compute endpoint susbsets for each listener
-			subsets := map[int]v1.EndpointSubset{}
+		ls := supportedListeners(lb)
+		var problems []validation.Problem
+		var members []pools.Member
+		for _, l := range ls {
+			pool := findPool(ps, l.DefaultPoolID)
+			subsets, p := endpointSubsets(&l, pool)
+			ep.Subsets = append(ep.Subsets, subsets...)
+			problems = append(problems, p...)
+			members = append(members, pool.Members...)
+		}
+		ep.Annotations = weightAnnotations(translator.AddOriginAnnotations(nil, originIdentity(backendName, tenantName, region, lb, nil)), ep.Subsets, members)
+		endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: serviceNameOriginal(lb, region), problems: problems})
 
-			// get the listeners pool
-			var pool pools.Pool
-			for _, p := range ps {
-				if l.DefaultPoolID == p.ID {
-					pool = p
-					break
+		for _, l := range ls {
+			for _, policy := range redirectPolicies(&l) {
+				name := l7ServiceName(lb, region, policy)
+				pool := findPool(ps, policy.RedirectPoolID)
+				subsets, problems := endpointSubsets(&l, pool)
+				ep := v1.Endpoints{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace:   tenantName,
+						Name:        names.Name(backendName, tenantName, name),
+						Labels:      translator.AddGimbalLabels(backendName, name, l7PolicyLabels(lb, region, policy)),
+						Annotations: weightAnnotations(translator.AddOriginAnnotations(l7PolicyAnnotations(policy), originIdentity(backendName, tenantName, region, lb, &policy)), subsets, pool.Members),
+					},
+					Subsets: subsets,
 				}
+				endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: l7ServiceNameOriginal(lb, region, policy), problems: problems})
 			}
+		}
+	}
+	return endpoints
+}
 
-			// We want to group all members that are listening on the same port
-			// into a single EndpointSubset. We achieve this by using a map of
-			// subsets, keyed by the listening port.
-			for _, member := range pool.Members {
-				s := subsets[member.ProtocolPort]
-				// Add the port if we haven't added it yet to the EndpointSubset
-				if len(s.Ports) == 0 {
-					s.Ports = append(s.Ports, v1.EndpointPort{Name: portName(&l), Port: int32(member.ProtocolPort), Protocol: v1.ProtocolTCP})
-				}
-				s.Addresses = append(s.Addresses, v1.EndpointAddress{IP: member.Address}) // TODO: can address be something other than an IP address?
-				subsets[member.ProtocolPort] = s
+// setTopology sets the locality metadata of the endpoints discovered in the
+// region. The zone of a member is the zone of its subnet, if known. Members
+// of the default region have no region.
+func setTopology(eps []Endpoints, region string, ps []pools.Pool, subnetZones map[string]string) {
+	zones := map[string]string{}
+	for _, pool := range ps {
+		for _, member := range pool.Members {
+			if zone, ok := subnetZones[member.SubnetID]; ok {
+				zones[member.Address] = zone
 			}
+		}
+	}
+	for i := range eps {
+		translator.SetTopology(&eps[i].endpoints, func(a v1.EndpointAddress) translator.Locality {
+			return translator.Locality{Region: region, Zone: zones[a.IP]}
+		})
+	}
+}
 
-			// Add the subsets to the Endpoint
-			for _, s := range subsets {
-				ep.Subsets = append(ep.Subsets, s)
+// ParseSubnetZones parses a comma separated list of subnet IDs and
+// availability zones, such as "subnet1=az1,subnet2=az2"
+func ParseSubnetZones(subnetZones string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, entry := range strings.Split(subnetZones, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid subnet zone %q: must be of the form <subnet ID>=<zone>", entry)
+		}
+		res[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return res, nil
+}
+
+// weightsAnnotation is the key of the annotation that contains the weight of
+// each endpoint, such as "10.0.0.1:8080=1,10.0.0.2:8080=3"
+const weightsAnnotation = "gimbal.projectcontour.io/weights"
+
+// weightAnnotations returns the annotations plus the weights of the members
+// that are endpoints in the subsets, if they do not all have the same weight.
+// The weight of a member that is in several pools is its first weight.
+func weightAnnotations(annotations map[string]string, subsets []v1.EndpointSubset, members []pools.Member) map[string]string {
+	memberWeights := map[string]int{}
+	for _, member := range members {
+		ip := net.ParseIP(member.Address)
+		if ip == nil {
+			continue
+		}
+		key := net.JoinHostPort(ip.String(), strconv.Itoa(member.ProtocolPort))
+		if _, ok := memberWeights[key]; !ok {
+			memberWeights[key] = member.Weight
+		}
+	}
+
+	weights := map[string]int{}
+	distinct := map[int]bool{}
+	for _, s := range subsets {
+		for _, p := range s.Ports {
+			for _, a := range s.Addresses {
+				key := net.JoinHostPort(a.IP, strconv.Itoa(int(p.Port)))
+				weights[key] = memberWeights[key]
+				distinct[memberWeights[key]] = true
 			}
 		}
-		endpoints = append(endpoints, Endpoints{endpoints: ep, upstreamName: serviceNameOriginal(lb)})
 	}
-	return endpoints
+	if len(distinct) < 2 {
+		return annotations
+	}
+
+	keys := make([]string, 0, len(weights))
+	for key := range weights {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, fmt.Sprintf("%s=%d", key, weights[key]))
+	}
+
+	res := make(map[string]string, len(annotations)+1)
+	for k, v := range annotations {
+		res[k] = v
+	}
+	res[weightsAnnotation] = strings.Join(entries, ",")
+	return res
 }
 
-func loadbalancerLabels(lb loadbalancers.LoadBalancer) map[string]string {
-	// Sanitize the load balancer name according to the kubernetes label value
-	// requirements: "Valid label values must be 63 characters or less and must
-	// be empty or begin and end with an alphanumeric character ([a-z0-9A-Z])
-	// with dashes (-), underscores (_), dots (.), and alphanumerics between."
-	name := lb.Name
-	if name != "" {
-		// 1. replace unallowed chars with a dash
-		reg := regexp.MustCompile(`[^a-zA-Z0-9\-._]`)
-		name = reg.ReplaceAllString(lb.Name, "-")
+// returns the endpoint subsets of the given pool's members, which receive
+// the traffic of the given listener, and a problem for each invalid member.
+// The endpoint ports are named after the listener port, so that they match the
+// service port. Members with an invalid port, or whose address is not an IP
+// address, are invalid and skipped. Hostnames must be resolved beforehand.
+// Members with a weight of zero are skipped.
+func endpointSubsets(l *listeners.Listener, pool pools.Pool) ([]v1.EndpointSubset, []validation.Problem) {
+	// compute endpoint susbsets for the listener
+	subsets := map[int]v1.EndpointSubset{}
+	seen := map[string]bool{}
+	var problems []validation.Problem
 
-		// 2. prepend/append a special marker if first/last char is not an alphanum
-		if !isalphanum(name[0]) {
-			name = "lb" + name
+	// We want to group all members that are listening on the same port
+	// into a single EndpointSubset. We achieve this by using a map of
+	// subsets, keyed by the listening port.
+	for _, member := range pool.Members {
+		ip := net.ParseIP(member.Address)
+		if ip == nil {
+			problems = append(problems, validation.Problem{
+				Reason:  validation.ReasonInvalidAddress,
+				Message: fmt.Sprintf("address %q of member %q of pool %q is not an IP address", member.Address, member.ID, pool.ID),
+			})
+			continue
+		}
+		if !validPort(member.ProtocolPort) {
+			problems = append(problems, validation.Problem{
+				Reason:  validation.ReasonInvalidAddress,
+				Message: fmt.Sprintf("port %d of member %q of pool %q is invalid", member.ProtocolPort, member.ID, pool.ID),
+			})
+			continue
 		}
-		if !isalphanum(name[len(name)-1]) {
-			name = name + "lb"
+		// Members drained to a weight of zero receive no new traffic
+		if member.Weight == 0 {
+			continue
 		}
-		// 3. shorten if necessary
-		name = translator.ShortenKubernetesLabelValue(name)
+		// A hostname can resolve to the address of another member
+		key := net.JoinHostPort(ip.String(), strconv.Itoa(member.ProtocolPort))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		s := subsets[member.ProtocolPort]
+		// Add the port if we haven't added it yet to the EndpointSubset
+		if len(s.Ports) == 0 {
+			s.Ports = append(s.Ports, v1.EndpointPort{Name: portName(l), Port: int32(member.ProtocolPort), Protocol: protocol(l).protocol})
+		}
+		s.Addresses = append(s.Addresses, v1.EndpointAddress{IP: ip.String()})
+		subsets[member.ProtocolPort] = s
+	}
+
+	// Sort the subsets by port so that the desired endpoints do not differ
+	// from one reconciliation to the next
+	ports := make([]int, 0, len(subsets))
+	for port := range subsets {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	var res []v1.EndpointSubset
+	for _, port := range ports {
+		res = append(res, subsets[port])
+	}
+	return res, problems
+}
+
+// returns the IP families of the members of the default pools of the
+// listeners, IPv4 first
+func listenerIPFamilies(ls []listeners.Listener, ps []pools.Pool) []translator.IPFamily {
+	var subsets []v1.EndpointSubset
+	for _, l := range ls {
+		s, _ := endpointSubsets(&l, findPool(ps, l.DefaultPoolID))
+		subsets = append(subsets, s...)
+	}
+	return translator.SubsetsIPFamilies(subsets)
+}
+
+// returns the IP families of the valid members of the pool, IPv4 first
+func poolIPFamilies(l *listeners.Listener, pool pools.Pool) []translator.IPFamily {
+	subsets, _ := endpointSubsets(l, pool)
+	return translator.SubsetsIPFamilies(subsets)
+}
+
+// returns the pools with the members whose address is an IP address of
+// another family removed. Members whose address is not an IP address are
+// kept, so that they are counted as invalid endpoints. If the family is
+// empty, the pools are returned as is.
+func filterMembers(ps []pools.Pool, family translator.IPFamily) []pools.Pool {
+	if family == "" {
+		return ps
+	}
+	res := make([]pools.Pool, 0, len(ps))
+	for _, p := range ps {
+		var members []pools.Member
+		for _, m := range p.Members {
+			if f := translator.AddressIPFamily(m.Address); f == "" || f == family {
+				members = append(members, m)
+			}
+		}
+		p.Members = members
+		res = append(res, p)
+	}
+	return res
+}
+
+// returns the member ports of the pool, without duplicates and in the order
+// they are first found. Invalid ports are skipped.
+func memberPorts(pool pools.Pool) []int {
+	var ports []int
+	seen := map[int]bool{}
+	for _, m := range pool.Members {
+		if validPort(m.ProtocolPort) && !seen[m.ProtocolPort] {
+			seen[m.ProtocolPort] = true
+			ports = append(ports, m.ProtocolPort)
+		}
+	}
+	return ports
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// listenerProtocol describes how the traffic of an OpenStack listener is
+// carried by a Kubernetes service port
+type listenerProtocol struct {
+	protocol v1.Protocol
+	// appProtocol is the application protocol spoken by the pool members
+	appProtocol string
+}
+
+// listenerProtocols maps the OpenStack listener protocols that Gimbal can
+// route to the protocol of the Kubernetes service port. TLS is terminated by
+// the load balancer of TERMINATED_HTTPS listeners, so their members speak
+// plain HTTP.
+var listenerProtocols = map[string]listenerProtocol{
+	"TCP":              {protocol: v1.ProtocolTCP},
+	"UDP":              {protocol: v1.ProtocolUDP},
+	"SCTP":             {protocol: v1.ProtocolSCTP},
+	"HTTP":             {protocol: v1.ProtocolTCP, appProtocol: "http"},
+	"HTTPS":            {protocol: v1.ProtocolTCP, appProtocol: "https"},
+	"TERMINATED_HTTPS": {protocol: v1.ProtocolTCP, appProtocol: "http"},
+}
+
+// returns the protocol of the listener, and whether Gimbal can route it
+func lookupProtocol(l *listeners.Listener) (listenerProtocol, bool) {
+	p, ok := listenerProtocols[strings.ToUpper(l.Protocol)]
+	return p, ok
+}
+
+// returns the protocol of a listener that Gimbal can route
+func protocol(l *listeners.Listener) listenerProtocol {
+	p, _ := lookupProtocol(l)
+	return p
+}
+
+// returns an error if Gimbal cannot route the traffic of the listener
+func validateListener(l *listeners.Listener) error {
+	if _, ok := lookupProtocol(l); !ok {
+		return fmt.Errorf("unsupported protocol %q", l.Protocol)
+	}
+	if !validPort(l.ProtocolPort) {
+		return fmt.Errorf("invalid port %d", l.ProtocolPort)
+	}
+	return nil
+}
+
+// returns the listeners of the load balancer that Gimbal can route
+func supportedListeners(lb loadbalancers.LoadBalancer) []listeners.Listener {
+	var res []listeners.Listener
+	for _, l := range lb.Listeners {
+		if validateListener(&l) == nil {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// returns the listeners of the load balancer that Gimbal cannot route, keyed
+// by listener ID. These listeners are not discovered.
+func unsupportedListeners(lb loadbalancers.LoadBalancer) map[string]error {
+	res := map[string]error{}
+	for _, l := range lb.Listeners {
+		if err := validateListener(&l); err != nil {
+			res[l.ID] = err
+		}
+	}
+	return res
+}
+
+// returns the annotations with the application protocol of each listener
+// port added to them. The vendored Kubernetes API predates the appProtocol
+// field of service ports, so the protocols are kept in an annotation of the
+// form "port-80=http,port-443=https".
+func appProtocolAnnotations(annotations map[string]string, ls ...listeners.Listener) map[string]string {
+	var protocols []string
+	for _, l := range ls {
+		if p := protocol(&l).appProtocol; p != "" {
+			protocols = append(protocols, portName(&l)+"="+p)
+		}
+	}
+	if len(protocols) == 0 {
+		return annotations
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations["gimbal.projectcontour.io/app-protocols"] = strings.Join(protocols, ",")
+	return annotations
+}
+
+// returns the pool with the given ID, or an empty pool if it does not exist
+func findPool(ps []pools.Pool, id string) pools.Pool {
+	for _, p := range ps {
+		if p.ID == id {
+			return p
+		}
+	}
+	return pools.Pool{}
+}
+
+// returns the enabled L7 policies of the listener that redirect requests to a
+// pool. Policies that redirect to a URL or reject requests have no backends.
+func redirectPolicies(l *listeners.Listener) []l7policies.L7Policy {
+	var res []l7policies.L7Policy
+	for _, p := range l.L7Policies {
+		if p.Action == string(l7policies.ActionRedirectToPool) && p.RedirectPoolID != "" && p.AdminStateUp {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func loadbalancerLabels(lb loadbalancers.LoadBalancer, region string) map[string]string {
+	labels := map[string]string{
+		translator.GimbalLabelLoadBalancerID:   lb.ID,
+		translator.GimbalLabelLoadBalancerName: sanitizeLabelValue(lb.Name, "lb"),
+	}
+	if region != "" {
+		labels[translator.GimbalLabelRegion] = sanitizeLabelValue(region, "region")
+	}
+	return labels
+}
+
+// l7PolicyLabels returns the load balancer labels plus labels that identify
+// the L7 policy and the host and path it matches, if any.
+func l7PolicyLabels(lb loadbalancers.LoadBalancer, region string, policy l7policies.L7Policy) map[string]string {
+	labels := loadbalancerLabels(lb, region)
+	labels["gimbal.projectcontour.io/l7-policy-id"] = policy.ID
+	labels["gimbal.projectcontour.io/l7-pool-id"] = policy.RedirectPoolID
+	if host := l7RuleValue(policy, l7policies.TypeHostName); host != "" {
+		labels["gimbal.projectcontour.io/l7-host"] = sanitizeLabelValue(host, "l7")
+	}
+	if path := l7RuleValue(policy, l7policies.TypePath); path != "" {
+		labels["gimbal.projectcontour.io/l7-path"] = sanitizeLabelValue(path, "l7")
+	}
+	return labels
+}
+
+// l7PolicyAnnotations returns annotations that hold the rules of the L7 policy
+// verbatim, given that rule values are not always valid label values.
+func l7PolicyAnnotations(policy l7policies.L7Policy) map[string]string {
+	var rules []string
+	for _, r := range policy.Rules {
+		rule := r.RuleType
+		if r.Key != "" {
+			rule += " " + r.Key
+		}
+		if r.Invert {
+			rule += " NOT"
+		}
+		rules = append(rules, rule+" "+r.CompareType+" "+r.Value)
 	}
 	return map[string]string{
-		"gimbal.projectcontour.io/load-balancer-id":   lb.ID,
-		"gimbal.projectcontour.io/load-balancer-name": name,
+		"gimbal.projectcontour.io/l7-rules": strings.Join(rules, "\n"),
+	}
+}
+
+// returns the value of the first non-inverted rule of the given type
+func l7RuleValue(policy l7policies.L7Policy, ruleType l7policies.RuleType) string {
+	for _, r := range policy.Rules {
+		if r.RuleType == string(ruleType) && !r.Invert {
+			return r.Value
+		}
+	}
+	return ""
+}
+
+// invalidLabelValueChars matches the characters that are not allowed in
+// Kubernetes label values
+var invalidLabelValueChars = regexp.MustCompile(`[^a-zA-Z0-9\-._]`)
+
+// Sanitize the value according to the kubernetes label value requirements:
+// "Valid label values must be 63 characters or less and must be empty or
+// begin and end with an alphanumeric character ([a-z0-9A-Z]) with dashes (-),
+// underscores (_), dots (.), and alphanumerics between."
+func sanitizeLabelValue(value, marker string) string {
+	if value == "" {
+		return value
+	}
+	// 1. replace unallowed chars with a dash
+	value = invalidLabelValueChars.ReplaceAllString(value, "-")
+
+	// 2. prepend/append a special marker if first/last char is not an alphanum
+	if !isalphanum(value[0]) {
+		value = marker + value
+	}
+	if !isalphanum(value[len(value)-1]) {
+		value = value + marker
 	}
+	// 3. shorten if necessary
+	return translator.ShortenKubernetesLabelValue(value)
 }
 
 func isalphanum(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
 }
 
-// use the load balancer ID as the service name
+// use the load balancer ID as the service name, prefixed with the region if
+// any
 // context: heptio/gimbal #216
-func serviceName(lb loadbalancers.LoadBalancer) string {
-	return strings.ToLower(lb.ID)
+func serviceName(lb loadbalancers.LoadBalancer, region string) string {
+	return regionQualifiedName(region, strings.ToLower(lb.ID))
 }
 
-// get the lb Name or ID if name is empty
-func serviceNameOriginal(lb loadbalancers.LoadBalancer) string {
+// use the load balancer ID and the L7 policy ID as the service name of an L7
+// policy
+func l7ServiceName(lb loadbalancers.LoadBalancer, region string, policy l7policies.L7Policy) string {
+	return serviceName(lb, region) + "-" + strings.ToLower(policy.ID)
+}
+
+// get the lb Name or ID if name is empty, followed by the L7 policy name or ID
+func l7ServiceNameOriginal(lb loadbalancers.LoadBalancer, region string, policy l7policies.L7Policy) string {
+	policyName := policy.Name
+	if policy.Name == "" {
+		policyName = policy.ID
+	}
+	return serviceNameOriginal(lb, region) + "-" + strings.ToLower(policyName)
+}
+
+// returns the identity of the load balancer, or of its L7 policy if not nil
+func originIdentity(backendName, tenantName, region string, lb loadbalancers.LoadBalancer, policy *l7policies.L7Policy) translator.OriginIdentity {
+	origin := translator.OriginIdentity{
+		Backend:          backendName,
+		Namespace:        tenantName,
+		Name:             serviceName(lb, region),
+		ProjectID:        lb.TenantID,
+		Region:           region,
+		LoadBalancerID:   lb.ID,
+		LoadBalancerName: lb.Name,
+	}
+	if policy != nil {
+		origin.Name = l7ServiceName(lb, region, *policy)
+		origin.L7PolicyID = policy.ID
+	}
+	return origin
+}
+
+// get the lb Name or ID if name is empty, prefixed with the region if any
+func serviceNameOriginal(lb loadbalancers.LoadBalancer, region string) string {
 	lbName := lb.Name
 	if lb.Name == "" {
 		lbName = lb.ID
 	}
-	return strings.ToLower(lbName)
+	return regionQualifiedName(region, strings.ToLower(lbName))
+}
+
+// invalidRegionChars matches the characters of lowercased region names that
+// are not allowed in Kubernetes names
+var invalidRegionChars = regexp.MustCompile(`[^a-z0-9\-]`)
+
+// prefix the name with the region, if any. Region names are lowercased and
+// characters that are not allowed in Kubernetes names are replaced with a dash.
+func regionQualifiedName(region, name string) string {
+	if region == "" {
+		return name
+	}
+	return invalidRegionChars.ReplaceAllString(strings.ToLower(region), "-") + "-" + name
 }
 
-func servicePort(listener *listeners.Listener) v1.ServicePort {
+// returns the service port of the listener. The port is the listener port,
+// and the target port is the port of the pool members that receive the
+// traffic of the listener:
+//
+//   - If all members use the same port, the target port is that port.
+//   - If members use different ports, the target port is the name of the
+//     service port. Each endpoint port has that name, so the target port is
+//     resolved per endpoint.
+//   - If the pool has no members, the target port is the listener port.
+func servicePort(listener *listeners.Listener, pool pools.Pool) v1.ServicePort {
 	pn := portName(listener)
+	// The K8s API server sets the target port on service creation. By setting
+	// it ourselves, we prevent the discoverer from thinking it needs to
+	// perform an update every time it compares the translated object with
+	// the one that exists in gimbal.
+	targetPort := intstr.FromInt(listener.ProtocolPort)
+	switch ports := memberPorts(pool); len(ports) {
+	case 0:
+	case 1:
+		targetPort = intstr.FromInt(ports[0])
+	default:
+		targetPort = intstr.FromString(pn)
+	}
 	return v1.ServicePort{
-		Name: pn,
-		Port: int32(listener.ProtocolPort),
-		// The K8s API server sets this field on service creation. By setting
-		// this ourselves, we prevent the discoverer from thinking it needs to
-		// perform an update every time it compares the translated object with
-		// the one that exists in gimbal.
-		TargetPort: intstr.FromInt(listener.ProtocolPort),
-		Protocol:   v1.ProtocolTCP, // only support TCP
+		Name:       pn,
+		Port:       int32(listener.ProtocolPort),
+		TargetPort: targetPort,
+		Protocol:   protocol(listener).protocol,
 	}
 }
 
+// returns the name of the listener port. The protocol is appended to the
+// name of non-TCP ports, given that a load balancer can have a TCP and a UDP
+// listener on the same port.
 func portName(listener *listeners.Listener) string {
-	p := strconv.Itoa(listener.ProtocolPort)
-	return "port-" + p
+	p := "port-" + strconv.Itoa(listener.ProtocolPort)
+	if proto := protocol(listener).protocol; proto != v1.ProtocolTCP {
+		p += "-" + strings.ToLower(string(proto))
+	}
+	return p
 }
@@ -14,13 +14,17 @@
 package openstack
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/l7policies"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/listeners"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
 	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/projectcontour/gimbal/pkg/validation"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -418,7 +422,10 @@ func TestKubeServices(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			got := kubeServices(tc.backendName, tc.tenantName, tc.lbs)
+			got := kubeServices(tc.backendName, nil, tc.tenantName, "", tc.lbs, nil)
+			for i := range got {
+				got[i].Annotations = withoutOriginAnnotations(got[i].Annotations)
+			}
 			assert.Equal(t, tc.expected, got)
 			assert.Len(t, got, len(tc.lbs))
 		})
@@ -528,14 +535,14 @@ func TestKubeEndpoints(t *testing.T) {
 						"gimbal.projectcontour.io/load-balancer-id":   "5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
 						"gimbal.projectcontour.io/load-balancer-name": "stocks"},
 					[]v1.EndpointSubset{
-						{
-							Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.4"}},
-							Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
-						},
 						{
 							Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.3"}},
 							Ports:     []v1.EndpointPort{{Name: "port-80", Port: 80, Protocol: v1.ProtocolTCP}},
 						},
+						{
+							Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.4"}},
+							Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+						},
 						{
 							Addresses: []v1.EndpointAddress{{IP: "10.0.0.5"}, {IP: "10.0.0.6"}},
 							Ports:     []v1.EndpointPort{{Name: "port-443", Port: 443, Protocol: v1.ProtocolTCP}},
@@ -550,21 +557,362 @@ func TestKubeEndpoints(t *testing.T) {
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			gotReturn := kubeEndpoints(tc.backendName, tc.tenantName, tc.lbs, tc.pools)
-			// Cannot use assert.Equal on the structs as the order of subsets is undetermined.
-			var got []Endpoints
-			got = append(got, gotReturn...)
-
+			got := kubeEndpoints(tc.backendName, nil, tc.tenantName, "", tc.lbs, tc.pools)
+			// Subsets are sorted by port, so the same load balancers always
+			// produce the same endpoints
+			assert.Equal(t, len(tc.expected), len(got))
 			for i := range tc.expected {
 				assert.Equal(t, tc.expected[i].Namespace, got[i].endpoints.Namespace)
 				assert.Equal(t, tc.expected[i].Name, got[i].endpoints.Name)
 				assert.Equal(t, tc.expected[i].Labels, got[i].endpoints.Labels)
-				assert.ElementsMatch(t, tc.expected[i].Subsets, got[i].endpoints.Subsets)
+				assert.Equal(t, tc.expected[i].Subsets, got[i].endpoints.Subsets)
+			}
+		})
+	}
+}
+
+// withoutOriginAnnotations returns the annotations without the origin
+// annotations, or nil if there are no others
+func withoutOriginAnnotations(annotations map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, "gimbal.projectcontour.io/origin-") {
+			result[k] = v
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func TestOriginAnnotations(t *testing.T) {
+	lb := loadbalancer("5A5C3D9E-E679-43EC-B9FC-9BC51132541E", "Stocks")
+	lb.TenantID = "c2e0d4e6ba2a4a0c8e5dd3d2c5b4e5a1"
+	svcs := kubeServices("us-east", nil, "finance", "RegionOne", []loadbalancers.LoadBalancer{lb}, nil)
+	eps := kubeEndpoints("us-east", nil, "finance", "RegionOne", []loadbalancers.LoadBalancer{lb}, nil)
+	expected := translator.OriginIdentity{
+		Backend:          "us-east",
+		Namespace:        "finance",
+		Name:             "regionone-5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
+		ProjectID:        "c2e0d4e6ba2a4a0c8e5dd3d2c5b4e5a1",
+		Region:           "RegionOne",
+		LoadBalancerID:   "5A5C3D9E-E679-43EC-B9FC-9BC51132541E",
+		LoadBalancerName: "Stocks",
+	}
+	origin, ok := translator.GetOriginIdentity(svcs[0].Annotations)
+	assert.True(t, ok)
+	assert.Equal(t, expected, origin)
+	origin, ok = translator.GetOriginIdentity(eps[0].endpoints.Annotations)
+	assert.True(t, ok)
+	assert.Equal(t, expected, origin)
+}
+
+func TestKubeServicesL7Policies(t *testing.T) {
+	l := listener("ls-1", "http", "HTTP", "pool-1", 80)
+	l.L7Policies = []l7policies.L7Policy{
+		l7policy("policy-1", "pool-2", l7rule("HOST_NAME", "EQUAL_TO", "www.example.com"), l7rule("PATH", "STARTS_WITH", "/api")),
+		l7policy("policy-2", "pool-3"),
+		{ID: "policy-3", Action: "REJECT", AdminStateUp: true},
+		{ID: "policy-4", Action: "REDIRECT_TO_POOL", RedirectPoolID: "pool-4", AdminStateUp: false},
+	}
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks", l)}
+	ports := []v1.ServicePort{{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP}}
+
+	policy1 := service("finance", "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-1",
+		map[string]string{
+			"gimbal.projectcontour.io/backend":            "us-east",
+			"gimbal.projectcontour.io/service":            "5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-1",
+			"gimbal.projectcontour.io/load-balancer-id":   "5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
+			"gimbal.projectcontour.io/load-balancer-name": "stocks",
+			"gimbal.projectcontour.io/l7-policy-id":       "policy-1",
+			"gimbal.projectcontour.io/l7-pool-id":         "pool-2",
+			"gimbal.projectcontour.io/l7-host":            "www.example.com",
+			"gimbal.projectcontour.io/l7-path":            "l7-api"},
+		ports)
+	policy1.Annotations = map[string]string{
+		"gimbal.projectcontour.io/l7-rules":                  "HOST_NAME EQUAL_TO www.example.com\nPATH STARTS_WITH /api",
+		"gimbal.projectcontour.io/app-protocols":             "port-80=http",
+		"gimbal.projectcontour.io/origin-backend":            "us-east",
+		"gimbal.projectcontour.io/origin-namespace":          "finance",
+		"gimbal.projectcontour.io/origin-name":               "5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-1",
+		"gimbal.projectcontour.io/origin-load-balancer-id":   "5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
+		"gimbal.projectcontour.io/origin-load-balancer-name": "stocks",
+		"gimbal.projectcontour.io/origin-l7-policy-id":       "policy-1",
+	}
+
+	policy2 := service("finance", "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-2",
+		map[string]string{
+			"gimbal.projectcontour.io/backend":            "us-east",
+			"gimbal.projectcontour.io/service":            "5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-2",
+			"gimbal.projectcontour.io/load-balancer-id":   "5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
+			"gimbal.projectcontour.io/load-balancer-name": "stocks",
+			"gimbal.projectcontour.io/l7-policy-id":       "policy-2",
+			"gimbal.projectcontour.io/l7-pool-id":         "pool-3"},
+		ports)
+	policy2.Annotations = map[string]string{
+		"gimbal.projectcontour.io/l7-rules":                  "",
+		"gimbal.projectcontour.io/app-protocols":             "port-80=http",
+		"gimbal.projectcontour.io/origin-backend":            "us-east",
+		"gimbal.projectcontour.io/origin-namespace":          "finance",
+		"gimbal.projectcontour.io/origin-name":               "5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-2",
+		"gimbal.projectcontour.io/origin-load-balancer-id":   "5a5c3d9e-e679-43ec-b9fc-9bc51132541e",
+		"gimbal.projectcontour.io/origin-load-balancer-name": "stocks",
+		"gimbal.projectcontour.io/origin-l7-policy-id":       "policy-2",
+	}
+
+	got := kubeServices("us-east", nil, "finance", "", lbs, nil)
+	assert.Len(t, got, 3)
+	assert.Equal(t, "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e", got[0].Name)
+	assert.Equal(t, policy1, got[1])
+	assert.Equal(t, policy2, got[2])
+}
+
+func TestKubeEndpointsL7Policies(t *testing.T) {
+	l := listener("ls-1", "http", "HTTP", "pool-1", 80)
+	l.L7Policies = []l7policies.L7Policy{
+		l7policy("policy-1", "pool-2", l7rule("PATH", "STARTS_WITH", "/api")),
+		l7policy("policy-2", "pool-missing"),
+	}
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks", l)}
+	ps := []pools.Pool{
+		pool("pool-1", "HTTP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.1", 8080)),
+		pool("pool-2", "HTTP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.2", 8080), poolmember("10.0.0.3", 9090)),
+	}
+
+	got := kubeEndpoints("us-east", nil, "finance", "", lbs, ps)
+	assert.Len(t, got, 3)
+
+	assert.Equal(t, "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e", got[0].endpoints.Name)
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+		},
+	}, got[0].endpoints.Subsets)
+
+	assert.Equal(t, "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-1", got[1].endpoints.Name)
+	assert.Equal(t, "stocks-policy-1", got[1].upstreamName)
+	assert.Equal(t, "l7-api", got[1].endpoints.Labels["gimbal.projectcontour.io/l7-path"])
+	assert.ElementsMatch(t, []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+		},
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.3"}},
+			Ports:     []v1.EndpointPort{{Name: "port-80", Port: 9090, Protocol: v1.ProtocolTCP}},
+		},
+	}, got[1].endpoints.Subsets)
+
+	// a policy that redirects to an unknown pool has no endpoints
+	assert.Equal(t, "us-east-5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-2", got[2].endpoints.Name)
+	assert.Empty(t, got[2].endpoints.Subsets)
+}
+
+func TestKubeServicesRegion(t *testing.T) {
+	l := listener("ls-1", "http", "HTTP", "pool-1", 80)
+	l.L7Policies = []l7policies.L7Policy{l7policy("policy-1", "pool-2")}
+	lbs := []loadbalancers.LoadBalancer{loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks", l)}
+	ps := []pools.Pool{pool("pool-1", "HTTP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.1", 8080))}
+
+	svcs := kubeServices("openstack", nil, "finance", "RegionOne", lbs, nil)
+	assert.Len(t, svcs, 2)
+	assert.Equal(t, "openstack-regionone-5a5c3d9e-e679-43ec-b9fc-9bc51132541e", svcs[0].Name)
+	assert.Equal(t, "regionone-5a5c3d9e-e679-43ec-b9fc-9bc51132541e", svcs[0].Labels["gimbal.projectcontour.io/service"])
+	assert.Equal(t, "RegionOne", svcs[0].Labels["gimbal.projectcontour.io/region"])
+	assert.Equal(t, "regionone-5a5c3d9e-e679-43ec-b9fc-9bc51132541e-policy-1", svcs[1].Labels["gimbal.projectcontour.io/service"])
+	assert.Equal(t, "RegionOne", svcs[1].Labels["gimbal.projectcontour.io/region"])
+
+	eps := kubeEndpoints("openstack", nil, "finance", "RegionOne", lbs, ps)
+	assert.Len(t, eps, 2)
+	assert.Equal(t, svcs[0].Name, eps[0].endpoints.Name)
+	assert.Equal(t, "regionone-stocks", eps[0].upstreamName)
+	assert.Equal(t, svcs[1].Name, eps[1].endpoints.Name)
+	assert.Equal(t, "regionone-stocks-policy-1", eps[1].upstreamName)
+
+	// no region, no qualification
+	svcs = kubeServices("openstack", nil, "finance", "", lbs, nil)
+	assert.Equal(t, "openstack-5a5c3d9e-e679-43ec-b9fc-9bc51132541e", svcs[0].Name)
+	assert.NotContains(t, svcs[0].Labels, "gimbal.projectcontour.io/region")
+}
+
+func TestKubeServicesProtocols(t *testing.T) {
+	lbs := []loadbalancers.LoadBalancer{
+		loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks",
+			listener("ls-1", "dns", "TCP", "pool-1", 53),
+			listener("ls-2", "dns-udp", "UDP", "pool-2", 53),
+			listener("ls-3", "sctp", "SCTP", "pool-3", 9999),
+			listener("ls-4", "http", "HTTP", "pool-4", 80),
+			listener("ls-5", "https", "HTTPS", "pool-5", 443),
+			listener("ls-6", "terminated", "TERMINATED_HTTPS", "pool-6", 8443),
+			listener("ls-7", "unknown", "QUIC", "pool-7", 4433),
+		),
+	}
+	ps := []pools.Pool{
+		pool("pool-2", "UDP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.1", 5353)),
+		pool("pool-7", "QUIC", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.2", 4433)),
+	}
+
+	svcs := kubeServices("us-east", nil, "finance", "", lbs, nil)
+	assert.Len(t, svcs, 1)
+	assert.Equal(t, []v1.ServicePort{
+		{Name: "port-53", Port: 53, TargetPort: intstr.FromInt(53), Protocol: v1.ProtocolTCP},
+		{Name: "port-53-udp", Port: 53, TargetPort: intstr.FromInt(53), Protocol: v1.ProtocolUDP},
+		{Name: "port-9999-sctp", Port: 9999, TargetPort: intstr.FromInt(9999), Protocol: v1.ProtocolSCTP},
+		{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP},
+		{Name: "port-443", Port: 443, TargetPort: intstr.FromInt(443), Protocol: v1.ProtocolTCP},
+		{Name: "port-8443", Port: 8443, TargetPort: intstr.FromInt(8443), Protocol: v1.ProtocolTCP},
+	}, svcs[0].Spec.Ports)
+	assert.Equal(t, map[string]string{
+		"gimbal.projectcontour.io/app-protocols": "port-80=http,port-443=https,port-8443=http",
+	}, withoutOriginAnnotations(svcs[0].Annotations))
+
+	eps := kubeEndpoints("us-east", nil, "finance", "", lbs, ps)
+	assert.Len(t, eps, 1)
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "port-53-udp", Port: 5353, Protocol: v1.ProtocolUDP}},
+		},
+	}, eps[0].endpoints.Subsets)
+
+	unsupported := unsupportedListeners(lbs[0])
+	assert.Len(t, unsupported, 1)
+	assert.EqualError(t, unsupported["ls-7"], `unsupported protocol "QUIC"`)
+}
+
+func TestServicePortMapping(t *testing.T) {
+	tests := []struct {
+		name              string
+		listener          listeners.Listener
+		pool              pools.Pool
+		expectedPort      v1.ServicePort
+		expectedEndpoints []v1.EndpointSubset
+		expectedInvalid   int
+	}{
+		{
+			name:         "no members",
+			listener:     listener("ls-1", "http", "TCP", "pool-1", 80),
+			pool:         pool("pool-1", "TCP", "lb-1"),
+			expectedPort: v1.ServicePort{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP},
+		},
+		{
+			name:         "members on the listener port",
+			listener:     listener("ls-1", "http", "TCP", "pool-1", 80),
+			pool:         pool("pool-1", "TCP", "lb-1", poolmember("10.0.0.1", 80), poolmember("10.0.0.2", 80)),
+			expectedPort: v1.ServicePort{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(80), Protocol: v1.ProtocolTCP},
+			expectedEndpoints: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+					Ports:     []v1.EndpointPort{{Name: "port-80", Port: 80, Protocol: v1.ProtocolTCP}},
+				},
+			},
+		},
+		{
+			name:         "members on a different port",
+			listener:     listener("ls-1", "http", "TCP", "pool-1", 80),
+			pool:         pool("pool-1", "TCP", "lb-1", poolmember("10.0.0.1", 8080), poolmember("10.0.0.2", 8080)),
+			expectedPort: v1.ServicePort{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+			expectedEndpoints: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+					Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+				},
+			},
+		},
+		{
+			name:         "members on mixed ports",
+			listener:     listener("ls-1", "dns", "UDP", "pool-1", 53),
+			pool:         pool("pool-1", "UDP", "lb-1", poolmember("10.0.0.1", 5353), poolmember("10.0.0.2", 53), poolmember("10.0.0.3", 5353)),
+			expectedPort: v1.ServicePort{Name: "port-53-udp", Port: 53, TargetPort: intstr.FromString("port-53-udp"), Protocol: v1.ProtocolUDP},
+			expectedEndpoints: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+					Ports:     []v1.EndpointPort{{Name: "port-53-udp", Port: 53, Protocol: v1.ProtocolUDP}},
+				},
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.3"}},
+					Ports:     []v1.EndpointPort{{Name: "port-53-udp", Port: 5353, Protocol: v1.ProtocolUDP}},
+				},
+			},
+		},
+		{
+			name:         "members with invalid ports",
+			listener:     listener("ls-1", "http", "TCP", "pool-1", 80),
+			pool:         pool("pool-1", "TCP", "lb-1", poolmember("10.0.0.1", 0), poolmember("10.0.0.2", 70000), poolmember("10.0.0.3", 8080)),
+			expectedPort: v1.ServicePort{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+			expectedEndpoints: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.3"}},
+					Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+				},
+			},
+			expectedInvalid: 2,
+		},
+		{
+			name:         "members with invalid or duplicate addresses",
+			listener:     listener("ls-1", "http", "TCP", "pool-1", 80),
+			pool:         pool("pool-1", "TCP", "lb-1", poolmember("backend.example.com", 8080), poolmember("", 8080), poolmember("10.0.0.1", 8080), poolmember("10.0.0.1", 8080)),
+			expectedPort: v1.ServicePort{Name: "port-80", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+			expectedEndpoints: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+					Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+				},
+			},
+			expectedInvalid: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			port := servicePort(&tc.listener, tc.pool)
+			assert.Equal(t, tc.expectedPort, port)
+			subsets, problems := endpointSubsets(&tc.listener, tc.pool)
+			assert.Equal(t, tc.expectedEndpoints, subsets)
+			assert.Equal(t, tc.expectedInvalid, validation.CountReason(problems, validation.ReasonInvalidAddress))
+			// Every endpoint port must match the service port by name
+			for _, s := range subsets {
+				for _, p := range s.Ports {
+					assert.Equal(t, port.Name, p.Name)
+					assert.Equal(t, port.Protocol, p.Protocol)
+				}
 			}
 		})
 	}
 }
 
+func TestUnsupportedListeners(t *testing.T) {
+	lb := loadbalancer("lb-1", "stocks",
+		listener("ls-1", "http", "HTTP", "pool-1", 80),
+		listener("ls-2", "quic", "QUIC", "pool-2", 443),
+		listener("ls-3", "zero", "TCP", "pool-3", 0),
+	)
+	assert.Len(t, supportedListeners(lb), 1)
+	unsupported := unsupportedListeners(lb)
+	assert.Len(t, unsupported, 2)
+	assert.EqualError(t, unsupported["ls-2"], `unsupported protocol "QUIC"`)
+	assert.EqualError(t, unsupported["ls-3"], "invalid port 0")
+}
+
+func TestRegionQualifiedName(t *testing.T) {
+	tests := []struct {
+		region   string
+		expected string
+	}{
+		{region: "", expected: "name"},
+		{region: "us-east-1", expected: "us-east-1-name"},
+		{region: "RegionOne", expected: "regionone-name"},
+		{region: "dc1.east_2", expected: "dc1-east-2-name"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.region, func(t *testing.T) {
+			assert.Equal(t, tc.expected, regionQualifiedName(tc.region, "name"))
+		})
+	}
+}
+
 func service(namespace, name string, labels map[string]string, ports []v1.ServicePort) v1.Service {
 	return v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -619,7 +967,21 @@ func pool(id, protocol, loadBalancerID string, members ...pools.Member) pools.Po
 }
 
 func poolmember(address string, port int) pools.Member {
-	return pools.Member{Address: address, ProtocolPort: port}
+	return pools.Member{Address: address, ProtocolPort: port, Weight: 1}
+}
+
+func l7policy(id, poolID string, rules ...l7policies.Rule) l7policies.L7Policy {
+	return l7policies.L7Policy{
+		ID:             id,
+		Action:         "REDIRECT_TO_POOL",
+		RedirectPoolID: poolID,
+		AdminStateUp:   true,
+		Rules:          rules,
+	}
+}
+
+func l7rule(ruleType, compareType, value string) l7policies.Rule {
+	return l7policies.Rule{RuleType: ruleType, CompareType: compareType, Value: value}
 }
 
 func TestIsAlphanum(t *testing.T) {
@@ -637,3 +999,134 @@ func TestIsAlphanum(t *testing.T) {
 		}
 	}
 }
+
+func TestKubeServicesIPFamilies(t *testing.T) {
+	l := listener("ls-1", "http", "TCP", "pool-1", 80)
+	l.L7Policies = []l7policies.L7Policy{l7policy("policy-1", "pool-2")}
+	lbs := []loadbalancers.LoadBalancer{
+		loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks", l),
+		loadbalancer("6b6d4e0f-e679-43ec-b9fc-9bc51132541e", "empty", listener("ls-2", "http", "TCP", "pool-3", 80)),
+	}
+	ps := []pools.Pool{
+		pool("pool-1", "TCP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.1", 8080), poolmember("2001:db8::1", 8080)),
+		pool("pool-2", "TCP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("2001:0db8:0000::2", 8080)),
+	}
+
+	svcs := kubeServices("us-east", nil, "finance", "", lbs, ps)
+	assert.Len(t, svcs, 3)
+	assert.Equal(t, "IPv4,IPv6", svcs[0].Annotations["gimbal.projectcontour.io/ip-families"])
+	assert.Equal(t, "PreferDualStack", svcs[0].Annotations["gimbal.projectcontour.io/ip-family-policy"])
+	assert.Equal(t, "IPv6", svcs[1].Annotations["gimbal.projectcontour.io/ip-families"])
+	assert.Equal(t, "SingleStack", svcs[1].Annotations["gimbal.projectcontour.io/ip-family-policy"])
+	// no members, no families
+	assert.NotContains(t, svcs[2].Annotations, "gimbal.projectcontour.io/ip-families")
+
+	eps := kubeEndpoints("us-east", nil, "finance", "", lbs, ps)
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}},
+			Ports:     []v1.EndpointPort{{Name: "port-80", Port: 8080, Protocol: v1.ProtocolTCP}},
+		},
+	}, eps[0].endpoints.Subsets)
+	assert.Equal(t, "2001:db8::2", eps[1].endpoints.Subsets[0].Addresses[0].IP)
+
+	// IPv4 only
+	eps = kubeEndpoints("us-east", nil, "finance", "", lbs, filterMembers(ps, translator.IPv4))
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, eps[0].endpoints.Subsets[0].Addresses)
+	assert.Empty(t, eps[1].endpoints.Subsets)
+	svcs = kubeServices("us-east", nil, "finance", "", lbs, filterMembers(ps, translator.IPv4))
+	assert.Equal(t, "IPv4", svcs[0].Annotations["gimbal.projectcontour.io/ip-families"])
+}
+
+func TestFilterMembers(t *testing.T) {
+	ps := []pools.Pool{
+		pool("pool-1", "TCP", "lb", poolmember("10.0.0.1", 8080), poolmember("2001:db8::1", 8080), poolmember("backend.example.com", 8080)),
+	}
+	assert.Equal(t, ps, filterMembers(ps, ""))
+
+	got := filterMembers(ps, translator.IPv6)
+	assert.Equal(t, []pools.Member{poolmember("2001:db8::1", 8080), poolmember("backend.example.com", 8080)}, got[0].Members)
+	// the given pools are not modified
+	assert.Len(t, ps[0].Members, 3)
+}
+
+func TestSetTopology(t *testing.T) {
+	member1 := poolmember("10.0.0.1", 8080)
+	member1.SubnetID = "subnet-1"
+	member2 := poolmember("10.0.0.2", 8080)
+	member2.SubnetID = "subnet-2"
+	ps := []pools.Pool{pool("pool-1", "TCP", "lb", member1, member2)}
+	eps := []Endpoints{{
+		endpoints: v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "finance", Name: "kuard", Labels: map[string]string{"app": "kuard"}},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+			}},
+		},
+	}}
+
+	setTopology(eps, "dfw", ps, map[string]string{"subnet-1": "az1"})
+	assert.Equal(t, map[string]string{"app": "kuard", "gimbal.projectcontour.io/region": "dfw"}, eps[0].endpoints.Labels)
+	assert.Equal(t, "10.0.0.1=dfw/az1,10.0.0.2=dfw/", eps[0].endpoints.Annotations["gimbal.projectcontour.io/localities"])
+}
+
+func TestParseSubnetZones(t *testing.T) {
+	got, err := ParseSubnetZones("subnet-1=az1, subnet-2=az2")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"subnet-1": "az1", "subnet-2": "az2"}, got)
+
+	_, err = ParseSubnetZones("subnet-1")
+	assert.Error(t, err)
+	_, err = ParseSubnetZones("subnet-1=")
+	assert.Error(t, err)
+}
+
+func TestKubeEndpointsWeights(t *testing.T) {
+	weighted := func(address string, port, weight int) pools.Member {
+		m := poolmember(address, port)
+		m.Weight = weight
+		return m
+	}
+	tests := []struct {
+		name                string
+		members             []pools.Member
+		expectedAddresses   []v1.EndpointAddress
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:              "uniform weights",
+			members:           []pools.Member{weighted("10.0.0.1", 8080, 2), weighted("10.0.0.2", 8080, 2)},
+			expectedAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+		},
+		{
+			name:                "weighted members",
+			members:             []pools.Member{weighted("10.0.0.1", 8080, 1), weighted("2001:db8::1", 8080, 3)},
+			expectedAddresses:   []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}},
+			expectedAnnotations: map[string]string{"gimbal.projectcontour.io/weights": "10.0.0.1:8080=1,[2001:db8::1]:8080=3"},
+		},
+		{
+			name:              "zero weight member",
+			members:           []pools.Member{weighted("10.0.0.1", 8080, 1), weighted("10.0.0.2", 8080, 0)},
+			expectedAddresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+		},
+		{
+			name:    "all members drained",
+			members: []pools.Member{weighted("10.0.0.1", 8080, 0)},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lbs := []loadbalancers.LoadBalancer{loadbalancer("lb", "kuard", listener("listener", "http", "TCP", "pool", 80))}
+			ps := []pools.Pool{pool("pool", "TCP", "lb", tc.members...)}
+			got := kubeEndpoints("openstack", nil, "finance", "", lbs, ps)
+			assert.Len(t, got, 1)
+			assert.Empty(t, got[0].problems)
+			assert.Equal(t, tc.expectedAnnotations, withoutOriginAnnotations(got[0].endpoints.Annotations))
+			if tc.expectedAddresses == nil {
+				assert.Empty(t, got[0].endpoints.Subsets)
+				return
+			}
+			assert.Equal(t, tc.expectedAddresses, got[0].endpoints.Subsets[0].Addresses)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"github.com/projectcontour/gimbal/pkg/validation"
+	v1 "k8s.io/api/core/v1"
+)
+
+// validate returns the services and endpoints that can be synced, the objects
+// that have problems, and the names of the services and endpoints that are
+// not synced because of their problems. Their existing copies in Gimbal are
+// kept, so that a problem in the backend does not stop traffic to them. The
+// endpoint addresses that cannot be routed to are removed from the other
+// endpoints, and the endpoints of invalid services, such as load balancers
+// without supported listeners, are not synced. The listener problems are
+// keyed by service name.
+func (r *Reconciler) validate(svcs []v1.Service, eps []Endpoints, listenerProblems map[string][]validation.Problem) ([]v1.Service, []Endpoints, []validation.Object, map[string]bool) {
+	var invalid []validation.Object
+	kept := map[string]bool{}
+	upstreamNames := map[string]string{}
+	for _, ep := range eps {
+		upstreamNames[ep.endpoints.Name] = ep.upstreamName
+	}
+
+	var validSvcs []v1.Service
+	for _, svc := range svcs {
+		validationProblems := validation.ValidateService(&svc)
+		if len(validationProblems) > 0 {
+			r.Logger.Warnf("skipping invalid service %s/%s: %v", svc.Namespace, svc.Name, validationProblems)
+			kept[svc.Name] = true
+		} else {
+			validSvcs = append(validSvcs, svc)
+		}
+		problems := append(append([]validation.Problem{}, listenerProblems[svc.Name]...), validationProblems...)
+		if len(problems) > 0 {
+			invalid = append(invalid, validation.Object{
+				Kind:         validation.KindService,
+				Namespace:    svc.Namespace,
+				Name:         svc.Name,
+				UpstreamName: upstreamNames[svc.Name],
+				Problems:     problems,
+			})
+		}
+	}
+
+	var validEps []Endpoints
+	for _, ep := range eps {
+		valid, validationProblems := validation.ValidateEndpoints(&ep.endpoints)
+		problems := append(append([]validation.Problem{}, ep.problems...), validationProblems...)
+		if len(problems) > 0 {
+			invalid = append(invalid, validation.Object{
+				Kind:         validation.KindEndpoints,
+				Namespace:    ep.endpoints.Namespace,
+				Name:         ep.endpoints.Name,
+				UpstreamName: ep.upstreamName,
+				Problems:     problems,
+			})
+		}
+		switch {
+		case kept[ep.endpoints.Name]:
+			continue
+		case valid == nil:
+			r.Logger.Warnf("skipping invalid endpoints %s/%s: %v", ep.endpoints.Namespace, ep.endpoints.Name, problems)
+			kept[ep.endpoints.Name] = true
+			continue
+		case len(problems) > 0:
+			r.Logger.Warnf("skipping invalid addresses of endpoints %s/%s: %v", ep.endpoints.Namespace, ep.endpoints.Name, problems)
+		}
+		validEps = append(validEps, Endpoints{endpoints: *valid, upstreamName: ep.upstreamName, problems: problems})
+	}
+	return validSvcs, validEps, invalid, kept
+}
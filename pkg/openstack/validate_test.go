@@ -0,0 +1,68 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package openstack
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/loadbalancers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/lbaas_v2/pools"
+	"github.com/projectcontour/gimbal/pkg/validation"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestValidate(t *testing.T) {
+	r := &Reconciler{Logger: logrus.New()}
+	lbs := []loadbalancers.LoadBalancer{
+		loadbalancer("5a5c3d9e-e679-43ec-b9fc-9bc51132541e", "stocks",
+			listener("ls-1", "http", "HTTP", "pool-1", 80),
+			listener("ls-2", "quic", "QUIC", "pool-1", 4433),
+		),
+		// no listeners, no ports
+		loadbalancer("6b6d4e0f-e679-43ec-b9fc-9bc51132541e", "empty"),
+	}
+	ps := []pools.Pool{
+		pool("pool-1", "HTTP", "5a5c3d9e-e679-43ec-b9fc-9bc51132541e", poolmember("10.0.0.1", 8080), poolmember("127.0.0.1", 8080), poolmember("backend.example.com", 8080)),
+	}
+	svcs := kubeServices("us-east", nil, "finance", "", lbs, ps)
+	eps := kubeEndpoints("us-east", nil, "finance", "", lbs, ps)
+	listenerProblems := map[string][]validation.Problem{
+		svcs[0].Name: {{Reason: validation.ReasonUnsupportedListener, Message: `listener "ls-2": unsupported protocol "QUIC"`}},
+	}
+
+	validSvcs, validEps, invalid, kept := r.validate(svcs, eps, listenerProblems)
+
+	// the load balancer without listeners is not synced, and neither are its
+	// empty endpoints
+	assert.Len(t, validSvcs, 1)
+	assert.Equal(t, svcs[0].Name, validSvcs[0].Name)
+	assert.Len(t, validEps, 1)
+	assert.Equal(t, []v1.EndpointAddress{{IP: "10.0.0.1"}}, validEps[0].endpoints.Subsets[0].Addresses)
+	assert.Equal(t, 2, validation.CountReason(validEps[0].problems, validation.ReasonInvalidAddress))
+	// their existing copies are kept
+	assert.Equal(t, map[string]bool{svcs[1].Name: true}, kept)
+
+	assert.Len(t, invalid, 3)
+	assert.Equal(t, validation.KindService, invalid[0].Kind)
+	assert.Equal(t, "stocks", invalid[0].UpstreamName)
+	assert.Equal(t, listenerProblems[svcs[0].Name], invalid[0].Problems)
+	assert.Equal(t, validation.KindService, invalid[1].Kind)
+	assert.Equal(t, "empty", invalid[1].UpstreamName)
+	assert.Equal(t, []validation.Problem{{Reason: validation.ReasonNoPorts, Message: "service has no ports"}}, invalid[1].Problems)
+	assert.Equal(t, validation.KindEndpoints, invalid[2].Kind)
+	assert.Equal(t, "stocks", invalid[2].UpstreamName)
+}
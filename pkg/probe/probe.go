@@ -0,0 +1,444 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package probe checks that the addresses of discovered endpoints can be
+// reached from Gimbal, and marks the ones that cannot as not ready.
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// GimbalAnnotationProbe is the key of the service annotation that holds
+	// the type of the probe of the addresses of its endpoints: none, tcp or
+	// http
+	GimbalAnnotationProbe = "gimbal.projectcontour.io/probe"
+	// GimbalAnnotationProbePort is the key of the service annotation that
+	// holds the name or number of the port that is probed. The first TCP
+	// port of each subset is probed by default.
+	GimbalAnnotationProbePort = "gimbal.projectcontour.io/probe-port"
+	// GimbalAnnotationProbePath is the key of the service annotation that
+	// holds the path of HTTP probes
+	GimbalAnnotationProbePath = "gimbal.projectcontour.io/probe-path"
+)
+
+// maxConcurrentProbes is the number of probes that run at the same time
+const maxConcurrentProbes = 32
+
+// Type is the type of a probe
+type Type string
+
+const (
+	// TypeNone does not probe addresses
+	TypeNone Type = "none"
+	// TypeTCP checks that a TCP connection can be opened to addresses
+	TypeTCP Type = "tcp"
+	// TypeHTTP checks that an HTTP GET of addresses returns a 2xx or 3xx
+	// status
+	TypeHTTP Type = "http"
+)
+
+// ParseType parses the type of a probe
+func ParseType(s string) (Type, error) {
+	switch t := Type(s); t {
+	case TypeNone, TypeTCP, TypeHTTP:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown probe %q, must be one of %s, %s or %s", s, TypeNone, TypeTCP, TypeHTTP)
+}
+
+// Config is the probe of the addresses of the endpoints of a service
+type Config struct {
+	Type Type
+	// Port is the name or number of the port that is probed. If empty, the
+	// first TCP port of each subset is probed.
+	Port string
+	// Path is the path of HTTP probes
+	Path string
+}
+
+// ParseConfig returns the probe configured by the annotations of a service,
+// which override the given defaults
+func ParseConfig(annotations map[string]string, defaults Config) (Config, error) {
+	config := defaults
+	if s, ok := annotations[GimbalAnnotationProbe]; ok {
+		t, err := ParseType(s)
+		if err != nil {
+			return Config{}, err
+		}
+		config.Type = t
+	}
+	if s, ok := annotations[GimbalAnnotationProbePort]; ok {
+		if s == "" {
+			return Config{}, fmt.Errorf("empty probe port")
+		}
+		if n, err := strconv.Atoi(s); err == nil && (n < 1 || n > 65535) {
+			return Config{}, fmt.Errorf("invalid probe port %d, must be between 1 and 65535", n)
+		}
+		config.Port = s
+	}
+	if s, ok := annotations[GimbalAnnotationProbePath]; ok {
+		if !strings.HasPrefix(s, "/") {
+			return Config{}, fmt.Errorf("invalid probe path %q, must start with /", s)
+		}
+		config.Path = s
+	}
+	if config.Type == "" {
+		config.Type = TypeNone
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	return config, nil
+}
+
+// ParseDefault parses the probe of the services that are not annotated
+func ParseDefault(probeType, path string) (Config, error) {
+	return ParseConfig(map[string]string{GimbalAnnotationProbe: probeType, GimbalAnnotationProbePath: path}, Config{})
+}
+
+// port returns the port of a subset with the given ports that is probed
+func (c Config) port(ports []v1.EndpointPort) (int, bool) {
+	if n, err := strconv.Atoi(c.Port); err == nil {
+		return n, true
+	}
+	for _, p := range ports {
+		if p.Protocol != "" && p.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		if c.Port == "" || c.Port == p.Name {
+			return int(p.Port), true
+		}
+	}
+	return 0, false
+}
+
+// target is the probe of an address
+type target struct {
+	kind Type
+	host string
+	path string
+}
+
+// targetOf returns the target of the probe of an address on a port
+func (c Config) targetOf(ip string, port int) target {
+	t := target{kind: c.Type, host: net.JoinHostPort(ip, strconv.Itoa(port))}
+	if c.Type == TypeHTTP {
+		t.path = c.Path
+	}
+	return t
+}
+
+type result struct {
+	// failures is the number of consecutive failed probes
+	failures int
+	failing  bool
+}
+
+// probed holds the probed addresses of endpoints
+type probed struct {
+	upstreamName string
+	config       Config
+	targets      map[target]bool
+}
+
+// Prober probes the ready addresses of discovered endpoints every interval,
+// and moves the addresses that fail their probe several times in a row to
+// the not ready addresses. An address is ready again once it passes its
+// probe.
+type Prober struct {
+	// Interval is the time between probes. If zero, addresses are not
+	// probed.
+	Interval time.Duration
+	// Timeout is the time after which a probe fails
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed probes after
+	// which an address is not ready
+	FailureThreshold int
+	// Default is the probe of the services that are not annotated
+	Default Config
+
+	mu gosync.Mutex
+	// probed holds the probed addresses of each endpoints
+	probed map[types.NamespacedName]probed
+	// results holds the results of the probes of every address
+	results map[target]*result
+	// resync, if not nil, is called with the namespace and upstream name of
+	// endpoints once one of their addresses starts or stops failing
+	resync    func(namespace, upstreamName string)
+	transport *http.Transport
+	logger    *logrus.Logger
+	metrics   localmetrics.DiscovererMetrics
+}
+
+// NewProber returns a prober that does not probe addresses until its interval
+// is set. If resync is not nil, it is called when the result of a probe
+// changes, so that the endpoints are synced again.
+func NewProber(resync func(namespace, upstreamName string), logger *logrus.Logger, metrics localmetrics.DiscovererMetrics) *Prober {
+	return &Prober{
+		Timeout:          2 * time.Second,
+		FailureThreshold: 3,
+		Default:          Config{Type: TypeNone, Path: "/"},
+		probed:           map[types.NamespacedName]probed{},
+		results:          map[target]*result{},
+		resync:           resync,
+		transport:        &http.Transport{DisableKeepAlives: true},
+		logger:           logger,
+		metrics:          metrics,
+	}
+}
+
+// Apply records the ready addresses of the endpoints that are about to be
+// synced, which are probed with the probe configured by the annotations of
+// their service. It returns the endpoints with the addresses that fail their
+// probe moved to the not ready addresses.
+func (p *Prober) Apply(ep *v1.Endpoints, upstreamName string, annotations map[string]string) *v1.Endpoints {
+	if p.Interval <= 0 {
+		return ep
+	}
+	key := types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}
+	config, err := ParseConfig(annotations, p.Default)
+	if err != nil {
+		p.logger.Warnf("not probing endpoints %s/%s: %v", ep.Namespace, ep.Name, err)
+		config = Config{Type: TypeNone}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	targets := map[target]bool{}
+	if config.Type != TypeNone {
+		for _, s := range ep.Subsets {
+			port, ok := config.port(s.Ports)
+			if !ok {
+				continue
+			}
+			for _, a := range s.Addresses {
+				targets[config.targetOf(a.IP, port)] = true
+			}
+		}
+	}
+	if len(targets) == 0 {
+		p.forget(key)
+		return ep
+	}
+	p.probed[key] = probed{upstreamName: upstreamName, config: config, targets: targets}
+	for t := range targets {
+		if _, ok := p.results[t]; !ok {
+			p.results[t] = &result{}
+		}
+	}
+	res, failing := p.withProbes(key, ep)
+	p.metrics.ProbeFailingAddressesMetric(ep.Namespace, ep.Name, failing)
+	return res
+}
+
+// WithProbes returns the endpoints with the addresses that fail their probe
+// moved to the not ready addresses, without recording their addresses
+func (p *Prober) WithProbes(ep *v1.Endpoints) *v1.Endpoints {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, _ := p.withProbes(types.NamespacedName{Namespace: ep.Namespace, Name: ep.Name}, ep)
+	return res
+}
+
+// withProbes returns a copy of the endpoints with the addresses that fail
+// their probe moved to the not ready addresses, and the number of these
+// addresses
+func (p *Prober) withProbes(key types.NamespacedName, ep *v1.Endpoints) (*v1.Endpoints, int) {
+	pr, ok := p.probed[key]
+	if !ok {
+		return ep, 0
+	}
+	var res *v1.Endpoints
+	failing := 0
+	for i, s := range ep.Subsets {
+		port, ok := pr.config.port(s.Ports)
+		if !ok {
+			continue
+		}
+		var ready []v1.EndpointAddress
+		var notReady []v1.EndpointAddress
+		for _, a := range s.Addresses {
+			if r, ok := p.results[pr.config.targetOf(a.IP, port)]; ok && r.failing {
+				notReady = append(notReady, a)
+			} else {
+				ready = append(ready, a)
+			}
+		}
+		if len(notReady) == 0 {
+			continue
+		}
+		if res == nil {
+			res = ep.DeepCopy()
+		}
+		failing += len(notReady)
+		res.Subsets[i].Addresses = ready
+		res.Subsets[i].NotReadyAddresses = append(res.Subsets[i].NotReadyAddresses, notReady...)
+	}
+	if res == nil {
+		return ep, 0
+	}
+	return res, failing
+}
+
+// Forget drops the addresses of endpoints that are deleted
+func (p *Prober) Forget(namespace, name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forget(types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// RetainNamespace drops the addresses of the endpoints of the namespace that
+// are not named
+func (p *Prober) RetainNamespace(namespace string, names []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	retained := map[string]bool{}
+	for _, name := range names {
+		retained[name] = true
+	}
+	for key := range p.probed {
+		if key.Namespace == namespace && !retained[key.Name] {
+			p.forget(key)
+		}
+	}
+}
+
+func (p *Prober) forget(key types.NamespacedName) {
+	if _, ok := p.probed[key]; ok {
+		p.metrics.ProbeFailingAddressesMetric(key.Namespace, key.Name, 0)
+	}
+	delete(p.probed, key)
+}
+
+// Run probes the addresses every interval until the stop channel is closed
+func (p *Prober) Run(stop <-chan struct{}) {
+	wait.Until(p.probeAll, p.Interval, stop)
+}
+
+// probeAll probes every address once, and syncs again the endpoints whose
+// addresses started or stopped failing
+func (p *Prober) probeAll() {
+	p.mu.Lock()
+	referenced := map[target]bool{}
+	for _, pr := range p.probed {
+		for t := range pr.targets {
+			referenced[t] = true
+		}
+	}
+	targets := make([]target, 0, len(referenced))
+	for t := range p.results {
+		if !referenced[t] {
+			delete(p.results, t)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	p.mu.Unlock()
+
+	errs := make([]error, len(targets))
+	var wg gosync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentProbes)
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t target) {
+			defer wg.Done()
+			errs[i] = p.check(t)
+			<-sem
+		}(i, t)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	changed := map[target]bool{}
+	for i, t := range targets {
+		r, ok := p.results[t]
+		if !ok {
+			continue
+		}
+		if errs[i] == nil {
+			r.failures = 0
+			if r.failing {
+				r.failing = false
+				changed[t] = true
+				p.logger.Infof("address %s passes its %s probe again", t.host, t.kind)
+			}
+			continue
+		}
+		r.failures++
+		if !r.failing && r.failures >= p.FailureThreshold {
+			r.failing = true
+			changed[t] = true
+			p.logger.Warnf("address %s failed its %s probe %d times, marking it not ready: %v", t.host, t.kind, r.failures, errs[i])
+		}
+	}
+	var resync []types.NamespacedName
+	for key, pr := range p.probed {
+		for t := range pr.targets {
+			if changed[t] {
+				resync = append(resync, types.NamespacedName{Namespace: key.Namespace, Name: pr.upstreamName})
+				break
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if p.resync != nil {
+		for _, key := range resync {
+			p.resync(key.Namespace, key.Name)
+		}
+	}
+}
+
+// check probes an address
+func (p *Prober) check(t target) error {
+	switch t.kind {
+	case TypeTCP:
+		conn, err := net.DialTimeout("tcp", t.host, p.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case TypeHTTP:
+		client := &http.Client{
+			Transport: p.transport,
+			Timeout:   p.Timeout,
+			// Redirects are not followed, since they may point
+			// elsewhere
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		resp, err := client.Get("http://" + t.host + t.path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("GET %s returned %s", t.path, resp.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/metrics/metricstest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseConfig(t *testing.T) {
+	defaults := Config{Type: TypeTCP, Path: "/"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    Config
+		err         bool
+	}{
+		{name: "defaults", expected: Config{Type: TypeTCP, Path: "/"}},
+		{
+			name:        "http",
+			annotations: map[string]string{GimbalAnnotationProbe: "http", GimbalAnnotationProbePort: "admin", GimbalAnnotationProbePath: "/healthz"},
+			expected:    Config{Type: TypeHTTP, Port: "admin", Path: "/healthz"},
+		},
+		{name: "none", annotations: map[string]string{GimbalAnnotationProbe: "none"}, expected: Config{Type: TypeNone, Path: "/"}},
+		{name: "unknown type", annotations: map[string]string{GimbalAnnotationProbe: "icmp"}, err: true},
+		{name: "invalid port", annotations: map[string]string{GimbalAnnotationProbePort: "70000"}, err: true},
+		{name: "invalid path", annotations: map[string]string{GimbalAnnotationProbePath: "healthz"}, err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := ParseConfig(tc.annotations, defaults)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, config)
+		})
+	}
+}
+
+// hostPort returns the IP and port of the address
+func hostPort(t *testing.T, address string) (string, int32) {
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	n, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return host, int32(n)
+}
+
+// closedPort returns the address of a port where nothing listens
+func closedPort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l.Close()
+	return l.Addr().String()
+}
+
+func endpoints(ip string, port int32, notReady ...string) *v1.Endpoints {
+	s := v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{IP: ip}},
+		Ports:     []v1.EndpointPort{{Name: "http", Port: port, Protocol: v1.ProtocolTCP}},
+	}
+	for _, ip := range notReady {
+		s.NotReadyAddresses = append(s.NotReadyAddresses, v1.EndpointAddress{IP: ip})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "us-east-a"},
+		Subsets:    []v1.EndpointSubset{s},
+	}
+}
+
+func newTestProber(resync func(namespace, upstreamName string)) *Prober {
+	p := NewProber(resync, logrus.New(), metricstest.NewMetrics())
+	p.Interval = time.Minute
+	p.Timeout = time.Second
+	p.FailureThreshold = 2
+	p.Default = Config{Type: TypeTCP, Path: "/"}
+	return p
+}
+
+func TestApply(t *testing.T) {
+	var resynced []string
+	p := newTestProber(func(namespace, upstreamName string) { resynced = append(resynced, namespace+"/"+upstreamName) })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	ip, port := hostPort(t, server.Listener.Addr().String())
+	up := endpoints(ip, port)
+	assert.Equal(t, up, p.Apply(up, "a", nil))
+	p.probeAll()
+	assert.Equal(t, up, p.Apply(up, "a", nil))
+
+	closedIP, closedPort := hostPort(t, closedPort(t))
+	down := endpoints(closedIP, closedPort)
+	assert.Equal(t, down, p.Apply(down, "a", nil))
+
+	// Addresses are not ready once they fail the threshold
+	p.probeAll()
+	assert.Equal(t, down, p.Apply(down, "a", nil))
+	assert.Empty(t, resynced)
+	p.probeAll()
+	notReady := endpoints(closedIP, closedPort, closedIP)
+	notReady.Subsets[0].Addresses = nil
+	assert.Equal(t, notReady, p.Apply(down, "a", nil))
+	assert.Equal(t, notReady, p.WithProbes(down))
+	assert.Equal(t, []string{"team1/a"}, resynced)
+	assert.Len(t, down.Subsets[0].Addresses, 1)
+
+	// Addresses are not probed once their service disables the probe
+	disabled := map[string]string{GimbalAnnotationProbe: "none"}
+	assert.Equal(t, down, p.Apply(down, "a", disabled))
+	assert.Equal(t, down, p.WithProbes(down))
+
+	// Addresses are ready again once they pass their probe
+	assert.Equal(t, up, p.Apply(up, "a", map[string]string{GimbalAnnotationProbe: "http", GimbalAnnotationProbePath: "/healthz"}))
+	p.probeAll()
+	assert.Equal(t, up, p.Apply(up, "a", nil))
+
+	p.Forget("team1", "us-east-a")
+	assert.Empty(t, p.probed)
+	p.probeAll()
+	assert.Empty(t, p.results)
+}
+
+func TestApplyHTTP(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	ip, port := hostPort(t, server.Listener.Addr().String())
+	ep := endpoints(ip, port)
+	notReady := endpoints(ip, port, ip)
+	notReady.Subsets[0].Addresses = nil
+	annotations := map[string]string{GimbalAnnotationProbe: "http", GimbalAnnotationProbePort: "http", GimbalAnnotationProbePath: "/healthz"}
+
+	p := newTestProber(nil)
+	p.FailureThreshold = 1
+	p.Apply(ep, "a", annotations)
+	p.probeAll()
+	assert.Equal(t, ep, p.Apply(ep, "a", annotations))
+
+	status = http.StatusServiceUnavailable
+	p.probeAll()
+	assert.Equal(t, notReady, p.Apply(ep, "a", annotations))
+
+	// Redirects pass
+	status = http.StatusFound
+	p.probeAll()
+	assert.Equal(t, ep, p.Apply(ep, "a", annotations))
+}
+
+func TestApplyDisabled(t *testing.T) {
+	p := newTestProber(nil)
+	p.Interval = 0
+	closedIP, closedPort := hostPort(t, closedPort(t))
+	down := endpoints(closedIP, closedPort)
+	p.Apply(down, "a", nil)
+	assert.Empty(t, p.probed)
+}
+
+func TestRetainNamespace(t *testing.T) {
+	p := newTestProber(nil)
+	a := endpoints("10.0.0.1", 80)
+	b := endpoints("10.0.0.2", 80)
+	b.Name = "us-east-b"
+	p.Apply(a, "a", nil)
+	p.Apply(b, "b", nil)
+	p.RetainNamespace("team1", []string{"us-east-b"})
+	assert.Len(t, p.probed, 1)
+	for key := range p.probed {
+		assert.Equal(t, "us-east-b", key.Name)
+	}
+}
+
+func TestParseDefault(t *testing.T) {
+	config, err := ParseDefault("http", "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Type: TypeHTTP, Path: "/healthz"}, config)
+	_, err = ParseDefault("icmp", "/")
+	assert.Error(t, err)
+	_, err = ParseDefault("http", "healthz")
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package reload watches credential files, such as the ones mounted from a
+// Kubernetes Secret, and notifies the discoverers when they change.
+package reload
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// Watcher polls a set of files and calls Reload when the content of any of
+// them changes. Files are compared by content instead of modification time,
+// given that Kubernetes updates mounted Secrets by swapping symlinks.
+type Watcher struct {
+	Files    []string
+	Interval time.Duration
+	// Reload is called when the files change. If it returns an error, it is
+	// called again on the next interval until it succeeds.
+	Reload  func() error
+	Logger  *logrus.Logger
+	Metrics localmetrics.DiscovererMetrics
+
+	hashes [][sha256.Size]byte
+}
+
+// NewWatcher returns a Watcher for the given files
+func NewWatcher(files []string, interval time.Duration, reload func() error, log *logrus.Logger, metrics localmetrics.DiscovererMetrics) *Watcher {
+	return &Watcher{
+		Files:    files,
+		Interval: interval,
+		Reload:   reload,
+		Logger:   log,
+		Metrics:  metrics,
+	}
+}
+
+// Run polls the files until the stop channel is closed
+func (w *Watcher) Run(stop <-chan struct{}) {
+	var err error
+	w.hashes, err = w.hash()
+	if err != nil {
+		w.Logger.Errorf("error reading credential files: %v", err)
+	}
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the credentials if the files changed since the last
+// successful reload
+func (w *Watcher) check() {
+	hashes, err := w.hash()
+	if err != nil {
+		// The files may be in the middle of being updated
+		w.Logger.Debugf("error reading credential files: %v", err)
+		return
+	}
+	if reflect.DeepEqual(hashes, w.hashes) {
+		return
+	}
+
+	w.Logger.Infof("Credential files %v changed, reloading credentials", w.Files)
+	if err := w.Reload(); err != nil {
+		w.Logger.Errorf("error reloading credentials: %v", err)
+		w.Metrics.CredentialsReloadMetric(false)
+		return
+	}
+	w.hashes = hashes
+	w.Logger.Info("Successfully reloaded credentials")
+	w.Metrics.CredentialsReloadMetric(true)
+}
+
+func (w *Watcher) hash() ([][sha256.Size]byte, error) {
+	var hashes [][sha256.Size]byte
+	for _, f := range w.Files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, sha256.Sum256(data))
+	}
+	return hashes, nil
+}
@@ -0,0 +1,102 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reload
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gimbal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "clouds.yaml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("password: one")
+
+	metrics := localmetrics.NewMetrics("openstack", "backend")
+	metrics.RegisterPrometheus(false)
+	reloads := 0
+	var reloadErr error
+	w := NewWatcher([]string{file}, time.Second, func() error {
+		reloads++
+		return reloadErr
+	}, logrus.New(), metrics)
+
+	w.hashes, err = w.hash()
+	assert.NoError(t, err)
+
+	// Unchanged files are not reloaded
+	w.check()
+	assert.Equal(t, 0, reloads)
+
+	write("password: two")
+	w.check()
+	assert.Equal(t, 1, reloads)
+	w.check()
+	assert.Equal(t, 1, reloads)
+
+	// Failed reloads are retried until they succeed
+	reloadErr = errors.New("invalid credentials")
+	write("password: three")
+	w.check()
+	w.check()
+	assert.Equal(t, 3, reloads)
+	reloadErr = nil
+	w.check()
+	w.check()
+	assert.Equal(t, 4, reloads)
+
+	// Files that cannot be read are ignored until they are available again
+	os.Remove(file)
+	w.check()
+	assert.Equal(t, 4, reloads)
+	write("password: three")
+	w.check()
+	assert.Equal(t, 4, reloads)
+
+	gathering, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]float64{}
+	for _, mf := range gathering {
+		if mf.GetName() != localmetrics.DiscovererCredentialsReloadTotal {
+			continue
+		}
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "result" {
+					results[l.GetValue()] = m.Counter.GetValue()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]float64{"success": 2, "failure": 2}, results)
+}
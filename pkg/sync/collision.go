@@ -0,0 +1,54 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"fmt"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CollisionError is returned when an object is not written because an object
+// with the same name, but from a different origin, exists in Gimbal. Writing
+// it would overwrite or delete an object discovered from another backend or
+// upstream object, so the action is not retried.
+type CollisionError struct {
+	Kind           string
+	Namespace      string
+	Name           string
+	Origin         string
+	ExistingOrigin string
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%s '%s/%s' from %q collides with the existing %s from %q", e.Kind, e.Namespace, e.Name, e.Origin, e.Kind, e.ExistingOrigin)
+}
+
+// checkOrigin returns a CollisionError if the existing object does not come
+// from the same origin as the desired one
+func checkOrigin(kind string, existing, desired *metav1.ObjectMeta) error {
+	origin := translator.Origin(desired.Labels)
+	existingOrigin := translator.Origin(existing.Labels)
+	if origin == existingOrigin {
+		return nil
+	}
+	return &CollisionError{
+		Kind:           kind,
+		Namespace:      desired.Namespace,
+		Name:           desired.Name,
+		Origin:         origin,
+		ExistingOrigin: existingOrigin,
+	}
+}
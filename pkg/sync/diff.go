@@ -0,0 +1,255 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ServiceDiff returns the fields of the current service that differ from the
+// desired one. The annotations that are set when the service is written, such
+// as the last sync time, are not compared, and defaults that the API server
+// sets are applied to the ports of both services.
+func ServiceDiff(desired, current *v1.Service) []string {
+	var fields []string
+	if !mapsEqual(desired.Labels, current.Labels) {
+		fields = append(fields, "metadata.labels")
+	}
+	if !annotationsEqual(desired.Annotations, current.Annotations) {
+		fields = append(fields, "metadata.annotations")
+	}
+	if serviceType(desired) != serviceType(current) {
+		fields = append(fields, "spec.type")
+	}
+	if desired.Spec.ExternalName != current.Spec.ExternalName {
+		fields = append(fields, "spec.externalName")
+	}
+	if !stringsEqual(servicePorts(desired), servicePorts(current)) {
+		fields = append(fields, "spec.ports")
+	}
+	return fields
+}
+
+// EndpointsDiff returns the fields of the current endpoints that differ from
+// the desired ones. The annotations that are set when the endpoints are
+// written are not compared, and the addresses are compared regardless of how
+// they are grouped into subsets.
+func EndpointsDiff(desired, current *v1.Endpoints) []string {
+	var fields []string
+	if !mapsEqual(desired.Labels, current.Labels) {
+		fields = append(fields, "metadata.labels")
+	}
+	if !annotationsEqual(desired.Annotations, current.Annotations) {
+		fields = append(fields, "metadata.annotations")
+	}
+	if !stringsEqual(endpointAddresses(desired), endpointAddresses(current)) {
+		fields = append(fields, "subsets")
+	}
+	return fields
+}
+
+// mapsEqual returns whether the maps have the same entries. A nil map equals
+// an empty one.
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// annotationsEqual compares the annotations without the ones that are set
+// when an object is written, such as the last sync time
+func annotationsEqual(a, b map[string]string) bool {
+	return mapsEqual(withoutSyncAnnotations(a), withoutSyncAnnotations(b))
+}
+
+// syncAnnotations holds the annotations that are set when an object is
+// written to Gimbal
+var syncAnnotations = []string{translator.GimbalAnnotationLastSyncTime, translator.GimbalAnnotationSyncHash, translator.GimbalAnnotationBackendHealth}
+
+// IsSyncAnnotation returns whether the annotation is set when an object is
+// written to Gimbal, rather than discovered from the backend
+func IsSyncAnnotation(key string) bool {
+	for _, k := range syncAnnotations {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutSyncAnnotations(annotations map[string]string) map[string]string {
+	res := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if !IsSyncAnnotation(k) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceType returns the type of the service. The API server defaults the
+// type to ClusterIP.
+func serviceType(svc *v1.Service) v1.ServiceType {
+	if svc.Spec.Type == "" {
+		return v1.ServiceTypeClusterIP
+	}
+	return svc.Spec.Type
+}
+
+// servicePorts returns the ports of the service in the order they are
+// defined, with the defaults of the API server
+func servicePorts(svc *v1.Service) []string {
+	res := make([]string, 0, len(svc.Spec.Ports))
+	for _, p := range svc.Spec.Ports {
+		targetPort := p.TargetPort
+		if targetPort.Type == intstr.Int && targetPort.IntVal == 0 {
+			targetPort = intstr.FromInt(int(p.Port))
+		}
+		res = append(res, fmt.Sprintf("%s %d/%s -> %s", p.Name, p.Port, protocol(p.Protocol), targetPort.String()))
+	}
+	return res
+}
+
+// endpointAddresses returns an entry for each address and port of the
+// endpoints, sorted. The API server drops repeated addresses when it regroups
+// the subsets, so each entry is only returned once.
+func endpointAddresses(ep *v1.Endpoints) []string {
+	var res []string
+	seen := map[string]bool{}
+	add := func(entry string) {
+		if !seen[entry] {
+			seen[entry] = true
+			res = append(res, entry)
+		}
+	}
+	for _, s := range ep.Subsets {
+		for ready, addresses := range map[string][]v1.EndpointAddress{"ready": s.Addresses, "not ready": s.NotReadyAddresses} {
+			for _, a := range addresses {
+				if len(s.Ports) == 0 {
+					add(fmt.Sprintf("%s %s", ready, a.IP))
+				}
+				for _, p := range s.Ports {
+					add(fmt.Sprintf("%s %s %s:%d/%s", ready, p.Name, a.IP, p.Port, protocol(p.Protocol)))
+				}
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// protocol returns the protocol of a port. The API server defaults the
+// protocol to TCP.
+func protocol(p v1.Protocol) v1.Protocol {
+	if p == "" {
+		return v1.ProtocolTCP
+	}
+	return p
+}
+
+// serviceHash returns a hash of the fields of the service that ServiceDiff
+// compares
+func serviceHash(svc *v1.Service) string {
+	entries := append(metaEntries(&svc.ObjectMeta), "type "+string(serviceType(svc)), "externalName "+svc.Spec.ExternalName)
+	for _, p := range servicePorts(svc) {
+		entries = append(entries, "port "+p)
+	}
+	return hash(entries)
+}
+
+// endpointsHash returns a hash of the fields of the endpoints that
+// EndpointsDiff compares
+func endpointsHash(ep *v1.Endpoints) string {
+	entries := metaEntries(&ep.ObjectMeta)
+	for _, a := range endpointAddresses(ep) {
+		entries = append(entries, "address "+a)
+	}
+	return hash(entries)
+}
+
+// metaEntries returns an entry for each label and annotation, sorted, without
+// the annotations that are set when the object is written
+func metaEntries(meta *metav1.ObjectMeta) []string {
+	var entries []string
+	for k, v := range meta.Labels {
+		entries = append(entries, fmt.Sprintf("label %s=%s", k, v))
+	}
+	for k, v := range withoutSyncAnnotations(meta.Annotations) {
+		entries = append(entries, fmt.Sprintf("annotation %s=%s", k, v))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+func hash(entries []string) string {
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintln(h, e)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// ServiceEdited returns whether the service, which exists in Gimbal, was
+// edited since it was last written by a discoverer
+func ServiceEdited(svc *v1.Service) bool {
+	return edited(&svc.ObjectMeta, serviceHash(svc))
+}
+
+// EndpointsEdited returns whether the endpoints, which exist in Gimbal, were
+// edited since they were last written by a discoverer
+func EndpointsEdited(ep *v1.Endpoints) bool {
+	return edited(&ep.ObjectMeta, endpointsHash(ep))
+}
+
+// edited returns whether an object that exists in Gimbal was changed since it
+// was last written by a discoverer, given the hash of its current fields.
+// Objects written by earlier versions, which have no sync hash, are not
+// considered edited.
+func edited(meta *metav1.ObjectMeta, currentHash string) bool {
+	syncHash, ok := meta.Annotations[translator.GimbalAnnotationSyncHash]
+	return ok && syncHash != currentHash
+}
+
+// setSyncAnnotations records the current time and the hash of the fields of an
+// object that is about to be written to Gimbal
+func setSyncAnnotations(meta *metav1.ObjectMeta, hash string) {
+	setLastSyncTime(meta)
+	meta.Annotations[translator.GimbalAnnotationSyncHash] = hash
+}
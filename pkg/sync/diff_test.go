@@ -0,0 +1,68 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"testing"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceDiff(t *testing.T) {
+	desired := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "kuard"}},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "kuard.example.com"},
+	}
+	assert.Empty(t, ServiceDiff(desired, desired.DeepCopy()))
+
+	current := &v1.Service{Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: "None"}}
+	assert.Equal(t, []string{"metadata.labels", "spec.type", "spec.externalName"}, ServiceDiff(desired, current))
+}
+
+func TestEndpointsDiff(t *testing.T) {
+	desired := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{translator.GimbalAnnotationLocalities: "10.0.0.1=us-east-1a"}},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+	current := desired.DeepCopy()
+	current.Subsets[0].Ports[0].Protocol = ""
+	assert.Empty(t, EndpointsDiff(desired, current))
+
+	current.Annotations = nil
+	current.Subsets[0].Ports[0].Port = 8443
+	assert.Equal(t, []string{"metadata.annotations", "subsets"}, EndpointsDiff(desired, current))
+}
+
+func TestEdited(t *testing.T) {
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "kuard"}},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+	}
+	// Services written by earlier versions have no hash
+	assert.False(t, edited(&svc.ObjectMeta, serviceHash(svc)))
+
+	setSyncAnnotations(&svc.ObjectMeta, serviceHash(svc))
+	// The hash does not depend on the sync annotations, nor on defaults
+	svc.Spec.Ports[0].Protocol = ""
+	assert.False(t, edited(&svc.ObjectMeta, serviceHash(svc)))
+
+	svc.Labels["app"] = "edited"
+	assert.True(t, edited(&svc.ObjectMeta, serviceHash(svc)))
+}
@@ -29,12 +29,12 @@ import (
 
 // AddEndpointsAction returns an action that adds a new endpoint to the cluster
 func AddEndpointsAction(endpoints *v1.Endpoints, upstreamName string) Action {
-	return endpointsAction{kind: actionAdd, upstreamName: upstreamName, endpoints: endpoints}
+	return endpointsAction{kind: actionAdd, upstreamName: upstreamName, endpoints: endpoints, reverted: new([]string)}
 }
 
 // UpdateEndpointsAction returns an action that updates the given endpoint in the cluster
 func UpdateEndpointsAction(endpoints *v1.Endpoints, upstreamName string) Action {
-	return endpointsAction{kind: actionUpdate, upstreamName: upstreamName, endpoints: endpoints}
+	return endpointsAction{kind: actionUpdate, upstreamName: upstreamName, endpoints: endpoints, reverted: new([]string)}
 }
 
 // DeleteEndpointsAction returns an action that deletes the given endpoint from the cluster
@@ -47,6 +47,9 @@ type endpointsAction struct {
 	kind         string
 	endpoints    *v1.Endpoints
 	upstreamName string
+	// reverted holds the fields of the existing endpoints whose manual edits
+	// were reverted when the action was synced
+	reverted *[]string
 }
 
 // ObjectMeta returns the objectMeta piece of the Action interface object
@@ -59,19 +62,31 @@ func (action endpointsAction) GetActionType() string {
 }
 
 // Sync performs the action on the given Endpoints resource
-func (action endpointsAction) Sync(kubeClient kubernetes.Interface, logger *logrus.Logger) error {
+func (action endpointsAction) Sync(kubeClient kubernetes.Interface, logger logrus.FieldLogger) error {
 	var err error
+	var reverted []string
 	switch action.kind {
 	case actionAdd:
-		err = addEndpoints(kubeClient, action.endpoints)
+		setSyncAnnotations(&action.endpoints.ObjectMeta, endpointsHash(action.endpoints))
+		reverted, err = addEndpoints(kubeClient, action.endpoints)
 	case actionUpdate:
-		err = updateEndpoints(kubeClient, action.endpoints)
+		setSyncAnnotations(&action.endpoints.ObjectMeta, endpointsHash(action.endpoints))
+		reverted, err = updateEndpoints(kubeClient, action.endpoints)
 	case actionDelete:
 		err = deleteEndpoints(kubeClient, action.endpoints)
 	}
+	if _, ok := err.(*CollisionError); ok {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("error handling %s: %v", action, err)
 	}
+	if len(reverted) > 0 {
+		recordRevert(kubeClient, logger, "Endpoints", &action.endpoints.ObjectMeta, reverted)
+	}
+	if action.reverted != nil {
+		*action.reverted = reverted
+	}
 
 	return nil
 }
@@ -81,28 +96,46 @@ func (action endpointsAction) String() string {
 }
 
 func (action endpointsAction) SetMetrics(gimbalKubeClient kubernetes.Interface, metrics localmetrics.DiscovererMetrics,
-	logger *logrus.Logger) {
+	logger logrus.FieldLogger) {
 	metrics.EndpointsEventTimestampMetric(action.endpoints.GetNamespace(), action.endpoints.GetName(), now().Unix())
 	metrics.DiscovererReplicatedEndpointsMetric(action.endpoints.GetNamespace(), action.upstreamName, SumEndpoints(action.endpoints))
+	if action.reverted != nil && len(*action.reverted) > 0 {
+		metrics.RevertedEditsMetric(action.endpoints.GetNamespace(), "endpoints")
+	}
 }
 
 func (action endpointsAction) SetMetricError(metrics localmetrics.DiscovererMetrics) {
 	metrics.EndpointsMetricError(action.ObjectMeta().GetNamespace(), action.ObjectMeta().GetName(), action.GetActionType())
 }
 
-func addEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) error {
+func addEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) ([]string, error) {
 	_, err := kubeClient.CoreV1().Endpoints(endpoints.Namespace).Create(endpoints)
 	if errors.IsAlreadyExists(err) {
 		return updateEndpoints(kubeClient, endpoints)
 	}
-	return err
+	return nil, err
 }
 
 func deleteEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) error {
-	return kubeClient.CoreV1().Endpoints(endpoints.Namespace).Delete(endpoints.Name, &metav1.DeleteOptions{})
+	client := kubeClient.CoreV1().Endpoints(endpoints.Namespace)
+	existing, err := client.Get(endpoints.Name, metav1.GetOptions{})
+	if err == nil {
+		if err := checkOrigin("endpoints", &existing.ObjectMeta, &endpoints.ObjectMeta); err != nil {
+			return err
+		}
+		err = client.Delete(endpoints.Name, &metav1.DeleteOptions{})
+	}
+	// Already deleted
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
-func updateEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) error {
+// updateEndpoints updates the endpoints, and returns the fields whose manual
+// edits were reverted, if the existing endpoints were edited since they were
+// last written
+func updateEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) ([]string, error) {
 	client := kubeClient.CoreV1().Endpoints(endpoints.Namespace)
 	existing, err := client.Get(endpoints.Name, metav1.GetOptions{})
 
@@ -110,12 +143,21 @@ func updateEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) e
 		if errors.IsNotFound(err) {
 			return addEndpoints(kubeClient, endpoints)
 		}
-		return err
+		return nil, err
+	}
+	if err := checkOrigin("endpoints", &existing.ObjectMeta, &endpoints.ObjectMeta); err != nil {
+		return nil, err
+	}
+	var reverted []string
+	if edited(&existing.ObjectMeta, endpointsHash(existing)) {
+		reverted = EndpointsDiff(endpoints, existing)
+		// The event that records the revert refers to the existing endpoints
+		endpoints.UID = existing.UID
 	}
 
 	existingBytes, err := json.Marshal(existing)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Need to set the resource version of the updated endpoints to the resource
 	// version of the current service. Otherwise, the resulting patch does not
@@ -123,14 +165,16 @@ func updateEndpoints(kubeClient kubernetes.Interface, endpoints *v1.Endpoints) e
 	endpoints.ResourceVersion = existing.ResourceVersion
 	updatedBytes, err := json.Marshal(endpoints)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(existingBytes, updatedBytes, v1.Endpoints{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = client.Patch(endpoints.Name, types.MergePatchType, patchBytes)
-	return err
+	if _, err = client.Patch(endpoints.Name, types.MergePatchType, patchBytes); err != nil {
+		return nil, err
+	}
+	return reverted, nil
 }
 
 // SumEndpoints takes an enpoints object and returns total number of Addresses
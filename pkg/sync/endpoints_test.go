@@ -73,14 +73,30 @@ func TestEndpointsAction(t *testing.T) {
 			actionKind:        actionDelete,
 			endpoints:         v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
 			existingEndpoints: v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
-			expectedVerbs:     []string{"delete"},
+			expectedVerbs:     []string{"get", "delete"},
 		},
 		{
 			name:          "delete non-existent endpoints resource",
 			actionKind:    actionDelete,
 			endpoints:     v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
-			expectedVerbs: []string{"delete"},
-			expectErr:     true,
+			expectedVerbs: []string{"get"},
+			expectErr:     false,
+		},
+		{
+			name:              "update endpoints discovered from another backend",
+			actionKind:        actionUpdate,
+			endpoints:         v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar", "gimbal.projectcontour.io/service": "baz"}}},
+			existingEndpoints: v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar-baz", "gimbal.projectcontour.io/service": "baz"}}},
+			expectedVerbs:     []string{"get"},
+			expectErr:         true,
+		},
+		{
+			name:              "delete endpoints discovered from another backend",
+			actionKind:        actionDelete,
+			endpoints:         v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar", "gimbal.projectcontour.io/service": "baz"}}},
+			existingEndpoints: v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar-baz", "gimbal.projectcontour.io/service": "baz"}}},
+			expectedVerbs:     []string{"get"},
+			expectErr:         true,
 		},
 	}
 
@@ -91,7 +107,9 @@ func TestEndpointsAction(t *testing.T) {
 			a := endpointsAction{kind: tc.actionKind, endpoints: &tc.endpoints}
 			err := a.Sync(client, logrus.New())
 
-			if !tc.expectErr {
+			if tc.expectErr {
+				require.IsType(t, &CollisionError{}, err)
+			} else {
 				require.NoError(t, err)
 			}
 			require.Len(t, client.Actions(), len(tc.expectedVerbs))
@@ -141,11 +159,50 @@ func TestUpdateEndpoints(t *testing.T) {
 		},
 	}
 	expectedPatch := `{"subsets":[{"addresses":[{"ip":"192.168.0.2"}],"ports":[{"port":8080}]},{"addresses":[{"ip":"192.168.0.3"}],"ports":[{"port":80}]}]}`
-	err := updateEndpoints(client, &newEndpoints)
+	_, err := updateEndpoints(client, &newEndpoints)
 	require.NoError(t, err)
 	assert.Equal(t, expectedPatch, string(gotPatchBytes))
 }
 
+func TestEndpointsActionRevertsEdits(t *testing.T) {
+	metrics := localmetrics.NewMetrics("kubernetes", "us-east")
+	metrics.RegisterPrometheus(false)
+	client := fake.NewSimpleClientset()
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "192.168.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	require.NoError(t, AddEndpointsAction(ep.DeepCopy(), "bar").Sync(client, logrus.New()))
+
+	existing, err := client.CoreV1().Endpoints("foo").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	existing.Subsets[0].Addresses[0].IP = "192.168.0.2"
+	_, err = client.CoreV1().Endpoints("foo").Update(existing)
+	require.NoError(t, err)
+
+	action := UpdateEndpointsAction(ep.DeepCopy(), "bar")
+	require.NoError(t, action.Sync(client, logrus.New()))
+	action.SetMetrics(client, metrics, logrus.New())
+
+	got, err := client.CoreV1().Endpoints("foo").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ep.Subsets, got.Subsets)
+	events, err := client.CoreV1().Events("foo").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, "Reverted manual edits of subsets", events.Items[0].Message)
+	assert.Equal(t, 1, revertedEdits(t, metrics, "foo", "endpoints"))
+
+	// Endpoints that were not edited since are not reverted again
+	require.NoError(t, UpdateEndpointsAction(ep.DeepCopy(), "bar").Sync(client, logrus.New()))
+	events, err = client.CoreV1().Events("foo").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, events.Items, 1)
+}
+
 func TestDiscovererEndpointsMetrics(t *testing.T) {
 	backendName := "backend"
 	backendType := "backtype"
@@ -256,7 +313,9 @@ func TestDiscovererEndpointsMetrics(t *testing.T) {
 
 			err := a.Sync(client, logrus.New())
 
-			if !tc.expectErr {
+			if tc.expectErr {
+				require.IsType(t, &CollisionError{}, err)
+			} else {
 				require.NoError(t, err)
 			}
 
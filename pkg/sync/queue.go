@@ -17,6 +17,7 @@ import (
 	"time"
 
 	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+	"github.com/projectcontour/gimbal/pkg/util"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
@@ -56,13 +57,40 @@ func NewQueue(logger *logrus.Logger, kubeClient kubernetes.Interface,
 
 // Action that is added to the queue for processing
 type Action interface {
-	Sync(kube kubernetes.Interface, logger *logrus.Logger) error
+	Sync(kube kubernetes.Interface, logger logrus.FieldLogger) error
 	ObjectMeta() *metav1.ObjectMeta
-	SetMetrics(gimbalKubeClient kubernetes.Interface, lm localmetrics.DiscovererMetrics, logger *logrus.Logger)
+	SetMetrics(gimbalKubeClient kubernetes.Interface, lm localmetrics.DiscovererMetrics, logger logrus.FieldLogger)
 	SetMetricError(metrics localmetrics.DiscovererMetrics)
 	GetActionType() string
 }
 
+// IsDelete returns whether the action deletes its object
+func IsDelete(action Action) bool {
+	return action.GetActionType() == actionDelete
+}
+
+// Kind returns the kind of the object of the action
+func Kind(action Action) string {
+	switch action.(type) {
+	case serviceAction:
+		return "Service"
+	case endpointsAction:
+		return "Endpoints"
+	}
+	return ""
+}
+
+// LogFields returns the fields of the log entries about the action
+func LogFields(action Action) logrus.Fields {
+	meta := action.ObjectMeta()
+	return logrus.Fields{
+		util.FieldKind:      Kind(action),
+		util.FieldNamespace: meta.Namespace,
+		util.FieldName:      meta.Name,
+		util.FieldAction:    action.GetActionType(),
+	}
+}
+
 // Enqueue adds a new resource action to the worker queue
 func (sq *Queue) Enqueue(action Action) {
 	sq.Workqueue.AddRateLimited(action)
@@ -114,14 +142,33 @@ func (sq *Queue) processNextWorkItem() bool {
 		return true
 	}
 
-	err := action.Sync(sq.KubeClient, sq.Logger)
+	// Actions are added with rate limiting, which counts as a requeue
+	numRequeues := sq.Workqueue.NumRequeues(obj)
+	attempt := numRequeues
+	if attempt < 1 {
+		attempt = 1
+	}
+	logger := sq.Logger.WithFields(LogFields(action)).WithField(util.FieldAttempt, attempt)
+	start := time.Now()
+	err := action.Sync(sq.KubeClient, logger)
+	logger = logger.WithField(util.FieldDuration, time.Since(start).String())
 
 	// We successfully handled the action, so we can forget the item and keep going.
 	if err == nil {
 		sq.Workqueue.Forget(obj)
-		action.SetMetrics(sq.KubeClient, sq.Metrics, sq.Logger)
+		action.SetMetrics(sq.KubeClient, sq.Metrics, logger)
+		sq.Metrics.QueueSizeGaugeMetric(sq.Workqueue.Len())
+		logger.Infof("Successfully handled: %s", action)
+		return true
+	}
+
+	// Writing the action would overwrite an object from another origin, and
+	// retrying does not help.
+	if collision, ok := err.(*CollisionError); ok {
+		sq.Workqueue.Forget(obj)
+		sq.Metrics.NameCollisionMetric(collision.Namespace, collision.Kind)
 		sq.Metrics.QueueSizeGaugeMetric(sq.Workqueue.Len())
-		sq.Logger.Infof("Successfully handled: %s", action)
+		logger.Warnf("Refusing to %s: %v", action, err)
 		return true
 	}
 
@@ -130,9 +177,8 @@ func (sq *Queue) processNextWorkItem() bool {
 
 	// If there was an error handling the item, we will retry up to
 	// queueMaxRetries times.
-	numRequeues := sq.Workqueue.NumRequeues(obj)
 	if numRequeues < queueMaxRetries {
-		sq.Logger.Errorf("Error handling %s: %v. Number of requeues: %d. Requeuing.", action, err, numRequeues)
+		logger.Errorf("Error handling %s: %v. Number of requeues: %d. Requeuing.", action, err, numRequeues)
 		sq.Workqueue.AddRateLimited(obj)
 		sq.Metrics.QueueSizeGaugeMetric(sq.Workqueue.Len())
 		return true
@@ -141,7 +187,7 @@ func (sq *Queue) processNextWorkItem() bool {
 	// We tried `queueMaxRetries` times but still failed. Dropping the item from
 	// the queue.
 	sq.Workqueue.Forget(obj)
-	sq.Logger.Errorf("Dropping %s out of the queue because we failed to handle the item %d times: %v", action, queueMaxRetries, err)
+	logger.Errorf("Dropping %s out of the queue because we failed to handle the item %d times: %v", action, queueMaxRetries, err)
 	sq.Metrics.QueueSizeGaugeMetric(sq.Workqueue.Len())
 	return true
 }
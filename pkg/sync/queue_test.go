@@ -93,6 +93,37 @@ func TestQueueMaxRetries(t *testing.T) {
 	assert.Equal(t, 0, q.Workqueue.Len())
 }
 
+func TestQueueNameCollision(t *testing.T) {
+	existing := &v1.Service{}
+	existing.Namespace = "default"
+	existing.Name = "foo-bar"
+	existing.Labels = map[string]string{"gimbal.projectcontour.io/backend": "foo-bar", "gimbal.projectcontour.io/service": "baz"}
+	client := fake.NewSimpleClientset(existing)
+	var patchAttempts int
+	client.PrependReactor("patch", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAttempts++
+		return true, nil, nil
+	})
+	m := metrics.NewMetrics("test", "foo")
+	m.RegisterPrometheus(false)
+	q := NewQueue(logrus.New(), client, 1, m)
+	stop := make(chan struct{})
+	go q.Run(stop)
+
+	s := existing.DeepCopy()
+	s.Labels = map[string]string{"gimbal.projectcontour.io/backend": "foo", "gimbal.projectcontour.io/service": "bar-baz"}
+	q.Enqueue(AddServiceAction(s))
+
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+
+	// The service is not written, and the action is not retried
+	assert.Equal(t, 0, patchAttempts)
+	assert.Equal(t, 0, q.Workqueue.Len())
+	assertCounterEqual(t, 1, metrics.DiscovererNameCollisionsTotal, m.Registry)
+	assertCounterEqual(t, -1, metrics.ServiceErrorTotalCounter, m.Registry)
+}
+
 func TestQueueServicesMetrics(t *testing.T) {
 	now := time.Date(2000, 1, 1, 10, 0, 00, 0, time.UTC)
 	tests := []struct {
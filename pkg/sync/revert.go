@@ -0,0 +1,64 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// EventReasonEditReverted is the reason of the events recorded when manual
+	// edits of a discovered object are reverted
+	EventReasonEditReverted = "EditReverted"
+
+	eventSourceComponent = "gimbal"
+)
+
+// recordRevert logs and records an event about the manual edits of the given
+// fields of the object, which were reverted. Failing to record the event does
+// not fail the sync.
+func recordRevert(kubeClient kubernetes.Interface, logger logrus.FieldLogger, kind string, meta *metav1.ObjectMeta, fields []string) {
+	logger.Warnf("Reverted manual edits of %s of %s '%s/%s'", strings.Join(fields, ", "), strings.ToLower(kind), meta.Namespace, meta.Name)
+
+	t := metav1.NewTime(now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: meta.Namespace,
+			Name:      fmt.Sprintf("%s.%x", meta.Name, t.UnixNano()),
+		},
+		InvolvedObject: v1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       kind,
+			Namespace:  meta.Namespace,
+			Name:       meta.Name,
+			UID:        meta.UID,
+		},
+		Reason:         EventReasonEditReverted,
+		Message:        fmt.Sprintf("Reverted manual edits of %s", strings.Join(fields, ", ")),
+		Type:           v1.EventTypeWarning,
+		Source:         v1.EventSource{Component: eventSourceComponent},
+		FirstTimestamp: t,
+		LastTimestamp:  t,
+		Count:          1,
+	}
+	if _, err := kubeClient.CoreV1().Events(meta.Namespace).Create(event); err != nil {
+		logger.Errorf("Error recording event for %s '%s/%s': %v", strings.ToLower(kind), meta.Namespace, meta.Name, err)
+	}
+}
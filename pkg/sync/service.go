@@ -29,12 +29,12 @@ import (
 
 // AddServiceAction returns an action that adds a new endpoint to the cluster
 func AddServiceAction(service *v1.Service) Action {
-	return serviceAction{kind: actionAdd, service: service}
+	return serviceAction{kind: actionAdd, service: service, reverted: new([]string)}
 }
 
 // UpdateServiceAction returns an action that updates the given endpoint in the cluster
 func UpdateServiceAction(service *v1.Service) Action {
-	return serviceAction{kind: actionUpdate, service: service}
+	return serviceAction{kind: actionUpdate, service: service, reverted: new([]string)}
 }
 
 // DeleteServiceAction returns an action that deletes the given endpoint from the cluster
@@ -46,6 +46,9 @@ func DeleteServiceAction(service *v1.Service) Action {
 type serviceAction struct {
 	kind    string
 	service *v1.Service
+	// reverted holds the fields of the existing service whose manual edits
+	// were reverted when the action was synced
+	reverted *[]string
 }
 
 // ObjectMeta returns the objectMeta piece of the Action interface object
@@ -58,20 +61,32 @@ func (action serviceAction) GetActionType() string {
 }
 
 // Sync performs the action on the given service
-func (action serviceAction) Sync(kubeClient kubernetes.Interface, logger *logrus.Logger) error {
+func (action serviceAction) Sync(kubeClient kubernetes.Interface, logger logrus.FieldLogger) error {
 
 	var err error
+	var reverted []string
 	switch action.kind {
 	case actionAdd:
-		err = addService(kubeClient, action.service)
+		setSyncAnnotations(&action.service.ObjectMeta, serviceHash(action.service))
+		reverted, err = addService(kubeClient, action.service)
 	case actionUpdate:
-		err = updateService(kubeClient, action.service)
+		setSyncAnnotations(&action.service.ObjectMeta, serviceHash(action.service))
+		reverted, err = updateService(kubeClient, action.service)
 	case actionDelete:
 		err = deleteService(kubeClient, action.service)
 	}
+	if _, ok := err.(*CollisionError); ok {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("error handling %s: %v", action, err)
 	}
+	if len(reverted) > 0 {
+		recordRevert(kubeClient, logger, "Service", &action.service.ObjectMeta, reverted)
+	}
+	if action.reverted != nil {
+		*action.reverted = reverted
+	}
 
 	return nil
 }
@@ -80,19 +95,34 @@ func (action serviceAction) String() string {
 	return fmt.Sprintf(`%s service '%s/%s'`, action.kind, action.service.Namespace, action.service.Name)
 }
 
-func addService(kubeClient kubernetes.Interface, service *v1.Service) error {
+func addService(kubeClient kubernetes.Interface, service *v1.Service) ([]string, error) {
 	_, err := kubeClient.CoreV1().Services(service.Namespace).Create(service)
 	if errors.IsAlreadyExists(err) {
 		return updateService(kubeClient, service)
 	}
-	return err
+	return nil, err
 }
 
 func deleteService(kubeClient kubernetes.Interface, service *v1.Service) error {
-	return kubeClient.CoreV1().Services(service.Namespace).Delete(service.Name, &metav1.DeleteOptions{})
+	client := kubeClient.CoreV1().Services(service.Namespace)
+	existing, err := client.Get(service.Name, metav1.GetOptions{})
+	if err == nil {
+		if err := checkOrigin("service", &existing.ObjectMeta, &service.ObjectMeta); err != nil {
+			return err
+		}
+		err = client.Delete(service.Name, &metav1.DeleteOptions{})
+	}
+	// Already deleted
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
 }
 
-func updateService(kubeClient kubernetes.Interface, service *v1.Service) error {
+// updateService updates the service, and returns the fields whose manual
+// edits were reverted, if the existing service was edited since it was last
+// written
+func updateService(kubeClient kubernetes.Interface, service *v1.Service) ([]string, error) {
 	client := kubeClient.CoreV1().Services(service.Namespace)
 	existing, err := client.Get(service.Name, metav1.GetOptions{})
 
@@ -100,12 +130,21 @@ func updateService(kubeClient kubernetes.Interface, service *v1.Service) error {
 		if errors.IsNotFound(err) {
 			return addService(kubeClient, service)
 		}
-		return err
+		return nil, err
+	}
+	if err := checkOrigin("service", &existing.ObjectMeta, &service.ObjectMeta); err != nil {
+		return nil, err
+	}
+	var reverted []string
+	if edited(&existing.ObjectMeta, serviceHash(existing)) {
+		reverted = ServiceDiff(service, existing)
+		// The event that records the revert refers to the existing service
+		service.UID = existing.UID
 	}
 
 	existingBytes, err := json.Marshal(existing)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// Need to set the resource version of the updated service to the resource
 	// version of the current service. Otherwise, the resulting patch does not
@@ -113,18 +152,20 @@ func updateService(kubeClient kubernetes.Interface, service *v1.Service) error {
 	service.ResourceVersion = existing.ResourceVersion
 	updatedBytes, err := json.Marshal(service)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	patchBytes, err := strategicpatch.CreateTwoWayMergePatch(existingBytes, updatedBytes, v1.Service{})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = client.Patch(service.Name, types.StrategicMergePatchType, patchBytes)
-	return err
+	if _, err = client.Patch(service.Name, types.StrategicMergePatchType, patchBytes); err != nil {
+		return nil, err
+	}
+	return reverted, nil
 }
 
 func (action serviceAction) SetMetrics(gimbalKubeClient kubernetes.Interface, metrics localmetrics.DiscovererMetrics,
-	logger *logrus.Logger) {
+	logger logrus.FieldLogger) {
 
 	// Log Service Event Timestamp
 	metrics.ServiceEventTimestampMetric(action.service.GetNamespace(), action.service.GetName(), now().Unix())
@@ -136,6 +177,9 @@ func (action serviceAction) SetMetrics(gimbalKubeClient kubernetes.Interface, me
 	} else {
 		metrics.DiscovererReplicatedServicesMetric(action.service.GetNamespace(), totalServices)
 	}
+	if action.reverted != nil && len(*action.reverted) > 0 {
+		metrics.RevertedEditsMetric(action.service.GetNamespace(), "service")
+	}
 }
 
 func (action serviceAction) SetMetricError(metrics localmetrics.DiscovererMetrics) {
@@ -73,14 +73,30 @@ func TestServiceActions(t *testing.T) {
 			actionKind:      actionDelete,
 			service:         v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
 			existingService: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
-			expectedVerbs:   []string{"delete"},
+			expectedVerbs:   []string{"get", "delete"},
 		},
 		{
 			name:          "delete non-existent service resource",
 			actionKind:    actionDelete,
 			service:       v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar"}},
-			expectedVerbs: []string{"delete"},
-			expectErr:     true,
+			expectedVerbs: []string{"get"},
+			expectErr:     false,
+		},
+		{
+			name:            "update service discovered from another backend",
+			actionKind:      actionUpdate,
+			service:         v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar", "gimbal.projectcontour.io/service": "baz"}}},
+			existingService: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar-baz", "gimbal.projectcontour.io/service": "baz"}}},
+			expectedVerbs:   []string{"get"},
+			expectErr:       true,
+		},
+		{
+			name:            "delete service discovered from another backend",
+			actionKind:      actionDelete,
+			service:         v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar", "gimbal.projectcontour.io/service": "baz"}}},
+			existingService: v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar-baz", Labels: map[string]string{"gimbal.projectcontour.io/backend": "bar-baz", "gimbal.projectcontour.io/service": "baz"}}},
+			expectedVerbs:   []string{"get"},
+			expectErr:       true,
 		},
 	}
 
@@ -91,7 +107,9 @@ func TestServiceActions(t *testing.T) {
 			a := serviceAction{kind: tc.actionKind, service: &tc.service}
 			err := a.Sync(client, logrus.New())
 
-			if !tc.expectErr {
+			if tc.expectErr {
+				require.IsType(t, &CollisionError{}, err)
+			} else {
 				require.NoError(t, err)
 			}
 			require.Len(t, client.Actions(), len(tc.expectedVerbs))
@@ -103,6 +121,91 @@ func TestServiceActions(t *testing.T) {
 	}
 }
 
+func TestServiceActionLastSyncTime(t *testing.T) {
+	nowFunc = func() time.Time {
+		return time.Date(2000, 1, 1, 10, 0, 0, 0, time.FixedZone("", 3600))
+	}
+	defer resetClockImplementation()
+
+	client := fake.NewSimpleClientset()
+	upstream := map[string]string{"foo": "bar"}
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Annotations: upstream}}
+	require.NoError(t, AddServiceAction(svc).Sync(client, logrus.New()))
+
+	got, err := client.CoreV1().Services("foo").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "2000-01-01T09:00:00Z", got.Annotations["gimbal.projectcontour.io/last-sync-time"])
+	assert.Equal(t, serviceHash(svc), got.Annotations["gimbal.projectcontour.io/sync-hash"])
+	// The annotations of the action are copied
+	assert.Equal(t, map[string]string{"foo": "bar"}, upstream)
+}
+
+func TestServiceActionRevertsEdits(t *testing.T) {
+	metrics := localmetrics.NewMetrics("kubernetes", "us-east")
+	metrics.RegisterPrometheus(false)
+	client := fake.NewSimpleClientset()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "bar", Labels: map[string]string{"app": "bar"}},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	}
+	require.NoError(t, AddServiceAction(svc.DeepCopy()).Sync(client, logrus.New()))
+
+	// An upstream change is not a revert
+	svc.Spec.Ports[0].Port = 8080
+	action := UpdateServiceAction(svc.DeepCopy())
+	require.NoError(t, action.Sync(client, logrus.New()))
+	action.SetMetrics(client, metrics, logrus.New())
+	events, err := client.CoreV1().Events("foo").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, events.Items)
+
+	existing, err := client.CoreV1().Services("foo").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	existing.UID = "1234"
+	existing.Labels["app"] = "edited"
+	existing.Spec.Ports[0].Port = 9090
+	_, err = client.CoreV1().Services("foo").Update(existing)
+	require.NoError(t, err)
+
+	action = UpdateServiceAction(svc.DeepCopy())
+	require.NoError(t, action.Sync(client, logrus.New()))
+	action.SetMetrics(client, metrics, logrus.New())
+
+	got, err := client.CoreV1().Services("foo").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "bar", got.Labels["app"])
+	assert.Equal(t, int32(8080), got.Spec.Ports[0].Port)
+
+	events, err = client.CoreV1().Events("foo").List(metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	assert.Equal(t, v1.ObjectReference{APIVersion: "v1", Kind: "Service", Namespace: "foo", Name: "bar", UID: "1234"}, events.Items[0].InvolvedObject)
+	assert.Equal(t, EventReasonEditReverted, events.Items[0].Reason)
+	assert.Equal(t, "Reverted manual edits of metadata.labels, spec.ports", events.Items[0].Message)
+	assert.Equal(t, v1.EventTypeWarning, events.Items[0].Type)
+	assert.Equal(t, 1, revertedEdits(t, metrics, "foo", "service"))
+}
+
+func revertedEdits(t *testing.T, metrics localmetrics.DiscovererMetrics, namespace, kind string) int {
+	mfs, err := metrics.Registry.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != localmetrics.DiscovererRevertedEditsTotal {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["namespace"] == namespace && labels["kind"] == kind {
+				return int(m.GetCounter().GetValue())
+			}
+		}
+	}
+	return 0
+}
+
 func TestUpdateService(t *testing.T) {
 	existing := v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -139,7 +242,7 @@ func TestUpdateService(t *testing.T) {
 		},
 	}
 	expectedPatch := `{"spec":{"$setElementOrder/ports":[{"port":8080}],"ports":[{"port":8080,"targetPort":0},{"$patch":"delete","port":80}]}}`
-	err := updateService(client, &newService)
+	_, err := updateService(client, &newService)
 	require.NoError(t, err)
 	assert.Equal(t, expectedPatch, string(gotPatchBytes))
 }
@@ -250,7 +353,9 @@ func TestDiscovererServiceMetrics(t *testing.T) {
 
 			err := a.Sync(client, logrus.New())
 
-			if !tc.expectErr {
+			if tc.expectErr {
+				require.IsType(t, &CollisionError{}, err)
+			} else {
 				require.NoError(t, err)
 			}
 
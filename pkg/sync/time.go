@@ -13,7 +13,12 @@
 
 package sync
 
-import "time"
+import (
+	"time"
+
+	"github.com/projectcontour/gimbal/pkg/translator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
 
 // This is used to allow for unit testing values that rely on `time.Now()`.
 // In order to write tests and expect certain values, it's nessesary to provide
@@ -36,3 +41,14 @@ func resetClockImplementation() {
 func now() time.Time {
 	return nowFunc()
 }
+
+// setLastSyncTime records the current time in the annotations of an object
+// that is about to be written to Gimbal
+func setLastSyncTime(meta *metav1.ObjectMeta) {
+	annotations := make(map[string]string, len(meta.Annotations)+1)
+	for k, v := range meta.Annotations {
+		annotations[k] = v
+	}
+	annotations[translator.GimbalAnnotationLastSyncTime] = now().UTC().Format(time.RFC3339)
+	meta.Annotations = annotations
+}
@@ -0,0 +1,144 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// IPFamily is the IP family of an address: IPv4 or IPv6
+type IPFamily string
+
+const (
+	// IPv4 is the IPv4 address family
+	IPv4 IPFamily = "IPv4"
+	// IPv6 is the IPv6 address family
+	IPv6 IPFamily = "IPv6"
+
+	// GimbalAnnotationIPFamilies is the key of the annotation that contains
+	// the IP families of a service. The Kubernetes API used by Gimbal
+	// predates the ipFamilies field of services.
+	GimbalAnnotationIPFamilies = "gimbal.projectcontour.io/ip-families"
+	// GimbalAnnotationIPFamilyPolicy is the key of the annotation that
+	// contains the IP family policy of a service
+	GimbalAnnotationIPFamilyPolicy = "gimbal.projectcontour.io/ip-family-policy"
+)
+
+// ParseIPFamily parses the name of an IP family. An empty name means all
+// families.
+func ParseIPFamily(name string) (IPFamily, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return "", nil
+	case "ipv4":
+		return IPv4, nil
+	case "ipv6":
+		return IPv6, nil
+	}
+	return "", fmt.Errorf("invalid IP family %q: must be IPv4 or IPv6", name)
+}
+
+// AddressIPFamily returns the IP family of the address, or an empty family if
+// the address is not an IP address
+func AddressIPFamily(address string) IPFamily {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return IPv4
+	default:
+		return IPv6
+	}
+}
+
+// SubsetsIPFamilies returns the IP families of the addresses of the subsets,
+// IPv4 first
+func SubsetsIPFamilies(subsets []v1.EndpointSubset) []IPFamily {
+	found := map[IPFamily]bool{}
+	for _, s := range subsets {
+		for _, a := range s.Addresses {
+			found[AddressIPFamily(a.IP)] = true
+		}
+		for _, a := range s.NotReadyAddresses {
+			found[AddressIPFamily(a.IP)] = true
+		}
+	}
+	var families []IPFamily
+	for _, f := range []IPFamily{IPv4, IPv6} {
+		if found[f] {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// FilterSubsets returns the subsets with the addresses of the given family
+// only. Subsets left without addresses are removed. If the family is empty,
+// the subsets are returned as is. The given subsets are not modified.
+func FilterSubsets(subsets []v1.EndpointSubset, family IPFamily) []v1.EndpointSubset {
+	if family == "" || subsets == nil {
+		return subsets
+	}
+	res := []v1.EndpointSubset{}
+	for _, s := range subsets {
+		filtered := v1.EndpointSubset{
+			Addresses:         filterAddresses(s.Addresses, family),
+			NotReadyAddresses: filterAddresses(s.NotReadyAddresses, family),
+			Ports:             s.Ports,
+		}
+		if len(filtered.Addresses) > 0 || len(filtered.NotReadyAddresses) > 0 {
+			res = append(res, filtered)
+		}
+	}
+	return res
+}
+
+func filterAddresses(addresses []v1.EndpointAddress, family IPFamily) []v1.EndpointAddress {
+	var res []v1.EndpointAddress
+	for _, a := range addresses {
+		if AddressIPFamily(a.IP) == family {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// AddIPFamilyAnnotations returns a copy of the annotations with the IP
+// families of the service and its IP family policy, which is SingleStack for
+// one family and PreferDualStack for both. If there are no families, the
+// annotations are returned as is.
+func AddIPFamilyAnnotations(annotations map[string]string, families []IPFamily) map[string]string {
+	if len(families) == 0 {
+		return annotations
+	}
+	res := make(map[string]string, len(annotations)+2)
+	for k, v := range annotations {
+		res[k] = v
+	}
+	names := make([]string, 0, len(families))
+	for _, f := range families {
+		names = append(names, string(f))
+	}
+	res[GimbalAnnotationIPFamilies] = strings.Join(names, ",")
+	res[GimbalAnnotationIPFamilyPolicy] = "SingleStack"
+	if len(families) > 1 {
+		res[GimbalAnnotationIPFamilyPolicy] = "PreferDualStack"
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseIPFamily(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected IPFamily
+		err      bool
+	}{
+		{name: "", expected: ""},
+		{name: "IPv4", expected: IPv4},
+		{name: "ipv6", expected: IPv6},
+		{name: "IPv5", err: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseIPFamily(tc.name)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestAddressIPFamily(t *testing.T) {
+	assert.Equal(t, IPv4, AddressIPFamily("10.0.0.1"))
+	assert.Equal(t, IPv6, AddressIPFamily("2001:db8::1"))
+	assert.Equal(t, IPv4, AddressIPFamily("::ffff:10.0.0.1"))
+	assert.Equal(t, IPFamily(""), AddressIPFamily("backend.example.com"))
+}
+
+func TestFilterSubsets(t *testing.T) {
+	port := []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}}
+	subsets := []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "2001:db8::1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "2001:db8::2"}},
+			Ports:             port,
+		},
+		{
+			Addresses: []v1.EndpointAddress{{IP: "2001:db8::3"}},
+			Ports:     port,
+		},
+	}
+	assert.Equal(t, []IPFamily{IPv4, IPv6}, SubsetsIPFamilies(subsets))
+	assert.Equal(t, subsets, FilterSubsets(subsets, ""))
+
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     port,
+		},
+	}, FilterSubsets(subsets, IPv4))
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "2001:db8::1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "2001:db8::2"}},
+			Ports:             port,
+		},
+		{
+			Addresses: []v1.EndpointAddress{{IP: "2001:db8::3"}},
+			Ports:     port,
+		},
+	}, FilterSubsets(subsets, IPv6))
+	// the given subsets are not modified
+	assert.Len(t, subsets[0].Addresses, 2)
+}
+
+func TestAddIPFamilyAnnotations(t *testing.T) {
+	annotations := map[string]string{"foo": "bar"}
+	assert.Equal(t, annotations, AddIPFamilyAnnotations(annotations, nil))
+	assert.Equal(t, map[string]string{
+		"foo":                                  "bar",
+		"gimbal.projectcontour.io/ip-families": "IPv6",
+		"gimbal.projectcontour.io/ip-family-policy": "SingleStack",
+	}, AddIPFamilyAnnotations(annotations, []IPFamily{IPv6}))
+	assert.Equal(t, map[string]string{
+		"gimbal.projectcontour.io/ip-families":      "IPv4,IPv6",
+		"gimbal.projectcontour.io/ip-family-policy": "PreferDualStack",
+	}, AddIPFamilyAnnotations(nil, []IPFamily{IPv4, IPv6}))
+	// the given annotations are not modified
+	assert.Len(t, annotations, 1)
+}
@@ -0,0 +1,128 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultNameTemplate is the template of the names built by
+// BuildDiscoveredName
+const DefaultNameTemplate = "{{.Backend}}-{{.Name}}"
+
+// GimbalLabelAggregate is the key of the label that contains the aggregation
+// key of the services and endpoints maintained by the aggregator
+const GimbalLabelAggregate = "gimbal.projectcontour.io/aggregate"
+
+// originLabels are the labels that identify where a discovered object comes
+// from. Objects with the same name but different values of these labels have
+// names that collide.
+var originLabels = []string{GimbalLabelBackend, GimbalLabelService, GimbalLabelAggregate}
+
+// NameData is the data that name templates are executed with
+type NameData struct {
+	// Backend is the name of the backend
+	Backend string
+	// Namespace is the namespace of the discovered object
+	Namespace string
+	// Name is the name of the object in the backend
+	Name string
+}
+
+// NameTemplate builds the names of discovered objects. A nil NameTemplate
+// builds names with BuildDiscoveredName.
+type NameTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// ParseNameTemplate parses a template of discovered names, such as
+// "{{.Backend}}-{{.Namespace}}-{{.Name}}". The template must use the name of
+// the object, so that different objects get different names. An empty
+// template, or DefaultNameTemplate, returns nil.
+func ParseNameTemplate(text string) (*NameTemplate, error) {
+	if text == "" || text == DefaultNameTemplate {
+		return nil, nil
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template %q: %v", text, err)
+	}
+	t := &NameTemplate{text: text, tmpl: tmpl}
+
+	// Check that the template builds valid names that depend on the name
+	a, err := t.execute(NameData{Backend: "backend", Namespace: "namespace", Name: "a"})
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template %q: %v", text, err)
+	}
+	b, err := t.execute(NameData{Backend: "backend", Namespace: "namespace", Name: "b"})
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template %q: %v", text, err)
+	}
+	if a == b {
+		return nil, fmt.Errorf("invalid name template %q: the name must be used", text)
+	}
+	if errs := validation.IsDNS1035Label(a); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid name template %q: %s", text, strings.Join(errs, ", "))
+	}
+	return t, nil
+}
+
+func (t *NameTemplate) String() string {
+	if t == nil {
+		return DefaultNameTemplate
+	}
+	return t.text
+}
+
+// Name returns the discovered name of the object of the backend. If the name
+// is longer than the Kubernetes DNS_LABEL maximum character limit, the name
+// is shortened.
+func (t *NameTemplate) Name(backendName, namespace, name string) string {
+	if t == nil {
+		return BuildDiscoveredName(backendName, name)
+	}
+	// Templates are checked when they are parsed, and the fields always exist
+	r, err := t.execute(NameData{Backend: backendName, Namespace: namespace, Name: name})
+	if err != nil {
+		return BuildDiscoveredName(backendName, name)
+	}
+	return hashname(maxKubernetesDNSLabelLength, r)
+}
+
+func (t *NameTemplate) execute(data NameData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Origin returns where the object with the given labels comes from. Discovered
+// objects come from an object of a backend, and aggregate objects come from an
+// aggregation key. Objects that were not created by Gimbal have no origin.
+func Origin(labels map[string]string) string {
+	var origin []string
+	for _, l := range originLabels {
+		if v, ok := labels[l]; ok {
+			origin = append(origin, fmt.Sprintf("%s=%s", l, v))
+		}
+	}
+	return strings.Join(origin, ",")
+}
@@ -0,0 +1,74 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNameTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		template  string
+		expectNil bool
+		expectErr bool
+	}{
+		{name: "empty", template: "", expectNil: true},
+		{name: "default", template: DefaultNameTemplate, expectNil: true},
+		{name: "namespace", template: "{{.Backend}}-{{.Namespace}}-{{.Name}}"},
+		{name: "syntax error", template: "{{.Backend}}-{{.Name", expectErr: true},
+		{name: "unknown field", template: "{{.Backend}}-{{.Service}}", expectErr: true},
+		{name: "without name", template: "{{.Backend}}-{{.Namespace}}", expectErr: true},
+		{name: "invalid name", template: "{{.Backend}}.{{.Name}}", expectErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseNameTemplate(tc.template)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectNil, got == nil)
+		})
+	}
+}
+
+func TestNameTemplateName(t *testing.T) {
+	var names *NameTemplate
+	assert.Equal(t, "cluster1-service1", names.Name("cluster1", "team1", "service1"))
+	assert.Equal(t, BuildDiscoveredName("cluster1", "the-really-long-kube-service-name-that-is-exactly-63-characters"),
+		names.Name("cluster1", "team1", "the-really-long-kube-service-name-that-is-exactly-63-characters"))
+
+	names, err := ParseNameTemplate("{{.Backend}}-{{.Namespace}}-{{.Name}}")
+	require.NoError(t, err)
+	assert.Equal(t, "cluster1-team1-service1", names.Name("cluster1", "team1", "service1"))
+
+	long := names.Name("cluster1", "team1", "the-really-long-kube-service-name-that-is-exactly-63-characters")
+	assert.Len(t, long, maxKubernetesDNSLabelLength)
+	assert.NotEqual(t, long, names.Name("cluster1", "team1", "the-really-long-kube-service-name-that-is-exactly-63-characterz"))
+}
+
+func TestOrigin(t *testing.T) {
+	assert.Equal(t, "", Origin(nil))
+	assert.Equal(t, "", Origin(map[string]string{"app": "web"}))
+	assert.Equal(t, "gimbal.projectcontour.io/backend=cluster1,gimbal.projectcontour.io/service=service1",
+		Origin(AddGimbalLabels("cluster1", "service1", map[string]string{"app": "web"})))
+	// A backend name that is a prefix of another does not give the same origin
+	assert.NotEqual(t, Origin(AddGimbalLabels("a", "b-c", nil)), Origin(AddGimbalLabels("a-b", "c", nil)))
+	assert.Equal(t, "gimbal.projectcontour.io/aggregate=web", Origin(map[string]string{GimbalLabelAggregate: "web"}))
+}
@@ -0,0 +1,124 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+const (
+	// GimbalAnnotationOriginBackend is the key of the annotation that
+	// contains the full name of the backend of a discovered object. Unlike
+	// labels, annotations are never shortened.
+	GimbalAnnotationOriginBackend = "gimbal.projectcontour.io/origin-backend"
+	// GimbalAnnotationOriginNamespace is the key of the annotation that
+	// contains the namespace, or OpenStack project, of the upstream object
+	GimbalAnnotationOriginNamespace = "gimbal.projectcontour.io/origin-namespace"
+	// GimbalAnnotationOriginName is the key of the annotation that contains
+	// the name of the upstream object that the discovered name is built from
+	GimbalAnnotationOriginName = "gimbal.projectcontour.io/origin-name"
+	// GimbalAnnotationOriginProjectID is the key of the annotation that
+	// contains the ID of the OpenStack project of the upstream load balancer
+	GimbalAnnotationOriginProjectID = "gimbal.projectcontour.io/origin-project-id"
+	// GimbalAnnotationOriginRegion is the key of the annotation that contains
+	// the OpenStack region of the upstream load balancer
+	GimbalAnnotationOriginRegion = "gimbal.projectcontour.io/origin-region"
+	// GimbalAnnotationOriginLoadBalancerID is the key of the annotation that
+	// contains the ID of the upstream OpenStack load balancer
+	GimbalAnnotationOriginLoadBalancerID = "gimbal.projectcontour.io/origin-load-balancer-id"
+	// GimbalAnnotationOriginLoadBalancerName is the key of the annotation
+	// that contains the name of the upstream OpenStack load balancer
+	GimbalAnnotationOriginLoadBalancerName = "gimbal.projectcontour.io/origin-load-balancer-name"
+	// GimbalAnnotationOriginL7PolicyID is the key of the annotation that
+	// contains the ID of the upstream OpenStack L7 policy
+	GimbalAnnotationOriginL7PolicyID = "gimbal.projectcontour.io/origin-l7-policy-id"
+	// GimbalAnnotationLastSyncTime is the key of the annotation that contains
+	// the time at which a discovered object was last written to Gimbal, in
+	// RFC 3339 format
+	GimbalAnnotationLastSyncTime = "gimbal.projectcontour.io/last-sync-time"
+	// GimbalAnnotationSyncHash is the key of the annotation that contains a
+	// hash of the fields of a discovered object when it was last written to
+	// Gimbal, which tells whether the object was edited since
+	GimbalAnnotationSyncHash = "gimbal.projectcontour.io/sync-hash"
+	// GimbalAnnotationBackendHealth is the key of the annotation that
+	// contains the health of the backend of a discovered object when the
+	// object was last written to Gimbal
+	GimbalAnnotationBackendHealth = "gimbal.projectcontour.io/backend-health"
+)
+
+// OriginIdentity identifies the upstream object that a discovered object
+// comes from. Empty fields do not apply to the backend of the object.
+type OriginIdentity struct {
+	Backend          string `json:"backend"`
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	ProjectID        string `json:"projectID,omitempty"`
+	Region           string `json:"region,omitempty"`
+	LoadBalancerID   string `json:"loadBalancerID,omitempty"`
+	LoadBalancerName string `json:"loadBalancerName,omitempty"`
+	L7PolicyID       string `json:"l7PolicyID,omitempty"`
+}
+
+// annotations returns the annotations that hold the identity, keyed by
+// annotation
+func (o OriginIdentity) annotations() map[string]string {
+	return map[string]string{
+		GimbalAnnotationOriginBackend:          o.Backend,
+		GimbalAnnotationOriginNamespace:        o.Namespace,
+		GimbalAnnotationOriginName:             o.Name,
+		GimbalAnnotationOriginProjectID:        o.ProjectID,
+		GimbalAnnotationOriginRegion:           o.Region,
+		GimbalAnnotationOriginLoadBalancerID:   o.LoadBalancerID,
+		GimbalAnnotationOriginLoadBalancerName: o.LoadBalancerName,
+		GimbalAnnotationOriginL7PolicyID:       o.L7PolicyID,
+	}
+}
+
+// AddOriginAnnotations returns a copy of the annotations that includes the
+// annotations of the origin identity. Empty fields are not annotated.
+func AddOriginAnnotations(annotations map[string]string, origin OriginIdentity) map[string]string {
+	result := map[string]string{}
+	for k, v := range annotations {
+		result[k] = v
+	}
+	for k, v := range origin.annotations() {
+		if v == "" {
+			delete(result, k)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// GetOriginIdentity returns the origin identity held by the annotations of a
+// discovered object, and whether the object has one. Objects discovered by
+// previous versions of the discoverers do not.
+func GetOriginIdentity(annotations map[string]string) (OriginIdentity, bool) {
+	o := OriginIdentity{
+		Backend:          annotations[GimbalAnnotationOriginBackend],
+		Namespace:        annotations[GimbalAnnotationOriginNamespace],
+		Name:             annotations[GimbalAnnotationOriginName],
+		ProjectID:        annotations[GimbalAnnotationOriginProjectID],
+		Region:           annotations[GimbalAnnotationOriginRegion],
+		LoadBalancerID:   annotations[GimbalAnnotationOriginLoadBalancerID],
+		LoadBalancerName: annotations[GimbalAnnotationOriginLoadBalancerName],
+		L7PolicyID:       annotations[GimbalAnnotationOriginL7PolicyID],
+	}
+	return o, o.Backend != "" && o.Name != ""
+}
+
+// OriginAnnotationsEqual returns whether both sets of annotations hold the
+// same origin identity
+func OriginAnnotationsEqual(a1, a2 map[string]string) bool {
+	o1, _ := GetOriginIdentity(a1)
+	o2, _ := GetOriginIdentity(a2)
+	return o1 == o2
+}
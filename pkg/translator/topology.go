@@ -0,0 +1,114 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// GimbalLabelRegion is the key of the label that contains the region of
+	// all the addresses of an endpoints object
+	GimbalLabelRegion = "gimbal.projectcontour.io/region"
+	// GimbalLabelZone is the key of the label that contains the zone of all
+	// the addresses of an endpoints object
+	GimbalLabelZone = "gimbal.projectcontour.io/zone"
+	// GimbalAnnotationLocalities is the key of the annotation that contains
+	// the locality of each address of an endpoints object, such as
+	// "10.0.0.1=us-east/us-east-1a,10.0.0.2=us-east/us-east-1b". The
+	// Kubernetes API used by Gimbal predates topology hints.
+	GimbalAnnotationLocalities = "gimbal.projectcontour.io/localities"
+)
+
+// Locality is the region and zone of an endpoint address
+type Locality struct {
+	Region string
+	Zone   string
+}
+
+func (l Locality) String() string {
+	return l.Region + "/" + l.Zone
+}
+
+// SetTopology sets the locality metadata of the endpoints, given the locality
+// of each address. The region and zone labels are set if all the addresses
+// share them, unless the endpoints already have them, and the localities
+// annotation lists the addresses that have a locality. The label and
+// annotation maps are copied.
+func SetTopology(ep *v1.Endpoints, locality func(v1.EndpointAddress) Locality) {
+	var localities []string
+	regions := map[string]bool{}
+	zones := map[string]bool{}
+	visit := func(addresses []v1.EndpointAddress) {
+		for _, a := range addresses {
+			l := locality(a)
+			regions[l.Region] = true
+			zones[l.Zone] = true
+			if l != (Locality{}) {
+				localities = append(localities, a.IP+"="+l.String())
+			}
+		}
+	}
+	for _, s := range ep.Subsets {
+		visit(s.Addresses)
+		visit(s.NotReadyAddresses)
+	}
+
+	labels := make(map[string]string, len(ep.Labels)+2)
+	for k, v := range ep.Labels {
+		labels[k] = v
+	}
+	setLabel(labels, GimbalLabelRegion, only(regions))
+	setLabel(labels, GimbalLabelZone, only(zones))
+	ep.Labels = labels
+
+	annotations := make(map[string]string, len(ep.Annotations)+1)
+	for k, v := range ep.Annotations {
+		annotations[k] = v
+	}
+	delete(annotations, GimbalAnnotationLocalities)
+	if len(localities) > 0 {
+		sort.Strings(localities)
+		annotations[GimbalAnnotationLocalities] = strings.Join(localities, ",")
+	}
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	ep.Annotations = annotations
+}
+
+// setLabel sets the label, unless it is already set, or the value is empty or
+// is not a valid label value
+func setLabel(labels map[string]string, key, value string) {
+	if _, ok := labels[key]; ok || value == "" || len(validation.IsValidLabelValue(value)) > 0 {
+		return
+	}
+	labels[key] = value
+}
+
+// only returns the only key of the set, or an empty string if it does not
+// have exactly one key
+func only(set map[string]bool) string {
+	if len(set) != 1 {
+		return ""
+	}
+	for k := range set {
+		return k
+	}
+	return ""
+}
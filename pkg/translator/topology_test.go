@@ -0,0 +1,96 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package translator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSetTopology(t *testing.T) {
+	localities := map[string]Locality{
+		"10.0.0.1": {Region: "us-east", Zone: "us-east-1a"},
+		"10.0.0.2": {Region: "us-east", Zone: "us-east-1b"},
+		"10.0.0.3": {Region: "us-east", Zone: "us-east-1a"},
+		"10.0.0.5": {Region: "Region One", Zone: "az1"},
+	}
+	tests := []struct {
+		name                string
+		addresses           []v1.EndpointAddress
+		annotations         map[string]string
+		expectedLabels      map[string]string
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:           "single zone",
+			addresses:      []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.3"}},
+			expectedLabels: map[string]string{"app": "kuard", GimbalLabelRegion: "us-east", GimbalLabelZone: "us-west-1a"},
+			expectedAnnotations: map[string]string{
+				GimbalAnnotationLocalities: "10.0.0.1=us-east/us-east-1a,10.0.0.3=us-east/us-east-1a",
+			},
+		},
+		{
+			name:           "multiple zones",
+			addresses:      []v1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}},
+			annotations:    map[string]string{"foo": "bar"},
+			expectedLabels: map[string]string{"app": "kuard", GimbalLabelRegion: "us-east", GimbalLabelZone: "us-west-1a"},
+			expectedAnnotations: map[string]string{
+				"foo":                      "bar",
+				GimbalAnnotationLocalities: "10.0.0.1=us-east/us-east-1a,10.0.0.2=us-east/us-east-1b",
+			},
+		},
+		{
+			name:           "address without locality",
+			addresses:      []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.4"}},
+			expectedLabels: map[string]string{"app": "kuard", GimbalLabelZone: "us-west-1a"},
+			expectedAnnotations: map[string]string{
+				GimbalAnnotationLocalities: "10.0.0.1=us-east/us-east-1a",
+			},
+		},
+		{
+			name:           "invalid region label",
+			addresses:      []v1.EndpointAddress{{IP: "10.0.0.5"}},
+			expectedLabels: map[string]string{"app": "kuard", GimbalLabelZone: "us-west-1a"},
+			expectedAnnotations: map[string]string{
+				GimbalAnnotationLocalities: "10.0.0.5=Region One/az1",
+			},
+		},
+		{
+			name:           "no locality",
+			addresses:      []v1.EndpointAddress{{IP: "10.0.0.4"}},
+			annotations:    map[string]string{GimbalAnnotationLocalities: "10.0.0.4=us-west/us-west-1a"},
+			expectedLabels: map[string]string{"app": "kuard", GimbalLabelZone: "us-west-1a"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// the existing zone label is kept
+			labels := map[string]string{"app": "kuard", GimbalLabelZone: "us-west-1a"}
+			ep := &v1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: tc.annotations},
+				Subsets:    []v1.EndpointSubset{{Addresses: tc.addresses}},
+			}
+			SetTopology(ep, func(a v1.EndpointAddress) Locality {
+				return localities[a.IP]
+			})
+			assert.Equal(t, tc.expectedLabels, ep.Labels)
+			assert.Equal(t, tc.expectedAnnotations, ep.Annotations)
+			// the given labels are not modified
+			assert.Len(t, labels, 2)
+		})
+	}
+}
@@ -22,26 +22,30 @@ import (
 
 const (
 	// GimbalLabelBackend is the key of the label that contains the cluster name
-	GimbalLabelBackend          = "gimbal.projectcontour.io/backend"
-	gimbalLabelService          = "gimbal.projectcontour.io/service"
+	GimbalLabelBackend = "gimbal.projectcontour.io/backend"
+	// GimbalLabelService is the key of the label that contains the name of
+	// the upstream service
+	GimbalLabelService = "gimbal.projectcontour.io/service"
+	// GimbalLabelLoadBalancerID is the key of the label that contains the ID
+	// of the OpenStack load balancer of a discovered service
+	GimbalLabelLoadBalancerID = "gimbal.projectcontour.io/load-balancer-id"
+	// GimbalLabelLoadBalancerName is the key of the label that contains the
+	// name of the OpenStack load balancer of a discovered service
+	GimbalLabelLoadBalancerName = "gimbal.projectcontour.io/load-balancer-name"
 	maxKubernetesDNSLabelLength = 63
 )
 
 // AddGimbalLabels returns a new set of labels that includes the incoming set of
-// labels, plus gimbal-specific ones.
+// labels, plus gimbal-specific ones. The incoming labels are not modified, as
+// they typically belong to an object of an informer cache.
 func AddGimbalLabels(backendname, name string, existingLabels map[string]string) map[string]string {
-	gimbalLabels := map[string]string{
-		GimbalLabelBackend: ShortenKubernetesLabelValue(backendname),
-		gimbalLabelService: ShortenKubernetesLabelValue(name),
+	labels := make(map[string]string, len(existingLabels)+2)
+	for k, v := range existingLabels {
+		labels[k] = v
 	}
-	if existingLabels == nil {
-		return gimbalLabels
-	}
-	// Set gimbal labels on the existing labels map
-	for k, v := range gimbalLabels {
-		existingLabels[k] = v
-	}
-	return existingLabels
+	labels[GimbalLabelBackend] = ShortenKubernetesLabelValue(backendname)
+	labels[GimbalLabelService] = ShortenKubernetesLabelValue(name)
+	return labels
 }
 
 // BuildDiscoveredName returns the discovered name of the service in a given
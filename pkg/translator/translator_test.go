@@ -179,8 +179,17 @@ func TestAddLabels(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			result := AddGimbalLabels(test.backendName, test.serviceName, test.podLabels)
+			var podLabels map[string]string
+			if test.podLabels != nil {
+				podLabels = map[string]string{}
+				for k, v := range test.podLabels {
+					podLabels[k] = v
+				}
+			}
+			result := AddGimbalLabels(test.backendName, test.serviceName, podLabels)
 			assert.Equal(t, test.expected, result, "Expected name does not match")
+			// The incoming labels are not modified
+			assert.Equal(t, test.podLabels, podLabels)
 		})
 	}
 }
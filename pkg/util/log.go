@@ -0,0 +1,112 @@
+/*
+Copyright 2018 the Gimbal contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The keys of the fields of log entries
+const (
+	FieldBackend     = "backend"
+	FieldBackendType = "backendtype"
+	FieldNamespace   = "namespace"
+	FieldName        = "name"
+	FieldKind        = "kind"
+	FieldAction      = "action"
+	FieldAttempt     = "attempt"
+	FieldDuration    = "duration"
+	FieldProject     = "project"
+	FieldRegion      = "region"
+)
+
+// NewFormatter returns the formatter of logs in the given format, text or
+// json, which adds the given fields to every entry, such as the backend of a
+// discoverer
+func NewFormatter(format string, fields logrus.Fields) (logrus.Formatter, error) {
+	var formatter logrus.Formatter
+	switch format {
+	case "text":
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be text or json", format)
+	}
+	if len(fields) == 0 {
+		return formatter, nil
+	}
+	return fieldsFormatter{Formatter: formatter, fields: fields}, nil
+}
+
+// fieldsFormatter adds fields to the entries it formats. Entries share their
+// fields with the entries they derive from, so they are copied rather than
+// modified.
+type fieldsFormatter struct {
+	logrus.Formatter
+	fields logrus.Fields
+}
+
+func (f fieldsFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(f.fields)+len(entry.Data))
+	for k, v := range f.fields {
+		data[k] = v
+	}
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	e := *entry
+	e.Data = data
+	return f.Formatter.Format(&e)
+}
+
+// LogLevelHandler serves the level of the logger, which a PUT with a level
+// parameter changes, such as /debug/loglevel?level=debug
+func LogLevelHandler(logger *logrus.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			level, err := logrus.ParseLevel(r.URL.Query().Get("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if level != logLevel(logger) {
+				logger.Infof("changing log level to %s", level)
+				logger.SetLevel(level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]string{"level": logLevel(logger).String()}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// logLevel returns the level of the logger. SetLevel changes the level
+// atomically while the logger is in use, so it must be read atomically too.
+// logrus v1.0.6 has no GetLevel to do so; use it once logrus is upgraded.
+func logLevel(logger *logrus.Logger) logrus.Level {
+	return logrus.Level(atomic.LoadUint32((*uint32)(&logger.Level)))
+}
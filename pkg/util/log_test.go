@@ -0,0 +1,81 @@
+/*
+Copyright 2018 the Gimbal contributors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFormatter(t *testing.T) {
+	_, err := NewFormatter("xml", nil)
+	assert.Error(t, err)
+
+	formatter, err := NewFormatter("json", logrus.Fields{FieldBackend: "cluster1", FieldBackendType: "kubernetes"})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	log := logrus.New()
+	log.Out = &out
+	log.Formatter = formatter
+	entry := log.WithField(FieldNamespace, "team1")
+	entry.Info("synced")
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &line))
+	assert.Equal(t, "cluster1", line[FieldBackend])
+	assert.Equal(t, "kubernetes", line[FieldBackendType])
+	assert.Equal(t, "team1", line[FieldNamespace])
+	assert.Equal(t, "synced", line["msg"])
+	assert.Equal(t, logrus.Fields{FieldNamespace: "team1"}, entry.Data)
+
+	formatter, err = NewFormatter("text", nil)
+	require.NoError(t, err)
+	assert.IsType(t, &logrus.TextFormatter{}, formatter)
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	log := logrus.New()
+	log.Out = &bytes.Buffer{}
+	handler := LogLevelHandler(log)
+
+	tests := []struct {
+		method   string
+		url      string
+		status   int
+		expected logrus.Level
+	}{
+		{method: http.MethodGet, url: "/debug/loglevel", status: http.StatusOK, expected: logrus.InfoLevel},
+		{method: http.MethodPut, url: "/debug/loglevel?level=debug", status: http.StatusOK, expected: logrus.DebugLevel},
+		{method: http.MethodPut, url: "/debug/loglevel?level=verbose", status: http.StatusBadRequest, expected: logrus.DebugLevel},
+		{method: http.MethodPost, url: "/debug/loglevel?level=info", status: http.StatusMethodNotAllowed, expected: logrus.DebugLevel},
+		{method: http.MethodGet, url: "/debug/loglevel", status: http.StatusOK, expected: logrus.DebugLevel},
+	}
+
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		assert.Equal(t, tc.status, rec.Code, tc.url)
+		assert.Equal(t, tc.expected, logLevel(log), tc.url)
+		if tc.status == http.StatusOK {
+			assert.JSONEq(t, `{"level": "`+tc.expected.String()+`"}`, rec.Body.String())
+		}
+	}
+}
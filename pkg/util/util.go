@@ -16,19 +16,10 @@ package util
 
 import (
 	"regexp"
-
-	"github.com/sirupsen/logrus"
 )
 
 var backendNameRegex = regexp.MustCompile("^[a-z]([-a-z0-9]*[a-z0-9])?$")
 
-// GetFormatter returns a textformatter to customize logs
-func GetFormatter() *logrus.TextFormatter {
-	return &logrus.TextFormatter{
-		FullTimestamp: true,
-	}
-}
-
 // IsInvalidBackendName returns true if valid cluster name
 func IsInvalidBackendName(backendname string) bool {
 	return !backendNameRegex.MatchString(backendname)
@@ -0,0 +1,169 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validation
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+)
+
+const (
+	// KindService is the kind of invalid services
+	KindService = "Service"
+	// KindEndpoints is the kind of invalid endpoints
+	KindEndpoints = "Endpoints"
+)
+
+// Object is a service or endpoints resource with validation problems
+type Object struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	// Name is the name of the object in Gimbal
+	Name string `json:"name"`
+	// UpstreamName is the name of the object in the backend
+	UpstreamName string    `json:"upstreamName"`
+	Problems     []Problem `json:"problems"`
+}
+
+type objectKey struct {
+	kind, namespace, name string
+}
+
+// Store holds the objects of a backend that have validation problems, and
+// reports them in metrics and over HTTP
+type Store struct {
+	mu      sync.Mutex
+	objects map[objectKey]Object
+	metrics localmetrics.DiscovererMetrics
+}
+
+// NewStore returns an empty store that reports to the given metrics
+func NewStore(metrics localmetrics.DiscovererMetrics) *Store {
+	return &Store{
+		objects: map[objectKey]Object{},
+		metrics: metrics,
+	}
+}
+
+// Set records the problems of the object. An object without problems is
+// removed from the store.
+func (s *Store) Set(o Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := objectKey{o.Kind, o.Namespace, o.Name}
+	if len(o.Problems) == 0 {
+		delete(s.objects, key)
+	} else {
+		s.objects[key] = o
+	}
+	s.writeMetrics(o.Namespace)
+}
+
+// Delete removes the object from the store
+func (s *Store) Delete(kind, namespace, name string) {
+	s.Set(Object{Kind: kind, Namespace: namespace, Name: name})
+}
+
+// ReplaceNamespace replaces the objects of the namespace with the given ones,
+// which must belong to the namespace
+func (s *Store) ReplaceNamespace(namespace string, objects []Object) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.objects {
+		if key.namespace == namespace {
+			delete(s.objects, key)
+		}
+	}
+	for _, o := range objects {
+		if len(o.Problems) > 0 {
+			s.objects[objectKey{o.Kind, namespace, o.Name}] = o
+		}
+	}
+	s.writeMetrics(namespace)
+}
+
+// Count returns the number of objects of the given kind in the namespace that
+// have problems
+func (s *Store) Count(kind, namespace string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.objects {
+		if key.kind == kind && key.namespace == namespace {
+			n++
+		}
+	}
+	return n
+}
+
+// List returns the objects that have problems, sorted by namespace, kind and
+// name
+func (s *Store) List() []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Object, 0, len(s.objects))
+	for _, o := range s.objects {
+		res = append(res, o)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Namespace != res[j].Namespace {
+			return res[i].Namespace < res[j].Namespace
+		}
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// ServeHTTP writes the objects that have problems as JSON
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.List()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeMetrics sets the number of objects of the namespace with each reason.
+// An object with several problems of the same reason is counted once.
+func (s *Store) writeMetrics(namespace string) {
+	counts := map[string]map[Reason]int{KindService: {}, KindEndpoints: {}}
+	for key, o := range s.objects {
+		if key.namespace != namespace {
+			continue
+		}
+		if counts[key.kind] == nil {
+			counts[key.kind] = map[Reason]int{}
+		}
+		seen := map[Reason]bool{}
+		for _, p := range o.Problems {
+			if !seen[p.Reason] {
+				seen[p.Reason] = true
+				counts[key.kind][p.Reason]++
+			}
+		}
+	}
+	for _, kind := range []string{KindService, KindEndpoints} {
+		for _, reason := range Reasons {
+			s.metrics.DiscovererInvalidObjectsMetric(namespace, kind, string(reason), counts[kind][reason])
+		}
+	}
+}
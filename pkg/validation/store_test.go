@@ -0,0 +1,86 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	localmetrics "github.com/projectcontour/gimbal/pkg/metrics"
+)
+
+func TestStore(t *testing.T) {
+	metrics := localmetrics.NewMetrics("openstack", "us-east")
+	metrics.RegisterPrometheus(false)
+	s := NewStore(metrics)
+
+	noPorts := []Problem{{Reason: ReasonNoPorts, Message: "service has no ports"}}
+	s.Set(Object{Kind: KindService, Namespace: "team1", Name: "us-east-b", Problems: noPorts})
+	s.Set(Object{Kind: KindService, Namespace: "team1", Name: "us-east-a", Problems: noPorts})
+	s.Set(Object{Kind: KindService, Namespace: "team2", Name: "us-east-a", Problems: noPorts})
+	// an object without problems is removed
+	s.Set(Object{Kind: KindService, Namespace: "team1", Name: "us-east-b"})
+
+	assert.Equal(t, 1, s.Count(KindService, "team1"))
+	assert.Equal(t, 0, s.Count(KindEndpoints, "team1"))
+	assert.Equal(t, 1, invalidObjects(t, metrics, "team1", KindService, ReasonNoPorts))
+
+	s.ReplaceNamespace("team1", []Object{
+		{Kind: KindEndpoints, Namespace: "team1", Name: "us-east-c", Problems: []Problem{
+			{Reason: ReasonInvalidAddress, Message: `address "127.0.0.1" is a loopback address`},
+			{Reason: ReasonInvalidAddress, Message: `address "::1" is a loopback address`},
+		}},
+	})
+	assert.Equal(t, 0, s.Count(KindService, "team1"))
+	assert.Equal(t, 0, invalidObjects(t, metrics, "team1", KindService, ReasonNoPorts))
+	// the object is counted once per reason
+	assert.Equal(t, 1, invalidObjects(t, metrics, "team1", KindEndpoints, ReasonInvalidAddress))
+
+	s.Delete(KindService, "team2", "us-east-a")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/invalid", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var got []Object
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, s.List(), got)
+	assert.Len(t, got, 1)
+	assert.Equal(t, "us-east-c", got[0].Name)
+}
+
+func invalidObjects(t *testing.T, metrics localmetrics.DiscovererMetrics, namespace, kind string, reason Reason) int {
+	mfs, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != localmetrics.DiscovererInvalidObjectsGauge {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["namespace"] == namespace && labels["kind"] == kind && labels["reason"] == string(reason) {
+				return int(m.Gauge.GetValue())
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,249 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package validation checks the services and endpoints produced by the
+// translators before they are synced to Gimbal, so that invalid objects are
+// reported instead of being rejected by the API server
+package validation
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Reason is a short, machine readable reason for a problem
+type Reason string
+
+const (
+	// ReasonInvalidName is the reason of objects with an invalid name or namespace
+	ReasonInvalidName Reason = "InvalidName"
+	// ReasonInvalidLabel is the reason of objects with an invalid label
+	ReasonInvalidLabel Reason = "InvalidLabel"
+	// ReasonNoPorts is the reason of services without ports
+	ReasonNoPorts Reason = "NoPorts"
+	// ReasonInvalidPort is the reason of objects with an invalid port
+	ReasonInvalidPort Reason = "InvalidPort"
+	// ReasonPortNameClash is the reason of objects whose ports do not have
+	// unique names
+	ReasonPortNameClash Reason = "PortNameClash"
+	// ReasonInvalidAddress is the reason of endpoint addresses, or OpenStack
+	// pool members, that cannot be routed to. These addresses are removed,
+	// and the rest of the endpoints are synced.
+	ReasonInvalidAddress Reason = "InvalidAddress"
+	// ReasonUnsupportedListener is the reason of OpenStack load balancers
+	// with listeners that cannot be routed to. These listeners are skipped,
+	// and the rest of the load balancer is synced.
+	ReasonUnsupportedListener Reason = "UnsupportedListener"
+)
+
+// Reasons lists all the reasons
+var Reasons = []Reason{
+	ReasonInvalidName,
+	ReasonInvalidLabel,
+	ReasonNoPorts,
+	ReasonInvalidPort,
+	ReasonPortNameClash,
+	ReasonInvalidAddress,
+	ReasonUnsupportedListener,
+}
+
+// Problem describes why an object, or part of it, cannot be synced
+type Problem struct {
+	Reason  Reason `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Reason, p.Message)
+}
+
+func problemf(reason Reason, format string, args ...interface{}) Problem {
+	return Problem{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// CountReason returns the number of problems with the given reason
+func CountReason(problems []Problem, reason Reason) int {
+	n := 0
+	for _, p := range problems {
+		if p.Reason == reason {
+			n++
+		}
+	}
+	return n
+}
+
+// ValidateService returns the problems that prevent the service from being
+// synced. A service with problems must not be synced.
+func ValidateService(svc *v1.Service) []Problem {
+	problems := validateObjectMeta(svc.Namespace, svc.Name, svc.Labels)
+	// ExternalName services are aliases of a DNS name, and need no ports
+	if svc.Spec.Type == v1.ServiceTypeExternalName {
+		if errs := utilvalidation.IsDNS1123Subdomain(svc.Spec.ExternalName); len(errs) > 0 {
+			problems = append(problems, problemf(ReasonInvalidName, "invalid external name %q: %s", svc.Spec.ExternalName, strings.Join(errs, ", ")))
+		}
+	} else if len(svc.Spec.Ports) == 0 {
+		problems = append(problems, problemf(ReasonNoPorts, "service has no ports"))
+	}
+
+	names := map[string]bool{}
+	ports := map[string]bool{}
+	for i, p := range svc.Spec.Ports {
+		problems = append(problems, validatePortName(p.Name, i, len(svc.Spec.Ports), names)...)
+		problems = append(problems, validatePort(p.Name, p.Port, p.Protocol)...)
+		key := fmt.Sprintf("%d/%s", p.Port, p.Protocol)
+		if ports[key] {
+			problems = append(problems, problemf(ReasonPortNameClash, "port %s is defined more than once", key))
+		}
+		ports[key] = true
+
+		// A zero target port defaults to the port
+		var errs []string
+		if p.TargetPort.Type == intstr.String {
+			errs = utilvalidation.IsValidPortName(p.TargetPort.StrVal)
+		} else if p.TargetPort.IntVal != 0 {
+			errs = utilvalidation.IsValidPortNum(int(p.TargetPort.IntVal))
+		}
+		if len(errs) > 0 {
+			problems = append(problems, problemf(ReasonInvalidPort, "invalid target port %q of port %q: %s", p.TargetPort.String(), p.Name, strings.Join(errs, ", ")))
+		}
+	}
+	return problems
+}
+
+// ValidateEndpoints returns a copy of the endpoints without the addresses that
+// cannot be routed to, and the problems found. Subsets left without addresses
+// are removed. If the endpoints cannot be synced at all, the returned
+// endpoints are nil. Problems with the ReasonInvalidAddress reason are
+// reported once per removed address.
+func ValidateEndpoints(ep *v1.Endpoints) (*v1.Endpoints, []Problem) {
+	problems := validateObjectMeta(ep.Namespace, ep.Name, ep.Labels)
+
+	valid := ep.DeepCopy()
+	valid.Subsets = nil
+	for _, s := range ep.Subsets {
+		names := map[string]bool{}
+		for i, p := range s.Ports {
+			problems = append(problems, validatePortName(p.Name, i, len(s.Ports), names)...)
+			problems = append(problems, validatePort(p.Name, p.Port, p.Protocol)...)
+		}
+
+		addresses, addressProblems := validateAddresses(s.Addresses)
+		problems = append(problems, addressProblems...)
+		notReadyAddresses, addressProblems := validateAddresses(s.NotReadyAddresses)
+		problems = append(problems, addressProblems...)
+		if len(addresses) == 0 && len(notReadyAddresses) == 0 && (len(s.Addresses) > 0 || len(s.NotReadyAddresses) > 0) {
+			continue
+		}
+		valid.Subsets = append(valid.Subsets, v1.EndpointSubset{
+			Addresses:         addresses,
+			NotReadyAddresses: notReadyAddresses,
+			Ports:             s.Ports,
+		})
+	}
+
+	if CountReason(problems, ReasonInvalidAddress) < len(problems) {
+		return nil, problems
+	}
+	return valid, problems
+}
+
+func validateObjectMeta(namespace, name string, labels map[string]string) []Problem {
+	var problems []Problem
+	if errs := utilvalidation.IsDNS1123Label(namespace); len(errs) > 0 {
+		problems = append(problems, problemf(ReasonInvalidName, "invalid namespace %q: %s", namespace, strings.Join(errs, ", ")))
+	}
+	if errs := utilvalidation.IsDNS1035Label(name); len(errs) > 0 {
+		problems = append(problems, problemf(ReasonInvalidName, "invalid name %q: %s", name, strings.Join(errs, ", ")))
+	}
+	for k, v := range labels {
+		if errs := utilvalidation.IsQualifiedName(k); len(errs) > 0 {
+			problems = append(problems, problemf(ReasonInvalidLabel, "invalid label key %q: %s", k, strings.Join(errs, ", ")))
+		}
+		if errs := utilvalidation.IsValidLabelValue(v); len(errs) > 0 {
+			problems = append(problems, problemf(ReasonInvalidLabel, "invalid value %q of label %q: %s", v, k, strings.Join(errs, ", ")))
+		}
+	}
+	return problems
+}
+
+// validatePortName checks the name of the i-th of n ports. Names must be
+// unique, and are required if there is more than one port.
+func validatePortName(name string, i, n int, names map[string]bool) []Problem {
+	if name == "" {
+		if n > 1 {
+			return []Problem{problemf(ReasonPortNameClash, "port %d has no name, which is required when there is more than one port", i)}
+		}
+		return nil
+	}
+	if names[name] {
+		return []Problem{problemf(ReasonPortNameClash, "port name %q is used more than once", name)}
+	}
+	names[name] = true
+	if errs := utilvalidation.IsDNS1123Label(name); len(errs) > 0 {
+		return []Problem{problemf(ReasonInvalidPort, "invalid port name %q: %s", name, strings.Join(errs, ", "))}
+	}
+	return nil
+}
+
+func validatePort(name string, port int32, protocol v1.Protocol) []Problem {
+	var problems []Problem
+	if errs := utilvalidation.IsValidPortNum(int(port)); len(errs) > 0 {
+		problems = append(problems, problemf(ReasonInvalidPort, "invalid port %d of port %q: %s", port, name, strings.Join(errs, ", ")))
+	}
+	// The API server defaults an empty protocol to TCP
+	switch protocol {
+	case "", v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+	default:
+		problems = append(problems, problemf(ReasonInvalidPort, "unsupported protocol %q of port %q", protocol, name))
+	}
+	return problems
+}
+
+// validateAddresses returns the addresses that can be routed to, and a
+// problem for each one that cannot
+func validateAddresses(addresses []v1.EndpointAddress) ([]v1.EndpointAddress, []Problem) {
+	var valid []v1.EndpointAddress
+	var problems []Problem
+	for _, a := range addresses {
+		if err := validateIP(a.IP); err != "" {
+			problems = append(problems, problemf(ReasonInvalidAddress, "address %q %s", a.IP, err))
+			continue
+		}
+		valid = append(valid, a)
+	}
+	return valid, problems
+}
+
+// validateIP returns why the IP address cannot be routed to, if it cannot.
+// These are the addresses that the API server rejects in endpoints.
+func validateIP(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return "is not an IP address"
+	case ip.IsUnspecified():
+		return "is unspecified"
+	case ip.IsLoopback():
+		return "is a loopback address"
+	case ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return "is a link-local address"
+	case ip.IsMulticast():
+		return "is a multicast address"
+	}
+	return ""
+}
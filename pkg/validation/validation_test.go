@@ -0,0 +1,140 @@
+// Copyright © 2018 the Gimbal contributors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidateService(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  *v1.Service
+		expected []Reason
+	}{
+		{
+			name: "valid service",
+			service: service("cluster1-kuard",
+				v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromString("http")},
+				v1.ServicePort{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP, TargetPort: intstr.FromInt(5353)},
+			),
+		},
+		{
+			name:     "invalid name",
+			service:  service("Cluster1_kuard", v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}),
+			expected: []Reason{ReasonInvalidName},
+		},
+		{
+			name:     "no ports",
+			service:  service("cluster1-kuard"),
+			expected: []Reason{ReasonNoPorts},
+		},
+		{
+			name:    "external name",
+			service: &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cluster1-db"}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db.example.com"}},
+		},
+		{
+			name:     "invalid external name",
+			service:  &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cluster1-db"}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "db_example.com"}},
+			expected: []Reason{ReasonInvalidName},
+		},
+		{
+			name: "invalid ports",
+			service: service("cluster1-kuard",
+				v1.ServicePort{Name: "zero", Port: 0, Protocol: v1.ProtocolTCP},
+				v1.ServicePort{Name: "quic", Port: 443, Protocol: "QUIC"},
+				v1.ServicePort{Name: "target", Port: 80, Protocol: v1.ProtocolTCP, TargetPort: intstr.FromInt(70000)},
+			),
+			expected: []Reason{ReasonInvalidPort, ReasonInvalidPort, ReasonInvalidPort},
+		},
+		{
+			name: "port name clashes",
+			service: service("cluster1-kuard",
+				v1.ServicePort{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+				v1.ServicePort{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP},
+				v1.ServicePort{Port: 9090, Protocol: v1.ProtocolTCP},
+				v1.ServicePort{Name: "again", Port: 80, Protocol: v1.ProtocolTCP},
+			),
+			expected: []Reason{ReasonPortNameClash, ReasonPortNameClash, ReasonPortNameClash},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []Reason
+			for _, p := range ValidateService(tc.service) {
+				got = append(got, p.Reason)
+			}
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestValidateEndpoints(t *testing.T) {
+	ports := []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}}
+	ep := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team1", Name: "cluster1-kuard"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "127.0.0.1"}, {IP: "169.254.0.1"}},
+				NotReadyAddresses: []v1.EndpointAddress{{IP: "0.0.0.0"}, {IP: "2001:db8::1"}},
+				Ports:             ports,
+			},
+			{
+				Addresses: []v1.EndpointAddress{{IP: "fe80::1"}, {IP: "backend.example.com"}},
+				Ports:     ports,
+			},
+		},
+	}
+
+	valid, problems := ValidateEndpoints(ep)
+	assert.Equal(t, []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "2001:db8::1"}},
+			Ports:             ports,
+		},
+	}, valid.Subsets)
+	assert.Equal(t, 5, CountReason(problems, ReasonInvalidAddress))
+	assert.Equal(t, 5, len(problems))
+	// the given endpoints are not modified
+	assert.Len(t, ep.Subsets, 2)
+
+	// endpoints that cannot be synced at all
+	ep.Name = "-kuard"
+	ep.Subsets[0].Ports = []v1.EndpointPort{{Name: "http", Port: 8080}, {Name: "http", Port: 9090}}
+	valid, problems = ValidateEndpoints(ep)
+	assert.Nil(t, valid)
+	assert.Equal(t, 1, CountReason(problems, ReasonInvalidName))
+	assert.Equal(t, 1, CountReason(problems, ReasonPortNameClash))
+}
+
+func service(name string, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "team1",
+			Name:      name,
+			Labels:    map[string]string{"gimbal.projectcontour.io/backend": "cluster1"},
+		},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "None",
+			Ports:     ports,
+		},
+	}
+}